@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	appstore "camera-appstore"
+	"camera/lib"
+	"camera/models"
+	"camera/monitor"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 苹果服务器通知 V2, 返回非200时苹果会重试
+func AppStoreNotify(c *gin.Context) {
+	req := struct {
+		SignedPayload string `json:"signedPayload"`
+	}{}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SignedPayload == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if lib.AppStoreVerifier == nil {
+		logOrder.Errorf("[Notify] appstore notification received but verifier is not configured")
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
+	notification, err := lib.AppStoreVerifier.VerifyNotification(req.SignedPayload)
+	if err != nil {
+		logOrder.Errorf("[Notify] verify appstore notification failed: %s", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	// TEST等不含交易的通知
+	if notification.Data.SignedTransactionInfo == "" {
+		logOrder.Infof("[Notify] appstore notification: %s, uuid: %s", notification.NotificationType, notification.NotificationUUID)
+		c.Status(http.StatusOK)
+		return
+	}
+	trans, err := lib.AppStoreVerifier.VerifyTransaction(notification.Data.SignedTransactionInfo)
+	if err != nil {
+		logOrder.Errorf("[Notify] verify appstore transaction failed: %s, uuid: %s", err, notification.NotificationUUID)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	var renewal *appstore.RenewalInfo
+	if notification.Data.SignedRenewalInfo != "" {
+		if renewal, err = lib.AppStoreVerifier.VerifyRenewalInfo(notification.Data.SignedRenewalInfo); err != nil {
+			logOrder.Errorf("[Notify] verify appstore renewal info failed: %s, uuid: %s", err, notification.NotificationUUID)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+	}
+	logOrder.Infof("[Notify] appstore notification: %s %s, uuid: %s, trans_id: %s, proid: %s", notification.NotificationType, notification.Subtype, notification.NotificationUUID, trans.TransactionId, trans.ProductId)
+
+	switch notification.NotificationType {
+	case appstore.NOTIFY_REFUND:
+		if err = appStoreRefund(trans, models.ORDER_REFUND_REFUND); err == nil {
+			err = appStoreSubscription(trans, renewal)
+		}
+	case appstore.NOTIFY_REVOKE:
+		if err = appStoreRefund(trans, models.ORDER_REFUND_REVOKE); err == nil {
+			err = appStoreSubscription(trans, renewal)
+		}
+	case appstore.NOTIFY_DID_RENEW:
+		err = appStoreRenew(trans, notification.Data.SignedTransactionInfo, renewal)
+	case appstore.NOTIFY_SUBSCRIBED, appstore.NOTIFY_DID_CHANGE_RENEWAL_STATUS, appstore.NOTIFY_DID_FAIL_TO_RENEW,
+		appstore.NOTIFY_EXPIRED, appstore.NOTIFY_GRACE_PERIOD_EXPIRED:
+		err = appStoreSubscription(trans, renewal)
+	case appstore.NOTIFY_CONSUMPTION_REQUEST:
+		err = appStoreConsumption(c.Request.Context(), trans)
+	}
+	if err != nil {
+		logOrder.Errorf("[Notify] handle appstore notification: %s failed: %s, trans_id: %s", notification.NotificationType, err, trans.TransactionId)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// 退款或撤销, 收回发放的钻石和分身次数
+func appStoreRefund(trans *appstore.Transaction, refundType int) error {
+	locked, err := lib.LockOrder(trans.TransactionId)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("order is locked")
+	}
+	defer lib.UnlockOrder(trans.TransactionId)
+
+	order := &models.RechargeRecord{OrderNum: trans.TransactionId}
+	if err = order.GetByOrderNum(); err != nil {
+		if err.Error() == models.NoRowError {
+			logOrder.Warnf("[Notify] refund order not found, trans_id: %s, proid: %s", trans.TransactionId, trans.ProductId)
+			return nil
+		}
+		return err
+	}
+
+	refund := &models.OrderRefund{Type: refundType}
+	if trans.RevocationReason != nil {
+		refund.Reason = fmt.Sprintf("revocation reason %d", *trans.RevocationReason)
+	}
+	return refundOrder(order, refund)
+}
+
+// 保存退款记录并收回, 调用方需已锁定订单
+func refundOrder(order *models.RechargeRecord, refund *models.OrderRefund) error {
+	applied, err := refund.Apply(order)
+	if err != nil || !applied {
+		return err
+	}
+	logOrder.Infof("[Refund] order refunded, cus_id: %d, order_num: %s, diamond: %d, card_times: %d, short diamond: %d, short card_times: %d",
+		refund.CusId, refund.OrderNum, refund.Diamond, refund.CardTimes, refund.ShortDiamond, refund.ShortCardTimes)
+
+	// 已消耗的部分无法收回, 通知客服
+	if refund.Flagged {
+		bark := monitor.Bark{Title: "退款收回不足", Message: fmt.Sprintf("cus_id %d order %s", refund.CusId, refund.OrderNum)}
+		bark.SendMessage(monitor.ORDER_REFUND)
+	}
+	return nil
+}
+
+// 自动续期, 按原始交易的用户发放新一期
+func appStoreRenew(trans *appstore.Transaction, signedTransaction string, renewal *appstore.RenewalInfo) error {
+	locked, err := lib.LockOrder(trans.TransactionId)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("order is locked")
+	}
+	defer lib.UnlockOrder(trans.TransactionId)
+
+	order := &models.RechargeRecord{OrderNum: trans.TransactionId}
+	if err = order.GetByOrderNum(); err == nil {
+		return nil
+	} else if err.Error() != models.NoRowError {
+		return err
+	}
+
+	original := &models.RechargeRecord{OrderNum: trans.OriginalTransactionId}
+	if err = original.GetByOrderNum(); err != nil {
+		if err.Error() == models.NoRowError {
+			logOrder.Warnf("[Notify] renew original order not found, trans_id: %s, original: %s", trans.TransactionId, trans.OriginalTransactionId)
+			return nil
+		}
+		return err
+	}
+	customer := models.UserAccount{ID: original.CusId}
+	if err = customer.GetByID(); err != nil {
+		return err
+	}
+	product := &models.Product{ProductId: trans.ProductId}
+	if err = product.GetByProductID(); err != nil {
+		return err
+	}
+	// 订阅产品按期同步发放
+	if product.ProductType == models.PRODUCT_SUBSCRIPTION {
+		return appStoreSubscription(trans, renewal)
+	}
+
+	appStorePaid(customer, product, newRechargeOrder(customer, product, trans.TransactionId), signedTransaction, trans.Environment != appstore.ENV_PRODUCTION)
+	return nil
+}
+
+// 订阅状态变化, 同步最近一期和续期信息, 新的一期发放钻石
+// 订阅还不存在时归属原始交易订单的用户, 退款的一期为当前一期时订阅失效
+func appStoreSubscription(trans *appstore.Transaction, renewal *appstore.RenewalInfo) error {
+	if trans.Type != appstore.TYPE_AUTO_RENEWABLE {
+		return nil
+	}
+	product := &models.Product{ProductId: trans.ProductId}
+	if err := product.GetByProductID(); err != nil {
+		if err.Error() == models.NoRowError {
+			logOrder.Warnf("[Notify] subscription product not found, trans_id: %s, proid: %s", trans.TransactionId, trans.ProductId)
+			return nil
+		}
+		return err
+	}
+	if product.ProductType != models.PRODUCT_SUBSCRIPTION {
+		return nil
+	}
+
+	locked, err := lib.LockOrder(trans.OriginalTransactionId)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("order is locked")
+	}
+	defer lib.UnlockOrder(trans.OriginalTransactionId)
+
+	sub := &models.UserSubscription{OriginalTransId: trans.OriginalTransactionId}
+	if err = sub.GetByOriginalTransId(); err != nil {
+		if err.Error() != models.NoRowError {
+			return err
+		}
+		original := &models.RechargeRecord{OrderNum: trans.OriginalTransactionId}
+		if err = original.GetByOrderNum(); err != nil {
+			if err.Error() == models.NoRowError {
+				logOrder.Warnf("[Notify] subscription original order not found, trans_id: %s, original: %s", trans.TransactionId, trans.OriginalTransactionId)
+				return nil
+			}
+			return err
+		}
+		sub.CusId = original.CusId
+	}
+
+	if sub, err = models.SyncSubscription(sub.CusId, product, trans, renewal); err != nil {
+		return err
+	}
+	grantSubscription(sub)
+	return nil
+}
+
+// 退款请求, 用户在App内同意过时回复消费情况
+func appStoreConsumption(ctx context.Context, trans *appstore.Transaction) error {
+	if !lib.AppStoreConsumption {
+		return nil
+	}
+	order := &models.RechargeRecord{OrderNum: trans.TransactionId}
+	if err := order.GetByOrderNum(); err != nil {
+		if err.Error() == models.NoRowError {
+			return nil
+		}
+		return err
+	}
+	customer := models.UserAccount{ID: order.CusId}
+	if err := customer.GetByID(); err != nil {
+		return err
+	}
+	if !customer.RefundConsent {
+		logOrder.Infof("[Notify] consumption request without consent, cus_id: %d, trans_id: %s", customer.ID, trans.TransactionId)
+		return nil
+	}
+
+	// 按订单剩余的钻石和分身次数估算消耗程度, 钻石按账本中该订单发放后的消耗计算
+	spent, err := models.OrderSpentDiamond(order)
+	if err != nil {
+		return err
+	}
+	status := appstore.CONSUMPTION_FULL
+	granted := order.Diamond + order.CardTimes
+	left := order.Diamond - spent + min(max(customer.RemainTimes, 0), order.CardTimes)
+	if granted > 0 && left >= granted {
+		status = appstore.CONSUMPTION_NONE
+	} else if left > 0 {
+		status = appstore.CONSUMPTION_PARTIAL
+	}
+	userStatus := appstore.USER_STATUS_ACTIVE
+	if !customer.Enabled {
+		userStatus = appstore.USER_STATUS_SUSPENDED
+	}
+
+	req := &appstore.ConsumptionRequest{
+		CustomerConsented: true,
+		ConsumptionStatus: status,
+		Platform:          appstore.PLATFORM_APPLE,
+		DeliveryStatus:    appstore.DELIVERY_OK,
+		AccountTenure:     appstore.AccountTenure(int(time.Since(customer.CreatedAt).Hours() / 24)),
+		UserStatus:        userStatus,
+	}
+	return lib.SendAppStoreConsumption(ctx, trans.BundleId, trans.TransactionId, req)
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+
+	"camera/lib"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// worker轮询执行中的任务是否已取消
+func GetCanceledTasks(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		logApi.Errorf("[IO] read body failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "查询失败"})
+		return
+	}
+	b, err := lib.WebUICipher.Decrypt(string(body))
+	if err != nil {
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
+		c.JSON(http.StatusOK, Response{FAILURE, "解密失败"})
+		return
+	}
+	query := lib.TaskCancelQuery{}
+	if err = json.Unmarshal(b, &query); err != nil {
+		logApi.Errorf("[IO] json unmarshal failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "取消查询json解析失败"})
+		return
+	}
+	queue := lib.WorkQueue(query.TaskType)
+	if queue == nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	canceled, err := queue.Canceled(query.TaskIds)
+	if err != nil {
+		logApi.Errorf("[Redis] get canceled tasks %d failed: %s", query.TaskType, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "查询失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, canceled})
+}
+
+// worker上报任务已中止, 租约在取消时已释放
+func reportCanceled(c *gin.Context, queue *lib.Queue, id int) {
+	if err := queue.CancelDone(id); err != nil {
+		logApi.Warnf("[Redis] clear canceled task %d:%d failed: %s", queue.TaskType, id, err)
+	}
+	logApi.Infof("[Worker] %s aborted canceled task %d:%d", workerName(c), queue.TaskType, id)
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 取消分身任务, 包括训练和未完成的分身图
+func cancelCardTask(taskId int, reason string) {
+	task := &models.UserCardTask{ID: taskId}
+	if err := task.GetByID(); err != nil {
+		logApi.Warnf("[Mysql] get card task %d for cancel failed: %s", taskId, err)
+		return
+	}
+
+	if _, err := lib.LoraQueue.Cancel(taskId); err != nil {
+		logApi.Errorf("[Redis] cancel lora task %d failed: %s", taskId, err)
+	}
+	output := &models.UserCardImage{TaskId: taskId}
+	images, err := output.GetByTaskID()
+	if err != nil {
+		logApi.Warnf("[Mysql] get card images %d for cancel failed: %s", taskId, err)
+	}
+	for _, image := range images {
+		if image.ImgUrl != "" {
+			continue
+		}
+		if _, err = lib.CardQueue.Cancel(image.ID); err != nil {
+			logApi.Errorf("[Redis] cancel card task %d failed: %s", image.ID, err)
+		}
+	}
+
+	if task.Status <= models.RUNNING {
+		if err = task.UpdateStatus(models.CANCELD, reason); err != nil {
+			logApi.Warnf("[Mysql] cancel card task %d failed: %s", taskId, err)
+		}
+	}
+}
+
+// 取消未完成的写真或高清, 高清已扣除钻石, 取消后退还
+func cancelPhotoImage(photo *models.UserPhotoImage) {
+	queue := lib.PhotoQueue
+	if photo.DownUrl != "" {
+		if !photo.EnableHr || photo.HrDownUrl != "" {
+			return
+		}
+		queue = lib.PhotoHrQueue
+	}
+	if _, err := queue.Cancel(photo.ID); err != nil {
+		logApi.Errorf("[Redis] cancel task %d:%d failed: %s", queue.TaskType, photo.ID, err)
+	}
+	if queue != lib.PhotoHrQueue {
+		return
+	}
+	if _, err := models.RefundPhotoHr(lib.REC_HR, photo.ID, "任务已取消"); err != nil && err.Error() != models.NoRowError {
+		logApi.Errorf("[Mysql] refund canceled photo hr %d failed: %s", photo.ID, err)
+	}
+}
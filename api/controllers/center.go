@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"time"
 
 	"camera/lib"
 	"camera/models"
@@ -23,31 +22,49 @@ func GetUserProgress(c *gin.Context) {
 
 	result := make(map[string]any)
 	result["step"] = customer.Step
-	// 查看队列排名
+	// 查看队列排名和预计时间
 	if customer.Step == models.CARD_STEP_MAKING {
-		rank := lib.GetSDTaskRank(customer.TempCardTaskId)
+		rank, eta := cardTaskEstimate(customer.TempCardTaskId)
 		result["rank"] = rank
-		if rank > 0 {
-			result["wait_time"] = (rank + 1) * 10
-		} else {
-			task := &models.UserCardTask{ID: customer.TempCardTaskId}
-			if err := task.GetByID(); err != nil {
-				logApi.Errorf("[Mysql] get card task: %d failed: %s", task.ID, err)
-				result["wait_time"] = 10
-			} else {
-				minute := int(time.Now().Sub(task.StartTime).Minutes())
-				if minute < 10 {
-					result["wait_time"] = 10 - minute
-				} else {
-					result["wait_time"] = 1
-				}
-			}
-		}
+		result["wait_time"] = max((eta.P50+59)/60, 1)
+		result["eta"] = eta
+		result["stage"], result["progress"] = cardTaskProgress(customer.TempCardTaskId)
 	}
 
 	c.JSON(http.StatusOK, Response{SUCCESS, result})
 }
 
+// 分身任务预计完成时间: 训练排队或执行中时加上分身出图时间, 训练完成后取最慢的分身图
+func cardTaskEstimate(taskId int) (int, lib.Percentile) {
+	rank, eta := lib.LoraQueue.Estimate(taskId)
+	if rank > 0 || lib.LoraQueue.Leased(taskId) {
+		run := lib.CardQueue.Stats().Run
+		eta.P50 += run.P50
+		eta.P90 += run.P90
+		return rank, eta
+	}
+
+	output := &models.UserCardImage{TaskId: taskId}
+	images, err := output.GetByTaskID()
+	if err != nil {
+		logApi.Errorf("[Mysql] get card images: %d failed: %s", taskId, err)
+		return 0, lib.CardQueue.Stats().Run
+	}
+	ids := make([]int, 0, len(images))
+	for _, image := range images {
+		if image.ImgUrl == "" {
+			ids = append(ids, image.ID)
+		}
+	}
+	eta = lib.Percentile{}
+	for id, rank := range lib.CardQueue.Ranks(ids) {
+		_, e := lib.CardQueue.EstimateRank(id, rank)
+		eta.P50 = max(eta.P50, e.P50)
+		eta.P90 = max(eta.P90, e.P90)
+	}
+	return 0, eta
+}
+
 // 用户注销
 func Logout(c *gin.Context) {
 	//校验用户
@@ -69,9 +86,17 @@ func Logout(c *gin.Context) {
 	}
 	lib.RDB.HDel(ctx, lib.RedisUserToken, fmt.Sprintf("%d", customer.ID))
 
-	// 删除队列中的任务
-	switch customer.Step {
-	case models.CARD_STEP_MAKING:
+	// 取消排队或执行中的任务
+	if customer.Step == models.CARD_STEP_MAKING {
+		cancelCardTask(customer.TempCardTaskId, "用户注销")
+	}
+	photo := &models.UserPhotoImage{CusId: customer.ID}
+	photos, err := photo.GetUnfinishedByCusId()
+	if err != nil {
+		logApi.Warnf("[Mysql] get unfinished photos %d failed: %s", customer.ID, err)
+	}
+	for _, p := range photos {
+		cancelPhotoImage(p)
 	}
 
 	c.JSON(http.StatusOK, Response{SUCCESS, ""})
@@ -87,7 +112,7 @@ func SystemMessage(c *gin.Context) {
 
 	page, _ := strconv.Atoi(c.Query("page"))
 	message := &models.SysMessage{}
-	list, err := message.List(page)
+	list, err := message.List(customer.ID, page)
 	if err != nil {
 		logApi.Errorf("[Mysql] get message list error: %s", err.Error())
 	}
@@ -120,6 +145,11 @@ func PersonalCenter(c *gin.Context) {
 	if customer.NewUser && !customer.Paid {
 		data["give_times"] = true
 	}
+	// 订阅是否有效
+	data["subscribed"], err = models.HasActiveSubscription(customer.ID)
+	if err != nil {
+		logApi.Errorf("[Mysql] get subscription of user: %d failed: %s", customer.ID, err)
+	}
 
 	// 分身创建时间
 	if customer.AvatarId > 0 {
@@ -135,14 +165,32 @@ func PersonalCenter(c *gin.Context) {
 
 	//未读消息数量
 	message := &models.SysMessage{}
-	msgcount, err := message.UnReadCount(customer.MessageId)
+	msgcount, err := message.UnReadCount(customer.ID, customer.MessageId)
 	if err != nil {
 		logApi.Errorf("[Mysql] get message unread count error: %s", err.Error())
 	}
 	data["msgcount"] = msgcount
+	data["refund_consent"] = customer.RefundConsent
 	c.JSON(http.StatusOK, Response{SUCCESS, data})
 }
 
+// 是否同意退款时向苹果提供消费信息
+func RefundConsent(c *gin.Context) {
+	customer, err := GetUser(c)
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	customer.RefundConsent = c.PostForm("consent") == "1"
+	if err = customer.UpdateRefundConsent(); err != nil {
+		logApi.Errorf("[Mysql] update refund consent of user: %d failed: %s", customer.ID, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "设置失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
 // 钻石变动记录
 func DiamondChangeRecord(c *gin.Context) {
 	page, _ := strconv.Atoi(c.Query("page"))
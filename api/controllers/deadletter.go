@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"camera/lib"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 死信列表
+func DeadLetterList(c *gin.Context) {
+	taskType, _ := strconv.Atoi(c.Query("type"))
+	status, _ := strconv.Atoi(c.Query("status"))
+	page, _ := strconv.Atoi(c.Query("page"))
+
+	list, err := models.GetDeadLetterList(taskType, uint8(status), page)
+	if err != nil {
+		logApi.Errorf("[Mysql] get dead letter list failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "获取失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, list})
+}
+
+// 死信详情
+func DeadLetterInfo(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Query("id"))
+	letter := &models.TaskDeadLetter{ID: id}
+	if err := letter.GetByID(); err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "死信不存在"})
+		return
+	}
+
+	result := make(map[string]any)
+	result["letter"] = letter
+	attempts := make([]lib.TaskAttempt, 0)
+	json.UnmarshalFromString(letter.Attempts, &attempts)
+	result["attempts"] = attempts
+	c.JSON(http.StatusOK, Response{SUCCESS, result})
+}
+
+// 死信重新投递
+func DeadLetterRequeue(c *gin.Context) {
+	letter, ok := getPendingDeadLetter(c)
+	if !ok {
+		return
+	}
+
+	queue := getTaskQueue(letter.TaskType)
+	if queue == nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "任务类型错误"})
+		return
+	}
+	if updated, err := letter.UpdateStatus(models.DEAD_REQUEUED); err != nil || !updated {
+		c.JSON(http.StatusOK, Response{FAILURE, "死信已处理"})
+		return
+	}
+
+	// 恢复所属任务
+	if err := restoreOwnerTask(letter.TaskType, letter.TaskId); err != nil {
+		logApi.Errorf("[Mysql] restore task %d_%d failed: %s", letter.TaskType, letter.TaskId, err)
+	}
+	if err := queue.Push(letter.TaskId); err != nil {
+		logApi.Errorf("[Redis] requeue task %d_%d failed: %s", letter.TaskType, letter.TaskId, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "重新投递失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 死信判定失败并退还
+func DeadLetterFail(c *gin.Context) {
+	letter, ok := getPendingDeadLetter(c)
+	if !ok {
+		return
+	}
+
+	if updated, err := letter.UpdateStatus(models.DEAD_FAILED); err != nil || !updated {
+		c.JSON(http.StatusOK, Response{FAILURE, "死信已处理"})
+		return
+	}
+	if err := refundDeadTask(letter); err != nil {
+		logApi.Errorf("[Mysql] refund task %d_%d failed: %s", letter.TaskType, letter.TaskId, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "退还失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+func getPendingDeadLetter(c *gin.Context) (*models.TaskDeadLetter, bool) {
+	id, _ := strconv.Atoi(c.Request.FormValue("id"))
+	letter := &models.TaskDeadLetter{ID: id}
+	if err := letter.GetByID(); err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "死信不存在"})
+		return nil, false
+	}
+	if letter.Status != models.DEAD_PENDING {
+		c.JSON(http.StatusOK, Response{FAILURE, "死信已处理"})
+		return nil, false
+	}
+	return letter, true
+}
+
+func getTaskQueue(taskType int) *lib.Queue {
+	for _, queue := range lib.TaskQueues {
+		if queue.TaskType == taskType {
+			return queue
+		}
+	}
+	return nil
+}
+
+// 恢复所属任务为执行中
+func restoreOwnerTask(taskType, taskId int) error {
+	switch taskType {
+	case lib.REC_FRONT:
+		front := &models.UserFrontImage{ID: taskId}
+		return front.UpdateStatus(1)
+	case lib.REC_SIDE:
+		input := &models.UserInputImage{ID: taskId}
+		return input.UpdateStatus(1)
+	case lib.REC_LORA:
+		task := &models.UserCardTask{ID: taskId}
+		return task.UpdateStatus(models.RUNNING, "")
+	case lib.REC_CARD:
+		card := &models.UserCardImage{ID: taskId}
+		if err := card.GetByID(); err != nil {
+			return err
+		}
+		task := &models.UserCardTask{ID: card.TaskId}
+		return task.UpdateStatus(models.RUNNING, "")
+	case lib.REC_PHOTO:
+		photo := &models.UserPhotoImage{ID: taskId}
+		if err := photo.GetByID(); err != nil {
+			return err
+		}
+		if err := photo.SetFailed(false); err != nil {
+			return err
+		}
+		task := &models.UserPhotoTask{ID: photo.TaskId}
+		return task.UpdateStatus(models.RUNNING, "")
+	case lib.REC_HR:
+		photo := &models.UserPhotoImage{ID: taskId}
+		return photo.SetEnableHr(true)
+	}
+	return nil
+}
+
+// 退还分身次数或高清钻石
+func refundDeadTask(letter *models.TaskDeadLetter) error {
+	_, err := models.RefundTask(letter.TaskType, letter.TaskId, letter.Reason)
+	return err
+}
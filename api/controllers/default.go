@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"math"
 	"net/http"
@@ -59,6 +60,17 @@ func CheckLogin(c *gin.Context) {
 	c.Next()
 }
 
+// CheckWebToken 管理后台校验
+func CheckWebToken(c *gin.Context) {
+	token := c.GetHeader("token")
+	if lib.WebToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(lib.WebToken)) != 1 {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
 // 获取用户信息
 func GetUser(c *gin.Context) (models.UserAccount, error) {
 	cusId, ok := c.Get("customer_id")
@@ -75,6 +87,19 @@ func GetUser(c *gin.Context) (models.UserAccount, error) {
 	return customer, nil
 }
 
+// 获取用户任务优先级通道, 查询失败时按未购买加速和未订阅处理
+func getUserLane(customer *models.UserAccount) int {
+	speedPaidAt, err := customer.LastSpeedPaidAt()
+	if err != nil {
+		logApi.Errorf("[Mysql] get customer: %d speed order failed: %s", customer.ID, err)
+	}
+	subscribed, err := models.HasActiveSubscription(customer.ID)
+	if err != nil {
+		logApi.Errorf("[Mysql] get customer: %d subscription failed: %s", customer.ID, err)
+	}
+	return lib.GetLane(customer.Paid, speedPaidAt, subscribed, time.Now())
+}
+
 func GetUserID(c *gin.Context) int {
 	cusId, ok := c.Get("customer_id")
 	if !ok {
@@ -99,9 +124,9 @@ func readDeviceFromHeader(c *gin.Context) (DeviceHeader, error) {
 	if userAgent == "" {
 		return device, fmt.Errorf("no device info in header")
 	}
-	body, err := lib.DESDecrypt(userAgent, lib.ApiDeskey)
+	body, err := lib.ApiCipher.Decrypt(userAgent)
 	if err != nil {
-		return device, fmt.Errorf("[Device] 3des decrypt failed: %s, ip: %s", err, c.ClientIP())
+		return device, fmt.Errorf("[Device] decrypt failed: %s, ip: %s", err, c.ClientIP())
 	}
 	if err = json.Unmarshal(body, &device); err != nil {
 		return device, fmt.Errorf("[Device] json unmarshal failed: %s, ip: %s", err, c.ClientIP())
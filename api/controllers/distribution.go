@@ -3,6 +3,7 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"camera/lib"
@@ -13,7 +14,7 @@ import (
 
 // 照片识别任务分发
 func GetPhotoRecognizeTask(c *gin.Context) {
-	ctype, ids, err := lib.PopSDCheckTask()
+	ctype, ids, err := lib.PopSDCheckTask(workerName(c))
 	if err != nil {
 		if err.Error() != lib.RedisNull {
 			logApi.Errorf("[Redis] pop sd check task error: %v", err)
@@ -22,18 +23,12 @@ func GetPhotoRecognizeTask(c *gin.Context) {
 		return
 	}
 
-	ctask := lib.TaskCheck{}
+	ctask := lib.TaskCheck{Version: lib.SchemaVersion}
 	arrs := make(map[uint64]string)
 	switch ctype {
 	case 1:
 		// 正面照
 		for _, id := range ids {
-			// 加入维护
-			record := &lib.TaskRecord{TaskType: lib.REC_FRONT, TaskID: id}
-			if err = record.Set(); err != nil {
-				logApi.Errorf("[Redis] set task record error: %v, %+v", err, record)
-			}
-
 			// 处理业务
 			task := models.UserFrontImage{ID: id}
 			if err := task.GetByID(); err != nil {
@@ -54,12 +49,6 @@ func GetPhotoRecognizeTask(c *gin.Context) {
 		// 侧面照
 		cusId := 0
 		for _, id := range ids {
-			// 加入维护
-			record := &lib.TaskRecord{TaskType: lib.REC_SIDE, TaskID: id}
-			if err = record.Set(); err != nil {
-				logApi.Errorf("[Redis] set task record error: %v, %+v", err, record)
-			}
-
 			// 处理业务
 			task := models.UserInputImage{ID: id}
 			if err := task.GetByID(); err != nil {
@@ -105,7 +94,7 @@ func GetPhotoRecognizeTask(c *gin.Context) {
 
 // Lora模型训练
 func GetLoraTask(c *gin.Context) {
-	taskId, err := lib.PopSDTask()
+	taskId, err := lib.PopSDTask(workerName(c))
 	if err != nil {
 		if err.Error() != lib.RedisNull {
 			logApi.Errorf("[Redis] pop sd task error: %v", err)
@@ -117,15 +106,17 @@ func GetLoraTask(c *gin.Context) {
 	task := &models.UserCardTask{ID: taskId}
 	if err = task.GetByID(); err != nil {
 		if err.Error() == models.NoRowError {
+			lib.LoraQueue.Ack(taskId)
 			c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 			return
 		}
 		logApi.Errorf("[Mysql] get train task: %d error: %v", taskId, err)
-		lib.PushSDTask(taskId)
+		lib.LoraQueue.Nack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
 	if task.Status > models.RUNNING {
+		lib.LoraQueue.Ack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
@@ -135,16 +126,18 @@ func GetLoraTask(c *gin.Context) {
 	if err = customer.GetByID(); err != nil {
 		if err.Error() == models.NoRowError {
 			task.UpdateStatus(models.FAILED, "用户不存在")
+			lib.LoraQueue.Ack(taskId)
 			c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 			return
 		}
 		logApi.Errorf("[Mysql] get customer: %d error: %v", task.CusId, err)
-		lib.PushSDTask(taskId)
+		lib.LoraQueue.Nack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
 	if !customer.Enabled {
 		task.UpdateStatus(models.FAILED, "用户被禁用")
+		lib.LoraQueue.Ack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
@@ -161,7 +154,7 @@ func GetLoraTask(c *gin.Context) {
 	images, err := input.GetByCusId()
 	if err != nil {
 		logApi.Errorf("[Mysql] get pass input images error: %v", err)
-		lib.PushSDTask(taskId)
+		lib.LoraQueue.Nack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
@@ -181,6 +174,7 @@ func GetLoraTask(c *gin.Context) {
 	if len(lora.ImageUrl) < 10 {
 		logApi.Warnf("taskId: %d image < 10", taskId)
 		task.UpdateStatus(models.FAILED, "训练照不足10张")
+		lib.LoraQueue.Ack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 		return
 	}
@@ -188,12 +182,11 @@ func GetLoraTask(c *gin.Context) {
 	if err = task.UpdateStatus(models.RUNNING, ""); err != nil {
 		logApi.Errorf("[Mysql] update running status: %d failed: %s", task.ID, err)
 	}
-
-	record := &lib.TaskRecord{TaskType: lib.REC_LORA, TaskID: taskId}
-	record.Set()
+	publishTaskEvent(task.CusId, &lib.TaskEvent{Event: lib.EVENT_STARTED, Task: lib.EVENT_TASK_CARD, TaskId: task.ID})
 
 	// 任务
 	webuiTask := lib.Task{
+		Version:   lib.SchemaVersion,
 		TaskId:    uint(taskId),
 		Callback:  lib.WebUICallback,
 		LoraTrain: lora,
@@ -203,32 +196,61 @@ func GetLoraTask(c *gin.Context) {
 }
 
 // 写真
+// batch>0时返回任务数组, 同一写真任务的图片最多batch个一起下发
 func GetPhotoTask(c *gin.Context) {
+	batch, _ := strconv.Atoi(c.Query("batch"))
+	if batch > 0 {
+		getPhotoTasks(c, min(batch, lib.PhotoBatchMax))
+		return
+	}
+
 	task := getCardTask(c)
 	if task.TaskId > 0 {
-		record := &lib.TaskRecord{TaskType: lib.REC_CARD, TaskID: int(task.TaskId)}
-		record.Set()
-
 		c.JSON(http.StatusOK, Response{SUCCESS, task})
 		return
 	}
 
 	task = getPhotoTask(c)
 	if task.TaskId > 0 {
-		record := &lib.TaskRecord{TaskType: lib.REC_PHOTO, TaskID: int(task.TaskId)}
-		record.Set()
-
 		c.JSON(http.StatusOK, Response{SUCCESS, task})
 		return
 	}
 	c.JSON(http.StatusOK, Response{FAILURE, lib.Task{}})
 }
 
+// 批量下发, 分身任务单个下发
+func getPhotoTasks(c *gin.Context, batch int) {
+	tasks := make([]lib.Task, 0, batch)
+	if task := getCardTask(c); task.TaskId > 0 {
+		tasks = append(tasks, task)
+		c.JSON(http.StatusOK, Response{SUCCESS, tasks})
+		return
+	}
+
+	task := getPhotoTask(c)
+	if task.TaskId == 0 {
+		c.JSON(http.StatusOK, Response{FAILURE, tasks})
+		return
+	}
+	tasks = append(tasks, task)
+
+	ids, err := lib.PhotoQueue.PopGroup(workerName(c), int(task.TaskId), batch-1)
+	if err != nil {
+		logApi.Errorf("[Redis] pop photo group %d error: %v", task.TaskId, err)
+	}
+	for _, id := range ids {
+		if t := buildPhotoTask(id); t.TaskId > 0 {
+			tasks = append(tasks, t)
+		}
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, tasks})
+}
+
 // 分身任务
 func getCardTask(c *gin.Context) lib.Task {
 	webuiTask := lib.Task{}
 
-	taskId, err := lib.PopSDCardTask()
+	taskId, err := lib.PopSDCardTask(workerName(c))
 	if err != nil {
 		if err.Error() != lib.RedisNull {
 			logApi.Errorf("[Redis] pop card task error: %v", err)
@@ -239,17 +261,18 @@ func getCardTask(c *gin.Context) lib.Task {
 	task := &models.UserCardImage{ID: taskId}
 	if err = task.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get card task: %d error: %v", taskId, err)
-		lib.PushSDCardTask(taskId)
+		lib.CardQueue.Nack(taskId)
 		return webuiTask
 	}
 	if task.ImgUrl != "" {
+		lib.CardQueue.Ack(taskId)
 		return webuiTask
 	}
 
 	itask := &models.UserCardTask{ID: task.TaskId}
 	if err = itask.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get card task: %d error: %v", taskId, err)
-		lib.PushSDCardTask(taskId)
+		lib.CardQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -257,23 +280,24 @@ func getCardTask(c *gin.Context) lib.Task {
 	front := &models.UserFrontImage{CusId: task.CusId}
 	if err = front.GetByCusId(); err != nil {
 		logApi.Errorf("[Mysql] get front image failed: %s", err)
-		lib.PushSDCardTask(taskId)
+		lib.CardQueue.Nack(taskId)
 		return webuiTask
 	}
 	frontUrl, err := lib.GetImageUrl(front.ImgUrl)
 	if err != nil {
 		logApi.Errorf("bad front image: %s", front.ImgUrl)
-		lib.PushSDCardTask(taskId)
+		lib.CardQueue.Nack(taskId)
 		return webuiTask
 	}
 	customer := &models.UserAccount{ID: front.CusId}
 	if err = customer.GetByID(); err != nil {
 		if err.Error() == models.NoRowError {
 			logApi.Warnf("[Mysql] get customer: %d not exist", front.CusId)
+			lib.CardQueue.Ack(taskId)
 			return webuiTask
 		}
 		logApi.Errorf("[Mysql] get customer: %d error: %v", front.CusId, err)
-		lib.PushSDCardTask(taskId)
+		lib.CardQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -338,6 +362,7 @@ func getCardTask(c *gin.Context) lib.Task {
 	}
 
 	// 任务
+	webuiTask.Version = lib.SchemaVersion
 	webuiTask.TaskType = 1
 	webuiTask.TaskId = uint(taskId)
 	webuiTask.Callback = lib.WebUICallbackCard
@@ -372,30 +397,39 @@ func getPromptByGender(gender int, card, lora string, weight float64) string {
 func getPhotoTask(c *gin.Context) lib.Task {
 	webuiTask := lib.Task{}
 
-	taskId, err := lib.PopSDPhotoTask()
+	taskId, err := lib.PopSDPhotoTask(workerName(c), workerCheckpoint(c))
 	if err != nil {
 		if err.Error() != lib.RedisNull {
 			logApi.Errorf("[Redis] pop photo task error: %v", err)
 		}
 		return webuiTask
 	}
+	return buildPhotoTask(taskId)
+}
+
+// 组装写真任务, 失败时Ack或Nack并返回空任务
+func buildPhotoTask(taskId int) lib.Task {
+	webuiTask := lib.Task{}
 
 	task := &models.UserPhotoImage{ID: taskId}
-	if err = task.GetByID(); err != nil {
+	err := task.GetByID()
+	if err != nil {
 		logApi.Errorf("[Mysql] get photo task: %d error: %v", taskId, err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 	if task.ImgUrl != "" {
+		lib.PhotoQueue.Ack(taskId)
 		return webuiTask
 	}
 	ptask := &models.UserPhotoTask{ID: task.TaskId}
 	if err = ptask.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get photo task: %d error: %v", taskId, err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 	if ptask.Status != models.DEFAULT && ptask.Status != models.RUNNING {
+		lib.PhotoQueue.Ack(taskId)
 		return webuiTask
 	}
 
@@ -403,7 +437,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 	card := &models.UserCardImage{ID: ptask.AvatarId}
 	if err = card.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get card image: %d error: %v", card.ID, err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -411,7 +445,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 	customer := &models.UserAccount{ID: ptask.CusId}
 	if err = customer.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get account error: %v", err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -419,7 +453,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 	pose := &models.UserPhotoPose{ID: task.PoseId}
 	if err = pose.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get pose: %d error: %v", pose.ID, err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -427,7 +461,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 	template := &models.UserPhotoTemplate{ID: pose.TemplateId}
 	if err = template.GetByID(); err != nil {
 		logApi.Errorf("[Mysql] get template: %d error: %v", template.ID, err)
-		lib.PushSDPhotoTask(taskId, false)
+		lib.PhotoQueue.Nack(taskId)
 		return webuiTask
 	}
 
@@ -531,6 +565,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 	}
 
 	// 任务
+	webuiTask.Version = lib.SchemaVersion
 	webuiTask.TaskType = 2
 	webuiTask.TaskId = uint(taskId)
 	webuiTask.Callback = lib.WebUICallbackPhoto
@@ -543,6 +578,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 		if err = ptask.UpdateStatus(models.RUNNING, ""); err != nil {
 			logApi.Errorf("[Mysql] update status %d:1 failed: %s", ptask.ID, err)
 		}
+		publishTaskEvent(ptask.CusId, &lib.TaskEvent{Event: lib.EVENT_STARTED, Task: lib.EVENT_TASK_PHOTO, TaskId: ptask.ID})
 	}
 
 	return webuiTask
@@ -550,7 +586,7 @@ func getPhotoTask(c *gin.Context) lib.Task {
 
 // 高清任务
 func GetPhotoHrTask(c *gin.Context) {
-	taskId, err := lib.PopSDPhotoHrTask()
+	taskId, err := lib.PopSDPhotoHrTask(workerName(c))
 	if err != nil {
 		if err.Error() != lib.RedisNull {
 			logApi.Errorf("[Redis] pop photo hr task error: %v", err)
@@ -562,15 +598,17 @@ func GetPhotoHrTask(c *gin.Context) {
 	photo := &models.UserPhotoImage{ID: taskId}
 	if err = photo.GetByID(); err != nil {
 		if err.Error() == models.NoRowError {
+			lib.PhotoHrQueue.Ack(taskId)
 			c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 			return
 		}
 		logApi.Errorf("[Mysql] get photo image: %d error: %v", taskId, err)
-		lib.PushSDPhotoHrTask(taskId)
+		lib.PhotoHrQueue.Nack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 		return
 	}
 	if photo.HrDownUrl != "" {
+		lib.PhotoHrQueue.Ack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 		return
 	}
@@ -579,24 +617,26 @@ func GetPhotoHrTask(c *gin.Context) {
 	customer := &models.UserAccount{ID: photo.CusId}
 	if err = customer.GetByID(); err != nil {
 		if err.Error() == models.NoRowError {
+			lib.PhotoHrQueue.Ack(taskId)
 			c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 			return
 		}
 		logApi.Errorf("[Mysql] get customer: %d error: %v", photo.CusId, err)
-		lib.PushSDPhotoHrTask(taskId)
+		lib.PhotoHrQueue.Nack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 		return
 	}
 	if !customer.Enabled {
+		lib.PhotoHrQueue.Ack(taskId)
 		c.JSON(http.StatusOK, Response{FAILURE, lib.TaskPhotoHr{}})
 		return
 	}
 
-	record := &lib.TaskRecord{TaskType: lib.REC_HR, TaskID: taskId}
-	record.Set()
+	publishTaskEvent(photo.CusId, &lib.TaskEvent{Event: lib.EVENT_STARTED, Task: lib.EVENT_TASK_HIRES, TaskId: photo.TaskId, ImageId: photo.ID})
 
 	// 任务
 	webuiTask := lib.TaskPhotoHr{
+		Version:  lib.SchemaVersion,
 		TaskId:   taskId,
 		Callback: lib.WebUICallbackPhotoHr,
 		ImageUrl: photo.DownUrl,
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"io"
+	"time"
+
+	"camera/lib"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SSE心跳间隔, 防止代理断开空闲连接
+const eventHeartbeat = 25 * time.Second
+
+// 任务事件推送(Server-Sent Events)
+func TaskEvents(c *gin.Context) {
+	cusId := GetUserID(c)
+	events, cancel := lib.SubscribeTaskEvent(cusId)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	c.SSEvent("ready", gin.H{"time": time.Now().Unix()})
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			c.SSEvent(event.Event, event)
+		case <-heartbeat.C:
+			c.SSEvent("ping", gin.H{"time": time.Now().Unix()})
+		}
+		return true
+	})
+}
+
+// 发布任务事件, 失败只记录日志
+func publishTaskEvent(cusId int, event *lib.TaskEvent) {
+	if err := lib.PublishTaskEvent(cusId, event); err != nil {
+		logApi.Errorf("[Redis] publish %s event %s:%d failed: %s", event.Task, event.Event, event.TaskId, err)
+	}
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	storage "camera-storage"
+	"camera/lib"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 代理下载
+var fileClient = &http.Client{Timeout: time.Minute}
+
+// 下载链接, 校验token后跳转到存储的限时地址或由api代理
+func ServeDownload(c *gin.Context) {
+	cusId, imageId, err := lib.ParseDownloadToken(c.Param("token"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	photo := &models.UserPhotoImage{ID: imageId}
+	if err = photo.GetByID(); err != nil || photo.CusId != cusId {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	serveFile(c, photoDownUrl(photo))
+}
+
+// 分享链接, 过期或撤销后失效
+func ServeShare(c *gin.Context) {
+	share, err := lib.GetFileShare(c.Param("id"))
+	if err != nil {
+		logApi.Errorf("[Redis] get file share %s failed: %s", c.Param("id"), err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if share == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	imgUrl := ""
+	switch share.Type {
+	case lib.SHARE_CARD:
+		card := &models.UserCardImage{ID: share.ImageId}
+		if err = card.GetByID(); err == nil && card.CusId == share.CusId {
+			imgUrl = card.ImgUrl
+		}
+	case lib.SHARE_PHOTO:
+		photo := &models.UserPhotoImage{ID: share.ImageId}
+		if err = photo.GetByID(); err == nil && photo.CusId == share.CusId {
+			imgUrl = photo.DownUrl
+		}
+	}
+	serveFile(c, imgUrl)
+}
+
+// 撤销分享
+func RevokeShare(c *gin.Context) {
+	// 校验用户
+	customer, err := GetUser(c)
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "用户不存在"})
+		return
+	}
+
+	id := c.Request.FormValue("id")
+	share, err := lib.GetFileShare(id)
+	if err != nil {
+		logApi.Errorf("[Redis] get file share %s failed: %s", id, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "撤销失败"})
+		return
+	}
+	if share == nil || share.CusId != customer.ID {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "分享不存在"})
+		return
+	}
+	if err = lib.RevokeFileShare(id); err != nil {
+		logApi.Errorf("[Redis] revoke file share %s failed: %s", id, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "撤销失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 写真下载地址, 开启高清时为高清图
+func photoDownUrl(photo *models.UserPhotoImage) string {
+	if photo.EnableHr {
+		return photo.HrDownUrl
+	}
+	return photo.DownUrl
+}
+
+// 存储中的文件跳转到限时地址或由api代理, 其他地址由api代理
+func serveFile(c *gin.Context, rawurl string) {
+	if rawurl == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "private, no-store")
+
+	key, ok := lib.Store.Key(rawurl)
+	if !ok {
+		proxyFile(c, rawurl)
+		return
+	}
+	if lib.FileRedirect {
+		signed, err := lib.Store.SignedURL(key, time.Now().Add(lib.FileRedirectExpire))
+		if err != nil {
+			logApi.Errorf("[File] sign url failed: %s, key: %s", err, key)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Redirect(http.StatusFound, signed)
+		return
+	}
+
+	reader, err := lib.Store.Get(c.Request.Context(), key)
+	if err == storage.ErrNotExist {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logApi.Errorf("[File] get %s failed: %s", key, err)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	defer reader.Close()
+	c.DataFromReader(http.StatusOK, -1, mime.TypeByExtension(filepath.Ext(key)), reader, nil)
+}
+
+// 代理外部地址
+func proxyFile(c *gin.Context, rawurl string) {
+	resp, err := fileClient.Get(rawurl)
+	if err != nil {
+		logApi.Errorf("[File] proxy failed: %s, url: %s", err, rawurl)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logApi.Errorf("[File] proxy status %d, url: %s", resp.StatusCode, rawurl)
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+	c.DataFromReader(http.StatusOK, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+}
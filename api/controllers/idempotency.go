@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+
+	"camera/lib"
+	"camera/middleware"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// Idempotent 幂等请求, 需放在CheckLogin之后
+// 带Idempotency-Key的请求只执行一次, 重放时返回原始响应
+// 失败和需重试的结果不保存, 客户端用同一个key重试时重新执行
+var Idempotent = middleware.IdempotencyWithConfig(middleware.IdempotencyConfig{
+	Store:      idempotencyStore{},
+	KeyHeader:  HeaderIdempotencyKey,
+	Replayable: middleware.ReplayableExceptCodes(idempotencyRetryCodes...),
+	ErrorHandler: func(c *gin.Context, err error) {
+		switch err {
+		case middleware.ErrIdempotencyKeyInvalid:
+			c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		case middleware.ErrIdempotencyKeyReused:
+			c.JSON(http.StatusOK, Response{INVALID_PARAM, "Idempotency-Key已被使用"})
+		case middleware.ErrIdempotencyRunning:
+			c.JSON(http.StatusOK, Response{REQUEST_RUNNING, "请求处理中，请稍后重试"})
+		default:
+			logApi.Errorf("[Redis] lock idempotency %d_%s failed: %s", GetUserID(c), c.GetHeader(HeaderIdempotencyKey), err)
+			c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
+		}
+	},
+})
+
+// 可重试的结果, 不保存
+// 钻石和分身次数不足时充值后可用同一个key重试
+var idempotencyRetryCodes = []int{
+	int(FAILURE),
+	int(NO_CARD_TIMES),
+	int(DIAMOND_NOT_ENOUGH),
+	int(PAY_CONFIRM_RETRY),
+	int(REQUEST_RUNNING),
+}
+
+// 按用户保存, 缓存24小时, 数据库永久保存
+type idempotencyStore struct{}
+
+// 先查缓存, 再查数据库
+func (idempotencyStore) Get(c *gin.Context, idemKey string) (*middleware.IdempotencyRecord, bool) {
+	cusId := GetUserID(c)
+	key := lib.GetMd5([]byte(idemKey))
+	record := &models.IdempotencyRecord{CusId: cusId, IdemKey: idemKey}
+	if value, err := lib.GetIdempotencyResponse(cusId, key); err == nil {
+		if err = json.UnmarshalFromString(value, record); err == nil {
+			return idempotencyRecord(record), true
+		}
+	}
+	if err := record.GetByKey(); err != nil {
+		return nil, false
+	}
+	if value, err := json.MarshalToString(record); err == nil {
+		lib.SetIdempotencyResponse(cusId, key, value)
+	}
+	return idempotencyRecord(record), true
+}
+
+func (idempotencyStore) Lock(c *gin.Context, idemKey string) (bool, error) {
+	return lib.LockIdempotency(GetUserID(c), lib.GetMd5([]byte(idemKey)))
+}
+
+func (idempotencyStore) Unlock(c *gin.Context, idemKey string) {
+	lib.UnlockIdempotency(GetUserID(c), lib.GetMd5([]byte(idemKey)))
+}
+
+func (idempotencyStore) Save(c *gin.Context, idemKey string, resp *middleware.IdempotencyRecord) error {
+	cusId := GetUserID(c)
+	record := &models.IdempotencyRecord{
+		CusId:   cusId,
+		IdemKey: idemKey,
+		Path:    resp.Path,
+		ReqHash: resp.ReqHash,
+		Status:  resp.Status,
+		Body:    resp.Body,
+	}
+	if _, err := record.Create(); err != nil {
+		logApi.Errorf("[Mysql] create idempotency %d_%s failed: %s", cusId, idemKey, err)
+	}
+	if value, err := json.MarshalToString(record); err == nil {
+		if err = lib.SetIdempotencyResponse(cusId, lib.GetMd5([]byte(idemKey)), value); err != nil {
+			logApi.Errorf("[Redis] set idempotency %d_%s failed: %s", cusId, idemKey, err)
+		}
+	}
+	return nil
+}
+
+func idempotencyRecord(record *models.IdempotencyRecord) *middleware.IdempotencyRecord {
+	return &middleware.IdempotencyRecord{
+		Path:    record.Path,
+		ReqHash: record.ReqHash,
+		Status:  record.Status,
+		Body:    record.Body,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"camera/models"
 	"fmt"
 	"net/http"
+	"testing"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,6 +14,10 @@ var (
 )
 
 func init() {
+	// 测试时不预加载
+	if testing.Testing() {
+		return
+	}
 	//预加载产品
 	if err := loadAppVersion(); err != nil {
 		logApi.Fatal(err)
@@ -88,7 +93,7 @@ func CacheRefresh(c *gin.Context) {
 // if err != nil {
 // 	return c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
 // }
-// bdata, err := lib.DESDecrypt(string(body), lib.ApiDeskey)
+// bdata, err := lib.ApiCipher.Decrypt(string(body))
 // if err != nil {
 // 	logApi.Warnf("[base app data] des decrypt failed, body: %s", string(body))
 // 	return c.JSON(http.StatusOK, Response{FAILURE, "参数错误"})
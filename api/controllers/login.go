@@ -15,9 +15,9 @@ import (
 
 // SendMessage 发送短信验证码
 func SendMessage(c *gin.Context) {
-	phoneByte, err := lib.DESDecrypt(c.Query("p"), lib.ApiDeskey)
+	phoneByte, err := lib.ApiCipher.Decrypt(c.Query("p"))
 	if err != nil {
-		logApi.Warnf("[3DES] decrypt failed: %s, param: %s", err, c.Query("p"))
+		logApi.Warnf("[Cipher] decrypt failed: %s, param: %s", err, c.Query("p"))
 		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
 		return
 	}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"camera/lib"
+
+	"github.com/gin-gonic/gin"
+)
+
+// worker节点启动注册
+func RegisterWorker(c *gin.Context) {
+	saveWorkerNode(c, true)
+}
+
+// worker节点心跳
+func WorkerHeartbeat(c *gin.Context) {
+	saveWorkerNode(c, false)
+}
+
+func saveWorkerNode(c *gin.Context, register bool) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		logApi.Errorf("[IO] read body failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "心跳失败"})
+		return
+	}
+	b, err := lib.WebUICipher.Decrypt(string(body))
+	if err != nil {
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
+		c.JSON(http.StatusOK, Response{FAILURE, "解密失败"})
+		return
+	}
+	node := &lib.WorkerNode{}
+	if err = json.Unmarshal(b, node); err != nil {
+		logApi.Errorf("[IO] json unmarshal failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "心跳json解析失败"})
+		return
+	}
+	if node.Service == "" {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	node.Worker = workerName(c)
+	node.IP = c.ClientIP()
+	node.HeartbeatAt = time.Now().Unix()
+	node.Offline = false
+	prev, err := lib.SaveWorkerNode(node)
+	if err != nil {
+		logApi.Errorf("[Redis] save worker node %s failed: %s", node.Key(), err)
+		c.JSON(http.StatusOK, Response{FAILURE, "心跳失败"})
+		return
+	}
+	switch {
+	case register:
+		logApi.Infof("[Worker] %s registered, host: %s, version: %s, types: %v, threads: %d",
+			node.Key(), node.Hostname, node.Version, node.TaskTypes, node.Threads)
+	case prev != nil && prev.Offline:
+		logApi.Warnf("[Worker] %s back online after %ds", node.Key(), node.HeartbeatAt-prev.HeartbeatAt)
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// worker已加载的底模, 优先使用领取任务时上报的, 其次是心跳上报的
+func workerCheckpoint(c *gin.Context) string {
+	if checkpoint := c.Query("checkpoint"); checkpoint != "" {
+		return checkpoint
+	}
+	if node := lib.GetWorkerNode(workerName(c) + "/qianyi"); node != nil && !node.Offline {
+		return node.Checkpoint
+	}
+	return ""
+}
+
+// worker节点列表, 包含在线状态和执行中的任务
+func WorkerNodeList(c *gin.Context) {
+	nodes, err := lib.GetWorkerNodes()
+	if err != nil {
+		logApi.Errorf("[Redis] get worker nodes failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "获取失败"})
+		return
+	}
+
+	// 队列名 => worker => 任务ID
+	leases := make(map[string]map[string][]int)
+	for _, q := range lib.TaskQueues {
+		workers, err := q.LeaseWorkers()
+		if err != nil {
+			logApi.Errorf("[Redis] get lease workers %d failed: %s", q.TaskType, err)
+			continue
+		}
+		leases[q.Name] = workers
+	}
+
+	now := time.Now()
+	list := make([]gin.H, 0, len(nodes))
+	for _, node := range nodes {
+		nodeLeases := make(map[string][]int)
+		for _, name := range node.TaskTypes {
+			if ids := leases[name][node.Worker]; len(ids) > 0 {
+				nodeLeases[name] = ids
+			}
+		}
+		status := "online"
+		if node.Offline {
+			status = "offline"
+		} else if node.Expired(now) {
+			status = "timeout"
+		}
+		list = append(list, gin.H{"node": node, "status": status, "leases": nodeLeases})
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, gin.H{
+		"nodes":             list,
+		"heartbeat_timeout": lib.WorkerHeartbeatTimeout.Seconds(),
+		"affinity":          lib.GetAffinityStats(lib.PhotoQueue.TaskType),
+	}})
+}
+
+// 移除worker节点, 在线节点下次心跳会重新出现
+func WorkerNodeRemove(c *gin.Context) {
+	key := c.Request.FormValue("key")
+	if key == "" {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+	if err := lib.RemoveWorkerNode(key); err != nil {
+		logApi.Errorf("[Redis] remove worker node %s failed: %s", key, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "移除失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
@@ -30,6 +30,7 @@ const (
 	GEN_TASK_FAILED   RespCode = 1004 // 任务执行失败
 	IMAGE_SIZE_BIG    RespCode = 1005 // 头像文件最大100KB
 	PAY_CONFIRM_RETRY RespCode = 1006 // 支付确认失败，请重试
+	REQUEST_RUNNING   RespCode = 1007 // 请求处理中，请稍后重试
 )
 
 type Response struct {
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	appstore "camera-appstore"
 	"camera/lib"
 	"camera/models"
 	"camera/monitor"
@@ -25,8 +26,10 @@ func AppStoreConfirm(c *gin.Context) {
 	orderNum := c.Request.FormValue("order_num")
 	productId := c.Request.FormValue("product_id")
 	receipt := c.Request.FormValue("receipt")
+	// StoreKit 2 的签名交易, 与receipt二选一
+	signedTransaction := c.Request.FormValue("signed_transaction")
 
-	if orderNum == "" || productId == "" || receipt == "" {
+	if orderNum == "" || productId == "" || (receipt == "" && signedTransaction == "") {
 		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
 		return
 	}
@@ -60,20 +63,7 @@ func AppStoreConfirm(c *gin.Context) {
 			c.JSON(http.StatusOK, Response{INVALID_PARAM, "订单不存在"})
 			return
 		} else {
-			order.CusId = customer.ID
-			order.OrderNum = orderNum
-			order.ProductId = productId
-			order.Amount = product.Price
-			order.Diamond = product.Diamond
-			order.CardTimes = product.CardTimes
-			order.Sandbox = false
-			order.PayType = product.PayType
-			order.CreatedAt = time.Now()
-			order.UpdatedAt = time.Now()
-			if product.ProductType == 1 && customer.NewUser && !customer.Paid {
-				order.Diamond += 10
-				order.CardTimes += 1
-			}
+			order = newRechargeOrder(customer, product, orderNum)
 		}
 	} else {
 		if order.Status != 0 {
@@ -86,9 +76,26 @@ func AppStoreConfirm(c *gin.Context) {
 		}
 	}
 
+	// StoreKit 2 本地校验签名
+	if signedTransaction != "" {
+		trans, err := lib.VerifyAppStoreTransaction(signedTransaction)
+		if err != nil || trans.BundleId != bundleId || trans.TransactionId != orderNum || trans.ProductId != productId || trans.Revoked() {
+			logOrder.Errorf("[Confirm] appstore transaction confirm failed: %v, bundle_id: %s, cusid: %d, trans_id: %s, proid: %s", err, bundleId, customer.ID, orderNum, productId)
+			c.JSON(http.StatusOK, Response{FAILURE, "订单验证失败"})
+			return
+		}
+		if product.ProductType == models.PRODUCT_SUBSCRIPTION {
+			appStoreSubscribed(customer, product, order, signedTransaction, trans, nil, trans.IsTrial())
+		} else {
+			appStorePaid(customer, product, order, signedTransaction, trans.Environment != appstore.ENV_PRODUCTION)
+		}
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
+
 	// 请求AppStore
 	sandbox := false
-	respData, err := lib.ConfirmAppStorePay(receipt, sandbox, false, "")
+	respData, err := lib.ConfirmAppStorePay(receipt, sandbox, lib.AppStoreSharedSecret != "", lib.AppStoreSharedSecret)
 	if err != nil {
 		if order.ID == 0 {
 			logOrder.Errorf("[Http] check appstore order failed: %s, cus_id: %d, trans_id: %s, pro_id: %s, receipt: %s", err, customer.ID, orderNum, productId, receipt)
@@ -109,7 +116,7 @@ func AppStoreConfirm(c *gin.Context) {
 	// 沙盒
 	if respData.Status == 21007 {
 		sandbox = true
-		respData, err = lib.ConfirmAppStorePay(receipt, sandbox, false, "")
+		respData, err = lib.ConfirmAppStorePay(receipt, sandbox, lib.AppStoreSharedSecret != "", lib.AppStoreSharedSecret)
 		if err != nil {
 			logOrder.Errorf("[Http][Sandbox] check appstore order failed: %s, cus_id: %d, trans_id: %s, pro_id: %s, receipt: %s", err, customer.ID, orderNum, productId, receipt)
 
@@ -140,40 +147,105 @@ func AppStoreConfirm(c *gin.Context) {
 		return
 	}
 
-	// 校验成功
+	if product.ProductType == models.PRODUCT_SUBSCRIPTION {
+		trans, renewal := respData.Subscription(orderNum)
+		if trans == nil {
+			logOrder.Warnf("[Confirm] appstore subscription not in receipt, cusid: %d, trans_id: %s, proid: %s", customer.ID, orderNum, productId)
+			c.JSON(http.StatusOK, Response{FAILURE, "订单验证失败"})
+			return
+		}
+		appStoreSubscribed(customer, product, order, receipt, trans, renewal, respData.IsTrial(orderNum))
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
+
+	appStorePaid(customer, product, order, receipt, sandbox)
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 新订单, 状态为待确认
+func newRechargeOrder(customer models.UserAccount, product *models.Product, orderNum string) *models.RechargeRecord {
+	order := &models.RechargeRecord{
+		CusId:     customer.ID,
+		OrderNum:  orderNum,
+		ProductId: product.ProductId,
+		Amount:    product.Price,
+		Diamond:   product.Diamond,
+		CardTimes: product.CardTimes,
+		Sandbox:   false,
+		PayType:   product.PayType,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if product.ProductType == 1 && customer.NewUser && !customer.Paid {
+		order.Diamond += 10
+		order.CardTimes += 1
+	}
+	// 订阅按期发放, 发放时再记录到订单
+	if product.ProductType == models.PRODUCT_SUBSCRIPTION {
+		order.Diamond, order.CardTimes = 0, 0
+	}
+	return order
+}
+
+// 校验成功, 保存订单并发放
+// 新订单先保存为待确认, 再由ConfirmPending在同一事务内改为已支付并按订单发放, 确认失败时由补单任务继续
+func appStorePaid(customer models.UserAccount, product *models.Product, order *models.RechargeRecord, receipt string, sandbox bool) {
+	orderNum := order.OrderNum
 	if order.ID == 0 {
-		order.Sandbox = sandbox
-		order.Status = 1
-		if err = order.Create(receipt); err != nil {
+		if err := order.Create(receipt); err != nil {
 			logOrder.Errorf("[Mysql] create order: %s failed: %s", orderNum, err)
+			return
 		}
-	} else {
-		if err = order.Update(sandbox, 1); err != nil {
+	}
+	confirmed, err := order.ConfirmPending(sandbox, product.PayEvent())
+	if err != nil {
+		logOrder.Errorf("[Mysql] confirm order: %s failed: %s, cus_id: %d", orderNum, err, customer.ID)
+		return
+	}
+	if confirmed {
+		logOrder.Infof("[Confirm] appstore order: %s confirmed, cus_id: %d, diamond: %d, card_times: %d", orderNum, customer.ID, order.Diamond, order.CardTimes)
+	}
+}
+
+// 订阅校验成功, 保存订单后同步订阅并发放未发放的各期
+// 收据中的最近一期可能晚于本订单, 本订单直接更新为已支付并记为订阅的一期, trial为本订单是否免费试用
+func appStoreSubscribed(customer models.UserAccount, product *models.Product, order *models.RechargeRecord, receipt string, trans *appstore.Transaction, renewal *appstore.RenewalInfo, trial bool) {
+	orderNum := order.OrderNum
+	var err error
+	// 先保存收据, 未配置Server API时定时任务使用收据刷新订阅
+	if order.ID == 0 {
+		if err = order.Create(receipt); err != nil {
 			logOrder.Errorf("[Mysql] create order: %s failed: %s", orderNum, err)
+			return
 		}
 	}
 
-	// 更新用户信息
-	var event int
-	diamond, cardTimes := product.Diamond, product.CardTimes
-	switch product.ProductType {
-	case 1:
-		event = models.EVENT_PAYMENT_CARD
-		// 新用户首次付费赠送10钻石和1次重置机会
-		if customer.NewUser && !customer.Paid {
-			diamond += 10
-			cardTimes += 1
-		}
-	case 2:
-		event = models.EVENT_CARD_SPEED
-	case 3:
-		event = models.EVENT_RECHARGE_DIAMOND
+	sub, err := models.SyncSubscription(customer.ID, product, trans, renewal)
+	if err != nil {
+		logOrder.Errorf("[Mysql] sync subscription: %s failed: %s, trans_id: %s", trans.OriginalTransactionId, err, orderNum)
+		return
 	}
-	if err = customer.PayEvent(event, diamond, cardTimes); err != nil {
-		logApi.Errorf("[Mysql] trans_id: %s update customer: %d diamond + %d remain_times + %d failed: %s", orderNum, customer.ID, product.Diamond, product.CardTimes, err)
+	if trans.TransactionId != orderNum {
+		if err = order.Update(trans.Environment != appstore.ENV_PRODUCTION, models.ORDER_PAID); err != nil {
+			logOrder.Errorf("[Mysql] update order: %s failed: %s", orderNum, err)
+		} else if err = models.AddSubscriptionPeriod(order.ID, sub.OriginalTransId, trial); err != nil {
+			logOrder.Errorf("[Mysql] add subscription: %s period failed: %s, trans_id: %s", sub.OriginalTransId, err, orderNum)
+		}
 	}
+	grantSubscription(sub)
+}
 
-	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+// 发放订阅未发放的各期钻石, 失败时由定时任务补发
+func grantSubscription(sub *models.UserSubscription) {
+	diamond, err := sub.Grant()
+	if err != nil {
+		logOrder.Errorf("[Mysql] grant subscription: %s failed: %s, trans_id: %s", sub.OriginalTransId, err, sub.TransId)
+		return
+	}
+	if diamond > 0 {
+		logOrder.Infof("[Subscription] subscription granted, cus_id: %d, original: %s, trans_id: %s, diamond: %d", sub.CusId, sub.OriginalTransId, sub.TransId, diamond)
+	}
 }
 
 // 验证交易信息
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camera/models"
+)
+
+// 需要按 api/sql/upgrade.sql 升级过的MySQL测试库, 如:
+// API_TEST_MYSQL='root:@tcp(127.0.0.1:3306)/camera_test?parseTime=true&loc=Local' go test -run AppStorePaid
+func TestAppStorePaidSpentDiamond(t *testing.T) {
+	if os.Getenv("API_TEST_MYSQL") == "" {
+		t.Skip("API_TEST_MYSQL not set")
+	}
+	now := time.Now()
+	customer := models.UserAccount{Mobile: fmt.Sprintf("t%d", now.UnixNano()), NewUser: true, CreatedAt: now}
+	if err := customer.Create(); err != nil {
+		t.Fatal(err)
+	}
+	product := &models.Product{ProductType: models.PRODUCT_CARD, ProductId: "test.card", Price: 6, Diamond: 100, CardTimes: 1}
+	orderNum := fmt.Sprintf("%d", now.UnixNano())
+
+	// 新用户首次付费含赠送
+	appStorePaid(customer, product, newRechargeOrder(customer, product, orderNum), "receipt", true)
+	order := &models.RechargeRecord{OrderNum: orderNum}
+	if err := order.GetByOrderNum(); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != models.ORDER_PAID || order.Diamond != 110 || order.CardTimes != 2 {
+		t.Fatalf("order = %+v, want paid with 110 diamond and 2 card times", order)
+	}
+	if spent, err := models.OrderSpentDiamond(order); err != nil || spent != 0 {
+		t.Fatalf("OrderSpentDiamond = %d, %v, want 0", spent, err)
+	}
+
+	// 重复确认不再发放
+	appStorePaid(customer, product, order, "receipt", true)
+	if err := customer.GetByID(); err != nil {
+		t.Fatal(err)
+	}
+	if customer.Diamond != 110 || customer.RemainTimes != 2 || !customer.Paid {
+		t.Fatalf("customer diamond = %d, remain_times = %d, paid = %v, want 110, 2, true", customer.Diamond, customer.RemainTimes, customer.Paid)
+	}
+
+	// 发放后的消耗计入该订单
+	image := &models.UserPhotoImage{ID: order.ID}
+	if _, err := image.Download(customer.ID, 30); err != nil {
+		t.Fatal(err)
+	}
+	if spent, err := models.OrderSpentDiamond(order); err != nil || spent != 30 {
+		t.Fatalf("OrderSpentDiamond = %d, %v, want 30", spent, err)
+	}
+}
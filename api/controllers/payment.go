@@ -0,0 +1,328 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	payment "camera-payment"
+	"camera/lib"
+	"camera/models"
+	"camera/monitor"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 第三方渠道下单, 返回客户端调起支付的参数
+func PayCreate(c *gin.Context) {
+	customer, err := GetUser(c)
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "用户不存在"})
+		return
+	}
+	provider, err := lib.GetPayProvider(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "不支持的支付方式"})
+		return
+	}
+	productId := c.Request.FormValue("product_id")
+	if productId == "" {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+	product := &models.Product{ProductId: productId}
+	if err = product.GetByProductID(); err != nil || !product.Enabled {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "产品不存在"})
+		return
+	}
+	// 订阅只支持苹果自动续期
+	if product.ProductType == models.PRODUCT_SUBSCRIPTION {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "该产品不支持此支付方式"})
+		return
+	}
+
+	// 先保存订单, 渠道通知可能早于下单接口返回
+	order := newRechargeOrder(customer, product, lib.GenOrderNum())
+	order.Channel = provider.Name()
+	order.Status = models.ORDER_CREATED
+	if err = order.Create(""); err != nil {
+		logOrder.Errorf("[Mysql] create %s order: %s failed: %s", order.Channel, order.OrderNum, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "下单失败"})
+		return
+	}
+
+	params, err := provider.CreateOrder(c.Request.Context(), &payment.Order{
+		OrderNum:    order.OrderNum,
+		ProductId:   product.ProductId,
+		Description: productDescription(product),
+		Amount:      order.Amount,
+		NotifyURL:   lib.PayNotifyURL(provider.Name()),
+	})
+	if err != nil {
+		logOrder.Errorf("[Http] create %s order: %s failed: %s, cus_id: %d", order.Channel, order.OrderNum, err, customer.ID)
+		c.JSON(http.StatusOK, Response{FAILURE, "下单失败"})
+		return
+	}
+	params["order_num"] = order.OrderNum
+	c.JSON(http.StatusOK, Response{SUCCESS, params})
+}
+
+// 客户端支付完成后确认, Google Play需上传purchaseToken
+func PayConfirm(c *gin.Context) {
+	customer, err := GetUser(c)
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "用户不存在"})
+		return
+	}
+	provider, err := lib.GetPayProvider(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "不支持的支付方式"})
+		return
+	}
+	orderNum := c.Request.FormValue("order_num")
+	token := c.Request.FormValue("token")
+	if orderNum == "" {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	// 与渠道通知和补单使用同一把锁
+	locked, err := lib.LockOrder(orderNum)
+	if err != nil {
+		logApi.Errorf("[Redis] lock order: %s failed: %s", orderNum, err)
+		c.JSON(http.StatusOK, Response{PAY_CONFIRM_RETRY, "订单校验失败"})
+		return
+	}
+	if !locked {
+		c.JSON(http.StatusOK, Response{PAY_CONFIRM_RETRY, "订单处理中"})
+		return
+	}
+	defer lib.UnlockOrder(orderNum)
+
+	order := &models.RechargeRecord{OrderNum: orderNum}
+	if err = order.GetByOrderNum(); err != nil || order.CusId != customer.ID || order.Channel != provider.Name() {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "订单不存在"})
+		return
+	}
+	// 渠道通知已完成
+	if order.Status == models.ORDER_PAID {
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
+	if order.Status != models.ORDER_CREATED && order.Status != models.ORDER_PENDING {
+		c.JSON(http.StatusOK, Response{FAILURE, "订单状态错误"})
+		return
+	}
+	product := &models.Product{ProductId: order.ProductId}
+	if err = product.GetByProductID(); err != nil || product.ProductType == models.PRODUCT_SUBSCRIPTION {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "该产品不支持此支付方式"})
+		return
+	}
+	// 保存凭证供补单使用
+	if token != "" {
+		receipt := &models.RechargeReceipt{ID: order.ID, Receipt: token}
+		if err = receipt.Save(); err != nil {
+			logOrder.Errorf("[Mysql] save order: %s receipt failed: %s", orderNum, err)
+		}
+	}
+
+	result, err := lib.VerifyPayment(c.Request.Context(), provider, &payment.Order{OrderNum: orderNum, ProductId: order.ProductId, Amount: order.Amount}, token)
+	if err != nil {
+		logOrder.Errorf("[Http] verify %s order: %s failed: %s, cus_id: %d", order.Channel, orderNum, err, customer.ID)
+		// 转为待确认, 由补单任务继续确认
+		if _, err = order.MarkPending(); err != nil {
+			logOrder.Errorf("[Mysql] mark order: %s pending failed: %s", orderNum, err)
+		}
+		c.JSON(http.StatusOK, Response{PAY_CONFIRM_RETRY, "操作失败，请重试"})
+		return
+	}
+	if !result.Paid {
+		c.JSON(http.StatusOK, Response{FAILURE, "订单未支付"})
+		return
+	}
+
+	if err = confirmPayOrder(order, result); err != nil {
+		logOrder.Errorf("[Mysql] confirm order: %s failed: %s", orderNum, err)
+		c.JSON(http.StatusOK, Response{PAY_CONFIRM_RETRY, "操作失败，请重试"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 渠道通知, 返回非2xx时渠道会重试
+func PayNotify(c *gin.Context) {
+	provider, err := lib.GetPayProvider(c.Param("provider"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	notify, err := provider.HandleNotification(c.Request.Context(), c.Request)
+	if err != nil {
+		logOrder.Errorf("[Notify] handle %s notification failed: %s", provider.Name(), err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if notify == nil {
+		provider.NotifyAck(c.Writer)
+		return
+	}
+	logOrder.Infof("[Notify] %s notification: %s, order_num: %s, trans_id: %s", provider.Name(), notify.Type, notify.OrderNum, notify.TransactionId)
+
+	switch notify.Type {
+	case payment.NOTIFY_PAID:
+		err = payNotifyPaid(provider, notify)
+	case payment.NOTIFY_REFUND:
+		err = payNotifyRefund(provider, notify)
+	}
+	if err != nil {
+		logOrder.Errorf("[Notify] handle %s notification: %s failed: %s, order_num: %s", provider.Name(), notify.Type, err, notify.OrderNum)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	provider.NotifyAck(c.Writer)
+}
+
+func payNotifyPaid(provider payment.Provider, notify *payment.Notification) error {
+	locked, err := lib.LockOrder(notify.OrderNum)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("order is locked")
+	}
+	defer lib.UnlockOrder(notify.OrderNum)
+
+	order := &models.RechargeRecord{OrderNum: notify.OrderNum}
+	if err = order.GetByOrderNum(); err != nil {
+		if err.Error() == models.NoRowError {
+			logOrder.Warnf("[Notify] %s paid order not found, order_num: %s, trans_id: %s", provider.Name(), notify.OrderNum, notify.TransactionId)
+			return nil
+		}
+		return err
+	}
+	if order.Channel != provider.Name() || (order.Status != models.ORDER_CREATED && order.Status != models.ORDER_PENDING) {
+		return nil
+	}
+	// 金额或产品不符, 不发放并通知客服
+	if err = lib.CheckPayment(&payment.Order{OrderNum: order.OrderNum, ProductId: order.ProductId, Amount: order.Amount}, &notify.Payment); err != nil {
+		logOrder.Errorf("[Notify] %s paid order: %s mismatch: %s", provider.Name(), order.OrderNum, err)
+		bark := monitor.Bark{Title: "支付通知不符", Message: order.OrderNum}
+		bark.SendMessage(monitor.ORDER_PAY)
+		return nil
+	}
+	return confirmPayOrder(order, &notify.Payment)
+}
+
+// 退款通知, Google Play只有渠道交易号
+func payNotifyRefund(provider payment.Provider, notify *payment.Notification) error {
+	order := &models.RechargeRecord{OrderNum: notify.OrderNum, Channel: provider.Name(), TransId: notify.TransactionId}
+	var err error
+	if notify.OrderNum != "" {
+		err = order.GetByOrderNum()
+	} else {
+		err = order.GetByTransId()
+	}
+	if err != nil {
+		if err.Error() == models.NoRowError {
+			logOrder.Warnf("[Notify] %s refund order not found, order_num: %s, trans_id: %s", provider.Name(), notify.OrderNum, notify.TransactionId)
+			return nil
+		}
+		return err
+	}
+	if order.Channel != provider.Name() {
+		return nil
+	}
+
+	locked, err := lib.LockOrder(order.OrderNum)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("order is locked")
+	}
+	defer lib.UnlockOrder(order.OrderNum)
+	return refundOrder(order, &models.OrderRefund{Type: models.ORDER_REFUND_REFUND})
+}
+
+// 渠道已退款, 收回发放的钻石和分身次数
+func PayRefund(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Request.FormValue("id"))
+	reason := c.Request.FormValue("reason")
+	if id == 0 {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+	order := &models.RechargeRecord{ID: id}
+	if err := order.GetByID(); err != nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "订单不存在"})
+		return
+	}
+	// 苹果订单只能由用户向苹果申请
+	provider, err := lib.GetPayProvider(order.Channel)
+	if err != nil {
+		c.JSON(http.StatusOK, Response{FAILURE, "该支付方式不支持退款"})
+		return
+	}
+	if order.Status != models.ORDER_PAID {
+		c.JSON(http.StatusOK, Response{FAILURE, "订单不是已发放状态"})
+		return
+	}
+
+	locked, err := lib.LockOrder(order.OrderNum)
+	if err != nil || !locked {
+		c.JSON(http.StatusOK, Response{FAILURE, "订单处理中"})
+		return
+	}
+	defer lib.UnlockOrder(order.OrderNum)
+
+	err = provider.Refund(c.Request.Context(), &payment.Refund{
+		OrderNum:      order.OrderNum,
+		TransactionId: order.TransId,
+		RefundNo:      "R" + order.OrderNum,
+		Amount:        order.Amount,
+		Total:         order.Amount,
+		Reason:        reason,
+	})
+	if err != nil {
+		logOrder.Errorf("[Http] refund %s order: %s failed: %s", order.Channel, order.OrderNum, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "退款失败"})
+		return
+	}
+	// 渠道随后的退款通知不会重复收回
+	if err = refundOrder(order, &models.OrderRefund{Type: models.ORDER_REFUND_REFUND, Reason: reason}); err != nil {
+		logOrder.Errorf("[Mysql] refund order: %s failed: %s", order.OrderNum, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "渠道已退款，收回失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 确认并发放, 与补单共用ConfirmPending
+func confirmPayOrder(order *models.RechargeRecord, result *payment.Payment) error {
+	product := &models.Product{ProductId: order.ProductId}
+	if err := product.GetByProductID(); err != nil {
+		return err
+	}
+	order.TransId = result.TransactionId
+	confirmed, err := order.ConfirmPending(result.Sandbox, product.PayEvent())
+	if err != nil {
+		return err
+	}
+	if confirmed {
+		logOrder.Infof("[Confirm] %s order: %s confirmed, cus_id: %d, trans_id: %s, diamond: %d, card_times: %d", order.Channel, order.OrderNum, order.CusId, order.TransId, order.Diamond, order.CardTimes)
+	}
+	return nil
+}
+
+// 渠道展示的商品描述
+func productDescription(product *models.Product) string {
+	switch product.ProductType {
+	case models.PRODUCT_CARD:
+		return fmt.Sprintf("分身制作%d次", product.CardTimes)
+	case models.PRODUCT_SPEED:
+		return "制作加速"
+	case models.PRODUCT_SUBSCRIPTION:
+		return fmt.Sprintf("订阅每期%d钻石", product.Diamond)
+	}
+	return fmt.Sprintf("%d钻石", product.Diamond)
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"testing"
 
 	"camera/models"
 
@@ -14,6 +15,10 @@ var (
 )
 
 func init() {
+	// 测试时不预加载
+	if testing.Testing() {
+		return
+	}
 	//预加载产品
 	if err := loadProduct(); err != nil {
 		logApi.Fatal(err)
@@ -52,7 +57,3 @@ func ProductList(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, Response{FAILURE, "加载失败"})
 }
-
-func UserProductPay(c *gin.Context) {
-	c.JSON(http.StatusOK, Response{SUCCESS, ""})
-}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+
+	"camera/lib"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 执行进度上报
+func ReportTaskProgress(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		logApi.Errorf("[IO] read body failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "进度上报失败"})
+		return
+	}
+	b, err := lib.WebUICipher.Decrypt(string(body))
+	if err != nil {
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
+		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
+		return
+	}
+	progress := lib.TaskProgress{}
+	if err = json.Unmarshal(b, &progress); err != nil {
+		logApi.Errorf("[IO] json unmarshal failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "进度json解析失败"})
+		return
+	}
+	queue := lib.WorkQueue(progress.TaskType)
+	if queue == nil {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	// 任务已结束或租约已过期
+	id := int(progress.TaskId)
+	if !queue.Leased(id) {
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
+	progress.Percent = min(max(progress.Percent, 0), 100)
+	if err = queue.SetProgress(id, &progress); err != nil {
+		logApi.Errorf("[Redis] set progress %d:%d failed: %s", progress.TaskType, id, err)
+	}
+	// 有进度说明任务仍在执行, 延长租约
+	if err = queue.Extend(id); err != nil {
+		logApi.Errorf("[Redis] extend lease %d:%d failed: %s", progress.TaskType, id, err)
+	}
+	publishProgressEvent(&progress)
+
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 推送进度事件
+func publishProgressEvent(progress *lib.TaskProgress) {
+	id := int(progress.TaskId)
+	switch progress.TaskType {
+	case lib.WORK_TRAIN:
+		task := &models.UserCardTask{ID: id}
+		if err := task.GetByID(); err != nil {
+			return
+		}
+		stage, percent := cardTaskProgress(task.ID)
+		publishTaskEvent(task.CusId, &lib.TaskEvent{Event: lib.EVENT_PROGRESS, Task: lib.EVENT_TASK_CARD, TaskId: task.ID, Stage: stage, Progress: percent})
+	case lib.WORK_CARD:
+		image := &models.UserCardImage{ID: id}
+		if err := image.GetByID(); err != nil {
+			return
+		}
+		stage, percent := cardTaskProgress(image.TaskId)
+		publishTaskEvent(image.CusId, &lib.TaskEvent{Event: lib.EVENT_PROGRESS, Task: lib.EVENT_TASK_CARD, TaskId: image.TaskId, ImageId: id, Stage: stage, Progress: percent})
+	case lib.WORK_PHOTO, lib.WORK_HIRES:
+		image := &models.UserPhotoImage{ID: id}
+		if err := image.GetByID(); err != nil {
+			return
+		}
+		task := lib.EVENT_TASK_PHOTO
+		if progress.TaskType == lib.WORK_HIRES {
+			task = lib.EVENT_TASK_HIRES
+		}
+		publishTaskEvent(image.CusId, &lib.TaskEvent{Event: lib.EVENT_PROGRESS, Task: task, TaskId: image.TaskId, ImageId: id, Stage: progress.Stage, Progress: progress.Percent})
+	}
+}
+
+// 分身任务整体进度: 训练占cardTrainProgress, 其余按分身图平均
+func cardTaskProgress(taskId int) (string, int) {
+	if progress, ok := lib.LoraQueue.Progress(taskId); ok {
+		return progress.Stage, progress.Percent * cardTrainProgress / 100
+	}
+	if lib.LoraQueue.Leased(taskId) {
+		return "", 0
+	}
+
+	output := &models.UserCardImage{TaskId: taskId}
+	images, err := output.GetByTaskID()
+	if err != nil || len(images) == 0 {
+		return "", 0
+	}
+	stage, total := lib.STAGE_GENERATE, 0
+	for _, image := range images {
+		if image.ImgUrl != "" {
+			total += 100
+			continue
+		}
+		if progress, ok := lib.CardQueue.Progress(image.ID); ok {
+			total += progress.Percent
+			stage = progress.Stage
+		}
+	}
+	return stage, cardTrainProgress + total*(100-cardTrainProgress)/(100*len(images))
+}
+
+// 写真图片排队位置, 预计时间和执行进度, rank为Queue.Ranks计算的排名
+func setPhotoProgress(photo *models.UserPhotoImageWeb, queue *lib.Queue, rank int) {
+	var eta lib.Percentile
+	photo.Rank, eta = queue.EstimateRank(photo.ID, rank)
+	photo.Eta, photo.EtaMax = eta.P50, eta.P90
+	if progress, ok := queue.Progress(photo.ID); ok {
+		photo.Stage, photo.Progress = progress.Stage, progress.Percent
+	}
+}
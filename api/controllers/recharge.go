@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 补单列表 status: 0-待确认 4-补单失败
+func RechargeOrderList(c *gin.Context) {
+	status, _ := strconv.Atoi(c.Query("status"))
+	cusId, _ := strconv.Atoi(c.Query("cus_id"))
+	page, _ := strconv.Atoi(c.Query("page"))
+	if status != models.ORDER_PENDING && status != models.ORDER_FAILED {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "状态错误"})
+		return
+	}
+
+	list, err := models.GetRechargeOrderList(uint8(status), cusId, page)
+	if err != nil {
+		logApi.Errorf("[Mysql] get recharge order list failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "获取失败"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, list})
+}
+
+// 补单失败的订单重新补单
+func RechargeOrderRetry(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Request.FormValue("id"))
+	if id == 0 {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+
+	order := &models.RechargeRecord{ID: id}
+	reopened, err := order.Reopen()
+	if err != nil {
+		logApi.Errorf("[Mysql] reopen order: %d failed: %s", id, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
+		return
+	}
+	if !reopened {
+		c.JSON(http.StatusOK, Response{FAILURE, "订单不是补单失败状态"})
+		return
+	}
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nfnt/resize"
 )
 
+// 分身任务中训练完成时的进度, 其余为4张分身图
+const cardTrainProgress = 40
+
 // 写真上报
 func ReportPhotoTask(c *gin.Context) {
 	body, err := io.ReadAll(c.Request.Body)
@@ -21,9 +23,9 @@ func ReportPhotoTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "写真任务上报失败"})
 		return
 	}
-	b, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	b, err := lib.WebUICipher.Decrypt(string(body))
 	if err != nil {
-		logApi.Warnf("des decrypt failed: %s, body: %s", err, string(body))
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
 		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
 		return
 	}
@@ -34,8 +36,11 @@ func ReportPhotoTask(c *gin.Context) {
 		return
 	}
 
-	record := &lib.TaskRecord{TaskType: lib.REC_PHOTO, TaskID: int(callback.TaskId)}
-	record.Delete()
+	if callback.Code == lib.CALLBACK_CANCELED {
+		reportCanceled(c, lib.PhotoQueue, int(callback.TaskId))
+		return
+	}
+	lib.PhotoQueue.Complete(int(callback.TaskId), workerName(c), callback.Code == 1)
 
 	// 校验写真图片
 	output := &models.UserPhotoImage{ID: int(callback.TaskId)}
@@ -52,6 +57,21 @@ func ReportPhotoTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{SUCCESS, ""})
 		return
 	}
+	// 失败,只标记该图片失败,全部图片结束后更新写真任务(写真不收费,无需退还)
+	if callback.Code != 1 {
+		if err = output.SetFailed(true); err != nil {
+			logApi.Warnf("update photo image %d failed: %s", output.ID, err.Error())
+			c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
+			return
+		}
+		done, failed, total, err := models.SettlePhotoTask(output.TaskId, callback.Message)
+		if err != nil {
+			logApi.Warnf("update task %d failed: %s", output.TaskId, err.Error())
+		}
+		publishPhotoEvent(output, done, failed, total, callback.Message)
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
 	if len(callback.Images) == 0 {
 		c.JSON(http.StatusOK, Response{FAILURE, "写真图片缺失"})
 		return
@@ -73,17 +93,11 @@ func ReportPhotoTask(c *gin.Context) {
 	output.DownUrl = imgurl
 
 	imgz2 := resize.Resize(300, 0, img, resize.Lanczos2)
-	if _, err = lib.UploadQNCDN(imgz2, keyz2); err != nil {
+	if output.ThumbUrl, err = lib.UploadImage(imgz2, keyz2); err != nil {
 		logApi.Errorf("[IO] upload cdn failed: %s", err)
 		c.JSON(http.StatusOK, Response{FAILURE, "上传CDN失败"})
 		return
 	}
-	output.ThumbUrl, err = url.JoinPath(lib.QiniuHost, keyz2)
-	if err != nil {
-		logApi.Errorf("url joinpath failed: %s, %s %s", err, lib.QiniuHost, keyz2)
-		c.JSON(http.StatusOK, Response{FAILURE, "url拼接失败"})
-		return
-	}
 
 	// 下载水印图
 	wimgurl := callback.WaterMarks[0]
@@ -96,17 +110,11 @@ func ReportPhotoTask(c *gin.Context) {
 		}
 
 		// 上传CDN
-		if _, err = lib.UploadQNCDN(wimg, wkey); err != nil {
+		if output.ImgUrl, err = lib.UploadImage(wimg, wkey); err != nil {
 			logApi.Errorf("[IO] upload cdn failed: %s", err)
 			c.JSON(http.StatusOK, Response{FAILURE, "上传CDN失败"})
 			return
 		}
-		output.ImgUrl, err = url.JoinPath(lib.QiniuHost, wkey)
-		if err != nil {
-			logApi.Errorf("url joinpath failed: %s, %s %s", err, lib.QiniuHost, wkey)
-			c.JSON(http.StatusOK, Response{FAILURE, "url拼接失败"})
-			return
-		}
 	} else {
 		output.ImgUrl = wimgurl
 	}
@@ -121,27 +129,30 @@ func ReportPhotoTask(c *gin.Context) {
 		return
 	}
 
-	//校验4张分身是否全部完成，更新分身任务状态
-	images, err := output.GetByTaskID()
+	//全部图片出图或失败后更新写真任务状态
+	done, failed, total, err := models.SettlePhotoTask(output.TaskId, "")
 	if err != nil {
-		logApi.Errorf("[Mysql] get card image to check complete failed: %s", err)
-		c.JSON(http.StatusOK, Response{SUCCESS, ""})
-		return
+		logApi.Warnf("update task %d complete failed: %s", output.TaskId, err.Error())
 	}
-	completed := true
-	for _, image := range images {
-		if image.ImgUrl == "" {
-			completed = false
-			break
-		}
+	publishPhotoEvent(output, done, failed, total, "")
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
+
+// 写真图片出图或失败后推送事件: 全部图片结束时推送成功或失败, 否则推送进度
+func publishPhotoEvent(output *models.UserPhotoImage, done, failed, total int, message string) {
+	if total == 0 {
+		return
 	}
-	if completed {
-		task := &models.UserPhotoTask{ID: output.TaskId}
-		if err = task.UpdateStatus(models.SUCCESS, ""); err != nil {
-			logApi.Warnf("update task %d complete failed: %s", task.ID, err.Error())
-		}
+	event := &lib.TaskEvent{Task: lib.EVENT_TASK_PHOTO, TaskId: output.TaskId, ImageId: output.ID, Message: message}
+	switch {
+	case done+failed < total:
+		event.Event, event.Progress = lib.EVENT_PROGRESS, (done+failed)*100/total
+	case done == 0:
+		event.Event = lib.EVENT_FAILED
+	default:
+		event.Event, event.Progress = lib.EVENT_SUCCEEDED, 100
 	}
-	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+	publishTaskEvent(output.CusId, event)
 }
 
 // 上报Lora模型
@@ -152,9 +163,9 @@ func ReportLoraTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "分身任务上报失败"})
 		return
 	}
-	b, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	b, err := lib.WebUICipher.Decrypt(string(body))
 	if err != nil {
-		logApi.Warnf("des decrypt failed: %s, body: %s", err, string(body))
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
 		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
 		return
 	}
@@ -165,8 +176,11 @@ func ReportLoraTask(c *gin.Context) {
 		return
 	}
 
-	record := &lib.TaskRecord{TaskType: lib.REC_LORA, TaskID: int(callback.TaskId)}
-	record.Delete()
+	if callback.Code == lib.CALLBACK_CANCELED {
+		reportCanceled(c, lib.LoraQueue, int(callback.TaskId))
+		return
+	}
+	lib.LoraQueue.Complete(int(callback.TaskId), workerName(c), callback.Code == 1)
 
 	//校验任务
 	task := &models.UserCardTask{ID: int(callback.TaskId)}
@@ -189,6 +203,12 @@ func ReportLoraTask(c *gin.Context) {
 			logApi.Warnf("update task %d gender: %d failed: %s", task.ID, task.Gender, err.Error())
 		}
 
+		customer := &models.UserAccount{ID: task.CusId}
+		if err = customer.GetByID(); err != nil {
+			logApi.Warnf("get customer: %d for lane failed: %s", task.CusId, err.Error())
+		}
+		lane := getUserLane(customer)
+
 		sct := 0
 		for _, lora := range callback.Loras {
 			output := &models.UserCardImage{
@@ -204,12 +224,14 @@ func ReportLoraTask(c *gin.Context) {
 				continue
 			}
 
-			if err = lib.PushSDCardTask(output.ID); err != nil {
+			if err = lib.PushSDCardTask(output.ID, lane); err != nil {
 				logApi.Errorf("push sd card task: %d failed: %s", output.ID, err)
 			}
 			sct++
 		}
 
+		publishTaskEvent(task.CusId, &lib.TaskEvent{Event: lib.EVENT_PROGRESS, Task: lib.EVENT_TASK_CARD, TaskId: task.ID, Progress: cardTrainProgress})
+
 		// 删除用户上传图片
 		if sct > 0 {
 			cdn := &lib.UploadCDNTask{
@@ -228,6 +250,11 @@ func ReportLoraTask(c *gin.Context) {
 			c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
 			return
 		}
+		// 退还分身次数
+		if _, err = models.RefundCardTask(lib.REC_LORA, task.ID, callback.Message); err != nil {
+			logApi.Errorf("[Mysql] refund card task %d failed: %s", task.ID, err)
+		}
+		publishTaskEvent(task.CusId, &lib.TaskEvent{Event: lib.EVENT_FAILED, Task: lib.EVENT_TASK_CARD, TaskId: task.ID, Message: callback.Message})
 		// 报警
 		bark := monitor.Bark{Title: "Lora失败", Message: fmt.Sprintf("任务ID:%d, 错误信息:%s", task.ID, callback.Message)}
 		bark.SendMessage(monitor.CARD_LORA)
@@ -259,9 +286,9 @@ func ReportCardTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "分身任务上报失败"})
 		return
 	}
-	b, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	b, err := lib.WebUICipher.Decrypt(string(body))
 	if err != nil {
-		logApi.Warnf("des decrypt failed: %s, body: %s", err, string(body))
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
 		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
 		return
 	}
@@ -272,8 +299,11 @@ func ReportCardTask(c *gin.Context) {
 		return
 	}
 
-	record := &lib.TaskRecord{TaskType: lib.REC_CARD, TaskID: int(callback.TaskId)}
-	record.Delete()
+	if callback.Code == lib.CALLBACK_CANCELED {
+		reportCanceled(c, lib.CardQueue, int(callback.TaskId))
+		return
+	}
+	lib.CardQueue.Complete(int(callback.TaskId), workerName(c), callback.Code == 1)
 
 	// 校验分身图片
 	output := &models.UserCardImage{ID: int(callback.TaskId)}
@@ -286,6 +316,26 @@ func ReportCardTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{SUCCESS, ""})
 		return
 	}
+	// 任务已取消, 忽略取消前已出图的上报
+	task := &models.UserCardTask{ID: output.TaskId}
+	if err = task.GetByID(); err == nil && task.Status == models.CANCELD {
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
+	// 失败,分身任务失败并退还
+	if callback.Code != 1 {
+		if err = task.UpdateStatus(models.FAILED, callback.Message); err != nil {
+			logApi.Warnf("update task %d failed: %s", task.ID, err.Error())
+			c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
+			return
+		}
+		if _, err = models.RefundCardTask(lib.REC_CARD, task.ID, callback.Message); err != nil {
+			logApi.Errorf("[Mysql] refund card task %d failed: %s", task.ID, err)
+		}
+		publishTaskEvent(output.CusId, &lib.TaskEvent{Event: lib.EVENT_FAILED, Task: lib.EVENT_TASK_CARD, TaskId: task.ID, ImageId: output.ID, Message: callback.Message})
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
 	if len(callback.Images) == 0 {
 		c.JSON(http.StatusOK, Response{FAILURE, "分身图片缺失"})
 		return
@@ -312,15 +362,16 @@ func ReportCardTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{SUCCESS, ""})
 		return
 	}
-	completed := true
+	done := 0
 	for _, image := range images {
-		if image.ImgUrl == "" {
-			completed = false
-			break
+		if image.ImgUrl != "" {
+			done++
 		}
 	}
-	if completed {
-		task := &models.UserCardTask{ID: output.TaskId}
+	if done < len(images) {
+		progress := cardTrainProgress + done*(100-cardTrainProgress)/len(images)
+		publishTaskEvent(output.CusId, &lib.TaskEvent{Event: lib.EVENT_PROGRESS, Task: lib.EVENT_TASK_CARD, TaskId: output.TaskId, ImageId: output.ID, Progress: progress})
+	} else {
 		if err = task.UpdateStatus(models.SUCCESS, ""); err != nil {
 			logApi.Warnf("update task %d complete failed: %s", task.ID, err.Error())
 		}
@@ -339,6 +390,7 @@ func ReportCardTask(c *gin.Context) {
 				logApi.Warnf("[SMS] send phone message failed: %s", err)
 			}
 		}
+		publishTaskEvent(output.CusId, &lib.TaskEvent{Event: lib.EVENT_SUCCEEDED, Task: lib.EVENT_TASK_CARD, TaskId: output.TaskId, ImageId: output.ID, Progress: 100})
 	}
 	c.JSON(http.StatusOK, Response{SUCCESS, ""})
 }
@@ -352,13 +404,13 @@ func ReportPhotoRecognizeTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "照片识别任务上报失败"})
 		return
 	}
-	b, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	b, err := lib.WebUICipher.Decrypt(string(body))
 	if err != nil {
-		logApi.Warnf("des decrypt failed: %s, body: %s", err, string(body))
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
 		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
 		return
 	}
-	callback := lib.SDCallback{}
+	callback := lib.CheckCallback{}
 	if err = json.Unmarshal(b, &callback); err != nil {
 		logApi.Errorf("[IO] json unmarshal failed: %s", err)
 		c.JSON(http.StatusOK, Response{FAILURE, "照片识别任务json解析失败"})
@@ -368,9 +420,9 @@ func ReportPhotoRecognizeTask(c *gin.Context) {
 	// 0-未识别,1-识别成功,2-识别失败
 	switch ptype {
 	case "front":
-		for k, v := range callback.CheckStatus {
-			record := &lib.TaskRecord{TaskType: lib.REC_FRONT, TaskID: k}
-			record.Delete()
+		for id, v := range callback.Status {
+			k := int(id)
+			lib.CheckFrontQueue.Complete(k, workerName(c), v == 1)
 
 			front := &models.UserFrontImage{ID: k}
 			if err = front.GetByID(); err != nil {
@@ -393,9 +445,9 @@ func ReportPhotoRecognizeTask(c *gin.Context) {
 			}
 		}
 	case "side":
-		for k, v := range callback.CheckStatus {
-			record := &lib.TaskRecord{TaskType: lib.REC_SIDE, TaskID: k}
-			record.Delete()
+		for id, v := range callback.Status {
+			k := int(id)
+			lib.CheckSideQueue.Complete(k, workerName(c), v == 1)
 
 			input := &models.UserInputImage{ID: k}
 			if err = input.GetByID(); err != nil {
@@ -429,9 +481,9 @@ func ReportPhotoHrTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "高清任务上报失败"})
 		return
 	}
-	b, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	b, err := lib.WebUICipher.Decrypt(string(body))
 	if err != nil {
-		logApi.Warnf("des decrypt failed: %s, body: %s", err, string(body))
+		logApi.Warnf("decrypt failed: %s, body: %s", err, string(body))
 		c.JSON(http.StatusOK, Response{SUCCESS, "解密失败"})
 		return
 	}
@@ -442,8 +494,11 @@ func ReportPhotoHrTask(c *gin.Context) {
 		return
 	}
 
-	record := &lib.TaskRecord{TaskType: lib.REC_HR, TaskID: int(callback.TaskId)}
-	record.Delete()
+	if callback.Code == lib.CALLBACK_CANCELED {
+		reportCanceled(c, lib.PhotoHrQueue, int(callback.TaskId))
+		return
+	}
+	lib.PhotoHrQueue.Complete(int(callback.TaskId), workerName(c), callback.Code == 1)
 
 	// 校验写真图片
 	output := &models.UserPhotoImage{ID: int(callback.TaskId)}
@@ -460,6 +515,20 @@ func ReportPhotoHrTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{SUCCESS, ""})
 		return
 	}
+	// 失败,关闭高清并退还钻石
+	if callback.Code != 1 {
+		if err = output.SetEnableHr(false); err != nil {
+			logApi.Errorf("[Mysql] disable photo hr %d failed: %s", output.ID, err)
+			c.JSON(http.StatusOK, Response{FAILURE, "操作失败"})
+			return
+		}
+		if _, err = models.RefundPhotoHr(lib.REC_HR, output.ID, callback.Message); err != nil {
+			logApi.Errorf("[Mysql] refund photo hr %d failed: %s", output.ID, err)
+		}
+		publishTaskEvent(output.CusId, &lib.TaskEvent{Event: lib.EVENT_FAILED, Task: lib.EVENT_TASK_HIRES, TaskId: output.TaskId, ImageId: output.ID, Message: callback.Message})
+		c.JSON(http.StatusOK, Response{SUCCESS, ""})
+		return
+	}
 	output.HrDownUrl = callback.ImageUrl
 
 	// 水印图
@@ -471,8 +540,8 @@ func ReportPhotoHrTask(c *gin.Context) {
 				// 上传CDN
 				wfname := lib.GenGUID()
 				wkey := fmt.Sprintf("cphoto/%s/%s/%s.png", wfname[:2], wfname[2:4], wfname[4:])
-				if _, err = lib.UploadQNCDN(wimg, wkey); err == nil {
-					output.HrImgUrl, _ = url.JoinPath(lib.QiniuHost, wkey)
+				if output.HrImgUrl, err = lib.UploadImage(wimg, wkey); err != nil {
+					logApi.Errorf("[IO] upload cdn failed: %s", err)
 				}
 			}
 		}
@@ -489,5 +558,6 @@ func ReportPhotoHrTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "更新CDN失败"})
 		return
 	}
+	publishTaskEvent(output.CusId, &lib.TaskEvent{Event: lib.EVENT_SUCCEEDED, Task: lib.EVENT_TASK_HIRES, TaskId: output.TaskId, ImageId: output.ID, Progress: 100})
 	c.JSON(http.StatusOK, Response{SUCCESS, ""})
 }
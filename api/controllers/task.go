@@ -401,14 +401,9 @@ func CreateUserCardTask(c *gin.Context) {
 	}
 	fname := filepath.Base(front.ThumbUrl)
 	frontKey := fmt.Sprintf("cfront/%s/%s/%s", fname[:2], fname[2:4], fname[4:])
-	if _, err = lib.UploadQNCDN(frontImage, frontKey); err != nil {
-		logApi.Errorf("upload front image failed: %s", err)
-		c.JSON(http.StatusOK, Response{FAILURE, "任务创建失败，请重试"})
-		return
-	}
-	frontUrl, err := url.JoinPath(lib.QiniuHost, frontKey)
+	frontUrl, err := lib.UploadImage(frontImage, frontKey)
 	if err != nil {
-		logApi.Errorf("url joinpath failed: %s,  %s %s", err, lib.QiniuHost, frontKey)
+		logApi.Errorf("upload front image failed: %s", err)
 		c.JSON(http.StatusOK, Response{FAILURE, "任务创建失败，请重试"})
 		return
 	}
@@ -432,9 +427,10 @@ func CreateUserCardTask(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{FAILURE, "任务创建失败"})
 		return
 	}
-	if err = lib.PushSDTask(task.ID); err != nil {
+	if err = lib.PushSDTask(task.ID, getUserLane(&customer)); err != nil {
 		logApi.Errorf("push sd task: %d failed: %s", task.ID, err)
 	}
+	publishTaskEvent(customer.ID, &lib.TaskEvent{Event: lib.EVENT_QUEUED, Task: lib.EVENT_TASK_CARD, TaskId: task.ID})
 	os.RemoveAll(fmt.Sprintf("images/front/%s", customer.CardId))
 
 	c.JSON(http.StatusOK, Response{SUCCESS, task.ID})
@@ -470,7 +466,8 @@ func GetCardStatus(c *gin.Context) {
 	}
 
 	if task.Status == models.RUNNING || task.Status == models.DEFAULT {
-		c.JSON(http.StatusOK, Response{GEN_TASK_RUNNING, ""})
+		stage, progress := cardTaskProgress(task.ID)
+		c.JSON(http.StatusOK, Response{GEN_TASK_RUNNING, gin.H{"stage": stage, "progress": progress}})
 		return
 	}
 	if task.Status == models.CANCELD {
@@ -636,6 +633,10 @@ func BackLastUserCard(c *gin.Context) {
 		c.JSON(http.StatusOK, Response{INVALID_PARAM, "没有历史分身"})
 		return
 	}
+	// 取消本次分身未完成的任务
+	if customer.TempCardTaskId != customer.CardTaskId {
+		cancelCardTask(customer.TempCardTaskId, "放弃本次分身")
+	}
 
 	customer.Step = models.CARD_STEP_OK
 	if err = customer.UpdateStep(); err != nil {
@@ -747,6 +748,7 @@ func CreatePhotoTask(c *gin.Context) {
 	if err != nil {
 		logApi.Errorf("[Redis] incr photo count failed: %s", err)
 	}
+	lane := getUserLane(&customer)
 	for i, p := range poses {
 		image := &models.UserPhotoImage{
 			CusId:  customer.ID,
@@ -783,11 +785,13 @@ func CreatePhotoTask(c *gin.Context) {
 			continue
 		}
 
-		if err = lib.PushSDPhotoTask(image.ID, pct > lib.PhotoLimit); err != nil {
+		if err = lib.PushSDPhotoTask(customer.ID, image.ID, lane, pct > lib.PhotoLimit, template.MainModel, task.ID); err != nil {
 			logApi.Errorf("[Redis] push photo task failed: %s", err)
 		}
 	}
 
+	publishTaskEvent(customer.ID, &lib.TaskEvent{Event: lib.EVENT_QUEUED, Task: lib.EVENT_TASK_PHOTO, TaskId: task.ID})
+
 	// 统计模板使用次数
 	tct, _ := lib.AddTemplateUser(templateId, customer.ID)
 	if tct > 0 {
@@ -838,6 +842,8 @@ func GetPhotoStatus(c *gin.Context) {
 		return
 	}
 	poseId := -1
+	// 排队中和高清中的图片, 排名按队列各计算一次
+	var queued, hiresing []int
 	for _, image := range images {
 		if image.PoseId != poseId {
 			if poseId == -1 {
@@ -854,16 +860,31 @@ func GetPhotoStatus(c *gin.Context) {
 			ThumbUrl:  image.ThumbUrl,
 			EnableHr:  image.EnableHr,
 			Favourite: image.Favourite,
+			Failed:    image.Failed,
+		}
+		if image.ImgUrl == "" && !image.Failed {
+			queued = append(queued, image.ID)
 		}
 		if image.EnableHr {
 			if image.HrImgUrl != "" {
 				photo.ImgUrl = image.HrImgUrl
 			} else {
 				photo.Hiresing = true
+				hiresing = append(hiresing, image.ID)
 			}
 		}
 		art.Photos = append(art.Photos, photo)
 	}
+	ranks, hrRanks := lib.PhotoQueue.Ranks(queued), lib.PhotoHrQueue.Ranks(hiresing)
+	for i := range art.Photos {
+		photo := &art.Photos[i]
+		if rank, ok := ranks[photo.ID]; ok {
+			setPhotoProgress(photo, lib.PhotoQueue, rank)
+		}
+		if rank, ok := hrRanks[photo.ID]; ok {
+			setPhotoProgress(photo, lib.PhotoHrQueue, rank)
+		}
+	}
 	art.PoseId = poseId
 	art.PoseImage = task.ControlImage
 
@@ -913,6 +934,7 @@ func GetPhotoHistory(c *gin.Context) {
 				ThumbUrl:  photo.ThumbUrl,
 				EnableHr:  photo.EnableHr,
 				Favourite: photo.Favourite,
+				Failed:    photo.Failed,
 			}
 			if photo.EnableHr {
 				if photo.HrImgUrl != "" {
@@ -957,14 +979,15 @@ func PhotoImageHigher(c *gin.Context) {
 			c.JSON(http.StatusOK, Response{SUCCESS, ""})
 			return
 		}
-		if lib.CheckListExist(lib.RedisSDPhotoHrList, uint(photo.ID)) {
+		if lib.PhotoHrQueue.Queued(photo.ID) || lib.PhotoHrQueue.Leased(photo.ID) {
 			c.JSON(http.StatusOK, Response{SUCCESS, ""})
 			return
 		}
 		// 发送高清任务
-		if err = lib.PushSDPhotoHrTask(photo.ID); err != nil {
+		if err = lib.PushSDPhotoHrTask(photo.ID, getUserLane(&customer)); err != nil {
 			logApi.Errorf("[Redis] push photo hr task: %d failed: %s", photo.ID, err)
 		}
+		publishTaskEvent(customer.ID, &lib.TaskEvent{Event: lib.EVENT_QUEUED, Task: lib.EVENT_TASK_HIRES, TaskId: photo.TaskId, ImageId: photo.ID})
 		c.JSON(http.StatusOK, Response{SUCCESS, ""})
 		return
 	}
@@ -976,15 +999,25 @@ func PhotoImageHigher(c *gin.Context) {
 	}
 
 	// 高清处理
-	if err = photo.UpdateEnableHr(customer.ID, customer.Diamond, DIAMOND_HIGHER); err != nil {
+	if err = photo.UpdateEnableHr(customer.ID, DIAMOND_HIGHER); err != nil {
+		if err == models.ErrAlreadyPaid {
+			c.JSON(http.StatusOK, Response{SUCCESS, photo.HrImgUrl})
+			return
+		}
+		if err == models.ErrDiamondNotEnough {
+			c.JSON(http.StatusOK, Response{DIAMOND_NOT_ENOUGH, "钻石不足"})
+			return
+		}
+		logApi.Errorf("[Mysql] photo %d enable hr failed: %s", photo.ID, err)
 		c.JSON(http.StatusOK, Response{FAILURE, "高清处理失败"})
 		return
 	}
 
 	// 发送高清任务
-	if err = lib.PushSDPhotoHrTask(photo.ID); err != nil {
+	if err = lib.PushSDPhotoHrTask(photo.ID, getUserLane(&customer)); err != nil {
 		logApi.Errorf("[Redis] push photo hr task: %d failed: %s", photo.ID, err)
 	}
+	publishTaskEvent(customer.ID, &lib.TaskEvent{Event: lib.EVENT_QUEUED, Task: lib.EVENT_TASK_HIRES, TaskId: photo.TaskId, ImageId: photo.ID})
 
 	c.JSON(http.StatusOK, Response{SUCCESS, photo.HrImgUrl})
 }
@@ -1024,10 +1057,9 @@ func DeletePhotoTask(c *gin.Context) {
 	}
 
 	for _, p := range photos {
-		if p.DownUrl == "" {
-			// 如果任务未执行，删除任务
-			lib.DelSDPhotoTask(p.ID)
-		} else {
+		// 取消排队或执行中的写真和高清
+		cancelPhotoImage(p)
+		if p.DownUrl != "" {
 			imgs := make([]string, 0)
 			imgs = append(imgs, p.ImgUrl)
 			imgs = append(imgs, p.ThumbUrl)
@@ -1124,26 +1156,32 @@ func DownloadPhotoImage(c *gin.Context) {
 		return
 	}
 
-	// 检查钻石
-	if customer.Diamond < DIAMOND_DOWNLOAD {
-		c.JSON(http.StatusOK, Response{DIAMOND_NOT_ENOUGH, "钻石不足"})
+	if photoDownUrl(photo) == "" {
+		c.JSON(http.StatusOK, Response{FAILURE, "写真未完成"})
 		return
 	}
 
-	downUrl := photo.DownUrl
-	if photo.EnableHr {
-		downUrl = photo.HrDownUrl
+	// 扣除钻石, 已付费过的免费下载
+	if _, err = photo.Download(customer.ID, DIAMOND_DOWNLOAD); err != nil {
+		if err == models.ErrDiamondNotEnough {
+			c.JSON(http.StatusOK, Response{DIAMOND_NOT_ENOUGH, "钻石不足"})
+			return
+		}
+		logApi.Errorf("[Mysql] photo %d download failed: %s", photo.ID, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "钻石扣除失败"})
+		return
 	}
 
-	desUrl, err := lib.DESEncrypt([]byte(downUrl), lib.ApiDeskey)
+	// 扣费成功后签发限时链接, 失败时重试不会重复扣费
+	link, _, err := lib.DownloadLink(customer.ID, photo.ID)
 	if err != nil {
+		logApi.Errorf("[File] photo %d download link failed: %s", photo.ID, err)
 		c.JSON(http.StatusOK, Response{FAILURE, "下载失败"})
 		return
 	}
-
-	// 扣除钻石
-	if err = photo.Download(customer.ID, customer.Diamond, DIAMOND_DOWNLOAD); err != nil {
-		c.JSON(http.StatusOK, Response{FAILURE, "钻石扣除失败"})
+	desUrl, err := lib.ApiCipher.EncryptFor([]byte(link), c.GetHeader("ua"))
+	if err != nil {
+		c.JSON(http.StatusOK, Response{FAILURE, "下载失败"})
 		return
 	}
 
@@ -1165,13 +1203,16 @@ func SharePhotoImage(c *gin.Context) {
 	}
 	photoId, _ := strconv.Atoi(c.Query("id"))
 	ptype, _ := strconv.Atoi(c.Query("type"))
+	// 有效期(秒), 不超过配置的分享有效期
+	expire := lib.FileShareExpire
+	if v, _ := strconv.Atoi(c.Query("expire")); v > 0 && time.Duration(v)*time.Second < expire {
+		expire = time.Duration(v) * time.Second
+	}
 
 	retval := make(map[string]any)
 	if photoId > 0 {
-
-		var shareUrl string
 		switch ptype {
-		case 1:
+		case lib.SHARE_CARD:
 			// 分身
 			card := &models.UserCardImage{ID: photoId}
 			if err = card.GetByID(); err != nil {
@@ -1182,8 +1223,7 @@ func SharePhotoImage(c *gin.Context) {
 				c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
 				return
 			}
-			shareUrl = card.ImgUrl
-		case 2:
+		case lib.SHARE_PHOTO:
 			// 写真
 			photo := &models.UserPhotoImage{ID: photoId}
 			if err = photo.GetByID(); err != nil {
@@ -1194,15 +1234,31 @@ func SharePhotoImage(c *gin.Context) {
 				c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
 				return
 			}
-			shareUrl = photo.DownUrl
+		default:
+			c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+			return
 		}
 
-		desUrl, err := lib.DESEncrypt([]byte(shareUrl), lib.ApiDeskey)
+		share := &lib.FileShare{CusId: customer.ID, Type: ptype, ImageId: photoId}
+		shareId, err := lib.CreateFileShare(share, expire)
+		if err != nil {
+			logApi.Errorf("[Redis] create file share failed: %s", err)
+			c.JSON(http.StatusOK, Response{FAILURE, "分享失败"})
+			return
+		}
+		link, err := lib.ShareLink(shareId)
+		if err != nil {
+			c.JSON(http.StatusOK, Response{FAILURE, "分享失败"})
+			return
+		}
+		desUrl, err := lib.ApiCipher.EncryptFor([]byte(link), c.GetHeader("ua"))
 		if err != nil {
 			c.JSON(http.StatusOK, Response{FAILURE, "分享失败"})
 			return
 		}
 		retval["img_url"] = desUrl
+		retval["share_id"] = shareId
+		retval["expire_at"] = share.ExpireAt
 	}
 
 	retval["share_code"] = lib.ShareCode
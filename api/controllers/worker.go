@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"camera/lib"
+	"camera/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 数据库凭证缓存时间, 吊销最多延迟该时长生效
+const workerKeyCacheTTL = 30 * time.Second
+
+type workerKeyCache struct {
+	secret   string
+	expireAt time.Time
+}
+
+var workerKeys sync.Map
+
+// CheckWorker 校验worker签名, 用于任务分发和回调接口
+func CheckWorker(c *gin.Context) {
+	workerId := c.GetHeader(lib.HeaderWorkerId)
+	if workerId == "" && lib.WorkerAllowUnsigned {
+		c.Next()
+		return
+	}
+
+	timestamp := c.GetHeader(lib.HeaderWorkerTimestamp)
+	nonce := c.GetHeader(lib.HeaderWorkerNonce)
+	signature := c.GetHeader(lib.HeaderWorkerSignature)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if workerId == "" || nonce == "" || err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{INVALID_PARAM, "签名错误"})
+		return
+	}
+	if math.Abs(float64(time.Now().Unix()-ts)) > lib.WorkerClockSkew.Seconds() {
+		logApi.Warnf("[Worker] %s bad timestamp: %s, ip: %s", workerId, timestamp, c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{INVALID_PARAM, "签名已过期"})
+		return
+	}
+	secret, ok := getWorkerSecret(workerId)
+	if !ok {
+		logApi.Warnf("[Worker] unknown worker: %s, ip: %s", workerId, c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{INVALID_PARAM, "签名错误"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := lib.WorkerSignature(secret, c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		logApi.Warnf("[Worker] %s bad signature, ip: %s", workerId, c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{INVALID_PARAM, "签名错误"})
+		return
+	}
+	if used, err := lib.UseWorkerNonce(workerId, nonce); err != nil || !used {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, Response{INVALID_PARAM, "重复请求"})
+		return
+	}
+
+	c.Set("worker_id", workerId)
+	c.Next()
+}
+
+// 先查配置, 再查数据库
+func getWorkerSecret(workerId string) (string, bool) {
+	if secret, ok := lib.WorkerKeys[workerId]; ok && secret != "" {
+		return secret, true
+	}
+	if v, ok := workerKeys.Load(workerId); ok {
+		if cache := v.(workerKeyCache); time.Now().Before(cache.expireAt) {
+			return cache.secret, cache.secret != ""
+		}
+	}
+
+	key := &models.WorkerKey{WorkerId: workerId}
+	if err := key.GetByWorkerId(); err != nil && err.Error() != models.NoRowError {
+		logApi.Errorf("[Mysql] get worker key %s failed: %s", workerId, err)
+		return "", false
+	}
+	workerKeys.Store(workerId, workerKeyCache{secret: key.Secret, expireAt: time.Now().Add(workerKeyCacheTTL)})
+	return key.Secret, key.Secret != ""
+}
+
+// 当前worker标识, 未签名时使用IP
+func workerName(c *gin.Context) string {
+	if workerId := c.GetString("worker_id"); workerId != "" {
+		return workerId
+	}
+	return c.ClientIP()
+}
+
+// worker凭证列表
+func WorkerKeyList(c *gin.Context) {
+	list, err := models.GetWorkerKeyList()
+	if err != nil {
+		logApi.Errorf("[Mysql] get worker key list failed: %s", err)
+		c.JSON(http.StatusOK, Response{FAILURE, "获取失败"})
+		return
+	}
+
+	result := make(map[string]any)
+	result["keys"] = list
+	result["config_keys"] = len(lib.WorkerKeys)
+	result["stats"] = lib.GetWorkerStats()
+	result["failures"] = lib.GetWorkerFailures(100)
+	c.JSON(http.StatusOK, Response{SUCCESS, result})
+}
+
+// 签发worker凭证, 密钥只在签发时返回一次
+func WorkerKeyIssue(c *gin.Context) {
+	workerId := c.Request.FormValue("worker_id")
+	if workerId == "" || len(workerId) > 64 {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "参数错误"})
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		c.JSON(http.StatusOK, Response{FAILURE, "签发失败"})
+		return
+	}
+
+	now := time.Now()
+	key := &models.WorkerKey{
+		WorkerId:  workerId,
+		Secret:    hex.EncodeToString(b),
+		Remark:    c.Request.FormValue("remark"),
+		Enabled:   true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := key.Create(); err != nil {
+		logApi.Errorf("[Mysql] create worker key %s failed: %s", workerId, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "签发失败, worker_id已存在"})
+		return
+	}
+	workerKeys.Delete(workerId)
+	c.JSON(http.StatusOK, Response{SUCCESS, gin.H{"worker_id": key.WorkerId, "secret": key.Secret}})
+}
+
+// 吊销worker凭证
+func WorkerKeyRevoke(c *gin.Context) {
+	key := &models.WorkerKey{WorkerId: c.Request.FormValue("worker_id")}
+	revoked, err := key.Revoke()
+	if err != nil {
+		logApi.Errorf("[Mysql] revoke worker key %s failed: %s", key.WorkerId, err)
+		c.JSON(http.StatusOK, Response{FAILURE, "吊销失败"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusOK, Response{INVALID_PARAM, "凭证不存在"})
+		return
+	}
+	workerKeys.Delete(key.WorkerId)
+	c.JSON(http.StatusOK, Response{SUCCESS, ""})
+}
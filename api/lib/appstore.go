@@ -2,9 +2,18 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	appstore "camera-appstore"
+
+	"github.com/spf13/viper"
 )
 
 const (
@@ -38,10 +47,116 @@ type AppStoreData struct {
 	} `json:"receipt"`
 	LatestReceiptInfo  ReceiptList `json:"latest_receipt_info"`
 	PendingRenewalInfo []struct {
-		AutoRenewStatus string `json:"auto_renew_status"`
+		AutoRenewStatus   string `json:"auto_renew_status"`
+		OriginalTransID   string `json:"original_transaction_id"`
+		ProductID         string `json:"product_id"`
+		GracePeriodExpire string `json:"grace_period_expires_date_ms"`
+		BillingRetry      string `json:"is_in_billing_retry_period"`
 	} `json:"pending_renewal_info"`
 }
 
+// 收据中是否有该交易
+func (d *AppStoreData) HasTransaction(transId, productId string) bool {
+	for _, list := range []ReceiptList{d.LatestReceiptInfo, d.Receipt.InApp} {
+		for _, receipt := range list {
+			if receipt.TransactionID == transId && receipt.ProductID == productId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 交易的原始交易号, 收据中没有该交易时返回空
+func (d *AppStoreData) OriginalTransactionId(transId string) string {
+	for _, list := range []ReceiptList{d.LatestReceiptInfo, d.Receipt.InApp} {
+		for _, receipt := range list {
+			if receipt.TransactionID == transId {
+				return receipt.OriginalTransID
+			}
+		}
+	}
+	return ""
+}
+
+// 交易是否为订阅的免费试用期
+func (d *AppStoreData) IsTrial(transId string) bool {
+	for _, list := range []ReceiptList{d.LatestReceiptInfo, d.Receipt.InApp} {
+		for _, receipt := range list {
+			if receipt.TransactionID == transId {
+				return receipt.IsTrial == "true"
+			}
+		}
+	}
+	return false
+}
+
+// 按收据转换交易所属订阅的最近一期和续期信息, 与StoreKit 2的处理一致; 收据中没有该交易时返回nil
+func (d *AppStoreData) Subscription(transId string) (*appstore.Transaction, *appstore.RenewalInfo) {
+	originalTransId := d.OriginalTransactionId(transId)
+	if originalTransId == "" {
+		return nil, nil
+	}
+	environment := appstore.ENV_PRODUCTION
+	if d.Environment == appstore.ENV_SANDBOX {
+		environment = appstore.ENV_SANDBOX
+	}
+
+	var trans *appstore.Transaction
+	for _, list := range []ReceiptList{d.LatestReceiptInfo, d.Receipt.InApp} {
+		for _, receipt := range list {
+			expiresDate, _ := strconv.ParseInt(receipt.ExpireAt, 10, 64)
+			if receipt.OriginalTransID != originalTransId || (trans != nil && expiresDate <= trans.ExpiresDate) {
+				continue
+			}
+			purchaseDate, _ := strconv.ParseInt(receipt.PurchaseDate, 10, 64)
+			cancelDate, _ := strconv.ParseInt(receipt.CancelDate, 10, 64)
+			trans = &appstore.Transaction{
+				TransactionId:         receipt.TransactionID,
+				OriginalTransactionId: receipt.OriginalTransID,
+				BundleId:              d.Receipt.BundleID,
+				ProductId:             receipt.ProductID,
+				PurchaseDate:          purchaseDate,
+				ExpiresDate:           expiresDate,
+				Type:                  appstore.TYPE_AUTO_RENEWABLE,
+				RevocationDate:        cancelDate,
+				Environment:           environment,
+			}
+			if receipt.IsTrial == "true" {
+				trans.OfferType = appstore.OFFER_INTRODUCTORY
+				trans.OfferDiscountType = appstore.DISCOUNT_FREE_TRIAL
+			}
+		}
+	}
+
+	renewal := &appstore.RenewalInfo{OriginalTransactionId: originalTransId, Environment: environment}
+	for _, info := range d.PendingRenewalInfo {
+		if info.OriginalTransID == originalTransId {
+			renewal.ProductId = info.ProductID
+			renewal.AutoRenewStatus, _ = strconv.Atoi(info.AutoRenewStatus)
+			renewal.GracePeriodExpiresDate, _ = strconv.ParseInt(info.GracePeriodExpire, 10, 64)
+			renewal.IsInBillingRetryPeriod = info.BillingRetry == "1"
+		}
+	}
+	return trans, renewal
+}
+
+// 验证收据, 先正式环境, 返回21007时再验证沙盒; 配置了共享密钥时一并发送, 订阅收据需要
+func VerifyAppStoreReceipt(receipt string) (*AppStoreData, bool, error) {
+	sandbox := false
+	respData, err := ConfirmAppStorePay(receipt, sandbox, AppStoreSharedSecret != "", AppStoreSharedSecret)
+	if err != nil {
+		return nil, sandbox, err
+	}
+	if respData.Status == 21007 {
+		sandbox = true
+		if respData, err = ConfirmAppStorePay(receipt, sandbox, AppStoreSharedSecret != "", AppStoreSharedSecret); err != nil {
+			return nil, sandbox, err
+		}
+	}
+	return respData, sandbox, nil
+}
+
 // 验证AppStore内购 通用
 func ConfirmAppStorePay(receipt string, sandbox bool, needPassword bool, password string) (*AppStoreData, error) {
 	url := appstoreUrl
@@ -79,3 +194,148 @@ func ConfirmAppStorePay(receipt string, sandbox bool, needPassword bool, passwor
 	}
 	return &respData, nil
 }
+
+var (
+	// StoreKit 2签名交易校验, 未配置根证书时为nil
+	AppStoreVerifier *appstore.Verifier
+	// App Store Server API bundle id: [正式, 沙盒]
+	appStoreClients = make(map[string][2]*appstore.Client)
+	// 回复退款请求的消费信息, 只回复在App内同意过的用户
+	AppStoreConsumption bool
+	// App专用共享密钥, 验证订阅收据时使用
+	AppStoreSharedSecret string
+
+	// 待确认订单补单间隔, 按次数翻倍
+	OrderRetryInterval    time.Duration
+	OrderRetryMaxInterval time.Duration
+	// 超过该时长仍未确认的订单判定失败
+	OrderExpire time.Duration
+
+	ErrAppStoreDisabled = errors.New("appstore verifier is not configured")
+)
+
+// 校验客户端上传的签名交易
+func VerifyAppStoreTransaction(signed string) (*appstore.Transaction, error) {
+	if AppStoreVerifier == nil {
+		return nil, ErrAppStoreDisabled
+	}
+	return AppStoreVerifier.VerifyTransaction(signed)
+}
+
+// 是否可通过Server API查询交易
+func AppStoreServerEnabled(bundleId string) bool {
+	_, ok := appStoreClients[bundleId]
+	return ok
+}
+
+// 通过Server API查询交易
+func GetAppStoreTransaction(ctx context.Context, bundleId, transactionId string) (trans *appstore.Transaction, err error) {
+	err = withAppStoreClient(bundleId, func(client *appstore.Client) error {
+		trans, err = client.Transaction(ctx, AppStoreVerifier, transactionId)
+		return err
+	})
+	return trans, err
+}
+
+// 通过Server API查询交易所属用户的全部交易
+func GetAppStoreHistory(ctx context.Context, bundleId, transactionId string) (list []*appstore.Transaction, err error) {
+	err = withAppStoreClient(bundleId, func(client *appstore.Client) error {
+		list, err = client.History(ctx, AppStoreVerifier, transactionId)
+		return err
+	})
+	return list, err
+}
+
+// 通过Server API查询订阅的最近一期和续期信息
+func GetAppStoreSubscription(ctx context.Context, bundleId, originalTransId string) (trans *appstore.Transaction, renewal *appstore.RenewalInfo, err error) {
+	err = withAppStoreClient(bundleId, func(client *appstore.Client) error {
+		_, trans, renewal, err = client.SubscriptionStatus(ctx, AppStoreVerifier, originalTransId)
+		return err
+	})
+	return trans, renewal, err
+}
+
+// 回复退款请求的消费信息
+func SendAppStoreConsumption(ctx context.Context, bundleId, transactionId string, req *appstore.ConsumptionRequest) error {
+	return withAppStoreClient(bundleId, func(client *appstore.Client) error {
+		return client.SendConsumption(ctx, transactionId, req)
+	})
+}
+
+// 先查正式环境, 交易不存在时查沙盒
+func withAppStoreClient(bundleId string, fn func(client *appstore.Client) error) error {
+	clients, ok := appStoreClients[bundleId]
+	if !ok {
+		return ErrAppStoreDisabled
+	}
+	err := fn(clients[0])
+	if appstore.IsNotFound(err) {
+		err = fn(clients[1])
+	}
+	return err
+}
+
+func init() {
+	// 补单
+	OrderRetryInterval = time.Duration(viper.GetInt("order.retry_interval")) * time.Second
+	if OrderRetryInterval <= 0 {
+		OrderRetryInterval = time.Minute
+	}
+	OrderRetryMaxInterval = time.Duration(viper.GetInt("order.retry_max_interval")) * time.Second
+	if OrderRetryMaxInterval < OrderRetryInterval {
+		OrderRetryMaxInterval = 6 * time.Hour
+	}
+	OrderExpire = time.Duration(viper.GetInt("order.expire")) * time.Hour
+	if OrderExpire <= 0 {
+		OrderExpire = 72 * time.Hour
+	}
+
+	AppStoreSharedSecret = viper.GetString("appstore.shared_secret")
+	rootCert := viper.GetString("appstore.root_cert")
+	if rootCert == "" {
+		return
+	}
+	data, err := os.ReadFile(rootCert)
+	if err != nil {
+		panic(fmt.Errorf("appstore root cert: %s", err))
+	}
+	bundleIds := viper.GetStringSlice("appstore.bundle_ids")
+	AppStoreVerifier, err = appstore.NewVerifier([][]byte{data}, bundleIds, viper.GetStringSlice("appstore.environments"))
+	if err != nil {
+		panic(fmt.Errorf("appstore root cert: %s", err))
+	}
+
+	// Server API, 每个bundle id正式和沙盒各一个
+	AppStoreConsumption = viper.GetBool("appstore.consumption_consent")
+	keyFile := viper.GetString("appstore.private_key")
+	if keyFile == "" {
+		return
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		panic(fmt.Errorf("appstore private key: %s", err))
+	}
+	apiUrl, sandboxApiUrl := viper.GetString("appstore.api_url"), viper.GetString("appstore.sandbox_api_url")
+	if apiUrl == "" {
+		apiUrl = appstore.PRODUCTION_URL
+	}
+	if sandboxApiUrl == "" {
+		sandboxApiUrl = appstore.SANDBOX_URL
+	}
+	for _, bundleId := range bundleIds {
+		var clients [2]*appstore.Client
+		for i, baseUrl := range []string{apiUrl, sandboxApiUrl} {
+			clients[i], err = appstore.NewClient(appstore.ClientConfig{
+				BaseURL:    baseUrl,
+				KeyId:      viper.GetString("appstore.key_id"),
+				IssuerId:   viper.GetString("appstore.issuer_id"),
+				BundleId:   bundleId,
+				PrivateKey: key,
+			})
+			if err != nil {
+				panic(fmt.Errorf("appstore client: %s", err))
+			}
+		}
+		appStoreClients[bundleId] = clients
+	}
+}
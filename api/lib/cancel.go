@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	protocol "camera-protocol"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// 已取消的执行中任务 ZSet member=任务ID score=取消时间, worker轮询后中止
+	RedisTaskCancelZset = RedisPrefix + "task:cancel:%d"
+
+	// 取消记录保留时长, 超过后worker仍未中止的任务按正常上报处理
+	TaskCancelExpire = 6 * time.Hour
+)
+
+// worker上报的任务已取消, 与models.CANCELD一致
+const CALLBACK_CANCELED = protocol.CODE_CANCELED
+
+// worker查询已取消的任务
+type TaskCancelQuery struct {
+	TaskType int    `json:"task_type"` // WORK_*
+	TaskIds  []uint `json:"task_ids"`  // 执行中的任务
+}
+
+func (q *Queue) cancelKey() string {
+	return fmt.Sprintf(RedisTaskCancelZset, q.TaskType)
+}
+
+// 取消任务, 等待中的直接出队; 执行中的释放租约并通知worker中止, 返回是否正在执行
+func (q *Queue) Cancel(id int) (bool, error) {
+	member := strconv.Itoa(id)
+	value := member
+	if q.Batch {
+		value = "[" + member + "]"
+	}
+	lists := append(append([]string{}, q.Lists...), q.Lanes...)
+	_, err := RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, list := range lists {
+			pipe.LRem(ctx, list, 0, value)
+		}
+		pipe.HDel(ctx, q.seqKey(), member)
+		pipe.HDel(ctx, q.queuedKey(), member)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if !q.Leased(id) {
+		if q.Fair != nil {
+			return false, q.Fair.Remove(id)
+		}
+		return false, nil
+	}
+
+	q.clearProgress(id)
+	if err = q.Ack(id); err != nil {
+		return true, err
+	}
+	now := time.Now()
+	_, err = RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, q.cancelKey(), &redis.Z{Score: float64(now.Unix()), Member: member})
+		pipe.ZRemRangeByScore(ctx, q.cancelKey(), "-inf", strconv.FormatInt(now.Add(-TaskCancelExpire).Unix(), 10))
+		return nil
+	})
+	return true, err
+}
+
+// 执行中的任务里已被取消的
+func (q *Queue) Canceled(ids []uint) ([]uint, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	pipe := RDB.Pipeline()
+	cmds := make([]*redis.FloatCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.ZScore(ctx, q.cancelKey(), strconv.Itoa(int(id)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	canceled := make([]uint, 0)
+	for i, cmd := range cmds {
+		if cmd.Err() == nil {
+			canceled = append(canceled, ids[i])
+		}
+	}
+	return canceled, nil
+}
+
+// worker已中止, 删除取消记录
+func (q *Queue) CancelDone(id int) error {
+	return RDB.ZRem(ctx, q.cancelKey(), strconv.Itoa(id)).Err()
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"fmt"
+
+	protocol "camera-protocol"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// 客户端加解密: 设备ua, 手机号, 下载地址
+	ApiCipher *protocol.Cipher
+	// worker加解密: 任务下发和回调
+	WebUICipher *protocol.Cipher
+)
+
+// 读取加密配置 <section>.deskey 和 <section>.cipher
+func newCipher(section string) (*protocol.Cipher, error) {
+	return protocol.NewCipher(
+		viper.GetString(section+".cipher.mode"),
+		viper.GetString(section+".deskey"),
+		viper.GetString(section+".cipher.key_id"),
+		viper.GetStringMapString(section+".cipher.keys"),
+	)
+}
+
+func init() {
+	var err error
+	if ApiCipher, err = newCipher("common"); err != nil {
+		panic(fmt.Errorf("common cipher config: %s", err))
+	}
+	if WebUICipher, err = newCipher("webui"); err != nil {
+		panic(fmt.Errorf("webui cipher config: %s", err))
+	}
+}
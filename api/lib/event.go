@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 用户任务事件频道
+	RedisTaskEventChannel = RedisPrefix + "event:"
+)
+
+// 任务事件
+const (
+	EVENT_QUEUED    = "queued"    // 排队中
+	EVENT_STARTED   = "started"   // 开始执行
+	EVENT_PROGRESS  = "progress"  // 执行进度
+	EVENT_SUCCEEDED = "succeeded" // 成功
+	EVENT_FAILED    = "failed"    // 失败
+)
+
+// 事件所属任务
+const (
+	EVENT_TASK_CARD  = "card"  // 分身
+	EVENT_TASK_PHOTO = "photo" // 写真
+	EVENT_TASK_HIRES = "hires" // 高清
+)
+
+// 任务事件, 通过Redis发布, 任意api实例都可推送给用户
+type TaskEvent struct {
+	Event    string `json:"event"`
+	Task     string `json:"task"`
+	TaskId   int    `json:"task_id"`            // 分身任务ID或写真任务ID
+	ImageId  int    `json:"image_id,omitempty"` // 分身图片ID或写真图片ID
+	Stage    string `json:"stage,omitempty"`    // 执行阶段
+	Progress int    `json:"progress,omitempty"` // 进度 0-100
+	Message  string `json:"message,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// 发布任务事件
+func PublishTaskEvent(cusId int, event *TaskEvent) error {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	data, err := json.MarshalToString(event)
+	if err != nil {
+		return err
+	}
+	return RDB.Publish(ctx, RedisTaskEventChannel+strconv.Itoa(cusId), data).Err()
+}
+
+// 本实例的事件订阅, 所有用户共用一个Redis订阅连接
+type eventHub struct {
+	once sync.Once
+	mu   sync.RWMutex
+	subs map[int]map[chan *TaskEvent]struct{}
+}
+
+var taskEventHub = &eventHub{subs: make(map[int]map[chan *TaskEvent]struct{})}
+
+// 订阅用户任务事件, 用完需调用返回的取消函数
+func SubscribeTaskEvent(cusId int) (<-chan *TaskEvent, func()) {
+	h := taskEventHub
+	h.once.Do(func() { go h.run() })
+
+	ch := make(chan *TaskEvent, 16)
+	h.mu.Lock()
+	if h.subs[cusId] == nil {
+		h.subs[cusId] = make(map[chan *TaskEvent]struct{})
+	}
+	h.subs[cusId][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[cusId], ch)
+		if len(h.subs[cusId]) == 0 {
+			delete(h.subs, cusId)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) run() {
+	pubsub := RDB.PSubscribe(ctx, RedisTaskEventChannel+"*")
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		cusId, err := strconv.Atoi(strings.TrimPrefix(msg.Channel, RedisTaskEventChannel))
+		if err != nil {
+			continue
+		}
+		event := &TaskEvent{}
+		if err = json.UnmarshalFromString(msg.Payload, event); err != nil {
+			continue
+		}
+
+		h.mu.RLock()
+		for ch := range h.subs[cusId] {
+			// 客户端消费过慢时丢弃, 客户端可通过状态接口补齐
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		h.mu.RUnlock()
+	}
+}
@@ -0,0 +1,466 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// 用户待处理任务 List
+	RedisFairUserList = RedisPrefix + "fair:%d:user:%s"
+	// 轮询用户 List, 右侧出左侧入, 每个通道一个, 超过每日上限的用户进入slow
+	RedisFairRingList = RedisPrefix + "fair:%d:ring:%s"
+	// 用户所在轮询 Hash field=用户ID value=通道|slow
+	RedisFairActiveHash = RedisPrefix + "fair:%d:active"
+	// 任务所属用户 Hash field=任务ID value=用户ID
+	RedisFairOwnerHash = RedisPrefix + "fair:%d:owner"
+	// 用户执行中任务 ZSet member=任务ID score=租约到期时间
+	RedisFairRunningZset = RedisPrefix + "fair:%d:running:%s"
+	// 任务所需底模 Hash field=任务ID value=CheckpointName
+	RedisFairCheckpointHash = RedisPrefix + "fair:%d:checkpoint"
+	// 任务分组 Hash field=任务ID value=写真任务ID, 同组任务可批量出队
+	RedisFairGroupHash = RedisPrefix + "fair:%d:group"
+	// 底模亲和统计 Hash field=hit|match|miss|fallback
+	RedisAffinityStatsHash = RedisPrefix + "stats:affinity:%d"
+)
+
+const FAIR_SLOW = "slow"
+
+// 以下脚本按ARGV中的前缀拼接用户队列、轮询和执行中的key, 这些key未在KEYS中声明
+// 只能运行在单节点Redis(含主从)上, 不支持Redis Cluster
+
+// 加入用户队列, 用户不在轮询中时加入队尾
+var fairPushScript = redis.NewScript(`
+redis.call('LPUSH', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+redis.call('HSETNX', KEYS[4], ARGV[1], ARGV[5])
+if ARGV[6] ~= '' then
+	redis.call('HSET', KEYS[5], ARGV[1], ARGV[6])
+end
+if ARGV[7] ~= '0' then
+	redis.call('HSET', KEYS[6], ARGV[1], ARGV[7])
+end
+if redis.call('HSETNX', KEYS[2], ARGV[2], ARGV[3]) == 1 then
+	redis.call('LPUSH', ARGV[4] .. ARGV[3], ARGV[2])
+end
+return 1
+`)
+
+// 出队: 先取重新投递的任务, 再按权重选择通道, 通道内按用户轮询, 最后是slow
+// 执行中任务达到上限的用户本轮跳过
+// 指定底模时, 轮询窗口内优先出队底模一致的任务, 轮询顺序的第一个任务排队超过maxWait时不再跳过
+// KEYS[1..9] 租约 投递次数 投递记录 通道权重 用户所在轮询 任务所属用户 任务底模 亲和统计 入队时间
+// ARGV[5..12] 执行上限 用户队列前缀 轮询前缀 执行中前缀 通道数 底模 窗口 maxWait, ARGV[13..] 通道权重 重新投递队列
+var fairPopScript = redis.NewScript(leaseLua + laneLua + `
+local now, limit = tonumber(ARGV[4]), tonumber(ARGV[5])
+local userPrefix, ringPrefix, runningPrefix = ARGV[6], ARGV[7], ARGV[8]
+local nLanes = tonumber(ARGV[9])
+local checkpoint, window, maxWait = ARGV[10], tonumber(ARGV[11]), tonumber(ARGV[12])
+
+local function take(v)
+	lease(v)
+	redis.call('HDEL', KEYS[7], v)
+	local cus = redis.call('HGET', KEYS[6], v)
+	if cus then
+		redis.call('ZADD', runningPrefix .. cus, ARGV[1], v)
+	end
+	return v
+end
+
+local function running(cus)
+	local key = runningPrefix .. cus
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+	return redis.call('ZCARD', key)
+end
+
+local function peek(cus)
+	if limit > 0 and running(cus) >= limit then
+		return nil
+	end
+	return redis.call('LINDEX', userPrefix .. cus, -1)
+end
+
+local function popAffinity(key)
+	if checkpoint == '' or window <= 0 then
+		return nil
+	end
+	local users = redis.call('LRANGE', key, -window, -1)
+	local first = true
+	for i = #users, 1, -1 do
+		local cus = users[i]
+		local v = peek(cus)
+		if v then
+			local matched = redis.call('HGET', KEYS[7], v) == checkpoint
+			if first then
+				local queued = tonumber(redis.call('HGET', KEYS[9], v) or now)
+				if now - queued > maxWait then
+					redis.call('HINCRBY', KEYS[8], 'fallback', 1)
+					return nil
+				end
+				if matched then
+					redis.call('HINCRBY', KEYS[8], 'match', 1)
+					return nil
+				end
+				first = false
+			elseif matched then
+				local list = userPrefix .. cus
+				redis.call('LREM', key, 1, cus)
+				redis.call('RPOP', list)
+				if redis.call('LLEN', list) > 0 then
+					redis.call('LPUSH', key, cus)
+				else
+					redis.call('HDEL', KEYS[5], cus)
+				end
+				redis.call('HINCRBY', KEYS[8], 'hit', 1)
+				return v
+			end
+		end
+	end
+	if not first then
+		redis.call('HINCRBY', KEYS[8], 'miss', 1)
+	end
+	return nil
+end
+
+local function popRing(key)
+	local v = popAffinity(key)
+	if v then
+		return v
+	end
+	local n = redis.call('LLEN', key)
+	for i = 1, n do
+		local cus = redis.call('RPOP', key)
+		if not cus then
+			return nil
+		end
+		local list = userPrefix .. cus
+		if redis.call('LLEN', list) == 0 then
+			redis.call('HDEL', KEYS[5], cus)
+		elseif limit > 0 and running(cus) >= limit then
+			redis.call('LPUSH', key, cus)
+		else
+			local v = redis.call('RPOP', list)
+			if redis.call('LLEN', list) > 0 then
+				redis.call('LPUSH', key, cus)
+			else
+				redis.call('HDEL', KEYS[5], cus)
+			end
+			return v
+		end
+	end
+	return nil
+end
+
+for i = 13 + nLanes, #ARGV do
+	local v = redis.call('RPOP', ARGV[i])
+	if v then
+		return take(v)
+	end
+end
+
+local lens, weights = {}, {}
+for i = 1, nLanes do
+	weights[i] = tonumber(ARGV[12 + i])
+	lens[i] = redis.call('LLEN', ringPrefix .. (i - 1))
+end
+while true do
+	local lane = pickLane(KEYS[4], lens, weights)
+	if not lane then
+		break
+	end
+	local v = popRing(ringPrefix .. (lane - 1))
+	if v then
+		return take(v)
+	end
+	lens[lane] = 0
+end
+
+local v = popRing(ringPrefix .. 'slow')
+if v then
+	return take(v)
+end
+return false
+`)
+
+// 批量出队: 用户队列中紧随其后的同组任务一并出队, 受执行上限限制
+// 第i个任务的租约顺延i个租约时长: worker按顺序执行同批任务(见camera-webui RunTask),
+// 排在后面的任务开始前不会过期, 开始后由进度上报(Queue.Extend)续租
+// KEYS[1..5] 租约 投递次数 投递记录 任务所属用户 任务分组, KEYS[6] 任务底模
+// ARGV[1..4] 到期时间 批量 节点 当前时间, ARGV[5..9] 已出队任务 数量 执行上限 用户队列前缀 执行中前缀, ARGV[10] 租约秒数
+var fairGroupScript = redis.NewScript(leaseLua + `
+local cus = redis.call('HGET', KEYS[4], ARGV[5])
+local group = redis.call('HGET', KEYS[5], ARGV[5])
+redis.call('HDEL', KEYS[5], ARGV[5])
+if not cus or not group then
+	return {}
+end
+local list, running = ARGV[8] .. cus, ARGV[9] .. cus
+local limit = tonumber(ARGV[7])
+local taken = {}
+for i = 1, tonumber(ARGV[6]) do
+	if limit > 0 then
+		redis.call('ZREMRANGEBYSCORE', running, '-inf', ARGV[4])
+		if redis.call('ZCARD', running) >= limit then
+			break
+		end
+	end
+	local v = redis.call('LINDEX', list, -1)
+	if not v or redis.call('HGET', KEYS[5], v) ~= group then
+		break
+	end
+	redis.call('RPOP', list)
+	lease(v)
+	local expire = tonumber(ARGV[1]) + i * tonumber(ARGV[10])
+	redis.call('ZADD', KEYS[1], expire, v)
+	redis.call('ZADD', running, expire, v)
+	redis.call('HDEL', KEYS[5], v)
+	redis.call('HDEL', KEYS[6], v)
+	table.insert(taken, v)
+end
+return taken
+`)
+
+// 按用户公平调度的任务队列
+// 每个用户一个待处理队列, 出队时按用户轮询, 超过每日上限的用户进入慢轮询
+// 出队脚本访问未声明的key, 需要单节点Redis
+type FairQueue struct {
+	TaskType     int
+	RunningLimit int // 每个用户同时执行的任务上限, 0不限制
+
+	AffinityWindow  int // 底模亲和: 每个轮询向后查找的用户数, 0不启用
+	AffinityMaxWait int // 底模亲和: 轮询顺序的第一个任务排队超过该秒数时不再跳过
+}
+
+func (f *FairQueue) userKey(cusId string) string {
+	return fmt.Sprintf(RedisFairUserList, f.TaskType, cusId)
+}
+
+func (f *FairQueue) ringKey(ring string) string {
+	return fmt.Sprintf(RedisFairRingList, f.TaskType, ring)
+}
+
+func (f *FairQueue) runningKey(cusId string) string {
+	return fmt.Sprintf(RedisFairRunningZset, f.TaskType, cusId)
+}
+
+func (f *FairQueue) activeKey() string {
+	return fmt.Sprintf(RedisFairActiveHash, f.TaskType)
+}
+
+func (f *FairQueue) ownerKey() string {
+	return fmt.Sprintf(RedisFairOwnerHash, f.TaskType)
+}
+
+func (f *FairQueue) checkpointKey() string {
+	return fmt.Sprintf(RedisFairCheckpointHash, f.TaskType)
+}
+
+func (f *FairQueue) groupKey() string {
+	return fmt.Sprintf(RedisFairGroupHash, f.TaskType)
+}
+
+// 加入用户队列, checkpoint为任务所需底模, 用于亲和调度, group为所属写真任务, 用于批量出队
+func (f *FairQueue) Push(cusId, id, lane int, slow bool, checkpoint string, group int) error {
+	if lane < 0 || lane >= len(LaneWeights) {
+		lane = LANE_FREE
+	}
+	ring := strconv.Itoa(lane)
+	if slow {
+		ring = FAIR_SLOW
+	}
+	user := strconv.Itoa(cusId)
+	keys := []string{f.userKey(user), f.activeKey(), f.ownerKey(), fmt.Sprintf(RedisTaskQueuedHash, f.TaskType), f.checkpointKey(), f.groupKey()}
+	args := []any{id, user, ring, fmt.Sprintf(RedisFairRingList, f.TaskType, ""), time.Now().Unix(), CheckpointName(checkpoint), group}
+	return fairPushScript.Run(ctx, RDB, keys, args...).Err()
+}
+
+// checkpoint: worker已加载的底模, 为空时不做亲和调度
+func (f *FairQueue) pop(q *Queue, worker, checkpoint string) (string, error) {
+	now := time.Now()
+	keys := []string{
+		q.leaseKey(), q.triesKey(), q.attemptKey(), laneCreditKey(q.TaskType), f.activeKey(), f.ownerKey(),
+		f.checkpointKey(), fmt.Sprintf(RedisAffinityStatsHash, f.TaskType), q.queuedKey(),
+	}
+	args := []any{
+		now.Add(q.Lease).Unix(), q.batch(), worker, now.Unix(), f.RunningLimit,
+		fmt.Sprintf(RedisFairUserList, f.TaskType, ""),
+		fmt.Sprintf(RedisFairRingList, f.TaskType, ""),
+		fmt.Sprintf(RedisFairRunningZset, f.TaskType, ""),
+		len(LaneWeights),
+		CheckpointName(checkpoint), f.AffinityWindow, f.AffinityMaxWait,
+	}
+	for _, w := range LaneWeights {
+		args = append(args, w)
+	}
+	for _, list := range q.Lists {
+		args = append(args, list)
+	}
+	return fairPopScript.Run(ctx, RDB, keys, args...).Text()
+}
+
+// 与id同组的后续任务出队, 最多count个
+func (f *FairQueue) popGroup(q *Queue, worker string, id, count int) ([]string, error) {
+	now := time.Now()
+	keys := []string{q.leaseKey(), q.triesKey(), q.attemptKey(), f.ownerKey(), f.groupKey(), f.checkpointKey()}
+	args := []any{
+		now.Add(q.Lease).Unix(), q.batch(), worker, now.Unix(),
+		id, count, f.RunningLimit,
+		fmt.Sprintf(RedisFairUserList, f.TaskType, ""),
+		fmt.Sprintf(RedisFairRunningZset, f.TaskType, ""),
+		int(q.Lease.Seconds()),
+	}
+	return fairGroupScript.Run(ctx, RDB, keys, args...).StringSlice()
+}
+
+// 任务结束, 释放执行名额
+func (f *FairQueue) release(id int, done bool) error {
+	member := strconv.Itoa(id)
+	cusId, err := RDB.HGet(ctx, f.ownerKey(), member).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	}
+	_, err = RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, f.runningKey(cusId), member)
+		if done {
+			pipe.HDel(ctx, f.ownerKey(), member)
+			pipe.HDel(ctx, f.groupKey(), member)
+		}
+		return nil
+	})
+	return err
+}
+
+// 从用户队列删除
+func (f *FairQueue) Remove(id int) error {
+	member := strconv.Itoa(id)
+	cusId, err := RDB.HGet(ctx, f.ownerKey(), member).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	}
+	_, err = RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, f.userKey(cusId), 1, member)
+		pipe.HDel(ctx, f.ownerKey(), member)
+		pipe.HDel(ctx, f.checkpointKey(), member)
+		pipe.HDel(ctx, f.groupKey(), member)
+		return nil
+	})
+	return err
+}
+
+// 批量计算rest中任务的排名, 按当前轮询顺序模拟出队, 每个用户模拟一次
+// ahead为重新投递队列中的任务数
+func (f *FairQueue) ranks(ranks map[int]int, rest []int, ahead int) {
+	members := make([]string, len(rest))
+	for i, id := range rest {
+		members[i] = strconv.Itoa(id)
+	}
+	owners := RDB.HMGet(ctx, f.ownerKey(), members...).Val()
+	users := make(map[string][]int)
+	for i, owner := range owners {
+		if cusId, ok := owner.(string); ok && i < len(rest) {
+			users[cusId] = append(users[cusId], rest[i])
+		}
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	rings := make([][]laneUser, len(LaneWeights))
+	lanesAhead := 0
+	for i := range rings {
+		rings[i] = f.ringUsers(strconv.Itoa(i))
+		for _, u := range rings[i] {
+			lanesAhead += u.Count
+		}
+	}
+	credits := laneCredits(f.TaskType)
+	var slow [][]laneUser
+
+	for cusId, ids := range users {
+		// 任务在本用户队列中前面的任务数
+		owns := make(map[int]int, len(ids))
+		for _, id := range ids {
+			owns[id] = -1
+		}
+		n := 0
+		vals := RDB.LRange(ctx, f.userKey(cusId), 0, -1).Val()
+		for i, v := range vals {
+			id, err := strconv.Atoi(v)
+			if own, ok := owns[id]; err == nil && ok && own < 0 {
+				owns[id] = len(vals) - 1 - i
+				n = max(n, owns[id]+1)
+			}
+		}
+		if n == 0 {
+			continue
+		}
+
+		var steps []int
+		base := ahead
+		myRing := RDB.HGet(ctx, f.activeKey(), cusId).Val()
+		if myRing != FAIR_SLOW {
+			lane, _ := strconv.Atoi(myRing)
+			steps = simulateLanes(credits, rings, lane, cusId, n)
+		} else {
+			// 所有通道先于slow
+			if slow == nil {
+				slow = [][]laneUser{f.ringUsers(FAIR_SLOW)}
+			}
+			base += lanesAhead
+			steps = simulateLanes([]int{0}, slow, 0, cusId, n)
+		}
+		for id, own := range owns {
+			if own >= 0 && steps[own] > 0 {
+				ranks[id] = base + steps[own]
+			}
+		}
+	}
+}
+
+// 轮询中的用户, 按出队顺序排列
+func (f *FairQueue) ringUsers(ring string) []laneUser {
+	users := RDB.LRange(ctx, f.ringKey(ring), 0, -1).Val()
+	pipe := RDB.Pipeline()
+	lens := make([]*redis.IntCmd, len(users))
+	for i, user := range users {
+		lens[i] = pipe.LLen(ctx, f.userKey(user))
+	}
+	pipe.Exec(ctx)
+	result := make([]laneUser, 0, len(users))
+	for i := len(users) - 1; i >= 0; i-- {
+		if n := int(lens[i].Val()); n > 0 {
+			result = append(result, laneUser{ID: users[i], Count: n})
+		}
+	}
+	return result
+}
+
+// 底模名称, 去掉目录和webui返回的hash: E:\models\a.safetensors, a.safetensors [6ce0161689] => a.safetensors
+func CheckpointName(checkpoint string) string {
+	if i := strings.Index(checkpoint, " ["); i >= 0 {
+		checkpoint = checkpoint[:i]
+	}
+	if i := strings.LastIndexAny(checkpoint, "/\\"); i >= 0 {
+		checkpoint = checkpoint[i+1:]
+	}
+	return strings.ToLower(strings.TrimSpace(checkpoint))
+}
+
+// 底模亲和统计 hit:避免的切换 match:按顺序即一致 miss:需要切换 fallback:排队超时未亲和
+func GetAffinityStats(taskType int) map[string]int64 {
+	stats := make(map[string]int64)
+	for field, value := range RDB.HGetAll(ctx, fmt.Sprintf(RedisAffinityStatsHash, taskType)).Val() {
+		stats[field], _ = strconv.ParseInt(value, 10, 64)
+	}
+	return stats
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+)
+
+// 访问链接时的文件服务方式
+const (
+	FILE_SERVE_PROXY    = "proxy"    // api代理下载
+	FILE_SERVE_REDIRECT = "redirect" // 跳转到存储的限时地址
+)
+
+// 分享类型, 与分享接口的type一致
+const (
+	SHARE_CARD  = 1 // 分身
+	SHARE_PHOTO = 2 // 写真
+)
+
+var (
+	// 分享记录 String, 过期即失效, 删除即撤销
+	RedisFileShareKey = RedisPrefix + "file:share:%s"
+
+	// 跳转到存储的限时地址, 否则由api代理下载
+	FileRedirect bool
+	// 下载和分享链接的api地址
+	FileHost string
+	// 下载token签名密钥, 必须配置
+	FileSecret string
+	// 下载链接有效期
+	FileDownloadExpire = 5 * time.Minute
+	// 分享链接默认有效期
+	FileShareExpire = 7 * 24 * time.Hour
+	// 访问链接时跳转的后端地址有效期
+	FileRedirectExpire = time.Minute
+
+	ErrFileToken = errors.New("bad file token")
+)
+
+// 分享记录
+type FileShare struct {
+	CusId    int   `json:"cus_id"`
+	Type     int   `json:"type"` // SHARE_*
+	ImageId  int   `json:"image_id"`
+	ExpireAt int64 `json:"expire_at"`
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// 下载token base64url(用户ID.图片ID.过期时间).签名, 只能由该用户的图片使用
+func SignDownloadToken(cusId, imageId int, expire time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d.%d", cusId, imageId, expire.Unix())))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256([]byte(FileSecret), payload))
+}
+
+// 校验下载token, 返回用户ID和图片ID
+func ParseDownloadToken(token string) (int, int, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, 0, ErrFileToken
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sign, hmacSHA256([]byte(FileSecret), payload)) {
+		return 0, 0, ErrFileToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return 0, 0, ErrFileToken
+	}
+	var cusId, imageId int
+	var expire int64
+	if _, err = fmt.Sscanf(string(data), "%d.%d.%d", &cusId, &imageId, &expire); err != nil {
+		return 0, 0, ErrFileToken
+	}
+	if time.Now().Unix() > expire {
+		return 0, 0, ErrFileToken
+	}
+	return cusId, imageId, nil
+}
+
+// 下载链接
+func DownloadLink(cusId, imageId int) (string, time.Time, error) {
+	expire := time.Now().Add(FileDownloadExpire)
+	link, err := url.JoinPath(FileHost, "api/file/download", SignDownloadToken(cusId, imageId, expire))
+	return link, expire, err
+}
+
+// 创建分享, 返回分享ID
+func CreateFileShare(share *FileShare, expire time.Duration) (string, error) {
+	id := GenGUID()
+	share.ExpireAt = time.Now().Add(expire).Unix()
+	value, err := json.MarshalToString(share)
+	if err != nil {
+		return "", err
+	}
+	return id, RDB.Set(ctx, fmt.Sprintf(RedisFileShareKey, id), value, expire).Err()
+}
+
+// 分享记录, 不存在或已过期返回nil
+func GetFileShare(id string) (*FileShare, error) {
+	value, err := RDB.Get(ctx, fmt.Sprintf(RedisFileShareKey, id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	share := &FileShare{}
+	if err = json.UnmarshalFromString(value, share); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// 撤销分享
+func RevokeFileShare(id string) error {
+	return RDB.Del(ctx, fmt.Sprintf(RedisFileShareKey, id)).Err()
+}
+
+// 分享链接
+func ShareLink(id string) (string, error) {
+	return url.JoinPath(FileHost, "api/file/share", id)
+}
+
+func init() {
+	FileHost = viper.GetString("file.host")
+	FileSecret = viper.GetString("file.secret")
+	// 其他包的测试无法在此之前设置配置, 测试时使用固定密钥
+	if FileSecret == "" && testing.Testing() {
+		FileSecret = "file-secret-for-test"
+	}
+	// 密钥为空时任何人都可伪造下载和分享链接
+	if FileSecret == "" {
+		panic(fmt.Errorf("file config: secret is empty"))
+	}
+	if v := viper.GetInt("file.download_expire"); v > 0 {
+		FileDownloadExpire = time.Duration(v) * time.Second
+	}
+	if v := viper.GetInt("file.share_expire"); v > 0 {
+		FileShareExpire = time.Duration(v) * time.Second
+	}
+	if v := viper.GetInt("file.redirect_expire"); v > 0 {
+		FileRedirectExpire = time.Duration(v) * time.Second
+	}
+	FileRedirect = viper.GetString("file.serve") == FILE_SERVE_REDIRECT
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestDownloadToken(t *testing.T) {
+	token := SignDownloadToken(7, 42, time.Now().Add(time.Minute))
+	cusId, imageId, err := ParseDownloadToken(token)
+	if err != nil || cusId != 7 || imageId != 42 {
+		t.Fatalf("ParseDownloadToken = %d, %d, %v", cusId, imageId, err)
+	}
+}
+
+func TestDownloadTokenExpired(t *testing.T) {
+	for _, expire := range []time.Time{time.Now().Add(-time.Second), time.Now().Add(-FileDownloadExpire), time.Unix(0, 0)} {
+		if _, _, err := ParseDownloadToken(SignDownloadToken(7, 42, expire)); err != ErrFileToken {
+			t.Errorf("token expired at %s: %v", expire, err)
+		}
+	}
+}
+
+func TestDownloadTokenTampered(t *testing.T) {
+	expire := time.Now().Add(time.Minute)
+	token := SignDownloadToken(7, 42, expire)
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// 改用户, 图片或过期时间后签名不一致
+	exp := expire.Unix()
+	for _, data := range []string{fmt.Sprintf("8.42.%d", exp), fmt.Sprintf("7.43.%d", exp), fmt.Sprintf("7.42.%d", exp+3600)} {
+		forged := base64.RawURLEncoding.EncodeToString([]byte(data))
+		if _, _, err := ParseDownloadToken(forged + "." + signature); err != ErrFileToken {
+			t.Errorf("forged payload %q accepted: %v", data, err)
+		}
+	}
+
+	sign, _ := base64.RawURLEncoding.DecodeString(signature)
+	sign[0] ^= 1
+	for _, bad := range []string{
+		payload + "." + base64.RawURLEncoding.EncodeToString(sign),
+		payload,
+		payload + ".",
+		"." + signature,
+		token + "x",
+	} {
+		if _, _, err := ParseDownloadToken(bad); err != ErrFileToken {
+			t.Errorf("token %q accepted: %v", bad, err)
+		}
+	}
+
+	// 其他密钥签发的token
+	secret := FileSecret
+	FileSecret = "other"
+	other := SignDownloadToken(7, 42, expire)
+	FileSecret = secret
+	if _, _, err := ParseDownloadToken(other); err != ErrFileToken {
+		t.Errorf("token of other secret accepted: %v", err)
+	}
+}
+
+// 需要本地Redis, 如:
+// LIB_TEST_REDIS=127.0.0.1:6379 go test -run FileShare
+func TestFileShareRevoke(t *testing.T) {
+	addr := os.Getenv("LIB_TEST_REDIS")
+	if addr == "" {
+		t.Skip("LIB_TEST_REDIS not set")
+	}
+	rdb := RDB
+	RDB = redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	defer func() {
+		RDB.Close()
+		RDB = rdb
+	}()
+
+	id, err := CreateFileShare(&FileShare{CusId: 7, Type: SHARE_PHOTO, ImageId: 42}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := GetFileShare(id)
+	if err != nil || share == nil || share.CusId != 7 || share.ImageId != 42 {
+		t.Fatalf("GetFileShare = %+v, %v", share, err)
+	}
+
+	if err = RevokeFileShare(id); err != nil {
+		t.Fatal(err)
+	}
+	if share, err = GetFileShare(id); err != nil || share != nil {
+		t.Fatalf("revoked share = %+v, %v", share, err)
+	}
+
+	// 过期即失效
+	if id, err = CreateFileShare(&FileShare{CusId: 7, Type: SHARE_CARD, ImageId: 1}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if share, err = GetFileShare(id); err != nil || share != nil {
+		t.Fatalf("expired share = %+v, %v", share, err)
+	}
+}
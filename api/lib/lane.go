@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 优先级通道
+const (
+	LANE_FREE  = 0 // 免费用户
+	LANE_PAID  = 1 // 付费用户
+	LANE_SPEED = 2 // 购买加速
+)
+
+// 加速有效期, 从支付时起算
+var SpeedLaneExpire = 24 * time.Hour
+
+// 任务优先级通道: 加速有效期内或订阅有效时为加速通道, 付费用户为付费通道, 其他为免费通道
+// speedPaidAt为最近一次购买加速的支付时间, 没有购买为零值
+func GetLane(paid bool, speedPaidAt time.Time, subscribed bool, now time.Time) int {
+	if subscribed || (!speedPaidAt.IsZero() && now.Sub(speedPaidAt) < SpeedLaneExpire) {
+		return LANE_SPEED
+	}
+	if paid {
+		return LANE_PAID
+	}
+	return LANE_FREE
+}
+
+var (
+	// 通道当前权重 Hash field=通道序号(从1开始) value=当前权重, 平滑加权轮询
+	RedisLaneCreditHash = RedisPrefix + "lane:credit:%d"
+
+	// 各通道权重, 下标为通道
+	LaneWeights = []int{1, 3, 6}
+)
+
+// 出队并加入租约
+// KEYS[1..3] 租约 投递次数 投递记录, ARGV[1..4] 到期时间 批量 节点 当前时间
+const leaseLua = `
+local function lease(v)
+	local members = {v}
+	if ARGV[2] == '1' then
+		members = cjson.decode(v)
+	end
+	for _, m in ipairs(members) do
+		m = tostring(m)
+		redis.call('ZADD', KEYS[1], ARGV[1], m)
+		redis.call('HINCRBY', KEYS[2], m, 1)
+		local attempts = {}
+		local raw = redis.call('HGET', KEYS[3], m)
+		if raw then
+			attempts = cjson.decode(raw)
+		end
+		table.insert(attempts, {worker = ARGV[3], leased_at = tonumber(ARGV[4])})
+		redis.call('HSET', KEYS[3], m, cjson.encode(attempts))
+	end
+	return v
+end
+`
+
+// 平滑加权轮询选择通道, 只有非空通道参与, 权重最低的通道也能按比例出队
+const laneLua = `
+local function pickLane(key, lens, weights)
+	local total, best, bestCur = 0, nil, nil
+	local cur = {}
+	for i = 1, #weights do
+		if lens[i] > 0 then
+			local c = tonumber(redis.call('HGET', key, i) or '0') + weights[i]
+			cur[i] = c
+			total = total + weights[i]
+			if best == nil or c > bestCur then
+				best, bestCur = i, c
+			end
+		end
+	end
+	if best == nil then
+		return nil
+	end
+	for i, c in pairs(cur) do
+		if i == best then
+			c = c - total
+		end
+		redis.call('HSET', key, i, c)
+	end
+	return best
+end
+`
+
+func laneCreditKey(taskType int) string {
+	return fmt.Sprintf(RedisLaneCreditHash, taskType)
+}
+
+// 当前各通道权重
+func laneCredits(taskType int) []int {
+	vals := RDB.HGetAll(ctx, laneCreditKey(taskType)).Val()
+	credits := make([]int, len(LaneWeights))
+	for i := range credits {
+		credits[i], _ = strconv.Atoi(vals[strconv.Itoa(i+1)])
+	}
+	return credits
+}
+
+// 轮询中的用户及剩余任务数
+type laneUser struct {
+	ID    string
+	Count int
+}
+
+// 模拟出队顺序, 返回目标任务各是第几个出队, 0表示不在队列中
+// rings: 每个通道按出队顺序排列的用户; 目标为lane通道中user的前n个任务, 下标为在用户队列中的位置
+func simulateLanes(credits []int, rings [][]laneUser, lane int, user string, n int) []int {
+	result := make([]int, n)
+	credits = append([]int{}, credits...)
+	queues := make([][]laneUser, len(rings))
+	for i, ring := range rings {
+		queues[i] = append([]laneUser{}, ring...)
+	}
+
+	steps, own := 0, 0
+	for own < n {
+		total, best := 0, -1
+		for i := range queues {
+			if len(queues[i]) == 0 {
+				continue
+			}
+			credits[i] += LaneWeights[i]
+			total += LaneWeights[i]
+			if best < 0 || credits[i] > credits[best] {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		credits[best] -= total
+
+		u := queues[best][0]
+		queues[best] = queues[best][1:]
+		steps++
+		if best == lane && u.ID == user {
+			result[own] = steps
+			own++
+		}
+		if u.Count--; u.Count > 0 {
+			queues[best] = append(queues[best], u)
+		}
+	}
+	return result
+}
+
+func init() {
+	if hours := viper.GetInt("queue.speed_lane_hours"); hours > 0 {
+		SpeedLaneExpire = time.Duration(hours) * time.Hour
+	}
+	weights := viper.GetIntSlice("queue.lane_weights")
+	if len(weights) == len(LaneWeights) {
+		for i, w := range weights {
+			if w > 0 {
+				LaneWeights[i] = w
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGetLane(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		name        string
+		paid        bool
+		speedPaidAt time.Time
+		subscribed  bool
+		want        int
+	}{
+		{"free", false, time.Time{}, false, LANE_FREE},
+		{"paid", true, time.Time{}, false, LANE_PAID},
+		{"speed in window", true, now.Add(-time.Hour), false, LANE_SPEED},
+		{"speed just expired", true, now.Add(-SpeedLaneExpire), false, LANE_PAID},
+		{"speed long ago", true, now.AddDate(-1, 0, 0), false, LANE_PAID},
+		{"subscribed", true, time.Time{}, true, LANE_SPEED},
+		{"subscribed after speed expired", true, now.AddDate(0, -1, 0), true, LANE_SPEED},
+	} {
+		if got := GetLane(tc.paid, tc.speedPaidAt, tc.subscribed, now); got != tc.want {
+			t.Errorf("%s: GetLane = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSimulateLanes(t *testing.T) {
+	weights := LaneWeights
+	LaneWeights = []int{1, 3, 6}
+	defer func() { LaneWeights = weights }()
+
+	rings := [][]laneUser{
+		{{ID: "a", Count: 2}},
+		{{ID: "b", Count: 1}, {ID: "c", Count: 3}},
+		nil,
+	}
+	for _, tc := range []struct {
+		name string
+		lane int
+		user string
+		n    int
+		want []int
+	}{
+		{"all of c", 1, "c", 3, []int{3, 4, 5}},
+		{"more than queued", 1, "c", 4, []int{3, 4, 5, 0}},
+		{"low weight lane", 0, "a", 2, []int{2, 6}},
+		{"not in lane", 2, "a", 1, []int{0}},
+	} {
+		got := simulateLanes([]int{0, 0, 0}, rings, tc.lane, tc.user, tc.n)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: simulateLanes = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if rings[1][1].Count != 3 {
+		t.Errorf("simulateLanes modified rings: %+v", rings)
+	}
+}
@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// worker节点 Hash field=worker/service value=WorkerNode
+	RedisWorkerNodeHash = RedisPrefix + "worker:nodes"
+
+	// 心跳超时, 超时后节点的租约立即重新投递
+	WorkerHeartbeatTimeout = time.Minute
+	// 离线超过该时长从节点列表移除
+	WorkerNodeExpire = 24 * time.Hour
+)
+
+// worker节点, 每台机器的每个服务(check train qianyi photohr)一个
+type WorkerNode struct {
+	Worker      string   `json:"worker"`       // 凭证ID, 未签名时为IP, 与投递记录一致
+	Service     string   `json:"service"`      // 服务名
+	Hostname    string   `json:"hostname"`     // 主机名
+	IP          string   `json:"ip"`           // 来源IP
+	Version     string   `json:"version"`      // 软件版本
+	TaskTypes   []string `json:"task_types"`   // 处理的队列 front side lora card photo hr
+	Threads     int      `json:"threads"`      // 并发数
+	Running     int      `json:"running"`      // 执行中任务数
+	Checkpoint  string   `json:"checkpoint"`   // 已加载的底模
+	DiskFree    uint64   `json:"disk_free"`    // 工作目录剩余空间 bytes
+	StartedAt   int64    `json:"started_at"`   // 进程启动时间
+	HeartbeatAt int64    `json:"heartbeat_at"` // 最近心跳时间
+	Offline     bool     `json:"offline"`      // 心跳超时, 租约已重新投递
+}
+
+func (n *WorkerNode) Key() string {
+	return n.Worker + "/" + n.Service
+}
+
+// 节点处理的队列
+func (n *WorkerNode) Queues() []*Queue {
+	queues := make([]*Queue, 0, len(n.TaskTypes))
+	for _, q := range TaskQueues {
+		for _, name := range n.TaskTypes {
+			if q.Name == name {
+				queues = append(queues, q)
+				break
+			}
+		}
+	}
+	return queues
+}
+
+// 心跳是否超时
+func (n *WorkerNode) Expired(now time.Time) bool {
+	return now.Sub(time.Unix(n.HeartbeatAt, 0)) > WorkerHeartbeatTimeout
+}
+
+// 保存节点, 返回之前的记录
+func SaveWorkerNode(node *WorkerNode) (*WorkerNode, error) {
+	value, err := json.MarshalToString(node)
+	if err != nil {
+		return nil, err
+	}
+	prev := GetWorkerNode(node.Key())
+	return prev, RDB.HSet(ctx, RedisWorkerNodeHash, node.Key(), value).Err()
+}
+
+// 获取节点, 不存在返回nil
+func GetWorkerNode(key string) *WorkerNode {
+	raw, err := RDB.HGet(ctx, RedisWorkerNodeHash, key).Result()
+	if err != nil {
+		return nil
+	}
+	node := &WorkerNode{}
+	if err = json.UnmarshalFromString(raw, node); err != nil {
+		return nil
+	}
+	return node
+}
+
+// 节点列表
+func GetWorkerNodes() ([]WorkerNode, error) {
+	values, err := RDB.HGetAll(ctx, RedisWorkerNodeHash).Result()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]WorkerNode, 0, len(values))
+	for _, raw := range values {
+		node := WorkerNode{}
+		if err = json.UnmarshalFromString(raw, &node); err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Key() < nodes[j].Key()
+	})
+	return nodes, nil
+}
+
+// 移除节点
+func RemoveWorkerNode(key string) error {
+	return RDB.HDel(ctx, RedisWorkerNodeHash, key).Err()
+}
+
+// 标记节点离线并让其租约立即到期, 返回队列名 => 任务ID
+// 标记前重新检查心跳, 避免覆盖刚到达的心跳
+func MarkWorkerOffline(key string) (map[string][]int, error) {
+	node := GetWorkerNode(key)
+	if node == nil || node.Offline || !node.Expired(time.Now()) {
+		return nil, nil
+	}
+	node.Offline = true
+	if _, err := SaveWorkerNode(node); err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string][]int)
+	for _, q := range node.Queues() {
+		workers, err := q.LeaseWorkers()
+		if err != nil {
+			return expired, err
+		}
+		ids := workers[node.Worker]
+		if len(ids) == 0 {
+			continue
+		}
+		if err = q.ExpireLeases(ids); err != nil {
+			return expired, err
+		}
+		expired[q.Name] = ids
+	}
+	return expired, nil
+}
+
+func init() {
+	if sec := viper.GetInt("worker.heartbeat_timeout"); sec > 0 {
+		WorkerHeartbeatTimeout = time.Duration(sec) * time.Second
+	}
+}
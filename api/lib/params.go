@@ -9,7 +9,6 @@ import (
 )
 
 var (
-	ApiDeskey     string
 	ImageHost     string
 	GlobalSmsCode string
 	PhotoLimit    int64
@@ -21,27 +20,18 @@ var (
 	BaiduImgCheck        bool
 	BaiduTextCheck       bool
 
-	//七牛云
-	QiniuAccessKey string
-	QiniuSecretKey string
-	QiniuBucket    string
-	QiniuHost      string
-
 	// WebUI
 	WebUICallback          string
 	WebUICallbackCard      string
 	WebUICallbackPhoto     string
 	WebUICallbackPhotoHr   string
 	WebUICallbackRecognize string
-	WebUIDeskey            string
 
 	//Web管理后台
 	WebToken string
 )
 
 func init() {
-	ApiDeskey = viper.GetString("common.deskey")
-
 	// 图片通用域名
 	ImageHost = viper.GetString("common.img_host")
 
@@ -69,19 +59,12 @@ func init() {
 	BaiduImgCheck = viper.GetBool("baidu.img_censor")
 	BaiduTextCheck = viper.GetBool("baidu.text_censor")
 
-	//七牛云
-	QiniuAccessKey = viper.GetString("qiniu.access_key")
-	QiniuSecretKey = viper.GetString("qiniu.secret_key")
-	QiniuBucket = viper.GetString("qiniu.bucket")
-	QiniuHost = viper.GetString("qiniu.host")
-
 	// WebUI
 	WebUICallback = viper.GetString("webui.callback")
 	WebUICallbackCard = viper.GetString("webui.callback_card")
 	WebUICallbackPhoto = viper.GetString("webui.callback_photo")
 	WebUICallbackPhotoHr = viper.GetString("webui.callback_photo_hr")
 	WebUICallbackRecognize = viper.GetString("webui.callback_recognize")
-	WebUIDeskey = viper.GetString("webui.deskey")
 
 	//Web管理后台
 	WebToken = viper.GetString("web.token")
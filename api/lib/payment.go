@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	payment "camera-payment"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// 已配置的支付渠道, 苹果支付不在其中, 仍走 /api/appstore
+	PayProviders = make(map[string]payment.Provider)
+	// 渠道通知的回调域名
+	PayNotifyHost string
+
+	ErrPayProvider = errors.New("payment provider is not configured")
+)
+
+func GetPayProvider(name string) (payment.Provider, error) {
+	provider, ok := PayProviders[name]
+	if !ok {
+		return nil, ErrPayProvider
+	}
+	return provider, nil
+}
+
+// 第三方渠道的商户订单号, 以P开头区别于苹果交易号
+func GenOrderNum() string {
+	return "P" + time.Now().Format("20060102150405") + GenGUID()[:12]
+}
+
+// 渠道通知地址
+func PayNotifyURL(name string) string {
+	return PayNotifyHost + "/api/pay/" + name + "/notify"
+}
+
+// 查询渠道支付结果并核对订单号, 产品和金额, 渠道未返回的字段不核对
+func VerifyPayment(ctx context.Context, provider payment.Provider, order *payment.Order, token string) (*payment.Payment, error) {
+	result, err := provider.Verify(ctx, order, token)
+	if err != nil {
+		return nil, err
+	}
+	if err = CheckPayment(order, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func CheckPayment(order *payment.Order, result *payment.Payment) error {
+	if result.OrderNum != order.OrderNum {
+		return fmt.Errorf("order num mismatch: %s", result.OrderNum)
+	}
+	if result.ProductId != "" && result.ProductId != order.ProductId {
+		return fmt.Errorf("product mismatch: %s", result.ProductId)
+	}
+	if result.Amount > 0 && math.Round(result.Amount*100) != math.Round(order.Amount*100) {
+		return fmt.Errorf("amount mismatch: %.2f", result.Amount)
+	}
+	return nil
+}
+
+func readPayKey(key string) []byte {
+	data, err := os.ReadFile(viper.GetString(key))
+	if err != nil {
+		panic(fmt.Errorf("%s: %s", key, err))
+	}
+	return data
+}
+
+func init() {
+	PayNotifyHost = strings.TrimSuffix(viper.GetString("pay.notify_host"), "/")
+
+	// Google Play
+	if viper.GetString("pay.googleplay.package_name") != "" {
+		provider, err := payment.NewGooglePlay(payment.GooglePlayConfig{
+			PackageName:    viper.GetString("pay.googleplay.package_name"),
+			ServiceAccount: readPayKey("pay.googleplay.service_account"),
+			NotifyToken:    viper.GetString("pay.googleplay.notify_token"),
+			APIURL:         viper.GetString("pay.googleplay.api_url"),
+		})
+		if err != nil {
+			panic(fmt.Errorf("pay googleplay: %s", err))
+		}
+		PayProviders[payment.PROVIDER_GOOGLEPLAY] = provider
+	}
+
+	// 微信支付
+	if viper.GetString("pay.wechat.mch_id") != "" {
+		provider, err := payment.NewWechat(payment.WechatConfig{
+			AppId:             viper.GetString("pay.wechat.app_id"),
+			MchId:             viper.GetString("pay.wechat.mch_id"),
+			SerialNo:          viper.GetString("pay.wechat.serial_no"),
+			PrivateKey:        readPayKey("pay.wechat.private_key"),
+			APIv3Key:          viper.GetString("pay.wechat.apiv3_key"),
+			PlatformSerial:    viper.GetString("pay.wechat.platform_serial"),
+			PlatformPublicKey: readPayKey("pay.wechat.platform_public_key"),
+			APIURL:            viper.GetString("pay.wechat.api_url"),
+		})
+		if err != nil {
+			panic(fmt.Errorf("pay wechat: %s", err))
+		}
+		PayProviders[payment.PROVIDER_WECHAT] = provider
+	}
+
+	// 支付宝
+	if viper.GetString("pay.alipay.app_id") != "" {
+		provider, err := payment.NewAlipay(payment.AlipayConfig{
+			AppId:           viper.GetString("pay.alipay.app_id"),
+			PrivateKey:      readPayKey("pay.alipay.private_key"),
+			AlipayPublicKey: readPayKey("pay.alipay.alipay_public_key"),
+			Sandbox:         viper.GetBool("pay.alipay.sandbox"),
+			Gateway:         viper.GetString("pay.alipay.gateway"),
+		})
+		if err != nil {
+			panic(fmt.Errorf("pay alipay: %s", err))
+		}
+		PayProviders[payment.PROVIDER_ALIPAY] = provider
+	}
+}
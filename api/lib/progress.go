@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	// 任务执行进度 String, 过期时间与租约一致
+	RedisTaskProgressKey = RedisPrefix + "progress:%d:%s"
+)
+
+// 任务执行阶段
+const (
+	STAGE_DOWNLOAD   = "download"          // 下载素材
+	STAGE_CLIP_FACES = "clip_faces"        // 裁剪头像
+	STAGE_REMOVE_BG  = "remove_background" // 去背景
+	STAGE_TRAIN      = "train"             // 训练
+	STAGE_GENERATE   = "generate"          // 出图
+	STAGE_UPLOAD     = "upload"            // 上传
+)
+
+// worker任务类型, 与Task.TaskType一致
+const (
+	WORK_TRAIN = 0 // 训练
+	WORK_CARD  = 1 // 分身
+	WORK_PHOTO = 2 // 写真
+	WORK_HIRES = 3 // 高清
+)
+
+// worker上报的执行进度
+type TaskProgress struct {
+	TaskType  int    `json:"task_type"`
+	TaskId    uint   `json:"task_id"`
+	Stage     string `json:"stage"`
+	Percent   int    `json:"percent"` // 0-100
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// worker任务类型对应的队列
+func WorkQueue(taskType int) *Queue {
+	switch taskType {
+	case WORK_TRAIN:
+		return LoraQueue
+	case WORK_CARD:
+		return CardQueue
+	case WORK_PHOTO:
+		return PhotoQueue
+	case WORK_HIRES:
+		return PhotoHrQueue
+	}
+	return nil
+}
+
+func (q *Queue) progressKey(id int) string {
+	return fmt.Sprintf(RedisTaskProgressKey, q.TaskType, strconv.Itoa(id))
+}
+
+// 记录执行进度
+func (q *Queue) SetProgress(id int, progress *TaskProgress) error {
+	progress.UpdatedAt = time.Now().Unix()
+	value, err := json.MarshalToString(progress)
+	if err != nil {
+		return err
+	}
+	return RDB.Set(ctx, q.progressKey(id), value, q.Lease).Err()
+}
+
+// 获取执行进度
+func (q *Queue) Progress(id int) (TaskProgress, bool) {
+	progress := TaskProgress{}
+	value, err := RDB.Get(ctx, q.progressKey(id)).Result()
+	if err != nil {
+		return progress, false
+	}
+	if err = json.UnmarshalFromString(value, &progress); err != nil {
+		return progress, false
+	}
+	return progress, true
+}
+
+func (q *Queue) clearProgress(id int) error {
+	return RDB.Del(ctx, q.progressKey(id)).Err()
+}
@@ -0,0 +1,567 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/spf13/viper"
+)
+
+var (
+	// 任务租约 ZSet member=任务ID score=租约到期时间
+	RedisTaskLeaseZset = RedisPrefix + "task:lease:%d"
+	// 任务投递次数 Hash field=任务ID value=投递次数
+	RedisTaskTriesHash = RedisPrefix + "task:tries:%d"
+	// 任务投递记录 Hash field=任务ID value=[]TaskAttempt
+	RedisTaskAttemptHash = RedisPrefix + "task:attempts:%d"
+	// 通道序号 Hash field=push:通道/pop:通道 value=入队/出队计数, field=任务ID value=通道:序号
+	RedisTaskSeqHash = RedisPrefix + "task:seq:%d"
+	// 入队时间 Hash field=任务ID value=unix时间
+	RedisTaskQueuedHash = RedisPrefix + "task:queued:%d"
+)
+
+var (
+	CheckFrontQueue *Queue // 正面照检测
+	CheckSideQueue  *Queue // 侧面照检测
+	LoraQueue       *Queue // Lora训练
+	CardQueue       *Queue // 分身
+	PhotoQueue      *Queue // 写真
+	PhotoHrQueue    *Queue // 高清
+
+	// 需要monitor维护的队列
+	TaskQueues []*Queue
+
+	// 写真批量下发的最大任务数
+	PhotoBatchMax = 4
+)
+
+// 出队并加入租约, 批量任务(检测)按ID拆分租约
+// 先取重新投递的任务, 再按权重从各通道出队
+// KEYS[4] 通道权重, KEYS[5] 通道序号, KEYS[6..] 待处理队列和通道队列, ARGV[5] 待处理队列数, ARGV[6..] 通道权重
+var popScript = redis.NewScript(leaseLua + laneLua + `
+local nLists = tonumber(ARGV[5])
+for i = 1, nLists do
+	local v = redis.call('RPOP', KEYS[5 + i])
+	if v then
+		return lease(v)
+	end
+end
+
+local lens, weights = {}, {}
+for i = 6, #ARGV do
+	weights[i - 5] = tonumber(ARGV[i])
+	lens[i - 5] = redis.call('LLEN', KEYS[5 + nLists + i - 5])
+end
+local lane = pickLane(KEYS[4], lens, weights)
+if lane then
+	local v = redis.call('RPOP', KEYS[5 + nLists + lane])
+	redis.call('HINCRBY', KEYS[5], 'pop:' .. (lane - 1), 1)
+	redis.call('HDEL', KEYS[5], v)
+	return lease(v)
+end
+return false
+`)
+
+// 加入通道队列并记录序号, 排名 = 序号 - 已出队数
+var pushLaneScript = redis.NewScript(`
+local seq = redis.call('HINCRBY', KEYS[2], 'push:' .. ARGV[2], 1)
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2] .. ':' .. seq)
+redis.call('HSETNX', KEYS[3], ARGV[1], ARGV[3])
+return redis.call('LPUSH', KEYS[1], ARGV[1])
+`)
+
+// 释放租约并放回队尾, 本次投递不计入次数
+var nackScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+local raw = redis.call('HGET', KEYS[4], ARGV[1])
+if raw then
+	local attempts = cjson.decode(raw)
+	table.remove(attempts)
+	if #attempts > 0 then
+		redis.call('HSET', KEYS[4], ARGV[1], cjson.encode(attempts))
+	else
+		redis.call('HDEL', KEYS[4], ARGV[1])
+	end
+end
+redis.call('LPUSH', KEYS[1], ARGV[2])
+return 1
+`)
+
+// 回收到期租约, 未超过投递次数的放回队首, 否则连同投递记录一起返回
+var requeueScript = redis.NewScript(`
+local vals = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, 100)
+local requeued, dropped, attempts = {}, {}, {}
+for _, v in ipairs(vals) do
+	redis.call('ZREM', KEYS[2], v)
+	local tries = tonumber(redis.call('HGET', KEYS[3], v) or '0')
+	if tries >= tonumber(ARGV[2]) then
+		redis.call('HDEL', KEYS[3], v)
+		table.insert(dropped, v)
+		table.insert(attempts, redis.call('HGET', KEYS[4], v) or '[]')
+		redis.call('HDEL', KEYS[4], v)
+	else
+		if ARGV[3] == '1' then
+			redis.call('RPUSH', KEYS[1], '[' .. v .. ']')
+		else
+			redis.call('RPUSH', KEYS[1], v)
+		end
+		table.insert(requeued, v)
+	end
+end
+return {requeued, dropped, attempts}
+`)
+
+// 续租: 租约存在时刷新到期时间, KEYS[2]为用户执行中任务时一并刷新, 避免执行中的任务被移出执行名额
+// KEYS[1] 租约 KEYS[2] 执行中(公平队列), ARGV[1] 到期时间 ARGV[2] 任务ID
+var extendScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	return 0
+end
+for i = 1, #KEYS do
+	redis.call('ZADD', KEYS[i], ARGV[1], ARGV[2])
+end
+return 1
+`)
+
+// 可靠任务队列
+// 出队时任务移入租约集合, 上报后Ack删除; 租约到期未Ack的任务由monitor重新投递
+type Queue struct {
+	TaskType int           // REC_*
+	Name     string        // front side lora card photo hr
+	Lists    []string      // 重新投递和升级前的任务,先于通道按顺序出队,重新投递时放回第一个
+	Lease    time.Duration // 租约时长
+	MaxTries int           // 最大投递次数
+	Batch    bool          // 队列元素为ID数组
+	Lanes    []string      // 优先级通道队列, 下标为通道
+	Fair     *FairQueue    // 按用户公平调度, Lists只存放重新投递的任务
+}
+
+func (q *Queue) leaseKey() string {
+	return fmt.Sprintf(RedisTaskLeaseZset, q.TaskType)
+}
+
+func (q *Queue) triesKey() string {
+	return fmt.Sprintf(RedisTaskTriesHash, q.TaskType)
+}
+
+func (q *Queue) attemptKey() string {
+	return fmt.Sprintf(RedisTaskAttemptHash, q.TaskType)
+}
+
+func (q *Queue) seqKey() string {
+	return fmt.Sprintf(RedisTaskSeqHash, q.TaskType)
+}
+
+func (q *Queue) queuedKey() string {
+	return fmt.Sprintf(RedisTaskQueuedHash, q.TaskType)
+}
+
+func (q *Queue) keys() []string {
+	return []string{q.Lists[0], q.leaseKey(), q.triesKey(), q.attemptKey()}
+}
+
+func (q *Queue) batch() string {
+	if q.Batch {
+		return "1"
+	}
+	return "0"
+}
+
+// 出队, 队列为空时返回redis.Nil
+// worker: 领取任务的节点
+func (q *Queue) Pop(worker string) (string, error) {
+	return q.PopCheckpoint(worker, "")
+}
+
+// 出队, 公平队列优先出队底模与checkpoint一致的任务
+func (q *Queue) PopCheckpoint(worker, checkpoint string) (string, error) {
+	var value string
+	var err error
+	if q.Fair != nil {
+		value, err = q.Fair.pop(q, worker, checkpoint)
+	} else {
+		now := time.Now()
+		keys := []string{q.leaseKey(), q.triesKey(), q.attemptKey(), laneCreditKey(q.TaskType), q.seqKey()}
+		keys = append(keys, q.Lists...)
+		keys = append(keys, q.Lanes...)
+		args := []any{now.Add(q.Lease).Unix(), q.batch(), worker, now.Unix(), len(q.Lists)}
+		for i := range q.Lanes {
+			args = append(args, LaneWeights[i])
+		}
+		value, err = popScript.Run(ctx, RDB, keys, args...).Text()
+	}
+	if err == nil {
+		q.dispatched(value)
+	}
+	return value, err
+}
+
+// 批量出队, 与已出队的id同组的后续任务, 最多count个, 仅公平队列支持
+func (q *Queue) PopGroup(worker string, id, count int) ([]int, error) {
+	if q.Fair == nil || count <= 0 {
+		return nil, nil
+	}
+	values, err := q.Fair.popGroup(q, worker, id, count)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(values))
+	for _, value := range values {
+		q.dispatched(value)
+		if id, err := strconv.Atoi(value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// 加入通道队列
+func (q *Queue) PushLane(id, lane int) error {
+	if lane < 0 || lane >= len(q.Lanes) {
+		lane = LANE_FREE
+	}
+	keys := []string{q.Lanes[lane], q.seqKey(), q.queuedKey()}
+	return pushLaneScript.Run(ctx, RDB, keys, id, lane, time.Now().Unix()).Err()
+}
+
+// 任务排名, 按当前通道权重计算前面还有多少任务, 0表示不在队列中
+func (q *Queue) Rank(id int) int {
+	return q.Ranks([]int{id})[id]
+}
+
+// 批量计算任务排名, 队列状态只读取一次, 同一请求中有多个任务时使用
+// 返回 任务ID => 排名, 不在队列中的为0
+func (q *Queue) Ranks(ids []int) map[int]int {
+	ranks := make(map[int]int, len(ids))
+	if len(ids) == 0 {
+		return ranks
+	}
+	for _, id := range ids {
+		ranks[id] = 0
+	}
+	ahead := 0
+	for _, list := range q.Lists {
+		vals := RDB.LRange(ctx, list, 0, -1).Val()
+		for i, v := range vals {
+			id, err := strconv.Atoi(v)
+			if rank, ok := ranks[id]; err == nil && ok && rank == 0 {
+				ranks[id] = ahead + len(vals) - i
+			}
+		}
+		ahead += len(vals)
+	}
+	rest := make([]int, 0, len(ranks))
+	for id, rank := range ranks {
+		if rank == 0 {
+			rest = append(rest, id)
+		}
+	}
+	if len(rest) == 0 {
+		return ranks
+	}
+	if q.Fair != nil {
+		q.Fair.ranks(ranks, rest, ahead)
+		return ranks
+	}
+	if len(q.Lanes) == 0 {
+		return ranks
+	}
+
+	// 通道内位置 = 序号 - 已出队数
+	fields := make([]string, 0, len(rest)+len(q.Lanes))
+	for _, id := range rest {
+		fields = append(fields, strconv.Itoa(id))
+	}
+	for i := range q.Lanes {
+		fields = append(fields, fmt.Sprintf("pop:%d", i))
+	}
+	vals := RDB.HMGet(ctx, q.seqKey(), fields...).Val()
+	if len(vals) != len(fields) {
+		return ranks
+	}
+	popped := make([]int, len(q.Lanes))
+	for i := range q.Lanes {
+		s, _ := vals[len(rest)+i].(string)
+		popped[i], _ = strconv.Atoi(s)
+	}
+	owns := make(map[int]int, len(rest))
+	laneIds := make(map[int][]int)
+	for i, id := range rest {
+		pos, _ := vals[i].(string)
+		var lane, seq int
+		if _, err := fmt.Sscanf(pos, "%d:%d", &lane, &seq); err != nil || lane < 0 || lane >= len(q.Lanes) {
+			continue
+		}
+		if own := seq - popped[lane] - 1; own >= 0 {
+			owns[id] = own
+			laneIds[lane] = append(laneIds[lane], id)
+		}
+	}
+	if len(laneIds) == 0 {
+		return ranks
+	}
+
+	pipe := RDB.Pipeline()
+	lens := make([]*redis.IntCmd, len(q.Lanes))
+	for i, list := range q.Lanes {
+		lens[i] = pipe.LLen(ctx, list)
+	}
+	pipe.Exec(ctx)
+	rings := make([][]laneUser, len(q.Lanes))
+	for i := range q.Lanes {
+		if n := int(lens[i].Val()); n > 0 {
+			rings[i] = []laneUser{{ID: q.Lanes[i], Count: n}}
+		}
+	}
+	credits := laneCredits(q.TaskType)
+	for lane, ids := range laneIds {
+		n := 0
+		for _, id := range ids {
+			n = max(n, owns[id]+1)
+		}
+		steps := simulateLanes(credits, rings, lane, q.Lanes[lane], n)
+		for _, id := range ids {
+			if step := steps[owns[id]]; step > 0 {
+				ranks[id] = ahead + step
+			}
+		}
+	}
+	return ranks
+}
+
+// 任务上报, 成功时记录执行时长, 清除执行进度, 记录上报的worker
+func (q *Queue) Complete(id int, worker string, success bool) error {
+	RecordWorkerReport(q.TaskType, id, worker, success)
+	if success {
+		if leasedAt, ok := q.LeasedAt(id); ok {
+			recordSample(fmt.Sprintf(RedisStatsRunList, q.TaskType), time.Now().Unix()-leasedAt)
+		}
+	}
+	q.clearProgress(id)
+	return q.Ack(id)
+}
+
+// 任务完成, 删除租约
+func (q *Queue) Ack(id int) error {
+	member := strconv.Itoa(id)
+	_, err := RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.leaseKey(), member)
+		pipe.HDel(ctx, q.triesKey(), member)
+		pipe.HDel(ctx, q.attemptKey(), member)
+		return nil
+	})
+	if err == nil && q.Fair != nil {
+		err = q.Fair.release(id, true)
+	}
+	return err
+}
+
+// 任务未能下发, 立即重新投递
+func (q *Queue) Nack(id int) error {
+	member := strconv.Itoa(id)
+	value := member
+	if q.Batch {
+		value = "[" + member + "]"
+	}
+	if err := nackScript.Run(ctx, RDB, q.keys(), member, value).Err(); err != nil {
+		return err
+	}
+	if q.Fair != nil {
+		return q.Fair.release(id, false)
+	}
+	return nil
+}
+
+// 延长租约, 公平队列同时刷新用户执行中任务的到期时间
+func (q *Queue) Extend(id int) error {
+	member := strconv.Itoa(id)
+	keys := []string{q.leaseKey()}
+	if q.Fair != nil {
+		cusId, err := RDB.HGet(ctx, q.Fair.ownerKey(), member).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			keys = append(keys, q.Fair.runningKey(cusId))
+		}
+	}
+	return extendScript.Run(ctx, RDB, keys, time.Now().Add(q.Lease).Unix(), member).Err()
+}
+
+// 最近一次出队时间
+func (q *Queue) LeasedAt(id int) (int64, bool) {
+	raw, err := RDB.HGet(ctx, q.attemptKey(), strconv.Itoa(id)).Result()
+	if err != nil {
+		return 0, false
+	}
+	attempts := make([]TaskAttempt, 0)
+	if err = json.UnmarshalFromString(raw, &attempts); err != nil || len(attempts) == 0 {
+		return 0, false
+	}
+	return attempts[len(attempts)-1].LeasedAt, true
+}
+
+// 按worker分组的租约 worker => 任务ID
+func (q *Queue) LeaseWorkers() (map[string][]int, error) {
+	members, err := RDB.ZRange(ctx, q.leaseKey(), 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	raws, err := RDB.HMGet(ctx, q.attemptKey(), members...).Result()
+	if err != nil {
+		return nil, err
+	}
+	workers := make(map[string][]int)
+	for i, member := range members {
+		raw, _ := raws[i].(string)
+		attempts := make([]TaskAttempt, 0)
+		if err = json.UnmarshalFromString(raw, &attempts); err != nil || len(attempts) == 0 {
+			continue
+		}
+		if id, err := strconv.Atoi(member); err == nil {
+			worker := attempts[len(attempts)-1].Worker
+			workers[worker] = append(workers[worker], id)
+		}
+	}
+	return workers, nil
+}
+
+// 租约立即到期, 由monitor重新投递
+func (q *Queue) ExpireLeases(ids []int) error {
+	pipe := RDB.Pipeline()
+	for _, id := range ids {
+		pipe.ZAddXX(ctx, q.leaseKey(), &redis.Z{Score: 0, Member: strconv.Itoa(id)})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 是否正在执行
+func (q *Queue) Leased(id int) bool {
+	return RDB.ZScore(ctx, q.leaseKey(), strconv.Itoa(id)).Err() == nil
+}
+
+// 是否在等待队列中
+func (q *Queue) Queued(id int) bool {
+	lists := append(append([]string{}, q.Lists...), q.Lanes...)
+	for _, list := range lists {
+		if CheckListExist(list, uint(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 重新加入队列(死信重试)
+func (q *Queue) Push(id int) error {
+	value := strconv.Itoa(id)
+	if q.Batch {
+		value = "[" + value + "]"
+	}
+	return RDB.LPush(ctx, q.Lists[0], value).Err()
+}
+
+// 投递记录
+type TaskAttempt struct {
+	Worker   string `json:"worker"`
+	LeasedAt int64  `json:"leased_at"`
+}
+
+// 超过投递次数被丢弃的任务
+type DeadTask struct {
+	TaskID   int
+	Attempts []TaskAttempt
+}
+
+// 回收到期租约, 返回重新投递的任务ID和丢弃的任务
+func (q *Queue) Requeue() ([]string, []DeadTask, error) {
+	res, err := requeueScript.Run(ctx, RDB, q.keys(), time.Now().Unix(), q.MaxTries, q.batch()).Slice()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dropped, attempts := toStrings(res[1]), toStrings(res[2])
+	dead := make([]DeadTask, 0, len(dropped))
+	for i, v := range dropped {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		if q.Fair != nil {
+			q.Fair.release(id, true)
+		}
+		task := DeadTask{TaskID: id}
+		if i < len(attempts) {
+			json.UnmarshalFromString(attempts[i], &task.Attempts)
+		}
+		dead = append(dead, task)
+	}
+	return toStrings(res[0]), dead, nil
+}
+
+func toStrings(v any) []string {
+	vals, _ := v.([]any)
+	result := make([]string, 0, len(vals))
+	for _, val := range vals {
+		if s, ok := val.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func newQueue(taskType int, name string, lease time.Duration, lists ...string) *Queue {
+	if sec := viper.GetInt("queue.lease_" + name); sec > 0 {
+		lease = time.Duration(sec) * time.Second
+	}
+	maxTries := viper.GetInt("queue.max_tries")
+	if maxTries <= 0 {
+		maxTries = 2
+	}
+	return &Queue{
+		TaskType: taskType,
+		Name:     name,
+		Lists:    lists,
+		Lease:    lease,
+		MaxTries: maxTries,
+	}
+}
+
+// 通道队列 list:lane:0 ...
+func laneLists(list string) []string {
+	lanes := make([]string, len(LaneWeights))
+	for i := range lanes {
+		lanes[i] = fmt.Sprintf("%s:lane:%d", list, i)
+	}
+	return lanes
+}
+
+func init() {
+	CheckFrontQueue = newQueue(REC_FRONT, "front", time.Minute, RedisSDCheckFrontList)
+	CheckFrontQueue.Batch = true
+	CheckSideQueue = newQueue(REC_SIDE, "side", time.Minute*2, RedisSDCheckSideList)
+	CheckSideQueue.Batch = true
+	LoraQueue = newQueue(REC_LORA, "lora", time.Minute*30, RedisSDList)
+	LoraQueue.Lanes = laneLists(RedisSDList)
+	CardQueue = newQueue(REC_CARD, "card", time.Minute, RedisSDCardList)
+	CardQueue.Lanes = laneLists(RedisSDCardList)
+	PhotoQueue = newQueue(REC_PHOTO, "photo", time.Minute, RedisSDPhotoList, RedisSDPhotoSlowList)
+	PhotoQueue.Fair = &FairQueue{
+		TaskType:        REC_PHOTO,
+		RunningLimit:    viper.GetInt("queue.photo_running_limit"),
+		AffinityWindow:  viper.GetInt("queue.affinity_window"),
+		AffinityMaxWait: viper.GetInt("queue.affinity_max_wait"),
+	}
+	if n := viper.GetInt("queue.photo_batch_max"); n > 0 {
+		PhotoBatchMax = n
+	}
+	PhotoHrQueue = newQueue(REC_HR, "hr", time.Minute, RedisSDPhotoHrList)
+	PhotoHrQueue.Lanes = laneLists(RedisSDPhotoHrList)
+
+	TaskQueues = []*Queue{CheckFrontQueue, CheckSideQueue, LoraQueue, CardQueue, PhotoQueue, PhotoHrQueue}
+}
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// 使用miniredis替换RDB
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	s := miniredis.RunT(t)
+	rdb := RDB
+	RDB = redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		RDB.Close()
+		RDB = rdb
+	})
+	return s
+}
+
+func newTestQueue() *Queue {
+	q := newQueue(REC_CARD, "card", time.Minute, "test:card")
+	q.Lanes = laneLists("test:card")
+	q.MaxTries = 2
+	return q
+}
+
+func newTestFairQueue(limit int) *Queue {
+	q := newQueue(REC_PHOTO, "photo", time.Minute, "test:photo")
+	q.Fair = &FairQueue{TaskType: REC_PHOTO, RunningLimit: limit}
+	return q
+}
+
+func mustPop(t *testing.T, q *Queue, want string) {
+	t.Helper()
+	got, err := q.Pop("w1")
+	if err != nil || got != want {
+		t.Fatalf("Pop = %q, %v, want %q", got, err, want)
+	}
+}
+
+func mustEmpty(t *testing.T, q *Queue) {
+	t.Helper()
+	if got, err := q.Pop("w1"); err != redis.Nil {
+		t.Fatalf("Pop = %q, %v, want redis.Nil", got, err)
+	}
+}
+
+func TestQueueLeaseAck(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestQueue()
+
+	if err := q.PushLane(1, LANE_PAID); err != nil {
+		t.Fatal(err)
+	}
+	mustPop(t, q, "1")
+	if !q.Leased(1) {
+		t.Fatal("Leased = false after Pop")
+	}
+	if tries := s.HGet(q.triesKey(), "1"); tries != "1" {
+		t.Errorf("tries = %q, want 1", tries)
+	}
+	if _, ok := q.LeasedAt(1); !ok {
+		t.Error("LeasedAt not recorded")
+	}
+	mustEmpty(t, q)
+
+	if err := q.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if q.Leased(1) || s.HGet(q.triesKey(), "1") != "" || s.HGet(q.attemptKey(), "1") != "" {
+		t.Error("Ack left lease, tries or attempts behind")
+	}
+}
+
+func TestQueueNack(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestQueue()
+
+	q.PushLane(1, LANE_FREE)
+	mustPop(t, q, "1")
+	if err := q.Nack(1); err != nil {
+		t.Fatal(err)
+	}
+	if q.Leased(1) {
+		t.Error("Leased = true after Nack")
+	}
+	if tries := s.HGet(q.triesKey(), "1"); tries != "0" {
+		t.Errorf("tries = %q after Nack, want 0", tries)
+	}
+	if attempts := s.HGet(q.attemptKey(), "1"); attempts != "" {
+		t.Errorf("attempts = %q after Nack, want none", attempts)
+	}
+
+	// 放回重新投递队列, 先于通道出队
+	q.PushLane(2, LANE_SPEED)
+	mustPop(t, q, "1")
+	if tries := s.HGet(q.triesKey(), "1"); tries != "1" {
+		t.Errorf("tries = %q, want 1", tries)
+	}
+
+	// 未租约的任务不重复放回
+	q.Ack(1)
+	if err := q.Nack(1); err != nil {
+		t.Fatal(err)
+	}
+	mustPop(t, q, "2")
+	mustEmpty(t, q)
+}
+
+func TestQueueRequeue(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestQueue()
+
+	q.PushLane(1, LANE_FREE)
+	mustPop(t, q, "1")
+	requeued, dead, err := q.Requeue()
+	if err != nil || len(requeued) != 0 || len(dead) != 0 {
+		t.Fatalf("Requeue before expiry = %v, %v, %v", requeued, dead, err)
+	}
+
+	// 租约到期, 未超过投递次数放回
+	q.ExpireLeases([]int{1})
+	requeued, dead, err = q.Requeue()
+	if err != nil || len(requeued) != 1 || requeued[0] != "1" || len(dead) != 0 {
+		t.Fatalf("Requeue = %v, %v, %v, want [1] requeued", requeued, dead, err)
+	}
+	if q.Leased(1) {
+		t.Error("Leased = true after Requeue")
+	}
+	mustPop(t, q, "1")
+
+	// 超过投递次数丢弃, 返回投递记录
+	q.ExpireLeases([]int{1})
+	requeued, dead, err = q.Requeue()
+	if err != nil || len(requeued) != 0 || len(dead) != 1 {
+		t.Fatalf("Requeue = %v, %v, %v, want 1 dead", requeued, dead, err)
+	}
+	if dead[0].TaskID != 1 || len(dead[0].Attempts) != 2 || dead[0].Attempts[1].Worker != "w1" {
+		t.Errorf("dead = %+v, want task 1 with 2 attempts", dead[0])
+	}
+	if s.HGet(q.triesKey(), "1") != "" || s.HGet(q.attemptKey(), "1") != "" {
+		t.Error("Requeue left tries or attempts of a dead task")
+	}
+	mustEmpty(t, q)
+}
+
+func TestQueueBatch(t *testing.T) {
+	newTestRedis(t)
+	q := newQueue(REC_FRONT, "front", time.Minute, "test:front")
+	q.Batch = true
+
+	RDB.LPush(ctx, q.Lists[0], "[1,2]")
+	mustPop(t, q, "[1,2]")
+	if !q.Leased(1) || !q.Leased(2) {
+		t.Fatal("batch members not leased separately")
+	}
+	q.Ack(1)
+	q.ExpireLeases([]int{2})
+	requeued, _, err := q.Requeue()
+	if err != nil || len(requeued) != 1 {
+		t.Fatalf("Requeue = %v, %v", requeued, err)
+	}
+	mustPop(t, q, "[2]")
+}
+
+func TestQueueExtend(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestQueue()
+
+	q.PushLane(1, LANE_FREE)
+	mustPop(t, q, "1")
+	q.ExpireLeases([]int{1})
+	if err := q.Extend(1); err != nil {
+		t.Fatal(err)
+	}
+	score, _ := s.ZScore(q.leaseKey(), "1")
+	if want := float64(time.Now().Add(q.Lease).Unix()); score < want-1 {
+		t.Errorf("lease = %v after Extend, want %v", score, want)
+	}
+	requeued, _, _ := q.Requeue()
+	if len(requeued) != 0 {
+		t.Errorf("Requeue = %v after Extend, want none", requeued)
+	}
+
+	// 已结束的任务不续租
+	q.Ack(1)
+	if err := q.Extend(1); err != nil {
+		t.Fatal(err)
+	}
+	if q.Leased(1) {
+		t.Error("Extend created a lease for an acked task")
+	}
+}
+
+func TestFairQueuePopRelease(t *testing.T) {
+	newTestRedis(t)
+	q := newTestFairQueue(1)
+
+	q.Fair.Push(7, 1, LANE_FREE, false, "", 0)
+	q.Fair.Push(7, 2, LANE_FREE, false, "", 0)
+	q.Fair.Push(8, 3, LANE_FREE, false, "", 0)
+
+	// 按用户轮询
+	ranks := q.Ranks([]int{1, 2, 3, 4})
+	if fmt.Sprint(ranks) != fmt.Sprint(map[int]int{1: 1, 2: 3, 3: 2, 4: 0}) {
+		t.Errorf("Ranks = %v", ranks)
+	}
+	if rank := q.Rank(2); rank != 3 {
+		t.Errorf("Rank(2) = %d, want 3", rank)
+	}
+	mustPop(t, q, "1")
+	mustPop(t, q, "3")
+	// 用户7执行中任务已达上限
+	mustEmpty(t, q)
+
+	// 完成后释放名额
+	if err := q.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	mustPop(t, q, "2")
+
+	// 未能下发的任务重新投递, 释放名额
+	if err := q.Nack(3); err != nil {
+		t.Fatal(err)
+	}
+	if n := RDB.ZCard(ctx, q.Fair.runningKey("8")).Val(); n != 0 {
+		t.Errorf("running of user 8 = %d after Nack, want 0", n)
+	}
+	mustPop(t, q, "3")
+}
+
+func TestFairQueueExtendRunning(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestFairQueue(1)
+
+	q.Fair.Push(7, 1, LANE_FREE, false, "", 0)
+	q.Fair.Push(7, 2, LANE_FREE, false, "", 0)
+	mustPop(t, q, "1")
+
+	// 执行超过一个租约时长: 执行中的分数已过期, 续租后仍占用名额
+	running := q.Fair.runningKey("7")
+	s.ZAdd(running, float64(time.Now().Add(-time.Second).Unix()), "1")
+	if err := q.Extend(1); err != nil {
+		t.Fatal(err)
+	}
+	lease, _ := s.ZScore(q.leaseKey(), "1")
+	score, err := s.ZScore(running, "1")
+	if err != nil || score != lease {
+		t.Fatalf("running = %v, %v after Extend, want lease %v", score, err, lease)
+	}
+	mustEmpty(t, q)
+
+	// 执行中的记录已被移除时恢复
+	s.ZRem(running, "1")
+	q.Extend(1)
+	if _, err := s.ZScore(running, "1"); err != nil {
+		t.Fatalf("running not restored by Extend: %v", err)
+	}
+	mustEmpty(t, q)
+}
+
+func TestFairQueuePopGroup(t *testing.T) {
+	s := newTestRedis(t)
+	q := newTestFairQueue(0)
+
+	for id := 1; id <= 3; id++ {
+		q.Fair.Push(7, id, LANE_FREE, false, "", 100)
+	}
+	q.Fair.Push(7, 4, LANE_FREE, false, "", 200)
+	mustPop(t, q, "1")
+	ids, err := q.PopGroup("w1", 1, 4)
+	if err != nil || fmt.Sprint(ids) != "[2 3]" {
+		t.Fatalf("PopGroup = %v, %v, want [2 3]", ids, err)
+	}
+	// 同批任务按顺序执行, 租约依次顺延
+	first, _ := s.ZScore(q.leaseKey(), "1")
+	for i, id := range ids {
+		score, _ := s.ZScore(q.leaseKey(), strconv.Itoa(id))
+		if want := first + float64((i+1)*int(q.Lease.Seconds())); score != want {
+			t.Errorf("lease of %d = %v, want %v", id, score, want)
+		}
+	}
+	mustPop(t, q, "4")
+}
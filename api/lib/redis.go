@@ -32,16 +32,13 @@ var (
 	// SD任务队列
 	RedisSDList           = RedisPrefix + "task:sd"          // SD任务队列
 	RedisSDCardList       = RedisPrefix + "task:card"        // SD分身图片任务队列
-	RedisSDPhotoList      = RedisPrefix + "task:photo"       // 写真快任务队列
-	RedisSDPhotoSlowList  = RedisPrefix + "task:photo:slow"  // 写真慢任务队列
+	RedisSDPhotoList      = RedisPrefix + "task:photo"       // 写真重新投递队列(新任务进入用户队列)
+	RedisSDPhotoSlowList  = RedisPrefix + "task:photo:slow"  // 写真慢任务队列(仅兼容旧任务)
 	RedisSDOSSList        = RedisPrefix + "task:sdoss"       // OSS任务队列
 	RedisSDPhotoHrList    = RedisPrefix + "task:photo:hr"    // 写真高清任务队列
 	RedisSDCheckFrontList = RedisPrefix + "task:check:front" // 检测正面照任务队列
 	RedisSDCheckSideList  = RedisPrefix + "task:check:side"  // 检测侧面照任务队列
 
-	// 维护任务状态
-	RedisTaskRecordHash = RedisPrefix + "task:record"
-
 	// 每日注册人数
 	RedisUserRegCount = RedisPrefix + "reg:count:%s" // reg:count:20230719
 	// 每日每人写真任务数
@@ -49,6 +46,10 @@ var (
 	// 支付订单并发控制
 	RedisOrderLock = RedisPrefix + "order:%s" // order_num
 
+	// 幂等请求
+	RedisIdempotencyLock = RedisPrefix + "idem:lock:%d:%s" // cus_id:md5(key)
+	RedisIdempotencyResp = RedisPrefix + "idem:resp:%d:%s" // cus_id:md5(key) value=IdempotencyRecord
+
 	// 账号错误统计
 	RedisSDAccountError = RedisPrefix + "account:error:sd" // SD账号错误统计
 
@@ -65,67 +66,6 @@ const (
 	REC_HR    = 6 // 高清
 )
 
-// 专用于维护任务队列
-type TaskRecord struct {
-	TaskType  int   // 1-正面照检测 2-侧面照检测 3-Lora训练 4-分身任务 5-写真任务 6-高清
-	TaskID    int   //
-	ExpiredAt int64 // 超时时间
-	TryTimes  int   // 尝试次数
-}
-
-func (r *TaskRecord) Set() error {
-	if err := r.Get(); err != nil && err != redis.Nil {
-		return err
-	}
-
-	switch r.TaskType {
-	case REC_FRONT:
-		r.ExpiredAt = time.Now().Add(time.Minute).Unix()
-	case REC_SIDE:
-		r.ExpiredAt = time.Now().Add(time.Minute * 2).Unix()
-	case REC_LORA:
-		r.ExpiredAt = time.Now().Add(time.Minute * 30).Unix()
-	case REC_CARD:
-		r.ExpiredAt = time.Now().Add(time.Minute).Unix()
-	case REC_PHOTO:
-		r.ExpiredAt = time.Now().Add(time.Minute).Unix()
-	case REC_HR:
-		r.ExpiredAt = time.Now().Add(time.Minute).Unix()
-	}
-	r.TryTimes++
-
-	record, err := json.MarshalToString(r)
-	if err != nil {
-		return err
-	}
-	return RDB.HSet(ctx, RedisTaskRecordHash, fmt.Sprintf("%d_%d", r.TaskType, r.TaskID), record).Err()
-}
-
-func (r *TaskRecord) ClearExpireAt() error {
-	r.ExpiredAt = 0
-	record, err := json.MarshalToString(r)
-	if err != nil {
-		return err
-	}
-	return RDB.HSet(ctx, RedisTaskRecordHash, fmt.Sprintf("%d_%d", r.TaskType, r.TaskID), record).Err()
-}
-
-func (r *TaskRecord) Get() error {
-	record, err := RDB.HGet(ctx, RedisTaskRecordHash, fmt.Sprintf("%d_%d", r.TaskType, r.TaskID)).Result()
-	if err != nil {
-		return err
-	}
-	return json.UnmarshalFromString(record, r)
-}
-
-func (r *TaskRecord) Delete() error {
-	return RDB.HDel(ctx, RedisTaskRecordHash, fmt.Sprintf("%d_%d", r.TaskType, r.TaskID)).Err()
-}
-
-func GetTaskRecords() (map[string]string, error) {
-	return RDB.HGetAll(ctx, RedisTaskRecordHash).Result()
-}
-
 func init() {
 	config := viper.GetStringMapString("redis")
 	RDB = redis.NewClient(&redis.Options{
@@ -144,13 +84,13 @@ func GetMobileCode(mobile string) (string, error) {
 }
 
 // 加入SD队列
-func PushSDTask(id int) error {
-	return RDB.LPush(ctx, RedisSDList, id).Err()
+func PushSDTask(id, lane int) error {
+	return LoraQueue.PushLane(id, lane)
 }
 
 // 获取SD队列
-func PopSDTask() (int, error) {
-	value, err := RDB.RPop(ctx, RedisSDList).Result()
+func PopSDTask(worker string) (int, error) {
+	value, err := LoraQueue.Pop(worker)
 	if err != nil {
 		return 0, err
 	}
@@ -163,29 +103,17 @@ func PopSDTask() (int, error) {
 
 // 查看训练任务ID排名
 func GetSDTaskRank(id int) int {
-	strId := strconv.Itoa(id)
-	vals := RDB.LRange(ctx, RedisSDList, 0, -1).Val()
-	length := len(vals)
-	if length == 0 {
-		return 0
-	}
-
-	for i, v := range vals {
-		if v == strId {
-			return length - i
-		}
-	}
-	return 0
+	return LoraQueue.Rank(id)
 }
 
 // 加入SD队列
-func PushSDCardTask(id int) error {
-	return RDB.LPush(ctx, RedisSDCardList, id).Err()
+func PushSDCardTask(id, lane int) error {
+	return CardQueue.PushLane(id, lane)
 }
 
 // 获取SD队列
-func PopSDCardTask() (int, error) {
-	value, err := RDB.RPop(ctx, RedisSDCardList).Result()
+func PopSDCardTask(worker string) (int, error) {
+	value, err := CardQueue.Pop(worker)
 	if err != nil {
 		return 0, err
 	}
@@ -196,25 +124,16 @@ func PopSDCardTask() (int, error) {
 	return id, nil
 }
 
-// 加入写真队列
-func PushSDPhotoTask(id int, slow bool) error {
-	if slow {
-		return RDB.LPush(ctx, RedisSDPhotoSlowList, id).Err()
-	}
-	return RDB.LPush(ctx, RedisSDPhotoList, id).Err()
+// 加入写真队列, 超过每日上限的用户进入慢轮询
+func PushSDPhotoTask(cusId, id, lane int, slow bool, checkpoint string, group int) error {
+	return PhotoQueue.Fair.Push(cusId, id, lane, slow, checkpoint, group)
 }
 
-// 获取写真队列
-func PopSDPhotoTask() (int, error) {
-	value, err := RDB.RPop(ctx, RedisSDPhotoList).Result()
+// 获取写真队列, 优先底模与worker已加载底模一致的任务
+func PopSDPhotoTask(worker, checkpoint string) (int, error) {
+	value, err := PhotoQueue.PopCheckpoint(worker, checkpoint)
 	if err != nil {
-		if err != redis.Nil {
-			return 0, err
-		}
-		value, err = RDB.RPop(ctx, RedisSDPhotoSlowList).Result()
-		if err != nil {
-			return 0, err
-		}
+		return 0, err
 	}
 	id, err := strconv.Atoi(value)
 	if err != nil {
@@ -223,14 +142,6 @@ func PopSDPhotoTask() (int, error) {
 	return id, nil
 }
 
-// 从写真队列删除
-func DelSDPhotoTask(id int) error {
-	if err := RDB.LRem(ctx, RedisSDPhotoList, 1, id).Err(); err != nil {
-		return err
-	}
-	return RDB.LRem(ctx, RedisSDPhotoSlowList, 1, id).Err()
-}
-
 // 加入正面照检测队列
 func PushSDCheckFrontTask(ids []int) error {
 	if len(ids) == 0 {
@@ -260,14 +171,14 @@ func PushSDCheckSideTask(ids []int) error {
 }
 
 // 获取检测队列 1:正面 2:侧面
-func PopSDCheckTask() (int, []int, error) {
+func PopSDCheckTask(worker string) (int, []int, error) {
 	ctype := 1
-	value, err := RDB.RPop(ctx, RedisSDCheckFrontList).Result()
+	value, err := CheckFrontQueue.Pop(worker)
 	if err != nil {
 		if err != redis.Nil {
 			return 0, nil, err
 		}
-		value, err = RDB.RPop(ctx, RedisSDCheckSideList).Result()
+		value, err = CheckSideQueue.Pop(worker)
 		if err != nil {
 			return 0, nil, err
 		}
@@ -281,13 +192,13 @@ func PopSDCheckTask() (int, []int, error) {
 }
 
 // 加入高清写真队列
-func PushSDPhotoHrTask(id int) error {
-	return RDB.LPush(ctx, RedisSDPhotoHrList, id).Err()
+func PushSDPhotoHrTask(id, lane int) error {
+	return PhotoHrQueue.PushLane(id, lane)
 }
 
 // 获取高清写真队列
-func PopSDPhotoHrTask() (int, error) {
-	value, err := RDB.RPop(ctx, RedisSDPhotoHrList).Result()
+func PopSDPhotoHrTask(worker string) (int, error) {
+	value, err := PhotoHrQueue.Pop(worker)
 	if err != nil {
 		return 0, err
 	}
@@ -406,3 +317,23 @@ func LockOrder(orderNum string) (bool, error) {
 func UnlockOrder(orderNum string) error {
 	return RDB.Del(ctx, fmt.Sprintf(RedisOrderLock, orderNum)).Err()
 }
+
+// 锁定幂等请求
+func LockIdempotency(cusId int, key string) (bool, error) {
+	return RDB.SetNX(ctx, fmt.Sprintf(RedisIdempotencyLock, cusId, key), 1, time.Second*60).Result()
+}
+
+// 解锁幂等请求
+func UnlockIdempotency(cusId int, key string) error {
+	return RDB.Del(ctx, fmt.Sprintf(RedisIdempotencyLock, cusId, key)).Err()
+}
+
+// 获取幂等请求的原始响应
+func GetIdempotencyResponse(cusId int, key string) (string, error) {
+	return RDB.Get(ctx, fmt.Sprintf(RedisIdempotencyResp, cusId, key)).Result()
+}
+
+// 缓存幂等请求的原始响应
+func SetIdempotencyResponse(cusId int, key, value string) error {
+	return RDB.Set(ctx, fmt.Sprintf(RedisIdempotencyResp, cusId, key), value, time.Hour*24).Err()
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// 排队时长(秒) List, 保留最近样本
+	RedisStatsWaitList = RedisPrefix + "stats:wait:%d"
+	// 执行时长(秒) List, 保留最近样本
+	RedisStatsRunList = RedisPrefix + "stats:run:%d"
+	// 出队时间 List, 用于计算出队速度
+	RedisStatsDispatchList = RedisPrefix + "stats:dispatch:%d"
+)
+
+const (
+	statsSamples  = 500              // 每种任务保留的样本数
+	statsWindow   = 10 * 60          // 出队速度统计窗口(秒)
+	statsCacheTTL = 30 * time.Second // 统计结果缓存
+)
+
+// 时长分位数(秒)
+type Percentile struct {
+	P50 int `json:"p50"`
+	P90 int `json:"p90"`
+}
+
+// 任务耗时统计
+type TaskStats struct {
+	Wait       Percentile `json:"wait"`       // 排队
+	Run        Percentile `json:"run"`        // 执行
+	Throughput float64    `json:"throughput"` // 每秒出队数
+	Samples    int        `json:"samples"`    // 执行时长样本数
+	updatedAt  time.Time
+}
+
+var (
+	statsMu    sync.Mutex
+	statsCache = make(map[int]*TaskStats)
+)
+
+// 记录样本
+func recordSample(key string, value int64) error {
+	pipe := RDB.Pipeline()
+	pipe.LPush(ctx, key, value)
+	pipe.LTrim(ctx, key, 0, statsSamples-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 出队后记录排队时长和出队时间
+func (q *Queue) dispatched(value string) {
+	ids := []string{value}
+	if q.Batch {
+		var batch []int
+		json.UnmarshalFromString(value, &batch)
+		ids = ids[:0]
+		for _, id := range batch {
+			ids = append(ids, strconv.Itoa(id))
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if queuedAt, err := RDB.HGet(ctx, q.queuedKey(), id).Int64(); err == nil {
+			recordSample(fmt.Sprintf(RedisStatsWaitList, q.TaskType), now-queuedAt)
+			RDB.HDel(ctx, q.queuedKey(), id)
+		}
+	}
+	recordSample(fmt.Sprintf(RedisStatsDispatchList, q.TaskType), now)
+}
+
+// 获取耗时统计, 没有样本时按租约时长估算
+func (q *Queue) Stats() TaskStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if stats, ok := statsCache[q.TaskType]; ok && time.Since(stats.updatedAt) < statsCacheTTL {
+		return *stats
+	}
+
+	stats := &TaskStats{updatedAt: time.Now()}
+	waits := sampleInts(fmt.Sprintf(RedisStatsWaitList, q.TaskType))
+	runs := sampleInts(fmt.Sprintf(RedisStatsRunList, q.TaskType))
+	stats.Wait = percentile(waits)
+	stats.Run = percentile(runs)
+	stats.Samples = len(runs)
+	if len(runs) == 0 {
+		lease := int(q.Lease.Seconds())
+		stats.Run = Percentile{P50: lease / 2, P90: lease}
+	}
+
+	// 统计窗口内的出队速度
+	now := time.Now().Unix()
+	dispatches := sampleInts(fmt.Sprintf(RedisStatsDispatchList, q.TaskType))
+	count, oldest := 0, now
+	for _, ts := range dispatches {
+		if int64(ts) >= now-statsWindow {
+			count++
+			oldest = min(oldest, int64(ts))
+		}
+	}
+	if count > 1 && now > oldest {
+		stats.Throughput = float64(count) / float64(now-oldest)
+	}
+
+	statsCache[q.TaskType] = stats
+	return *stats
+}
+
+// 排队中任务的预计完成时间(秒)
+func (q *Queue) EstimateQueued(rank int) Percentile {
+	stats := q.Stats()
+	var wait int
+	if stats.Throughput > 0 {
+		wait = int(float64(rank) / stats.Throughput)
+	} else {
+		wait = rank * stats.Run.P50
+	}
+	return Percentile{P50: wait + stats.Run.P50, P90: wait + stats.Run.P90}
+}
+
+// 执行中任务的预计剩余时间(秒)
+func (q *Queue) EstimateRunning(id int) Percentile {
+	stats := q.Stats()
+	leasedAt, ok := q.LeasedAt(id)
+	if !ok {
+		return stats.Run
+	}
+	elapsed := int(time.Now().Unix() - leasedAt)
+	return Percentile{P50: max(stats.Run.P50-elapsed, 0), P90: max(stats.Run.P90-elapsed, 0)}
+}
+
+// 预计完成时间(秒), 排队中按排名估算, 否则按执行中估算
+func (q *Queue) Estimate(id int) (int, Percentile) {
+	return q.EstimateRank(id, q.Rank(id))
+}
+
+// 按已计算的排名(Queue.Ranks)估算预计完成时间
+func (q *Queue) EstimateRank(id, rank int) (int, Percentile) {
+	if rank > 0 {
+		return rank, q.EstimateQueued(rank)
+	}
+	return 0, q.EstimateRunning(id)
+}
+
+func sampleInts(key string) []int {
+	vals := RDB.LRange(ctx, key, 0, -1).Val()
+	result := make([]int, 0, len(vals))
+	for _, v := range vals {
+		if n, err := strconv.Atoi(v); err == nil {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func percentile(vals []int) Percentile {
+	if len(vals) == 0 {
+		return Percentile{}
+	}
+	sorted := append([]int{}, vals...)
+	sort.Ints(sorted)
+	at := func(p float64) int {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return Percentile{P50: at(0.5), P90: at(0.9)}
+}
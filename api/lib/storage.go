@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+
+	storage "camera-storage"
+
+	"github.com/spf13/viper"
+)
+
+// 对象存储
+var Store storage.Storage
+
+// 存储配置, 未配置storage.driver时使用旧的qiniu配置
+func StorageConfig() storage.Config {
+	if viper.GetString("storage.driver") == "" {
+		return storage.Config{
+			Driver:    storage.DRIVER_QINIU,
+			Host:      viper.GetString("qiniu.host"),
+			Bucket:    viper.GetString("qiniu.bucket"),
+			AccessKey: viper.GetString("qiniu.access_key"),
+			SecretKey: viper.GetString("qiniu.secret_key"),
+		}
+	}
+	return storage.Config{
+		Driver:    viper.GetString("storage.driver"),
+		Host:      viper.GetString("storage.host"),
+		Bucket:    viper.GetString("storage.bucket"),
+		AccessKey: viper.GetString("storage.access_key"),
+		SecretKey: viper.GetString("storage.secret_key"),
+		Region:    viper.GetString("storage.region"),
+		Endpoint:  viper.GetString("storage.endpoint"),
+		PathStyle: viper.GetBool("storage.path_style"),
+	}
+}
+
+// 上传png图片, 返回公开地址
+func UploadImage(img image.Image, key string) (string, error) {
+	buffer := new(bytes.Buffer)
+	if err := png.Encode(buffer, img); err != nil {
+		return "", err
+	}
+	if err := Store.Put(context.Background(), key, buffer, int64(buffer.Len()), "image/png"); err != nil {
+		return "", err
+	}
+	return Store.URL(key), nil
+}
+
+// 按地址删除文件, 不是本存储的地址返回false
+func DeleteFile(rawurl string) (bool, error) {
+	key, ok := Store.Key(rawurl)
+	if !ok {
+		return false, nil
+	}
+	return true, Store.Delete(context.Background(), key)
+}
+
+func init() {
+	var err error
+	if Store, err = storage.New(StorageConfig()); err != nil {
+		panic(fmt.Errorf("storage config: %s", err))
+	}
+}
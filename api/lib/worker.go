@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	protocol "camera-protocol"
+
+	"github.com/spf13/viper"
+)
+
+// worker签名请求头
+const (
+	HeaderWorkerId        = "X-Worker-Id"
+	HeaderWorkerTimestamp = "X-Timestamp"
+	HeaderWorkerNonce     = "X-Nonce"
+	HeaderWorkerSignature = "X-Signature"
+)
+
+var (
+	// 已使用的nonce, 防重放
+	RedisWorkerNonceKey = RedisPrefix + "worker:nonce:%s:%s"
+	// worker上报统计 Hash field=worker:ok|worker:fail
+	RedisWorkerStatsHash = RedisPrefix + "worker:stats:%d"
+	// 最近的失败上报 List
+	RedisWorkerFailureList = RedisPrefix + "worker:failures"
+
+	// 配置文件中的worker凭证 worker_id => secret
+	WorkerKeys map[string]string
+	// 允许未签名的请求, 仅用于worker升级过渡
+	WorkerAllowUnsigned bool
+	// 签名时间允许误差
+	WorkerClockSkew = 5 * time.Minute
+)
+
+const workerFailureSamples = 1000
+
+// worker失败上报记录
+type WorkerFailure struct {
+	Worker   string `json:"worker"`
+	TaskType int    `json:"task_type"`
+	TaskId   int    `json:"task_id"`
+	Time     int64  `json:"time"`
+}
+
+// 请求签名, 包含规范化后的query, 见protocol.WorkerSignature
+func WorkerSignature(secret, method, path, rawQuery, timestamp, nonce string, body []byte) string {
+	return protocol.WorkerSignature(secret, method, path, rawQuery, timestamp, nonce, body)
+}
+
+// 使用nonce, 已使用过返回false
+func UseWorkerNonce(workerId, nonce string) (bool, error) {
+	return RDB.SetNX(ctx, fmt.Sprintf(RedisWorkerNonceKey, workerId, nonce), 1, 2*WorkerClockSkew).Result()
+}
+
+// 记录worker上报结果
+func RecordWorkerReport(taskType, id int, worker string, success bool) error {
+	if worker == "" {
+		return nil
+	}
+	field := worker + ":ok"
+	if !success {
+		field = worker + ":fail"
+	}
+	pipe := RDB.Pipeline()
+	pipe.HIncrBy(ctx, fmt.Sprintf(RedisWorkerStatsHash, taskType), field, 1)
+	if !success {
+		value, _ := json.MarshalToString(WorkerFailure{Worker: worker, TaskType: taskType, TaskId: id, Time: time.Now().Unix()})
+		pipe.LPush(ctx, RedisWorkerFailureList, value)
+		pipe.LTrim(ctx, RedisWorkerFailureList, 0, workerFailureSamples-1)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 各worker上报统计 taskType => field => count
+func GetWorkerStats() map[int]map[string]string {
+	stats := make(map[int]map[string]string)
+	for _, q := range TaskQueues {
+		stats[q.TaskType] = RDB.HGetAll(ctx, fmt.Sprintf(RedisWorkerStatsHash, q.TaskType)).Val()
+	}
+	return stats
+}
+
+// 最近的失败上报
+func GetWorkerFailures(count int64) []WorkerFailure {
+	failures := make([]WorkerFailure, 0)
+	for _, value := range RDB.LRange(ctx, RedisWorkerFailureList, 0, count-1).Val() {
+		failure := WorkerFailure{}
+		if err := json.UnmarshalFromString(value, &failure); err == nil {
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+func init() {
+	WorkerKeys = viper.GetStringMapString("worker.keys")
+	WorkerAllowUnsigned = viper.GetBool("worker.allow_unsigned")
+}
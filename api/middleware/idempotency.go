@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	// IdempotencyConfig defines the config for Idempotency middleware.
+	IdempotencyConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper Skipper
+
+		// Store saves and loads recorded responses, scoped by the caller (e.g. per user).
+		// Required.
+		Store IdempotencyStore
+
+		// KeyHeader is the request header carrying the idempotency key.
+		// Optional. Default value "Idempotency-Key".
+		KeyHeader string
+
+		// KeyMaxLen is the max length of the key.
+		// Optional. Default value 64.
+		KeyMaxLen int
+
+		// Replayable reports whether a response may be recorded and replayed.
+		// Responses that are not recorded run the handler again on retry.
+		// Optional. Default value records responses with status below 500.
+		Replayable func(status int, body []byte) bool
+
+		// ErrorHandler writes the response for ErrIdempotencyKey* errors,
+		// ErrIdempotencyRunning and store errors.
+		// Optional. Default value responds with the status of the error.
+		ErrorHandler func(c *gin.Context, err error)
+	}
+
+	// IdempotencyRecord is a recorded response.
+	IdempotencyRecord struct {
+		Path    string
+		ReqHash string // digest of method, path, query and body; a key may not be reused for another request
+		Status  int
+		Body    string
+	}
+
+	// IdempotencyStore saves recorded responses.
+	IdempotencyStore interface {
+		// Get returns the record of key, ok is false when there is none.
+		Get(c *gin.Context, key string) (record *IdempotencyRecord, ok bool)
+		// Lock guards the first execution of key, false when it is held.
+		Lock(c *gin.Context, key string) (bool, error)
+		Unlock(c *gin.Context, key string)
+		Save(c *gin.Context, key string, record *IdempotencyRecord) error
+	}
+
+	// idempotencyWriter keeps a copy of the response body.
+	idempotencyWriter struct {
+		gin.ResponseWriter
+		body *bytes.Buffer
+	}
+)
+
+// Errors
+var (
+	ErrIdempotencyKeyInvalid = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyReused  = errors.New("idempotency key reused for another request")
+	ErrIdempotencyRunning    = errors.New("idempotent request is running")
+)
+
+var (
+	// DefaultIdempotencyConfig is the default Idempotency middleware config.
+	DefaultIdempotencyConfig = IdempotencyConfig{
+		Skipper:   DefaultSkipper,
+		KeyHeader: "Idempotency-Key",
+		KeyMaxLen: 64,
+		Replayable: func(status int, body []byte) bool {
+			return status < http.StatusInternalServerError
+		},
+		ErrorHandler: func(c *gin.Context, err error) {
+			status := http.StatusInternalServerError
+			switch err {
+			case ErrIdempotencyKeyInvalid, ErrIdempotencyKeyReused:
+				status = http.StatusBadRequest
+			case ErrIdempotencyRunning:
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"code": 0, "message": err.Error()})
+		},
+	}
+)
+
+// IdempotencyWithConfig returns an Idempotency middleware with config.
+//
+// A request carrying the key header runs the handler once; later requests with the
+// same key replay the recorded response. Responses rejected by Replayable are not
+// recorded, so a retry with the same key runs the handler again.
+// Requests without the header are passed through.
+func IdempotencyWithConfig(config IdempotencyConfig) gin.HandlerFunc {
+	// Defaults
+	if config.Store == nil {
+		panic("gin: idempotency middleware requires store")
+	}
+	if config.Skipper == nil {
+		config.Skipper = DefaultIdempotencyConfig.Skipper
+	}
+	if config.KeyHeader == "" {
+		config.KeyHeader = DefaultIdempotencyConfig.KeyHeader
+	}
+	if config.KeyMaxLen == 0 {
+		config.KeyMaxLen = DefaultIdempotencyConfig.KeyMaxLen
+	}
+	if config.Replayable == nil {
+		config.Replayable = DefaultIdempotencyConfig.Replayable
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = DefaultIdempotencyConfig.ErrorHandler
+	}
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(config.KeyHeader)
+		if config.Skipper(c) || key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > config.KeyMaxLen {
+			config.ErrorHandler(c, ErrIdempotencyKeyInvalid)
+			c.Abort()
+			return
+		}
+		reqHash, err := idempotencyRequestHash(c)
+		if err != nil {
+			config.ErrorHandler(c, ErrIdempotencyKeyInvalid)
+			c.Abort()
+			return
+		}
+
+		// Already done, replay
+		if record, ok := config.Store.Get(c, key); ok {
+			idempotencyReplay(c, config, record, reqHash)
+			return
+		}
+
+		locked, err := config.Store.Lock(c, key)
+		if err != nil {
+			config.ErrorHandler(c, err)
+			c.Abort()
+			return
+		}
+		if !locked {
+			config.ErrorHandler(c, ErrIdempotencyRunning)
+			c.Abort()
+			return
+		}
+		defer config.Store.Unlock(c, key)
+
+		// The previous request may have finished while we were locking
+		if record, ok := config.Store.Get(c, key); ok {
+			idempotencyReplay(c, config, record, reqHash)
+			return
+		}
+
+		writer := &idempotencyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+		c.Next()
+
+		if !config.Replayable(c.Writer.Status(), writer.body.Bytes()) {
+			return
+		}
+		record := &IdempotencyRecord{
+			Path:    c.FullPath(),
+			ReqHash: reqHash,
+			Status:  c.Writer.Status(),
+			Body:    writer.body.String(),
+		}
+		if err = config.Store.Save(c, key, record); err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// ReplayableExceptCodes returns a Replayable for JSON bodies of the form {"code": N, ...}.
+// Responses with one of the given codes, a status of 500 or above, or a body
+// without a code are not recorded.
+func ReplayableExceptCodes(codes ...int) func(status int, body []byte) bool {
+	return func(status int, body []byte) bool {
+		if status >= http.StatusInternalServerError {
+			return false
+		}
+		resp := struct {
+			Code *int `json:"code"`
+		}{}
+		if err := json.Unmarshal(body, &resp); err != nil || resp.Code == nil {
+			return false
+		}
+		for _, code := range codes {
+			if *resp.Code == code {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func idempotencyReplay(c *gin.Context, config IdempotencyConfig, record *IdempotencyRecord, reqHash string) {
+	if record.Path != c.FullPath() || record.ReqHash != reqHash {
+		config.ErrorHandler(c, ErrIdempotencyKeyReused)
+		c.Abort()
+		return
+	}
+	c.Data(record.Status, "application/json; charset=utf-8", []byte(record.Body))
+	c.Abort()
+}
+
+// idempotencyRequestHash digests method, route, query and body; the body is restored for the handler.
+func idempotencyRequestHash(c *gin.Context) (string, error) {
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(c.Request.Body); err != nil {
+			return "", err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	data := []byte(c.Request.Method + " " + c.FullPath() + "?" + c.Request.URL.RawQuery + "\n")
+	sum := md5.Sum(append(data, body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
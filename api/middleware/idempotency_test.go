@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]*IdempotencyRecord
+	locks   map[string]bool
+}
+
+func (s *memoryIdempotencyStore) Get(c *gin.Context, key string) (*IdempotencyRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	return record, ok
+}
+
+func (s *memoryIdempotencyStore) Lock(c *gin.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[key] {
+		return false, nil
+	}
+	s.locks[key] = true
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) Unlock(c *gin.Context, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, key)
+}
+
+func (s *memoryIdempotencyStore) Save(c *gin.Context, key string, record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = record
+	return nil
+}
+
+// 0-失败 1-成功 1006-支付确认失败请重试
+func newIdempotencyRouter(responses ...gin.H) (*gin.Engine, *int) {
+	gin.SetMode(gin.TestMode)
+	store := &memoryIdempotencyStore{records: map[string]*IdempotencyRecord{}, locks: map[string]bool{}}
+	calls := 0
+	r := gin.New()
+	r.POST("/order", IdempotencyWithConfig(IdempotencyConfig{
+		Store:      store,
+		Replayable: ReplayableExceptCodes(0, 1006),
+	}), func(c *gin.Context) {
+		resp := responses[min(calls, len(responses)-1)]
+		calls++
+		c.JSON(http.StatusOK, resp)
+	})
+	return r, &calls
+}
+
+func doIdempotent(r *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyRetryAfterFailure(t *testing.T) {
+	r, calls := newIdempotencyRouter(gin.H{"code": 0, "data": "操作失败"}, gin.H{"code": 1006, "data": "请重试"}, gin.H{"code": 1, "data": "ok"})
+
+	// 失败和需重试的结果不保存, 同一个key重试时重新执行
+	if w := doIdempotent(r, "k1", "a=1"); !strings.Contains(w.Body.String(), `"code":0`) {
+		t.Fatalf("first: %s", w.Body)
+	}
+	if w := doIdempotent(r, "k1", "a=1"); !strings.Contains(w.Body.String(), `"code":1006`) {
+		t.Fatalf("second: %s", w.Body)
+	}
+	if w := doIdempotent(r, "k1", "a=1"); !strings.Contains(w.Body.String(), `"code":1,`) {
+		t.Fatalf("third: %s", w.Body)
+	}
+	if *calls != 3 {
+		t.Fatalf("calls = %d, want 3", *calls)
+	}
+
+	// 成功后重放, 不再执行
+	if w := doIdempotent(r, "k1", "a=1"); !strings.Contains(w.Body.String(), `"code":1,`) {
+		t.Fatalf("replay: %s", w.Body)
+	}
+	if *calls != 3 {
+		t.Fatalf("calls after replay = %d, want 3", *calls)
+	}
+
+	// 同一个key不能用于不同的请求
+	if w := doIdempotent(r, "k1", "a=2"); w.Code != http.StatusBadRequest {
+		t.Fatalf("reused key: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyFinalCodeReplayed(t *testing.T) {
+	// 参数错误为最终结果, 保存并重放
+	r, calls := newIdempotencyRouter(gin.H{"code": 2, "data": "参数错误"}, gin.H{"code": 1, "data": "ok"})
+	doIdempotent(r, "k2", "")
+	if w := doIdempotent(r, "k2", ""); !strings.Contains(w.Body.String(), `"code":2`) || *calls != 1 {
+		t.Fatalf("replay: %s, calls %d", w.Body, *calls)
+	}
+
+	// 没有key的请求不处理
+	req := httptest.NewRequest(http.MethodPost, "/order", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if *calls != 2 {
+		t.Fatalf("calls without key = %d, want 2", *calls)
+	}
+}
+
+func TestReplayableExceptCodes(t *testing.T) {
+	replayable := ReplayableExceptCodes(0, 1006)
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusOK, `{"code":1,"data":"ok"}`, true},
+		{http.StatusOK, `{"code":7}`, true},
+		{http.StatusOK, `{"code":0,"data":"失败"}`, false},
+		{http.StatusOK, `{"code":1006}`, false},
+		{http.StatusOK, `{"data":"ok"}`, false},
+		{http.StatusOK, `not json`, false},
+		{http.StatusBadGateway, `{"code":1}`, false},
+	} {
+		if got := replayable(tc.status, []byte(tc.body)); got != tc.want {
+			t.Errorf("replayable(%d, %s) = %v, want %v", tc.status, tc.body, got, tc.want)
+		}
+	}
+}
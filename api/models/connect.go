@@ -3,6 +3,8 @@ package models
 import (
 	"fmt"
 	"log"
+	"os"
+	"testing"
 	"time"
 
 	"github.com/spf13/viper"
@@ -35,6 +37,12 @@ func init() {
 	var err error
 	config := viper.GetStringMapString("mysql")
 	uri := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Local", config["user"], config["password"], config["host"], config["port"], config["dbname"])
+	// 测试时只连接API_TEST_MYSQL指定的测试库, 未指定时不连接, 需要数据库的测试自行跳过
+	if testing.Testing() {
+		if uri = os.Getenv("API_TEST_MYSQL"); uri == "" {
+			return
+		}
+	}
 	db, err = gorm.Open(mysql.Open(uri), &gorm.Config{
 		SkipDefaultTransaction: true,
 		Logger:                 logger,
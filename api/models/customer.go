@@ -1,7 +1,7 @@
 package models
 
 import (
-	"fmt"
+	"database/sql"
 	"time"
 
 	"gorm.io/gorm"
@@ -32,6 +32,7 @@ type UserAccount struct {
 	NewUser        bool
 	Enabled        bool
 	Deleted        bool
+	RefundConsent  bool // 同意退款时向苹果提供消费信息
 	CardTaskId     int
 	TempCardTaskId int
 	FrontUrl       string
@@ -71,40 +72,13 @@ func (c *UserAccount) IsMobileExist() error {
 	return db.Model(c).Select("id").Where("mobile = ?", c.Mobile).Take(&cusId).Error
 }
 
-// 充值时间
-func (c *UserAccount) PayEvent(event, diamond, cardTimes int) error {
-	values := make(map[string]any)
-	if diamond > 0 {
-		values["diamond"] = gorm.Expr(fmt.Sprintf("diamond + %d", diamond))
-	}
-	if cardTimes > 0 {
-		values["remain_times"] = gorm.Expr(fmt.Sprintf("remain_times + %d", cardTimes))
-	}
-	values["paid"] = true
-
-	return db.Transaction(func(tx *gorm.DB) error {
-		if len(values) > 0 {
-			if err := tx.Model(c).Updates(values).Error; err != nil {
-				return err
-			}
-		}
-
-		//插入钻石获得记录
-		if diamond > 0 {
-			record := &DiamondChangeRecord{
-				CusId:     c.ID,
-				EventId:   event,
-				Gap:       diamond,
-				Quantity:  c.Diamond + diamond,
-				CreatedAt: time.Now(),
-			}
-			if err := tx.Create(record).Error; err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
+// 最近一次购买加速的支付时间, 没有购买返回零值
+func (c *UserAccount) LastSpeedPaidAt() (time.Time, error) {
+	var paidAt sql.NullTime
+	err := db.Table("recharge_record AS a").Joins("INNER JOIN product AS b ON a.product_id = b.product_id").
+		Where("a.cus_id = ? AND a.status = ? AND b.product_type = ?", c.ID, ORDER_PAID, PRODUCT_SPEED).
+		Select("MAX(a.created_at)").Row().Scan(&paidAt)
+	return paidAt.Time, err
 }
 
 // 扣除分身次数
@@ -160,6 +134,11 @@ func (c *UserAccount) UpdateMessageId() error {
 	return db.Model(c).Update("message_id", c.MessageId).Error
 }
 
+// 更新是否同意退款时提供消费信息
+func (c *UserAccount) UpdateRefundConsent() error {
+	return db.Model(c).Update("refund_consent", c.RefundConsent).Error
+}
+
 // 分身重置
 func (c *UserAccount) ResetUserCard() error {
 	return db.Transaction(func(tx *gorm.DB) error {
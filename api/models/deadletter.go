@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	DEAD_PENDING  = 0 // 待处理
+	DEAD_REQUEUED = 1 // 已重新投递
+	DEAD_FAILED   = 2 // 已判定失败并退还
+)
+
+// 死信任务,超过投递次数仍未完成的SD任务
+type TaskDeadLetter struct {
+	ID         int       `json:"id"`
+	TaskType   int       `json:"task_type"` // 1-正面照检测 2-侧面照检测 3-Lora训练 4-分身任务 5-写真任务 6-高清
+	TaskId     int       `json:"task_id"`
+	Reason     string    `json:"reason"`
+	Tries      int       `json:"tries"`
+	Attempts   string    `json:"attempts"` // 投递记录 json
+	LastWorker string    `json:"last_worker"`
+	Status     uint8     `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// 创建
+func (d *TaskDeadLetter) Create() error {
+	return db.Create(d).Error
+}
+
+// 根据ID获取
+func (d *TaskDeadLetter) GetByID() error {
+	return db.Where("id = ?", d.ID).First(d).Error
+}
+
+// 更新状态,只处理待处理的死信
+func (d *TaskDeadLetter) UpdateStatus(status uint8) (bool, error) {
+	res := db.Model(d).Where("status = ?", DEAD_PENDING).Updates(TaskDeadLetter{Status: status, UpdatedAt: time.Now()})
+	return res.RowsAffected > 0, res.Error
+}
+
+// 死信列表 taskType=0 不限类型
+func GetDeadLetterList(taskType int, status uint8, page int) ([]TaskDeadLetter, error) {
+	list := make([]TaskDeadLetter, 0)
+	query := db.Where("status = ?", status)
+	if taskType > 0 {
+		query = query.Where("task_type = ?", taskType)
+	}
+	err := query.Order("id desc").Offset(page * PageSize).Limit(PageSize).Find(&list).Error
+	return list, err
+}
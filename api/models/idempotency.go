@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+)
+
+// 幂等请求记录, (cus_id, idem_key) 唯一索引
+type IdempotencyRecord struct {
+	ID        int
+	CusId     int
+	IdemKey   string
+	Path      string
+	ReqHash   string // 请求参数摘要, 同一个key不允许用于不同请求
+	Status    int    // http状态码
+	Body      string // 原始响应
+	CreatedAt time.Time
+}
+
+// 创建, 已存在时不覆盖
+func (r *IdempotencyRecord) Create() (bool, error) {
+	r.CreatedAt = time.Now()
+	if err := db.Create(r).Error; err != nil {
+		if isDuplicateError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// 根据用户和key获取
+func (r *IdempotencyRecord) GetByKey() error {
+	return db.Where("cus_id = ? AND idem_key = ?", r.CusId, r.IdemKey).First(r).Error
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 退款类型
+const (
+	ORDER_REFUND_REFUND = 1 // 退款
+	ORDER_REFUND_REVOKE = 2 // 撤销, 不计入退款金额
+)
+
+// 订单退款记录, order_id 唯一索引保证只处理一次
+// 用户已消耗的部分无法收回, 记录在Short*并标记Flagged, 由客服跟进
+type OrderRefund struct {
+	ID             int
+	OrderId        int
+	CusId          int
+	OrderNum       string
+	Type           int
+	Amount         float64
+	Sandbox        bool
+	Diamond        int // 收回的钻石
+	CardTimes      int // 收回的分身次数
+	ShortDiamond   int // 已消耗无法收回的钻石
+	ShortCardTimes int // 已消耗无法收回的分身次数
+	Flagged        bool
+	Reason         string
+	CreatedAt      time.Time
+}
+
+// 更新订单状态并收回发放的钻石和分身次数, 已处理过返回false
+// 未发放的订单只更新状态
+func (r *OrderRefund) Apply(order *RechargeRecord) (bool, error) {
+	status := uint8(ORDER_REFUNDED)
+	if r.Type == ORDER_REFUND_REVOKE {
+		status = ORDER_REVOKED
+	}
+
+	applied := true
+	err := db.Transaction(func(tx *gorm.DB) error {
+		r.OrderId = order.ID
+		r.CusId = order.CusId
+		r.OrderNum = order.OrderNum
+		r.Amount = order.Amount
+		r.Sandbox = order.Sandbox
+		r.CreatedAt = time.Now()
+		if err := tx.Create(r).Error; err != nil {
+			if isDuplicateError(err) {
+				applied = false
+				return nil
+			}
+			return err
+		}
+
+		paid := order.Status == ORDER_PAID
+		if err := tx.Model(order).UpdateColumn("status", status).Error; err != nil {
+			return err
+		}
+		order.Status = status
+		if !paid {
+			return nil
+		}
+
+		// 收回分身次数
+		if order.CardTimes > 0 {
+			var remainTimes int
+			if err := tx.Table("user_account").Clauses(clause.Locking{Strength: "UPDATE"}).Select("remain_times").Where("id = ?", r.CusId).Take(&remainTimes).Error; err != nil {
+				return err
+			}
+			r.CardTimes = min(order.CardTimes, max(remainTimes, 0))
+			if r.CardTimes > 0 {
+				if err := tx.Table("user_account").Where("id = ?", r.CusId).UpdateColumn("remain_times", gorm.Expr("remain_times - ?", r.CardTimes)).Error; err != nil {
+					return err
+				}
+			}
+			r.ShortCardTimes = order.CardTimes - r.CardTimes
+		}
+
+		// 收回钻石
+		if order.Diamond > 0 {
+			diamond, err := NewWallet(tx, r.CusId).Clawback(EVENT_ORDER_REFUND, r.ID, order.Diamond)
+			if err != nil {
+				return err
+			}
+			r.Diamond = diamond
+			r.ShortDiamond = order.Diamond - diamond
+		}
+
+		r.Flagged = r.ShortDiamond > 0 || r.ShortCardTimes > 0
+		if err := tx.Model(r).Select("diamond", "card_times", "short_diamond", "short_card_times", "flagged").Updates(r).Error; err != nil {
+			return err
+		}
+
+		//系统通知
+		message := &SysMessage{
+			CusId:     r.CusId,
+			Title:     "订单退款",
+			Content:   r.notice(),
+			CreatedAt: JsonDate(r.CreatedAt),
+		}
+		return tx.Create(message).Error
+	})
+	return applied && err == nil, err
+}
+
+func (r *OrderRefund) notice() string {
+	if r.Diamond > 0 && r.CardTimes > 0 {
+		return fmt.Sprintf("您的订单%s已退款，已收回%d钻石和%d次分身制作次数。", r.OrderNum, r.Diamond, r.CardTimes)
+	}
+	if r.Diamond > 0 {
+		return fmt.Sprintf("您的订单%s已退款，已收回%d钻石。", r.OrderNum, r.Diamond)
+	}
+	if r.CardTimes > 0 {
+		return fmt.Sprintf("您的订单%s已退款，已收回%d次分身制作次数。", r.OrderNum, r.CardTimes)
+	}
+	return fmt.Sprintf("您的订单%s已退款。", r.OrderNum)
+}
+
+// GetReportRefundAmount 退款金额, 不含撤销和沙盒
+// 时间范围 [start,end)
+func (r *OrderRefund) GetReportRefundAmount(start, end time.Time) (float64, error) {
+	var num float64
+	err := db.Raw(`SELECT IFNULL(SUM(amount),0) FROM order_refund WHERE type=? AND sandbox=0 AND created_at>=? AND created_at<?`, ORDER_REFUND_REFUND, start, end).Scan(&num).Error
+	return num, err
+}
@@ -1,5 +1,13 @@
 package models
 
+// 产品类型
+const (
+	PRODUCT_CARD         = 1 // 分身制作
+	PRODUCT_SPEED        = 2 // 加速
+	PRODUCT_DIAMOND      = 3 // 钻石
+	PRODUCT_SUBSCRIPTION = 4 // 自动续期订阅, Diamond为每期发放的钻石
+)
+
 type Product struct {
 	ID          int     `json:"-"`
 	ProductType uint8   `json:"product_type"`
@@ -26,6 +34,21 @@ func (p *Product) GetListByBundleId(bundleId string) ([]Product, error) {
 	return products, err
 }
 
+// 产品类型对应的钻石变动事件
+func (p *Product) PayEvent() int {
+	switch p.ProductType {
+	case PRODUCT_CARD:
+		return EVENT_PAYMENT_CARD
+	case PRODUCT_SPEED:
+		return EVENT_CARD_SPEED
+	case PRODUCT_DIAMOND:
+		return EVENT_RECHARGE_DIAMOND
+	case PRODUCT_SUBSCRIPTION:
+		return EVENT_SUBSCRIPTION
+	}
+	return 0
+}
+
 // 根据产品ID获取
 func (p *Product) GetByProductID() error {
 	return db.Where("product_id = ?", p.ProductId).First(p).Error
@@ -6,10 +6,23 @@ import (
 	"gorm.io/gorm"
 )
 
+// 订单状态
+const (
+	ORDER_PENDING  = 0 // 待确认
+	ORDER_PAID     = 1 // 已发放
+	ORDER_REFUNDED = 2 // 已退款
+	ORDER_REVOKED  = 3 // 已撤销, 如家庭共享停止
+	ORDER_FAILED   = 4 // 补单超时, 判定失败
+	ORDER_CREATED  = 5 // 第三方渠道已下单未支付, 不补单, 由确认接口或渠道通知完成
+	ORDER_TRIAL    = 6 // 订阅的免费试用期, 不发放不计入收入
+)
+
 type RechargeRecord struct {
 	ID        int
 	CusId     int
 	OrderNum  string
+	Channel   string // 支付渠道, 苹果为空
+	TransId   string // 渠道交易号, 苹果为空
 	ProductId string
 	Amount    float64
 	Diamond   int
@@ -52,6 +65,16 @@ func (c *RechargeRecord) GetByOrderNum() error {
 	return db.Where("order_num = ?", c.OrderNum).First(c).Error
 }
 
+// 根据ID获取
+func (c *RechargeRecord) GetByID() error {
+	return db.Where("id = ?", c.ID).First(c).Error
+}
+
+// 根据渠道交易号获取
+func (c *RechargeRecord) GetByTransId() error {
+	return db.Where("channel = ? AND trans_id = ?", c.Channel, c.TransId).First(c).Error
+}
+
 type RechargeReceipt struct {
 	ID      int
 	Receipt string
@@ -62,13 +85,162 @@ func (c *RechargeReceipt) Create() error {
 	return db.Create(c).Error
 }
 
+// 根据订单ID获取
+func (c *RechargeReceipt) GetByID() error {
+	return db.Where("id = ?", c.ID).First(c).Error
+}
+
+// 保存
+func (c *RechargeReceipt) Save() error {
+	return db.Save(c).Error
+}
+
+// 确认待确认或已下单的订单并发放, 状态和发放在同一事务内, 已不是这两种状态返回false
+// 发放数量使用下单时记录的钻石和分身次数, 设置了TransId时一并保存
+func (c *RechargeRecord) ConfirmPending(sandbox bool, event int) (bool, error) {
+	confirmed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		values := map[string]any{
+			"status":     ORDER_PAID,
+			"sandbox":    sandbox,
+			"updated_at": time.Now(),
+		}
+		if c.TransId != "" {
+			values["trans_id"] = c.TransId
+		}
+		res := tx.Model(c).Where("status IN ?", []uint8{ORDER_PENDING, ORDER_CREATED}).Updates(values)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		account := map[string]any{"paid": true}
+		if c.CardTimes > 0 {
+			account["remain_times"] = gorm.Expr("remain_times + ?", c.CardTimes)
+		}
+		if err := tx.Table("user_account").Where("id = ?", c.CusId).Updates(account).Error; err != nil {
+			return err
+		}
+		if c.Diamond > 0 {
+			if _, err := NewWallet(tx, c.CusId).Credit(LEDGER_RECHARGE, event, c.ID, c.Diamond); err != nil {
+				return err
+			}
+		}
+		confirmed = true
+		return nil
+	})
+	if confirmed && err == nil {
+		c.Status = ORDER_PAID
+		c.Sandbox = sandbox
+	}
+	return confirmed && err == nil, err
+}
+
+// 待确认的订单判定失败
+func (c *RechargeRecord) MarkFailed() (bool, error) {
+	res := db.Model(c).Where("status = ?", ORDER_PENDING).Updates(map[string]any{"status": ORDER_FAILED, "updated_at": time.Now()})
+	return res.RowsAffected > 0, res.Error
+}
+
+// 已下单的订单转为待确认, 由补单任务继续确认
+func (c *RechargeRecord) MarkPending() (bool, error) {
+	res := db.Model(c).Where("status = ?", ORDER_CREATED).Updates(map[string]any{"status": ORDER_PENDING, "updated_at": time.Now()})
+	if res.RowsAffected > 0 {
+		c.Status = ORDER_PENDING
+	}
+	return res.RowsAffected > 0, res.Error
+}
+
+// 失败的订单重新补单, 清除重试记录
+func (c *RechargeRecord) Reopen() (bool, error) {
+	reopened := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(c).Where("status = ?", ORDER_FAILED).Updates(map[string]any{"status": ORDER_PENDING, "updated_at": time.Now()})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		reopened = true
+		return tx.Delete(&RechargeRetry{ID: c.ID}).Error
+	})
+	return reopened && err == nil, err
+}
+
+// 补单重试记录, ID为订单ID
+type RechargeRetry struct {
+	ID        int
+	Tries     int
+	LastError string
+	NextAt    time.Time
+	UpdatedAt time.Time
+}
+
+// 记录一次失败的补单, 下次补单时间按次数翻倍
+func (r *RechargeRetry) Fail(reason string, interval, maxInterval time.Duration) error {
+	if err := db.Where("id = ?", r.ID).Take(r).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	delay := maxInterval
+	if r.Tries < 20 {
+		delay = min(interval<<r.Tries, maxInterval)
+	}
+	r.Tries++
+	r.LastError = reason
+	if len(r.LastError) > 255 {
+		r.LastError = r.LastError[:255]
+	}
+	r.UpdatedAt = time.Now()
+	r.NextAt = r.UpdatedAt.Add(delay)
+	return db.Save(r).Error
+}
+
+// 到期需补单的订单
+func GetPendingOrders(now time.Time, limit int) ([]RechargeRecord, error) {
+	orders := make([]RechargeRecord, 0)
+	err := db.Table("recharge_record AS a").Select("a.*").
+		Joins("LEFT JOIN recharge_retry AS b ON b.id = a.id").
+		Where("a.status = ? AND (b.next_at IS NULL OR b.next_at <= ?)", ORDER_PENDING, now).
+		Order("a.id asc").Limit(limit).Find(&orders).Error
+	return orders, err
+}
+
+// 补单列表项
+type RechargeOrderInfo struct {
+	ID        int        `json:"id"`
+	CusId     int        `json:"cus_id"`
+	OrderNum  string     `json:"order_num"`
+	ProductId string     `json:"product_id"`
+	Amount    float64    `json:"amount"`
+	Status    uint8      `json:"status"`
+	Tries     int        `json:"tries"`
+	LastError string     `json:"last_error"`
+	NextAt    *time.Time `json:"next_at"` // 未重试过为null
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// 待确认或失败的订单列表 cusId=0 不限用户
+func GetRechargeOrderList(status uint8, cusId, page int) ([]RechargeOrderInfo, error) {
+	list := make([]RechargeOrderInfo, 0)
+	query := db.Table("recharge_record AS a").
+		Select("a.id, a.cus_id, a.order_num, a.product_id, a.amount, a.status, IFNULL(b.tries, 0) AS tries, IFNULL(b.last_error, '') AS last_error, b.next_at, a.created_at, a.updated_at").
+		Joins("LEFT JOIN recharge_retry AS b ON b.id = a.id").
+		Where("a.status = ?", status)
+	if cusId > 0 {
+		query = query.Where("a.cus_id = ?", cusId)
+	}
+	err := query.Order("a.id desc").Offset(page * PageSize).Limit(PageSize).Scan(&list).Error
+	return list, err
+}
+
 // ******** 报表统计 **********
+// 只统计实际支付过的订单, 待确认/失败/未支付的不计入
+
+var reportPaidStatus = []uint8{ORDER_PAID, ORDER_REFUNDED, ORDER_REVOKED}
 
 // GetReportPayerNum 当日支付人数
 // 时间范围 [start,end)
 func (c *RechargeRecord) GetReportPayerNum(start, end time.Time) (int, error) {
 	var num int
-	err := db.Raw(`SELECT COUNT(1) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.sandbox=0 AND a.created_at>=? AND a.created_at<? AND a.amount > 0`, start, end).Scan(&num).Error
+	err := db.Raw(`SELECT COUNT(1) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.status IN ? AND a.sandbox=0 AND a.created_at>=? AND a.created_at<? AND a.amount > 0`, reportPaidStatus, start, end).Scan(&num).Error
 	return num, err
 }
 
@@ -76,7 +248,7 @@ func (c *RechargeRecord) GetReportPayerNum(start, end time.Time) (int, error) {
 // 时间范围 [start,end)
 func (c *RechargeRecord) GetReportPayAmount(start, end time.Time) (float64, error) {
 	var num float64
-	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.sandbox=0 AND a.created_at>=? AND a.created_at<? AND a.amount > 0`, start, end).Scan(&num).Error
+	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.status IN ? AND a.sandbox=0 AND a.created_at>=? AND a.created_at<? AND a.amount > 0`, reportPaidStatus, start, end).Scan(&num).Error
 	return num, err
 }
 
@@ -84,7 +256,7 @@ func (c *RechargeRecord) GetReportPayAmount(start, end time.Time) (float64, erro
 // 时间范围 [start,end)
 func (c *RechargeRecord) GetReportIncome() (float64, error) {
 	var num float64
-	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.sandbox=0`).Scan(&num).Error
+	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id WHERE a.status IN ? AND a.sandbox=0`, reportPaidStatus).Scan(&num).Error
 	return num, err
 }
 
@@ -92,7 +264,7 @@ func (c *RechargeRecord) GetReportIncome() (float64, error) {
 // 时间范围 [start,end)
 func (c *RechargeRecord) GetReportPayerRegNum(start, end time.Time) (int, error) {
 	var num int
-	err := db.Raw(`SELECT COUNT(1) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id INNER JOIN user_account as c ON a.cus_id=c.id WHERE a.sandbox=0 AND a.amount > 0 AND a.created_at>=? AND a.created_at<? AND c.created_at>=? AND c.created_at<?`, start, end, start, end).Scan(&num).Error
+	err := db.Raw(`SELECT COUNT(1) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id INNER JOIN user_account as c ON a.cus_id=c.id WHERE a.status IN ? AND a.sandbox=0 AND a.amount > 0 AND a.created_at>=? AND a.created_at<? AND c.created_at>=? AND c.created_at<?`, reportPaidStatus, start, end, start, end).Scan(&num).Error
 	return num, err
 }
 
@@ -100,6 +272,6 @@ func (c *RechargeRecord) GetReportPayerRegNum(start, end time.Time) (int, error)
 // 时间范围 [start,end)
 func (c *RechargeRecord) GetReportPayerRegAmount(start, end time.Time) (float64, error) {
 	var num float64
-	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id INNER JOIN user_account as c ON a.cus_id=c.id WHERE a.sandbox=0 AND a.amount > 0 AND a.created_at>=? AND a.created_at<? AND c.created_at>=? AND c.created_at<?`, start, end, start, end).Scan(&num).Error
+	err := db.Raw(`SELECT IFNULL(SUM(a.amount),0) FROM recharge_record AS a INNER JOIN product AS b ON a.product_id=b.product_id INNER JOIN user_account as c ON a.cus_id=c.id WHERE a.status IN ? AND a.sandbox=0 AND a.amount > 0 AND a.created_at>=? AND a.created_at<? AND c.created_at>=? AND c.created_at<?`, reportPaidStatus, start, end, start, end).Scan(&num).Error
 	return num, err
 }
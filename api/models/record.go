@@ -8,6 +8,9 @@ const (
 	EVENT_PAYMENT_CARD     = 3 // 充值分身制作
 	EVENT_CARD_SPEED       = 4 // 充值分身加速
 	EVENT_RECHARGE_DIAMOND = 5 // 充值钻石
+	EVENT_TASK_REFUND      = 6 // 任务失败退还
+	EVENT_ORDER_REFUND     = 7 // 订单退款收回
+	EVENT_SUBSCRIPTION     = 8 // 订阅每期发放
 )
 
 type DiamondChangeRecord struct {
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	REFUND_CARD_TIMES = 1 // 退还分身次数 RefId=分身任务ID
+	REFUND_DIAMOND    = 2 // 退还高清钻石 RefId=钻石消耗记录ID
+)
+
+// 任务失败退还记录, (ref_type, ref_id) 唯一索引保证只退还一次
+type TaskRefund struct {
+	ID        int
+	CusId     int
+	RefType   int
+	RefId     int
+	TaskType  int // 1-正面照检测 2-侧面照检测 3-Lora训练 4-分身任务 5-写真任务 6-高清
+	TaskId    int
+	Diamond   int
+	CardTimes int
+	Reason    string
+	CreatedAt time.Time
+}
+
+// 退还并通知用户, 已退还过返回false
+func (r *TaskRefund) Apply() (bool, error) {
+	refunded := true
+	err := db.Transaction(func(tx *gorm.DB) error {
+		r.CreatedAt = time.Now()
+		if err := tx.Create(r).Error; err != nil {
+			if isDuplicateError(err) {
+				refunded = false
+				return nil
+			}
+			return err
+		}
+
+		if r.CardTimes > 0 {
+			if err := tx.Table("user_account").Where("id = ?", r.CusId).UpdateColumn("remain_times", gorm.Expr("remain_times + ?", r.CardTimes)).Error; err != nil {
+				return err
+			}
+		}
+
+		//退还钻石
+		if r.Diamond > 0 {
+			if _, err := NewWallet(tx, r.CusId).Credit(LEDGER_REFUND, EVENT_TASK_REFUND, r.ID, r.Diamond); err != nil {
+				return err
+			}
+		}
+
+		//系统通知
+		message := &SysMessage{
+			CusId:     r.CusId,
+			Title:     "任务失败退还",
+			Content:   r.notice(),
+			CreatedAt: JsonDate(r.CreatedAt),
+		}
+		return tx.Create(message).Error
+	})
+	return refunded && err == nil, err
+}
+
+func (r *TaskRefund) notice() string {
+	switch r.RefType {
+	case REFUND_CARD_TIMES:
+		return fmt.Sprintf("很抱歉，您的分身制作失败，已退还%d次分身制作次数。", r.CardTimes)
+	case REFUND_DIAMOND:
+		return fmt.Sprintf("很抱歉，您的写真高清处理失败，已退还%d钻石。", r.Diamond)
+	}
+	return "很抱歉，您的任务处理失败，已退还相应消耗。"
+}
+
+// 任务最终失败时退还, 写真任务不消耗无需退还
+// taskType: 1-正面照检测 2-侧面照检测 3-Lora训练 4-分身任务 5-写真任务 6-高清
+func RefundTask(taskType, taskId int, reason string) (bool, error) {
+	switch taskType {
+	case 3:
+		return RefundCardTask(taskType, taskId, reason)
+	case 4:
+		card := &UserCardImage{ID: taskId}
+		if err := card.GetByID(); err != nil {
+			return false, err
+		}
+		return RefundCardTask(taskType, card.TaskId, reason)
+	case 6:
+		return RefundPhotoHr(taskType, taskId, reason)
+	}
+	return false, nil
+}
+
+// 分身任务失败, 退还分身次数
+func RefundCardTask(taskType, taskId int, reason string) (bool, error) {
+	var cusId int
+	err := db.Model(&UserCardTask{}).Select("cus_id").Where("id = ?", taskId).Take(&cusId).Error
+	if err != nil {
+		return false, err
+	}
+	refund := &TaskRefund{
+		CusId:     cusId,
+		RefType:   REFUND_CARD_TIMES,
+		RefId:     taskId,
+		TaskType:  taskType,
+		TaskId:    taskId,
+		CardTimes: 1,
+		Reason:    reason,
+	}
+	return refund.Apply()
+}
+
+// 高清任务失败, 退还最近一次高清消耗的钻石
+func RefundPhotoHr(taskType, photoId int, reason string) (bool, error) {
+	record := &DiamondChangeRecord{}
+	err := db.Where("record_id = ? AND event_id = ?", photoId, EVENT_PHOTO_HIGH).Order("id desc").First(record).Error
+	if err != nil {
+		return false, err
+	}
+	if record.Gap >= 0 {
+		return false, nil
+	}
+	refund := &TaskRefund{
+		CusId:    record.CusId,
+		RefType:  REFUND_DIAMOND,
+		RefId:    record.ID,
+		TaskType: taskType,
+		TaskId:   photoId,
+		Diamond:  -record.Gap,
+		Reason:   reason,
+	}
+	return refund.Apply()
+}
+
+// 唯一索引冲突
+func isDuplicateError(err error) bool {
+	return strings.Contains(err.Error(), "Duplicate entry")
+}
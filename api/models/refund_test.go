@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 同一来源只退还一次, 依赖 task_refund(ref_type, ref_id) 唯一索引
+func TestTaskRefundOnce(t *testing.T) {
+	c := newTestCustomer(t, 0)
+
+	for i, want := range []bool{true, false} {
+		refund := &TaskRefund{CusId: c.ID, RefType: REFUND_DIAMOND, RefId: c.ID, TaskType: 6, TaskId: 1, Diamond: 20, Reason: "test"}
+		refunded, err := refund.Apply()
+		if err != nil || refunded != want {
+			t.Fatalf("Apply #%d = %v, %v, want %v", i+1, refunded, err, want)
+		}
+	}
+	if got := customerDiamond(t, c); got != 20 {
+		t.Errorf("diamond = %d, want 20", got)
+	}
+}
+
+// 同一订单只收回一次, 依赖 order_refund(order_id) 唯一索引
+func TestOrderRefundOnce(t *testing.T) {
+	c := newTestCustomer(t, 0)
+	now := time.Now()
+	order := &RechargeRecord{CusId: c.ID, OrderNum: fmt.Sprintf("%d", now.UnixNano()), Diamond: 100, CardTimes: 1, CreatedAt: now, UpdatedAt: now}
+	if err := order.Create("receipt"); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed, err := order.ConfirmPending(true, EVENT_RECHARGE_DIAMOND); err != nil || !confirmed {
+		t.Fatalf("ConfirmPending = %v, %v", confirmed, err)
+	}
+	order.Status = ORDER_PAID
+	image := &UserPhotoImage{ID: order.ID}
+	if _, err := image.Download(c.ID, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	refund := &OrderRefund{Type: ORDER_REFUND_REFUND}
+	if applied, err := refund.Apply(order); err != nil || !applied {
+		t.Fatalf("Apply = %v, %v", applied, err)
+	}
+	if refund.Diamond != 70 || refund.ShortDiamond != 30 || refund.CardTimes != 1 || !refund.Flagged {
+		t.Errorf("refund = %+v, want 70 diamond, 30 short, 1 card time, flagged", refund)
+	}
+
+	// 重复通知
+	paid := &RechargeRecord{ID: order.ID, CusId: c.ID, OrderNum: order.OrderNum, Diamond: 100, CardTimes: 1, Status: ORDER_PAID}
+	if applied, err := (&OrderRefund{Type: ORDER_REFUND_REFUND}).Apply(paid); err != nil || applied {
+		t.Fatalf("second Apply = %v, %v, want false", applied, err)
+	}
+	if got := customerDiamond(t, c); got != 0 || c.RemainTimes != 0 {
+		t.Errorf("diamond = %d, remain_times = %d, want 0, 0", got, c.RemainTimes)
+	}
+}
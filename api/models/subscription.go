@@ -0,0 +1,281 @@
+package models
+
+import (
+	"time"
+
+	appstore "camera-appstore"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 订阅状态
+const (
+	SUBSCRIPTION_ACTIVE  = 1 // 有效
+	SUBSCRIPTION_GRACE   = 2 // 续费失败, 宽限期内仍有效
+	SUBSCRIPTION_EXPIRED = 3 // 已过期, 已降级
+	SUBSCRIPTION_REVOKED = 4 // 当前一期已退款或撤销
+)
+
+// 自动续期订阅, 以原始交易号为主键
+// 每一期对应recharge_record中订单号为交易号的一条订单, 付费的一期记录到subscription_period, 钻石按期发放到订单上, 退款时按订单收回
+type UserSubscription struct {
+	OriginalTransId string `gorm:"primaryKey"`
+	CusId           int
+	ProductId       string
+	TransId         string // 当前一期的交易号
+	Status          uint8
+	Trial           bool // 当前一期为免费试用, 不发放钻石
+	AutoRenew       bool // 是否自动续期
+	Sandbox         bool
+	ExpiresAt       time.Time  // 当前一期到期时间
+	GraceExpiresAt  *time.Time // 宽限期到期时间
+	Periods         int        // 已发放的付费期数
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// 订阅付费的一期, 以订单ID为主键, 免费试用期不记录
+type SubscriptionPeriod struct {
+	OrderId         int `gorm:"primaryKey;autoIncrement:false"`
+	OriginalTransId string
+	Granted         bool // 是否已发放
+	CreatedAt       time.Time
+}
+
+// 根据原始交易号获取
+func (s *UserSubscription) GetByOriginalTransId() error {
+	return db.Where("original_trans_id = ?", s.OriginalTransId).First(s).Error
+}
+
+// 按当前时间计算的状态, 已撤销的不变
+func (s *UserSubscription) state(now time.Time) uint8 {
+	if s.Status == SUBSCRIPTION_REVOKED {
+		return s.Status
+	}
+	if s.ExpiresAt.After(now) {
+		return SUBSCRIPTION_ACTIVE
+	}
+	if s.GraceExpiresAt != nil && s.GraceExpiresAt.After(now) {
+		return SUBSCRIPTION_GRACE
+	}
+	return SUBSCRIPTION_EXPIRED
+}
+
+// 同步苹果返回的最近一期交易和续期信息, 新的一期创建订单, 订阅不存在时创建并归属cusId
+// 有效期内转为过期时发送降级通知
+func SyncSubscription(cusId int, product *Product, trans *appstore.Transaction, renewal *appstore.RenewalInfo) (*UserSubscription, error) {
+	s := &UserSubscription{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("original_trans_id = ?", trans.OriginalTransactionId).Take(s).Error
+		created := err == gorm.ErrRecordNotFound
+		if created {
+			s = &UserSubscription{OriginalTransId: trans.OriginalTransactionId, CusId: cusId, CreatedAt: now}
+		} else if err != nil {
+			return err
+		}
+		prevStatus := s.Status
+
+		// 新的一期
+		expiresAt := time.UnixMilli(trans.ExpiresDate)
+		if s.TransId != trans.TransactionId && expiresAt.After(s.ExpiresAt) {
+			s.TransId = trans.TransactionId
+			s.ProductId = trans.ProductId
+			s.Trial = trans.IsTrial()
+			s.Sandbox = trans.Environment != appstore.ENV_PRODUCTION
+			s.ExpiresAt = expiresAt
+			s.GraceExpiresAt = nil
+			if s.Status == SUBSCRIPTION_REVOKED {
+				s.Status = 0
+			}
+			if err := s.createOrder(tx, product); err != nil {
+				return err
+			}
+		}
+		if trans.TransactionId == s.TransId && trans.Revoked() {
+			s.Status = SUBSCRIPTION_REVOKED
+		}
+
+		if renewal != nil && renewal.OriginalTransactionId == s.OriginalTransId {
+			s.AutoRenew = renewal.AutoRenewStatus == 1
+			s.GraceExpiresAt = nil
+			if grace := time.UnixMilli(renewal.GracePeriodExpiresDate); renewal.GracePeriodExpiresDate > 0 && grace.After(s.ExpiresAt) {
+				s.GraceExpiresAt = &grace
+			}
+		}
+
+		s.Status = s.state(now)
+		s.UpdatedAt = now
+		if created {
+			err = tx.Create(s).Error
+		} else {
+			err = tx.Save(s).Error
+		}
+		if err != nil {
+			return err
+		}
+		if s.Status == SUBSCRIPTION_EXPIRED && (prevStatus == SUBSCRIPTION_ACTIVE || prevStatus == SUBSCRIPTION_GRACE) {
+			return s.notifyExpired(tx, now)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// 当前一期的订单, 已存在时(确认接口已创建)待确认的更新为已支付, 然后记为订阅的一期
+func (s *UserSubscription) createOrder(tx *gorm.DB, product *Product) error {
+	status, amount := uint8(ORDER_PAID), product.Price
+	if s.Trial {
+		status, amount = ORDER_TRIAL, 0
+	}
+	order := &RechargeRecord{}
+	err := tx.Where("order_num = ?", s.TransId).Take(order).Error
+	if err == gorm.ErrRecordNotFound {
+		now := time.Now()
+		order = &RechargeRecord{
+			CusId:     s.CusId,
+			OrderNum:  s.TransId,
+			ProductId: s.ProductId,
+			Amount:    amount,
+			Sandbox:   s.Sandbox,
+			PayType:   product.PayType,
+			Status:    status,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		err = tx.Create(order).Error
+	} else if err == nil && order.Status == ORDER_PENDING {
+		order.Status, order.Amount = status, amount
+		err = tx.Model(order).Updates(map[string]any{
+			"status":     status,
+			"sandbox":    s.Sandbox,
+			"amount":     amount,
+			"updated_at": time.Now(),
+		}).Error
+	}
+	if err != nil {
+		return err
+	}
+	return addPeriod(tx, order, s.OriginalTransId, s.Trial)
+}
+
+// 确认接口或补单已支付的订单, 不是最近一期时由此记为订阅的一期
+func AddSubscriptionPeriod(orderId int, originalTransId string, trial bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		order := &RechargeRecord{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", orderId).Take(order).Error; err != nil {
+			return err
+		}
+		return addPeriod(tx, order, originalTransId, trial)
+	})
+}
+
+// 已支付的订单记为付费的一期, 免费试用期改为试用状态, 不发放也不计入收入
+func addPeriod(tx *gorm.DB, order *RechargeRecord, originalTransId string, trial bool) error {
+	if order.Status != ORDER_PAID {
+		return nil
+	}
+	if trial {
+		order.Status, order.Amount = ORDER_TRIAL, 0
+		return tx.Model(order).Updates(map[string]any{"status": ORDER_TRIAL, "amount": 0, "updated_at": time.Now()}).Error
+	}
+	period := &SubscriptionPeriod{OrderId: order.ID, OriginalTransId: originalTransId, CreatedAt: time.Now()}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(period).Error
+}
+
+// 发放所有已支付未发放的一期, 每期只发放一次, 钻石按该期订单的产品计算, 返回发放的总数
+func (s *UserSubscription) Grant() (int, error) {
+	granted := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("original_trans_id = ?", s.OriginalTransId).Take(s).Error; err != nil {
+			return err
+		}
+		var periods []struct {
+			OrderId int
+			Diamond int
+		}
+		err := tx.Table("subscription_period AS p").
+			Joins("INNER JOIN recharge_record AS a ON p.order_id = a.id").
+			Joins("INNER JOIN product AS b ON a.product_id = b.product_id").
+			Where("p.original_trans_id = ? AND p.granted = 0 AND a.status = ?", s.OriginalTransId, ORDER_PAID).
+			Select("p.order_id, b.diamond").Order("p.order_id asc").Scan(&periods).Error
+		if err != nil || len(periods) == 0 {
+			return err
+		}
+
+		for _, period := range periods {
+			if period.Diamond > 0 {
+				if err = tx.Table("recharge_record").Where("id = ?", period.OrderId).UpdateColumn("diamond", period.Diamond).Error; err != nil {
+					return err
+				}
+				if _, err = NewWallet(tx, s.CusId).Credit(LEDGER_RECHARGE, EVENT_SUBSCRIPTION, period.OrderId, period.Diamond); err != nil {
+					return err
+				}
+				granted += period.Diamond
+			}
+			if err = tx.Model(&SubscriptionPeriod{OrderId: period.OrderId}).UpdateColumn("granted", true).Error; err != nil {
+				return err
+			}
+		}
+		if err = tx.Table("user_account").Where("id = ?", s.CusId).UpdateColumn("paid", true).Error; err != nil {
+			return err
+		}
+		s.Periods += len(periods)
+		return tx.Model(s).Updates(map[string]any{"periods": gorm.Expr("periods + ?", len(periods)), "updated_at": time.Now()}).Error
+	})
+	return granted, err
+}
+
+// 宽限期也已结束的订阅降级为过期, 已被同步为其他状态返回false
+func (s *UserSubscription) Expire() (bool, error) {
+	expired := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(s).Where("status IN ? AND expires_at <= ? AND (grace_expires_at IS NULL OR grace_expires_at <= ?)",
+			[]uint8{SUBSCRIPTION_ACTIVE, SUBSCRIPTION_GRACE}, now, now).
+			Updates(map[string]any{"status": SUBSCRIPTION_EXPIRED, "updated_at": now})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		expired = true
+		s.Status = SUBSCRIPTION_EXPIRED
+		return s.notifyExpired(tx, now)
+	})
+	return expired && err == nil, err
+}
+
+func (s *UserSubscription) notifyExpired(tx *gorm.DB, now time.Time) error {
+	message := &SysMessage{
+		CusId:     s.CusId,
+		Title:     "订阅已过期",
+		Content:   "您的订阅已过期，续订后可继续享受每期钻石和加速特权。",
+		CreatedAt: JsonDate(now),
+	}
+	return tx.Create(message).Error
+}
+
+// 有已支付未发放的一期的订阅
+func GetUngrantedSubscriptions(limit int) ([]UserSubscription, error) {
+	list := make([]UserSubscription, 0)
+	ungranted := db.Table("subscription_period AS p").Joins("INNER JOIN recharge_record AS a ON p.order_id = a.id").
+		Where("p.granted = 0 AND a.status = ?", ORDER_PAID).Select("p.original_trans_id")
+	err := db.Where("original_trans_id IN (?)", ungranted).Limit(limit).Find(&list).Error
+	return list, err
+}
+
+// 已到期且不在宽限期内, 但还未降级的订阅
+func GetLapsedSubscriptions(now time.Time, limit int) ([]UserSubscription, error) {
+	list := make([]UserSubscription, 0)
+	err := db.Where("status IN ? AND expires_at <= ? AND (grace_expires_at IS NULL OR grace_expires_at <= ?)",
+		[]uint8{SUBSCRIPTION_ACTIVE, SUBSCRIPTION_GRACE}, now, now).
+		Order("expires_at asc").Limit(limit).Find(&list).Error
+	return list, err
+}
+
+// 用户是否有有效的订阅, 宽限期内仍算有效
+func HasActiveSubscription(cusId int) (bool, error) {
+	var count int64
+	err := db.Model(&UserSubscription{}).Where("cus_id = ? AND status IN ?", cusId, []uint8{SUBSCRIPTION_ACTIVE, SUBSCRIPTION_GRACE}).Count(&count).Error
+	return count > 0, err
+}
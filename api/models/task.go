@@ -1,10 +1,10 @@
 package models
 
 import (
-	"fmt"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserPhotoTask struct {
@@ -130,6 +130,7 @@ type UserPhotoImage struct {
 	HiresAt     int64  `json:"-"`
 	Favourite   bool   `json:"favourite"`
 	FavouriteAt int64  `json:"-"`
+	Failed      bool   `json:"failed"`
 
 	SecondGeneration bool    `json:"-"`
 	LoraWeight       float64 `json:"-"`
@@ -145,6 +146,12 @@ type UserPhotoImageWeb struct {
 	EnableHr  bool   `json:"enable_hr"`
 	Favourite bool   `json:"favourite"`
 	Hiresing  bool   `json:"hiresing"`
+	Failed    bool   `json:"failed"`
+	Rank      int    `json:"rank,omitempty"`     // 排队位置
+	Eta       int    `json:"eta,omitempty"`      // 预计完成时间(秒) P50
+	EtaMax    int    `json:"eta_max,omitempty"`  // 预计完成时间(秒) P90
+	Stage     string `json:"stage,omitempty"`    // 执行阶段
+	Progress  int    `json:"progress,omitempty"` // 执行进度 0-100
 }
 
 // 创建
@@ -174,6 +181,15 @@ func (i *UserPhotoImage) GetByTaskIDWithoutImgUrl() ([]*UserPhotoImage, error) {
 	return images, nil
 }
 
+// 用户未完成的写真和高清
+func (i *UserPhotoImage) GetUnfinishedByCusId() ([]*UserPhotoImage, error) {
+	var images []*UserPhotoImage
+	if err := db.Where("cus_id = ? AND ((down_url = '' AND failed = 0) OR (enable_hr = ? AND hr_down_url = ''))", i.CusId, true).Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
 // 更新图片
 func (i *UserPhotoImage) UpdateImageUrl() error {
 	return db.Model(i).Updates(UserPhotoImage{
@@ -184,6 +200,36 @@ func (i *UserPhotoImage) UpdateImageUrl() error {
 	}).Error
 }
 
+// 标记出图失败, 已出图的不变
+func (i *UserPhotoImage) SetFailed(failed bool) error {
+	return db.Model(i).Where("img_url = ''").UpdateColumn("failed", failed).Error
+}
+
+// 根据全部图片更新写真任务状态, 还有图片未出图也未失败时不变, 全部失败为失败, 否则为成功
+// 返回出图数, 失败数和图片总数
+func SettlePhotoTask(taskId int, reason string) (int, int, int, error) {
+	var images []*UserPhotoImage
+	if err := db.Select("img_url", "failed").Where("task_id = ?", taskId).Find(&images).Error; err != nil {
+		return 0, 0, 0, err
+	}
+	done, failed := 0, 0
+	for _, image := range images {
+		if image.ImgUrl != "" {
+			done++
+		} else if image.Failed {
+			failed++
+		}
+	}
+	if len(images) == 0 || done+failed < len(images) {
+		return done, failed, len(images), nil
+	}
+	task := &UserPhotoTask{ID: taskId}
+	if done == 0 {
+		return done, failed, len(images), task.UpdateStatus(FAILED, reason)
+	}
+	return done, failed, len(images), task.UpdateStatus(SUCCESS, "")
+}
+
 // 更新高清图片
 func (i *UserPhotoImage) UpdateHrImageUrl() error {
 	return db.Model(i).Updates(UserPhotoImage{
@@ -192,56 +238,62 @@ func (i *UserPhotoImage) UpdateHrImageUrl() error {
 	}).Error
 }
 
-// 设置高清
-func (i *UserPhotoImage) UpdateEnableHr(cusId, diamond, gap int) error {
+// 设置高清, 已开启高清返回ErrAlreadyPaid
+func (i *UserPhotoImage) UpdateEnableHr(cusId, gap int) error {
 	return db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Model(i).Updates(UserPhotoImage{
+		res := tx.Model(i).Where("enable_hr = 0").Updates(UserPhotoImage{
 			EnableHr: true,
 			HiresAt:  time.Now().Unix(),
-		}).Error; err != nil {
-			return err
-		}
-		if err := tx.Table("user_account").Where("id = ?", cusId).UpdateColumn("diamond", gorm.Expr(fmt.Sprintf("diamond - %d", gap))).Error; err != nil {
-			return err
-		}
-		//插入钻石消耗记录
-		record := &DiamondChangeRecord{
-			CusId:     cusId,
-			RecordId:  i.ID,
-			EventId:   EVENT_PHOTO_HIGH,
-			Gap:       -gap,
-			Quantity:  diamond - gap,
-			CreatedAt: time.Now(),
+		})
+		if res.Error != nil {
+			return res.Error
 		}
-		if err := tx.Create(record).Error; err != nil {
-			return err
+		if res.RowsAffected == 0 {
+			return ErrAlreadyPaid
 		}
-
-		return nil
+		//扣除钻石
+		_, err := NewWallet(tx, cusId).Debit(EVENT_PHOTO_HIGH, i.ID, gap)
+		return err
 	})
 }
 
-// 下载图片，扣钻石
-func (i *UserPhotoImage) Download(cusId, diamond, gap int) error {
-	return db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Table("user_account").Where("id = ?", cusId).UpdateColumn("diamond", gorm.Expr(fmt.Sprintf("diamond - %d", gap))).Error; err != nil {
+// 下载图片，扣钻石, 已付费过的图片不再扣除
+func (i *UserPhotoImage) Download(cusId, gap int) (bool, error) {
+	charged := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		//锁定用户, 避免并发重复扣除
+		var id int
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Table("user_account").Select("id").Where("id = ?", cusId).Take(&id).Error; err != nil {
 			return err
 		}
-		//插入钻石消耗记录
-		record := &DiamondChangeRecord{
-			CusId:     cusId,
-			RecordId:  i.ID,
-			EventId:   EVENT_PHOTO_DOWNLOAD,
-			Gap:       -gap,
-			Quantity:  diamond - gap,
-			CreatedAt: time.Now(),
-		}
-		if err := tx.Create(record).Error; err != nil {
+		var count int64
+		if err := tx.Model(&DiamondChangeRecord{}).Where("cus_id = ? AND record_id = ? AND event_id = ?", cusId, i.ID, EVENT_PHOTO_DOWNLOAD).Count(&count).Error; err != nil {
 			return err
 		}
+		if count > 0 {
+			return nil
+		}
 
+		//扣除钻石
+		if _, err := NewWallet(tx, cusId).Debit(EVENT_PHOTO_DOWNLOAD, i.ID, gap); err != nil {
+			return err
+		}
+		charged = true
 		return nil
 	})
+	return charged && err == nil, err
+}
+
+// 设置高清状态(死信处理)
+func (i *UserPhotoImage) SetEnableHr(enable bool) error {
+	hiresAt := int64(0)
+	if enable {
+		hiresAt = time.Now().Unix()
+	}
+	return db.Model(i).Select("enable_hr", "hires_at").Updates(UserPhotoImage{
+		EnableHr: enable,
+		HiresAt:  hiresAt,
+	}).Error
 }
 
 // 设置收藏
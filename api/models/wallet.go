@@ -0,0 +1,217 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// 钻石不足
+	ErrDiamondNotEnough = errors.New("diamond not enough")
+	// 已付费
+	ErrAlreadyPaid = errors.New("already paid")
+)
+
+// 账本科目
+const (
+	LEDGER_USER     = "user"     // 用户钻石余额
+	LEDGER_OPENING  = "opening"  // 期初余额
+	LEDGER_RECHARGE = "recharge" // 充值发放
+	LEDGER_CONSUME  = "consume"  // 消费回收
+	LEDGER_REFUND   = "refund"   // 失败退还
+	LEDGER_CLAWBACK = "clawback" // 订单退款收回
+)
+
+// 钻石账本分录, 同一笔交易的分录金额合计为0
+type DiamondLedger struct {
+	ID        int
+	TxId      int    // 交易ID, 取该笔交易第一条分录的ID
+	CusId     int    // 用户ID
+	Account   string // 科目
+	EventId   int
+	RecordId  int
+	Amount    int // 借方为负, 贷方为正
+	CreatedAt time.Time
+}
+
+// 用户钻石钱包, 所有余额变动必须在事务内通过钱包完成
+type Wallet struct {
+	tx    *gorm.DB
+	CusId int
+}
+
+func NewWallet(tx *gorm.DB, cusId int) *Wallet {
+	return &Wallet{tx: tx, CusId: cusId}
+}
+
+// 扣除钻石, 余额不足返回ErrDiamondNotEnough
+func (w *Wallet) Debit(event, recordId, amount int) (*DiamondChangeRecord, error) {
+	res := w.tx.Table("user_account").Where("id = ? AND diamond >= ?", w.CusId, amount).
+		UpdateColumn("diamond", gorm.Expr("diamond - ?", amount))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrDiamondNotEnough
+	}
+	return w.post(LEDGER_CONSUME, event, recordId, -amount)
+}
+
+// 增加钻石
+func (w *Wallet) Credit(account string, event, recordId, amount int) (*DiamondChangeRecord, error) {
+	res := w.tx.Table("user_account").Where("id = ?", w.CusId).
+		UpdateColumn("diamond", gorm.Expr("diamond + ?", amount))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return w.post(account, event, recordId, amount)
+}
+
+// 收回钻石, 最多收回当前余额, 返回实际收回的数量
+func (w *Wallet) Clawback(event, recordId, amount int) (int, error) {
+	var diamond int
+	if err := w.tx.Table("user_account").Clauses(clause.Locking{Strength: "UPDATE"}).Select("diamond").Where("id = ?", w.CusId).Take(&diamond).Error; err != nil {
+		return 0, err
+	}
+	if amount = min(amount, diamond); amount <= 0 {
+		return 0, nil
+	}
+	if err := w.tx.Table("user_account").Where("id = ?", w.CusId).UpdateColumn("diamond", gorm.Expr("diamond - ?", amount)).Error; err != nil {
+		return 0, err
+	}
+	if _, err := w.post(LEDGER_CLAWBACK, event, recordId, -amount); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// 记账: 用户科目和对方科目各一条分录, 并写入钻石变动记录
+func (w *Wallet) post(account string, event, recordId, amount int) (*DiamondChangeRecord, error) {
+	var diamond int
+	if err := w.tx.Table("user_account").Select("diamond").Where("id = ?", w.CusId).Take(&diamond).Error; err != nil {
+		return nil, err
+	}
+	if err := w.open(diamond - amount); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := w.entries(account, event, recordId, amount, now); err != nil {
+		return nil, err
+	}
+
+	record := &DiamondChangeRecord{
+		CusId:     w.CusId,
+		RecordId:  recordId,
+		EventId:   event,
+		Gap:       amount,
+		Quantity:  diamond,
+		CreatedAt: now,
+	}
+	if err := w.tx.Create(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// 首次记账时补录期初余额
+func (w *Wallet) open(balance int) error {
+	var count int64
+	if err := w.tx.Model(&DiamondLedger{}).Where("cus_id = ? AND account = ?", w.CusId, LEDGER_USER).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 || balance == 0 {
+		return nil
+	}
+	return w.entries(LEDGER_OPENING, 0, 0, balance, time.Now())
+}
+
+func (w *Wallet) entries(account string, event, recordId, amount int, now time.Time) error {
+	user := &DiamondLedger{CusId: w.CusId, Account: LEDGER_USER, EventId: event, RecordId: recordId, Amount: amount, CreatedAt: now}
+	if err := w.tx.Create(user).Error; err != nil {
+		return err
+	}
+	if err := w.tx.Model(user).UpdateColumn("tx_id", user.ID).Error; err != nil {
+		return err
+	}
+	other := &DiamondLedger{TxId: user.ID, CusId: w.CusId, Account: account, EventId: event, RecordId: recordId, Amount: -amount, CreatedAt: now}
+	return w.tx.Create(other).Error
+}
+
+// 订单发放钻石后的净消耗(消费减失败退还), 购买后的消耗优先计入该订单, 最多为订单的钻石数
+// 未发放的订单返回0
+func OrderSpentDiamond(order *RechargeRecord) (int, error) {
+	if order.Diamond <= 0 {
+		return 0, nil
+	}
+	credit := &DiamondLedger{}
+	err := db.Where("cus_id = ? AND account = ? AND record_id = ?", order.CusId, LEDGER_RECHARGE, order.ID).First(credit).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var spent sql.NullInt64
+	err = db.Model(&DiamondLedger{}).Select("SUM(amount)").
+		Where("cus_id = ? AND account IN ? AND id > ?", order.CusId, []string{LEDGER_CONSUME, LEDGER_REFUND}, credit.ID).
+		Row().Scan(&spent)
+	if err != nil {
+		return 0, err
+	}
+	return min(max(int(spent.Int64), 0), order.Diamond), nil
+}
+
+// 对账差异
+type WalletDrift struct {
+	ID        int
+	CusId     int
+	Diamond   int // 账户余额
+	Ledger    int // 账本余额
+	Drift     int // 账户余额 - 账本余额
+	Repdate   string
+	CreatedAt time.Time
+}
+
+// 创建
+func (d *WalletDrift) Create() error {
+	return db.Create(d).Error
+}
+
+// 账户余额与账本不一致的用户, 只检查已有账本的用户
+func GetWalletDrifts() ([]WalletDrift, error) {
+	rows, err := db.Table("user_account").
+		Select("user_account.id, user_account.diamond, SUM(diamond_ledger.amount)").
+		Joins("inner join diamond_ledger on diamond_ledger.cus_id = user_account.id AND diamond_ledger.account = ?", LEDGER_USER).
+		Group("user_account.id").Having("user_account.diamond <> SUM(diamond_ledger.amount)").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drifts := make([]WalletDrift, 0)
+	for rows.Next() {
+		d := WalletDrift{}
+		if err = rows.Scan(&d.CusId, &d.Diamond, &d.Ledger); err != nil {
+			return nil, err
+		}
+		d.Drift = d.Diamond - d.Ledger
+		drifts = append(drifts, d)
+	}
+	return drifts, rows.Err()
+}
+
+// 不平衡的交易数量
+func GetUnbalancedLedgerCount() (int64, error) {
+	var count int64
+	err := db.Table("(?) as t", db.Model(&DiamondLedger{}).Select("tx_id").Group("tx_id").Having("SUM(amount) <> 0")).Count(&count).Error
+	return count, err
+}
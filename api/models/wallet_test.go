@@ -0,0 +1,89 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 需要按 api/sql/upgrade.sql 升级过的MySQL测试库, 如:
+// API_TEST_MYSQL='root:@tcp(127.0.0.1:3306)/camera_test?parseTime=true&loc=Local' go test ./models/
+func newTestCustomer(t *testing.T, diamond int) *UserAccount {
+	t.Helper()
+	if db == nil {
+		t.Skip("API_TEST_MYSQL not set")
+	}
+	now := time.Now()
+	c := &UserAccount{Mobile: fmt.Sprintf("t%d", now.UnixNano()), Diamond: diamond, CreatedAt: now}
+	if err := c.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func customerDiamond(t *testing.T, c *UserAccount) int {
+	t.Helper()
+	if err := c.GetByID(); err != nil {
+		t.Fatal(err)
+	}
+	return c.Diamond
+}
+
+func TestWalletBalance(t *testing.T) {
+	c := newTestCustomer(t, 50)
+
+	for _, tc := range []struct {
+		name  string
+		post  func(w *Wallet) (int, error)
+		want  int
+		taken int // 实际收回
+		err   error
+	}{
+		{"credit", func(w *Wallet) (int, error) {
+			_, err := w.Credit(LEDGER_RECHARGE, EVENT_RECHARGE_DIAMOND, 1, 100)
+			return 0, err
+		}, 150, 0, nil},
+		{"debit", func(w *Wallet) (int, error) {
+			_, err := w.Debit(EVENT_PHOTO_HIGH, 2, 30)
+			return 0, err
+		}, 120, 0, nil},
+		{"debit not enough", func(w *Wallet) (int, error) {
+			_, err := w.Debit(EVENT_PHOTO_HIGH, 3, 500)
+			return 0, err
+		}, 120, 0, ErrDiamondNotEnough},
+		{"clawback more than balance", func(w *Wallet) (int, error) {
+			return w.Clawback(EVENT_ORDER_REFUND, 4, 200)
+		}, 0, 120, nil},
+	} {
+		var taken int
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			taken, err = tc.post(NewWallet(tx, c.ID))
+			return err
+		})
+		if err != tc.err {
+			t.Fatalf("%s: err = %v, want %v", tc.name, err, tc.err)
+		}
+		if got := customerDiamond(t, c); got != tc.want {
+			t.Errorf("%s: diamond = %d, want %d", tc.name, got, tc.want)
+		}
+		if taken != tc.taken {
+			t.Errorf("%s: clawed back %d, want %d", tc.name, taken, tc.taken)
+		}
+	}
+
+	// 期初余额补录后, 用户科目合计等于账户余额, 每笔交易借贷平衡
+	var opening, balance int
+	db.Model(&DiamondLedger{}).Select("IFNULL(SUM(amount),0)").Where("cus_id = ? AND account = ?", c.ID, LEDGER_OPENING).Row().Scan(&opening)
+	db.Model(&DiamondLedger{}).Select("IFNULL(SUM(amount),0)").Where("cus_id = ? AND account = ?", c.ID, LEDGER_USER).Row().Scan(&balance)
+	if opening != -50 || balance != 0 {
+		t.Errorf("ledger opening = %d, user = %d, want -50, 0", opening, balance)
+	}
+	var unbalanced int64
+	db.Table("(?) as t", db.Model(&DiamondLedger{}).Select("tx_id").Where("cus_id = ?", c.ID).Group("tx_id").Having("SUM(amount) <> 0")).Count(&unbalanced)
+	if unbalanced != 0 {
+		t.Errorf("%d unbalanced transactions", unbalanced)
+	}
+}
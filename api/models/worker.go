@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+// worker凭证, 用于任务分发和回调接口的签名校验
+type WorkerKey struct {
+	ID        int       `json:"id"`
+	WorkerId  string    `json:"worker_id"` // 唯一
+	Secret    string    `json:"-"`
+	Remark    string    `json:"remark"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 创建
+func (k *WorkerKey) Create() error {
+	return db.Create(k).Error
+}
+
+// 根据WorkerId获取可用凭证
+func (k *WorkerKey) GetByWorkerId() error {
+	return db.Where("worker_id = ? AND enabled = ?", k.WorkerId, true).First(k).Error
+}
+
+// 吊销
+func (k *WorkerKey) Revoke() (bool, error) {
+	res := db.Model(&WorkerKey{}).Where("worker_id = ? AND enabled = ?", k.WorkerId, true).
+		Updates(map[string]any{"enabled": false, "updated_at": time.Now()})
+	return res.RowsAffected > 0, res.Error
+}
+
+// 凭证列表
+func GetWorkerKeyList() ([]WorkerKey, error) {
+	list := make([]WorkerKey, 0)
+	err := db.Order("id desc").Find(&list).Error
+	return list, err
+}
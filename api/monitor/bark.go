@@ -32,6 +32,9 @@ const (
 	WEBUI
 	ORDER_PAY
 	CARD_LORA
+	WALLET_DRIFT
+	WORKER_OFFLINE
+	ORDER_REFUND
 )
 
 var (
@@ -26,6 +26,9 @@ func Center(r *gin.Engine) {
 	// 钻石变动记录
 	center.GET("/diamond", controllers.CheckLogin, controllers.DiamondChangeRecord)
 
+	// 退款时提供消费信息的授权
+	center.POST("/refund_consent", controllers.CheckLogin, controllers.RefundConsent)
+
 	// 上报基础数据(首次启动APP)
 	// center.POST("/bai", controllers.ReportBaseApp, controllers.CheckLogin)
 }
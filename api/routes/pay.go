@@ -12,5 +12,18 @@ func Pay(r *gin.Engine) {
 	// 苹果支付
 	appstore := r.Group("/api/appstore", middleware.JWT([]byte(lib.JwtKey)))
 	// 支付
-	appstore.POST("/confirm", controllers.CheckLogin, controllers.AppStoreConfirm)
+	appstore.POST("/confirm", controllers.CheckLogin, controllers.Idempotent, controllers.AppStoreConfirm)
+
+	// 苹果服务器通知, 签名在接口内校验
+	r.POST("/api/appstore/notify", controllers.AppStoreNotify)
+
+	// 第三方支付 googleplay wechat alipay
+	pay := r.Group("/api/pay", middleware.JWT([]byte(lib.JwtKey)))
+	// 下单
+	pay.POST("/:provider/create", controllers.CheckLogin, controllers.Idempotent, controllers.PayCreate)
+	// 支付完成后确认
+	pay.POST("/:provider/confirm", controllers.CheckLogin, controllers.Idempotent, controllers.PayConfirm)
+
+	// 渠道通知, 签名在接口内校验
+	r.POST("/api/pay/:provider/notify", controllers.PayNotify)
 }
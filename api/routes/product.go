@@ -13,7 +13,4 @@ func Product(r *gin.Engine) {
 
 	// 产品列表
 	product.GET("/list", controllers.ProductList)
-
-	// 支付
-	product.POST("/pay", controllers.CheckLogin, controllers.UserProductPay)
 }
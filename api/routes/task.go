@@ -43,28 +43,41 @@ func Task(r *gin.Engine) {
 	*/
 	task := r.Group("/api/task", middleware.JWT([]byte(lib.JwtKey)))
 	// 创建写真任务
-	task.POST("/create", controllers.CheckLogin, controllers.CreatePhotoTask)
+	task.POST("/create", controllers.CheckLogin, controllers.Idempotent, controllers.CreatePhotoTask)
 	// 查看写真任务状态
 	task.GET("/status", controllers.CheckLogin, controllers.GetPhotoStatus)
 	// 写真列表
 	task.GET("/history", controllers.CheckLogin, controllers.GetPhotoHistory)
 	// 高清处理
-	task.POST("/higher", controllers.CheckLogin, controllers.PhotoImageHigher)
+	task.POST("/higher", controllers.CheckLogin, controllers.Idempotent, controllers.PhotoImageHigher)
 	// 删除写真
 	task.POST("/remove", controllers.CheckLogin, controllers.DeletePhotoTask)
 	// 收藏
 	task.POST("/favorite", controllers.CheckLogin, controllers.PhotoImageFavorite)
 	// 我的收藏
 	task.GET("/favorite", controllers.CheckLogin, controllers.MyPhotoFavorite)
-	// 下载
+	// 下载, 每次返回新的限时链接, 已付费的图片不重复扣费, 不做幂等重放
 	task.GET("/download", controllers.CheckLogin, controllers.DownloadPhotoImage)
 	// 分享
 	task.GET("/share", controllers.CheckLogin, controllers.SharePhotoImage)
+	// 撤销分享
+	task.POST("/share/revoke", controllers.CheckLogin, controllers.RevokeShare)
+	// 任务事件推送(分身,写真,高清)
+	task.GET("/events", controllers.CheckLogin, controllers.TaskEvents)
+
+	/**
+	========== 下载和分享链接 ==========
+	*/
+	file := r.Group("/api/file")
+	// 限时下载
+	file.GET("/download/:token", controllers.ServeDownload)
+	// 分享
+	file.GET("/share/:id", controllers.ServeShare)
 
 	/**
 	========== 任务分发 ==========
 	*/
-	work := r.Group("/api/work")
+	work := r.Group("/api/work", controllers.CheckWorker)
 	// 照片识别
 	work.GET("/recognize", controllers.GetPhotoRecognizeTask)
 	// Lora模型训练
@@ -73,18 +86,26 @@ func Task(r *gin.Engine) {
 	work.GET("/photo", controllers.GetPhotoTask)
 	// 写真高清
 	work.GET("/photohr", controllers.GetPhotoHrTask)
+	// 执行进度上报
+	work.POST("/progress", controllers.ReportTaskProgress)
+	// 查询已取消的任务
+	work.POST("/cancel", controllers.GetCanceledTasks)
+	// 节点注册
+	work.POST("/register", controllers.RegisterWorker)
+	// 节点心跳
+	work.POST("/heartbeat", controllers.WorkerHeartbeat)
 
 	/**
 	========== 任务上报 ==========
 	*/
 	// 照片识别上报
-	r.POST("/api/recognize/callback", controllers.ReportPhotoRecognizeTask)
+	r.POST("/api/recognize/callback", controllers.CheckWorker, controllers.ReportPhotoRecognizeTask)
 	// Lora模型上报
-	r.POST("/api/lora/callback", controllers.ReportLoraTask)
+	r.POST("/api/lora/callback", controllers.CheckWorker, controllers.ReportLoraTask)
 	// 分身图片上报
-	r.POST("/api/card/callback", controllers.ReportCardTask)
+	r.POST("/api/card/callback", controllers.CheckWorker, controllers.ReportCardTask)
 	// 写真上报
-	r.POST("/api/photo/callback", controllers.ReportPhotoTask)
+	r.POST("/api/photo/callback", controllers.CheckWorker, controllers.ReportPhotoTask)
 	// 写真上报
-	r.POST("/api/photohr/callback", controllers.ReportPhotoHrTask)
+	r.POST("/api/photohr/callback", controllers.CheckWorker, controllers.ReportPhotoHrTask)
 }
@@ -9,4 +9,43 @@ import (
 func Web(r *gin.Engine) {
 	// 刷缓存
 	r.GET("/api/cache_refresh", controllers.CacheRefresh)
+
+	/**
+	========== 死信任务 ==========
+	*/
+	dead := r.Group("/api/admin/deadletter", controllers.CheckWebToken)
+	// 死信列表
+	dead.GET("/list", controllers.DeadLetterList)
+	// 死信详情
+	dead.GET("/info", controllers.DeadLetterInfo)
+	// 重新投递
+	dead.POST("/requeue", controllers.DeadLetterRequeue)
+	// 判定失败并退还
+	dead.POST("/fail", controllers.DeadLetterFail)
+
+	/**
+	========== 补单 ==========
+	*/
+	order := r.Group("/api/admin/order", controllers.CheckWebToken)
+	// 待确认和补单失败的订单
+	order.GET("/list", controllers.RechargeOrderList)
+	// 补单失败的订单重新补单
+	order.POST("/retry", controllers.RechargeOrderRetry)
+	// 第三方渠道订单退款
+	order.POST("/refund", controllers.PayRefund)
+
+	/**
+	========== worker凭证 ==========
+	*/
+	worker := r.Group("/api/admin/worker", controllers.CheckWebToken)
+	// 凭证列表及上报统计
+	worker.GET("/list", controllers.WorkerKeyList)
+	// 签发
+	worker.POST("/issue", controllers.WorkerKeyIssue)
+	// 吊销
+	worker.POST("/revoke", controllers.WorkerKeyRevoke)
+	// 节点列表
+	worker.GET("/nodes", controllers.WorkerNodeList)
+	// 移除节点
+	worker.POST("/nodes/remove", controllers.WorkerNodeRemove)
 }
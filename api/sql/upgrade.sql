@@ -0,0 +1,157 @@
+-- 在现有库上按顺序执行, 新建的测试库先导入线上表结构再执行本文件
+-- 退还、退款、幂等请求只处理一次依赖这里的唯一索引, 缺少时会重复发放或收回
+
+-- 死信任务
+CREATE TABLE task_dead_letter (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  task_type int NOT NULL,
+  task_id int NOT NULL,
+  reason varchar(255) NOT NULL DEFAULT '',
+  tries int NOT NULL DEFAULT 0,
+  attempts text NOT NULL,
+  last_worker varchar(64) NOT NULL DEFAULT '',
+  status tinyint NOT NULL DEFAULT 0,
+  created_at datetime NOT NULL,
+  updated_at datetime NOT NULL,
+  KEY idx_status_type (status, task_type)
+);
+
+-- 任务失败退还, (ref_type, ref_id) 保证只退还一次
+CREATE TABLE task_refund (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  cus_id int NOT NULL,
+  ref_type int NOT NULL,
+  ref_id int NOT NULL,
+  task_type int NOT NULL,
+  task_id int NOT NULL,
+  diamond int NOT NULL DEFAULT 0,
+  card_times int NOT NULL DEFAULT 0,
+  reason varchar(255) NOT NULL DEFAULT '',
+  created_at datetime NOT NULL,
+  UNIQUE KEY uk_ref (ref_type, ref_id),
+  KEY idx_cus_id (cus_id)
+);
+
+ALTER TABLE user_photo_image
+  ADD COLUMN failed tinyint(1) NOT NULL DEFAULT 0;
+
+-- 钻石账本, 分录只追加
+-- 重复发放和收回由来源记录保证: 订单状态, task_refund, order_refund, subscription_period
+CREATE TABLE diamond_ledger (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  tx_id int NOT NULL DEFAULT 0,
+  cus_id int NOT NULL,
+  account varchar(16) NOT NULL,
+  event_id int NOT NULL DEFAULT 0,
+  record_id int NOT NULL DEFAULT 0,
+  amount int NOT NULL,
+  created_at datetime NOT NULL,
+  KEY idx_cus_account (cus_id, account, record_id),
+  KEY idx_tx_id (tx_id)
+);
+
+CREATE TABLE wallet_drift (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  cus_id int NOT NULL,
+  diamond int NOT NULL,
+  ledger int NOT NULL,
+  drift int NOT NULL,
+  repdate varchar(10) NOT NULL,
+  created_at datetime NOT NULL,
+  KEY idx_repdate (repdate)
+);
+
+INSERT INTO events (id, event_name) VALUES
+  (6, '任务失败退还'),
+  (7, '订单退款收回'),
+  (8, '订阅每期发放');
+
+-- 幂等请求, (cus_id, idem_key) 保证只执行一次
+CREATE TABLE idempotency_record (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  cus_id int NOT NULL,
+  idem_key varchar(64) NOT NULL,
+  path varchar(128) NOT NULL,
+  req_hash varchar(64) NOT NULL,
+  status int NOT NULL,
+  body mediumtext NOT NULL,
+  created_at datetime NOT NULL,
+  UNIQUE KEY uk_cus_key (cus_id, idem_key)
+);
+
+-- worker凭证
+CREATE TABLE worker_key (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  worker_id varchar(64) NOT NULL,
+  secret varchar(128) NOT NULL,
+  remark varchar(255) NOT NULL DEFAULT '',
+  enabled tinyint(1) NOT NULL DEFAULT 1,
+  created_at datetime NOT NULL,
+  updated_at datetime NOT NULL,
+  UNIQUE KEY uk_worker_id (worker_id)
+);
+
+-- 订单退款, order_id 保证只收回一次
+CREATE TABLE order_refund (
+  id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  order_id int NOT NULL,
+  cus_id int NOT NULL,
+  order_num varchar(64) NOT NULL,
+  type tinyint NOT NULL,
+  amount decimal(10,2) NOT NULL DEFAULT 0,
+  sandbox tinyint(1) NOT NULL DEFAULT 0,
+  diamond int NOT NULL DEFAULT 0,
+  card_times int NOT NULL DEFAULT 0,
+  short_diamond int NOT NULL DEFAULT 0,
+  short_card_times int NOT NULL DEFAULT 0,
+  flagged tinyint(1) NOT NULL DEFAULT 0,
+  reason varchar(255) NOT NULL DEFAULT '',
+  created_at datetime NOT NULL,
+  UNIQUE KEY uk_order_id (order_id),
+  KEY idx_created_at (created_at)
+);
+
+-- 补单重试, id为recharge_record.id
+CREATE TABLE recharge_retry (
+  id int NOT NULL PRIMARY KEY,
+  tries int NOT NULL DEFAULT 0,
+  last_error varchar(255) NOT NULL DEFAULT '',
+  next_at datetime NOT NULL,
+  updated_at datetime NOT NULL
+);
+
+ALTER TABLE recharge_record
+  ADD COLUMN channel varchar(16) NOT NULL DEFAULT '',
+  ADD COLUMN trans_id varchar(64) NOT NULL DEFAULT '',
+  ADD INDEX idx_channel_trans (channel, trans_id);
+
+-- 自动续期订阅
+CREATE TABLE user_subscription (
+  original_trans_id varchar(64) NOT NULL PRIMARY KEY,
+  cus_id int NOT NULL,
+  product_id varchar(64) NOT NULL,
+  trans_id varchar(64) NOT NULL,
+  status tinyint NOT NULL DEFAULT 0,
+  trial tinyint(1) NOT NULL DEFAULT 0,
+  auto_renew tinyint(1) NOT NULL DEFAULT 0,
+  sandbox tinyint(1) NOT NULL DEFAULT 0,
+  expires_at datetime NOT NULL,
+  grace_expires_at datetime NULL,
+  periods int NOT NULL DEFAULT 0,
+  created_at datetime NOT NULL,
+  updated_at datetime NOT NULL,
+  KEY idx_cus_id (cus_id),
+  KEY idx_status_expires (status, expires_at)
+);
+
+-- 订阅付费的一期, order_id 保证每期只发放一次
+CREATE TABLE subscription_period (
+  order_id int NOT NULL PRIMARY KEY,
+  original_trans_id varchar(64) NOT NULL,
+  granted tinyint(1) NOT NULL DEFAULT 0,
+  created_at datetime NOT NULL,
+  KEY idx_original_granted (original_trans_id, granted)
+);
+
+ALTER TABLE user_account
+  ADD COLUMN refund_consent tinyint(1) NOT NULL DEFAULT 0;
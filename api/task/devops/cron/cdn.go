@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
@@ -18,8 +17,6 @@ import (
 var (
 	logOps = logger.New("logs/devops.log")
 
-	noCDNFile = "no such file or directory"
-
 	emptySleep = time.Second * 10
 	errorSleep = time.Second * 60
 
@@ -101,14 +98,12 @@ func runCDNDelete(images []string) {
 		if url == "" {
 			continue
 		}
-		if !strings.HasPrefix(url, "http") {
+		ok, err := lib.DeleteFile(url)
+		if !ok {
 			logOps.Warnf("invalid url: %s", url)
 			continue
 		}
-
-		suburl := url[10:]
-		err := lib.DeleteQNCDN(suburl[strings.Index(suburl, "/")+1:])
-		if err != nil && err.Error() != noCDNFile {
+		if err != nil {
 			logOps.Errorf("[CDN] delete image: %s failed: %s", url, err)
 		}
 	}
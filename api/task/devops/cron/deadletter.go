@@ -0,0 +1,71 @@
+package cron
+
+import (
+	"time"
+
+	"camera/lib"
+	"camera/models"
+)
+
+// 超过投递次数的任务移入死信,标记所属任务失败
+// 不在此退还: 后台可能重新投递, 由后台判定失败时退还
+func deadLetter(queue *lib.Queue, task lib.DeadTask, reason string) error {
+	letter := &models.TaskDeadLetter{
+		TaskType:  queue.TaskType,
+		TaskId:    task.TaskID,
+		Reason:    reason,
+		Tries:     len(task.Attempts),
+		Status:    models.DEAD_PENDING,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if len(task.Attempts) > 0 {
+		letter.LastWorker = task.Attempts[len(task.Attempts)-1].Worker
+	}
+	attempts, err := json.MarshalToString(task.Attempts)
+	if err != nil {
+		return err
+	}
+	letter.Attempts = attempts
+	if err = letter.Create(); err != nil {
+		return err
+	}
+
+	return failOwnerTask(queue.TaskType, task.TaskID, reason)
+}
+
+// 标记所属任务失败,客户端停止轮询
+func failOwnerTask(taskType, taskId int, reason string) error {
+	switch taskType {
+	case lib.REC_FRONT:
+		front := &models.UserFrontImage{ID: taskId}
+		return front.UpdateStatus(4)
+	case lib.REC_SIDE:
+		input := &models.UserInputImage{ID: taskId}
+		return input.UpdateStatus(4)
+	case lib.REC_LORA:
+		task := &models.UserCardTask{ID: taskId}
+		return task.UpdateStatus(models.FAILED, reason)
+	case lib.REC_CARD:
+		card := &models.UserCardImage{ID: taskId}
+		if err := card.GetByID(); err != nil {
+			return err
+		}
+		task := &models.UserCardTask{ID: card.TaskId}
+		return task.UpdateStatus(models.FAILED, reason)
+	case lib.REC_PHOTO:
+		photo := &models.UserPhotoImage{ID: taskId}
+		if err := photo.GetByID(); err != nil {
+			return err
+		}
+		if err := photo.SetFailed(true); err != nil {
+			return err
+		}
+		_, _, _, err := models.SettlePhotoTask(photo.TaskId, reason)
+		return err
+	case lib.REC_HR:
+		photo := &models.UserPhotoImage{ID: taskId}
+		return photo.SetEnableHr(false)
+	}
+	return nil
+}
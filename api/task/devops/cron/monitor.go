@@ -2,6 +2,7 @@ package cron
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,7 +15,7 @@ func MonitorSDTask(ctx context.Context, ws *sync.WaitGroup) {
 	defer ws.Done()
 
 	wcs := new(sync.WaitGroup)
-	ticker := time.NewTicker(time.Minute * 2)
+	ticker := time.NewTicker(time.Second * 30)
 
 	for {
 		select {
@@ -29,64 +30,64 @@ func MonitorSDTask(ctx context.Context, ws *sync.WaitGroup) {
 	}
 }
 
+// 回收超时租约
 func runMonitor(wcs *sync.WaitGroup) {
 	defer wcs.Done()
 
-	kv, err := lib.GetTaskRecords()
-	if err != nil {
-		if err.Error() != lib.RedisNull {
-			logOps.Errorf("[Redis] get task records failed: %v", err)
-		}
-		return
-	}
+	checkWorkerNodes()
 
 	hasbark := false
-	now := time.Now().Unix()
-	for k, v := range kv {
-		record := &lib.TaskRecord{}
-		if err = json.UnmarshalFromString(v, record); err != nil {
-			logOps.Errorf("[Redis] unmarshal task record failed: %v", err)
+	for _, queue := range lib.TaskQueues {
+		requeued, dropped, err := queue.Requeue()
+		if err != nil {
+			logOps.Errorf("[Redis] requeue task type: %d failed: %v", queue.TaskType, err)
 			continue
 		}
 
-		if record.ExpiredAt > 0 && record.ExpiredAt < now {
-			if record.TryTimes >= 2 {
-				logOps.Warnf("%s 任务超时, ===== 丢弃 =====", k)
-				// 超时报警
-				if !hasbark {
-					bark := monitor.Bark{Title: "任务超时", Message: k}
-					bark.SendMessage(monitor.TASK_TIMEOUT)
-					hasbark = true
-				}
-				if err = record.Delete(); err != nil {
-					logOps.Errorf("[Redis] delete task record: %s failed: %v", k, err)
-				}
-			} else {
-				logOps.Warnf("%s 任务超时, 重试", k)
-				if err = record.ClearExpireAt(); err != nil {
-					logOps.Errorf("[Redis] clear task record expireAt failed: %v", err)
-					continue
-				}
+		for _, id := range requeued {
+			logOps.Warnf("%d_%s 任务超时, 重试", queue.TaskType, id)
+		}
+		for _, task := range dropped {
+			logOps.Warnf("%d_%d 任务超时, ===== 移入死信 =====", queue.TaskType, task.TaskID)
+			if err = deadLetter(queue, task, "任务超时"); err != nil {
+				logOps.Errorf("[Mysql] dead letter %d_%d failed: %v", queue.TaskType, task.TaskID, err)
+			}
+			// 超时报警
+			if !hasbark {
+				bark := monitor.Bark{Title: "任务超时", Message: fmt.Sprintf("%d_%d", queue.TaskType, task.TaskID)}
+				bark.SendMessage(monitor.TASK_TIMEOUT)
+				hasbark = true
+			}
+		}
+	}
+}
 
-				// 重试
-				switch record.TaskType {
-				case lib.REC_FRONT:
-					err = lib.PushSDCheckFrontTask([]int{record.TaskID})
-				case lib.REC_SIDE:
-					err = lib.PushSDCheckSideTask([]int{record.TaskID})
-				case lib.REC_LORA:
-					err = lib.PushSDTask(record.TaskID)
-				case lib.REC_CARD:
-					err = lib.PushSDCardTask(record.TaskID)
-				case lib.REC_PHOTO:
-					err = lib.PushSDPhotoTask(record.TaskID, false)
-				case lib.REC_HR:
-					err = lib.PushSDPhotoHrTask(record.TaskID)
-				}
-				if err != nil {
-					logOps.Errorf("[Redis] push task: %s failed: %v", k, err)
-				}
+// 心跳超时的节点租约立即到期, 随后的回收中重新投递
+func checkWorkerNodes() {
+	nodes, err := lib.GetWorkerNodes()
+	if err != nil {
+		logOps.Errorf("[Redis] get worker nodes failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, node := range nodes {
+		if node.Offline {
+			if now.Sub(time.Unix(node.HeartbeatAt, 0)) > lib.WorkerNodeExpire {
+				lib.RemoveWorkerNode(node.Key())
 			}
+			continue
+		}
+		if !node.Expired(now) {
+			continue
+		}
+
+		expired, err := lib.MarkWorkerOffline(node.Key())
+		if err != nil {
+			logOps.Errorf("[Redis] mark worker %s offline failed: %v", node.Key(), err)
 		}
+		logOps.Warnf("节点 %s 心跳超时, 重新投递: %v", node.Key(), expired)
+		bark := monitor.Bark{Title: "节点离线", Message: node.Key()}
+		bark.SendMessage(monitor.WORKER_OFFLINE)
 	}
 }
@@ -0,0 +1,203 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	appstore "camera-appstore"
+	payment "camera-payment"
+	"camera/lib"
+	"camera/models"
+	"camera/monitor"
+)
+
+// 每轮补单的订单数
+const reconcileBatch = 100
+
+// 补单: 确认时请求苹果或第三方渠道失败的订单, 按退避间隔重新确认
+func ReconcileOrders(ctx context.Context, ws *sync.WaitGroup) {
+	defer ws.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logOps.Debug("stop reconcile orders")
+			return
+		case <-ticker.C:
+			runReconcileOrders(ctx)
+		}
+	}
+}
+
+func runReconcileOrders(ctx context.Context) {
+	orders, err := models.GetPendingOrders(time.Now(), reconcileBatch)
+	if err != nil {
+		logOps.Errorf("[Mysql] get pending orders failed: %v", err)
+		return
+	}
+	for i := range orders {
+		if ctx.Err() != nil {
+			return
+		}
+		reconcileOrder(ctx, &orders[i])
+	}
+}
+
+// 与确认接口使用同一把锁, 只发放一次
+func reconcileOrder(ctx context.Context, order *models.RechargeRecord) {
+	locked, err := lib.LockOrder(order.OrderNum)
+	if err != nil {
+		logOps.Errorf("[Redis] lock order: %s failed: %v", order.OrderNum, err)
+		return
+	}
+	// 确认接口正在处理
+	if !locked {
+		return
+	}
+	defer lib.UnlockOrder(order.OrderNum)
+
+	// 加锁后重新读取, 确认接口可能已处理
+	if err = order.GetByOrderNum(); err != nil {
+		logOps.Errorf("[Mysql] get order: %s failed: %v", order.OrderNum, err)
+		return
+	}
+	if order.Status != models.ORDER_PENDING {
+		return
+	}
+
+	// 超时判定失败
+	if time.Since(order.CreatedAt) > lib.OrderExpire {
+		failed, err := order.MarkFailed()
+		if err != nil {
+			logOps.Errorf("[Mysql] mark order: %s failed failed: %v", order.OrderNum, err)
+			return
+		}
+		if failed {
+			logOps.Warnf("[Order] order: %s pending over %s, marked failed, cus_id: %d", order.OrderNum, lib.OrderExpire, order.CusId)
+			bark := monitor.Bark{Title: "补单失败", Message: order.OrderNum}
+			bark.SendMessage(monitor.ORDER_PAY)
+		}
+		return
+	}
+
+	product := &models.Product{ProductId: order.ProductId}
+	if err = product.GetByProductID(); err != nil {
+		retryOrder(order, fmt.Errorf("get product: %s", err))
+		return
+	}
+	sandbox, originalTransId, trial, err := verifyPendingOrder(ctx, order, product)
+	if err != nil {
+		retryOrder(order, err)
+		return
+	}
+
+	confirmed, err := order.ConfirmPending(sandbox, product.PayEvent())
+	if err != nil {
+		logOps.Errorf("[Mysql] confirm order: %s failed: %v", order.OrderNum, err)
+		retryOrder(order, err)
+		return
+	}
+	if confirmed {
+		logOps.Infof("[Order] order: %s confirmed, cus_id: %d, diamond: %d, card_times: %d, sandbox: %v", order.OrderNum, order.CusId, order.Diamond, order.CardTimes, sandbox)
+	}
+	// 订阅的一期, 先记为订阅的一期, 同步订阅后发放
+	if product.ProductType == models.PRODUCT_SUBSCRIPTION && originalTransId != "" {
+		if err = models.AddSubscriptionPeriod(order.ID, originalTransId, trial); err != nil {
+			logOps.Errorf("[Mysql] add subscription: %s period failed: %v, trans_id: %s", originalTransId, err, order.OrderNum)
+			return
+		}
+		sub := &models.UserSubscription{OriginalTransId: originalTransId, CusId: order.CusId, ProductId: order.ProductId}
+		if err = refreshSubscription(ctx, sub); err != nil {
+			logOps.Warnf("[Subscription] refresh subscription: %s failed: %v, cus_id: %d", originalTransId, err, order.CusId)
+			return
+		}
+		grantSubscription(sub)
+	}
+}
+
+func retryOrder(order *models.RechargeRecord, reason error) {
+	logOps.Warnf("[Order] verify pending order: %s failed: %v, cus_id: %d", order.OrderNum, reason, order.CusId)
+	retry := &models.RechargeRetry{ID: order.ID}
+	if err := retry.Fail(reason.Error(), lib.OrderRetryInterval, lib.OrderRetryMaxInterval); err != nil {
+		logOps.Errorf("[Mysql] save order: %s retry failed: %v", order.OrderNum, err)
+	}
+}
+
+// 向苹果确认订单已支付, 返回是否沙盒, 原始交易号和是否订阅的免费试用期
+// 配置了App Store Server API时按交易ID查询, 否则使用保存的收据
+func verifyPendingOrder(ctx context.Context, order *models.RechargeRecord, product *models.Product) (bool, string, bool, error) {
+	if order.Channel != "" {
+		sandbox, err := verifyChannelOrder(ctx, order)
+		return sandbox, "", false, err
+	}
+	if lib.AppStoreServerEnabled(product.BundleId) {
+		trans, err := lib.GetAppStoreTransaction(ctx, product.BundleId, order.OrderNum)
+		if err != nil {
+			return false, "", false, err
+		}
+		if trans.ProductId != order.ProductId {
+			return false, "", false, fmt.Errorf("product mismatch: %s", trans.ProductId)
+		}
+		if trans.Revoked() {
+			return false, "", false, fmt.Errorf("transaction revoked")
+		}
+		return trans.Environment != appstore.ENV_PRODUCTION, trans.OriginalTransactionId, trans.IsTrial(), nil
+	}
+
+	respData, sandbox, err := verifyOrderReceipt(order.ID, product.BundleId)
+	if err != nil {
+		return false, "", false, err
+	}
+	if !respData.HasTransaction(order.OrderNum, order.ProductId) {
+		return false, "", false, fmt.Errorf("transaction not in receipt")
+	}
+	return sandbox, respData.OriginalTransactionId(order.OrderNum), respData.IsTrial(order.OrderNum), nil
+}
+
+// 使用订单保存的收据向苹果验证, 返回是否沙盒
+func verifyOrderReceipt(orderId int, bundleId string) (*lib.AppStoreData, bool, error) {
+	receipt := &models.RechargeReceipt{ID: orderId}
+	if err := receipt.GetByID(); err != nil {
+		return nil, false, fmt.Errorf("get receipt: %s", err)
+	}
+	if receipt.Receipt == "" {
+		return nil, false, fmt.Errorf("receipt is empty")
+	}
+	respData, sandbox, err := lib.VerifyAppStoreReceipt(receipt.Receipt)
+	if err != nil {
+		return nil, sandbox, err
+	}
+	if respData.Status != 0 {
+		return nil, sandbox, fmt.Errorf("receipt status %d", respData.Status)
+	}
+	if bundleId != "" && respData.Receipt.BundleID != bundleId {
+		return nil, sandbox, fmt.Errorf("bundle id mismatch: %s", respData.Receipt.BundleID)
+	}
+	return respData, sandbox, nil
+}
+
+// 向第三方渠道查询, Google Play使用确认时保存的purchaseToken
+func verifyChannelOrder(ctx context.Context, order *models.RechargeRecord) (bool, error) {
+	provider, err := lib.GetPayProvider(order.Channel)
+	if err != nil {
+		return false, err
+	}
+	receipt := &models.RechargeReceipt{ID: order.ID}
+	if err = receipt.GetByID(); err != nil && err.Error() != models.NoRowError {
+		return false, fmt.Errorf("get receipt: %s", err)
+	}
+	result, err := lib.VerifyPayment(ctx, provider, &payment.Order{OrderNum: order.OrderNum, ProductId: order.ProductId, Amount: order.Amount}, receipt.Receipt)
+	if err != nil {
+		return false, err
+	}
+	if !result.Paid {
+		return false, fmt.Errorf("order not paid")
+	}
+	order.TransId = result.TransactionId
+	return result.Sandbox, nil
+}
@@ -0,0 +1,156 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	appstore "camera-appstore"
+	"camera/lib"
+	"camera/models"
+)
+
+// 每轮处理的订阅数
+const subscriptionBatch = 100
+
+// 苹果查询失败时, 到期后最多再等待的时间
+const subscriptionRefreshLimit = 24 * time.Hour
+
+// 订阅: 补发确认或通知时未发放的一期, 到期且宽限期结束的订阅向苹果刷新后仍未续期则降级
+func Subscriptions(ctx context.Context, ws *sync.WaitGroup) {
+	defer ws.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logOps.Debug("stop subscriptions")
+			return
+		case <-ticker.C:
+			runSubscriptions(ctx)
+		}
+	}
+}
+
+func runSubscriptions(ctx context.Context) {
+	subs, err := models.GetUngrantedSubscriptions(subscriptionBatch)
+	if err != nil {
+		logOps.Errorf("[Mysql] get ungranted subscriptions failed: %v", err)
+		return
+	}
+	for i := range subs {
+		grantSubscription(&subs[i])
+	}
+
+	subs, err = models.GetLapsedSubscriptions(time.Now(), subscriptionBatch)
+	if err != nil {
+		logOps.Errorf("[Mysql] get lapsed subscriptions failed: %v", err)
+		return
+	}
+	for i := range subs {
+		if ctx.Err() != nil {
+			return
+		}
+		lapseSubscription(ctx, &subs[i])
+	}
+}
+
+// 与通知使用同一把锁, 刷新后已续期的发放新一期, 未续期的在同步时降级
+// 苹果查询一直失败时, 宽限期结束超过subscriptionRefreshLimit后直接降级
+func lapseSubscription(ctx context.Context, sub *models.UserSubscription) {
+	locked, err := lib.LockOrder(sub.OriginalTransId)
+	if err != nil {
+		logOps.Errorf("[Redis] lock subscription: %s failed: %v", sub.OriginalTransId, err)
+		return
+	}
+	// 通知正在处理
+	if !locked {
+		return
+	}
+	defer lib.UnlockOrder(sub.OriginalTransId)
+
+	if err = refreshSubscription(ctx, sub); err == nil {
+		if sub.Status == models.SUBSCRIPTION_EXPIRED {
+			logOps.Infof("[Subscription] subscription expired, cus_id: %d, original: %s, expires_at: %s", sub.CusId, sub.OriginalTransId, sub.ExpiresAt.Format(time.DateTime))
+			return
+		}
+		grantSubscription(sub)
+		return
+	}
+	logOps.Warnf("[Subscription] refresh subscription: %s failed: %v, cus_id: %d", sub.OriginalTransId, err, sub.CusId)
+	lapsedAt := sub.ExpiresAt
+	if sub.GraceExpiresAt != nil {
+		lapsedAt = *sub.GraceExpiresAt
+	}
+	if time.Since(lapsedAt) < subscriptionRefreshLimit {
+		return
+	}
+
+	expired, err := sub.Expire()
+	if err != nil {
+		logOps.Errorf("[Mysql] expire subscription: %s failed: %v", sub.OriginalTransId, err)
+		return
+	}
+	if expired {
+		logOps.Warnf("[Subscription] subscription expired without refresh, cus_id: %d, original: %s, expires_at: %s", sub.CusId, sub.OriginalTransId, sub.ExpiresAt.Format(time.DateTime))
+	}
+}
+
+// 向苹果查询订阅的最近一期并同步, 结果更新到sub
+// 配置了App Store Server API时按原始交易号查询, 否则使用原始订单保存的收据
+func refreshSubscription(ctx context.Context, sub *models.UserSubscription) error {
+	product := &models.Product{ProductId: sub.ProductId}
+	if err := product.GetByProductID(); err != nil {
+		return fmt.Errorf("get product: %s", err)
+	}
+
+	var trans *appstore.Transaction
+	var renewal *appstore.RenewalInfo
+	if lib.AppStoreServerEnabled(product.BundleId) {
+		var err error
+		if trans, renewal, err = lib.GetAppStoreSubscription(ctx, product.BundleId, sub.OriginalTransId); err != nil {
+			return err
+		}
+	} else {
+		order := &models.RechargeRecord{OrderNum: sub.OriginalTransId}
+		if err := order.GetByOrderNum(); err != nil {
+			return fmt.Errorf("get original order: %s", err)
+		}
+		respData, _, err := verifyOrderReceipt(order.ID, product.BundleId)
+		if err != nil {
+			return err
+		}
+		if trans, renewal = respData.Subscription(sub.OriginalTransId); trans == nil {
+			return fmt.Errorf("subscription not in receipt")
+		}
+	}
+
+	// 升降级后最近一期的产品可能不同
+	if trans.ProductId != product.ProductId {
+		product = &models.Product{ProductId: trans.ProductId}
+		if err := product.GetByProductID(); err != nil {
+			return fmt.Errorf("get product: %s", err)
+		}
+	}
+	synced, err := models.SyncSubscription(sub.CusId, product, trans, renewal)
+	if err != nil {
+		return err
+	}
+	*sub = *synced
+	return nil
+}
+
+// 发放订阅未发放的各期钻石
+func grantSubscription(sub *models.UserSubscription) {
+	diamond, err := sub.Grant()
+	if err != nil {
+		logOps.Errorf("[Mysql] grant subscription: %s failed: %v, trans_id: %s", sub.OriginalTransId, err, sub.TransId)
+		return
+	}
+	if diamond > 0 {
+		logOps.Infof("[Subscription] subscription granted, cus_id: %d, original: %s, trans_id: %s, diamond: %d", sub.CusId, sub.OriginalTransId, sub.TransId, diamond)
+	}
+}
@@ -15,7 +15,7 @@ import (
 var ws = new(sync.WaitGroup)
 
 func main() {
-	ws.Add(2)
+	ws.Add(4)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// 头像上传CDN
@@ -24,6 +24,12 @@ func main() {
 	// 监控SD任务
 	go cron.MonitorSDTask(ctx, ws)
 
+	// 补单
+	go cron.ReconcileOrders(ctx, ws)
+
+	// 订阅发放和到期降级
+	go cron.Subscriptions(ctx, ws)
+
 	// 清理数据
 	go cron.ClearData()
 
@@ -124,6 +124,13 @@ func beginReport(now time.Time) error {
 		return fmt.Errorf("[Mysql] get report day pay amount failed: %s", err)
 	}
 
+	// 当日退款金额
+	refund := &models.OrderRefund{}
+	dayRefund, err := refund.GetReportRefundAmount(now.AddDate(0, 0, -1), now)
+	if err != nil {
+		return fmt.Errorf("[Mysql] get report day refund amount failed: %s", err)
+	}
+
 	report := &models.Reports{
 		Repdate:       now.AddDate(0, 0, -1).Format("20060102"),
 		Mau:           monthAu,
@@ -134,6 +141,7 @@ func beginReport(now time.Time) error {
 		DaypayAmount:  dayPay,
 		DayrpayNum:    dayPayReg,
 		DayrpayAmount: dayAmountReg,
+		Refund:        dayRefund,
 		TotalIncome:   totalPay,
 	}
 
@@ -0,0 +1,51 @@
+package cron
+
+import (
+	"fmt"
+	"time"
+
+	"camera/models"
+	"camera/monitor"
+
+	"github.com/robfig/cron/v3"
+)
+
+// 每日3:30，钻石余额对账
+func SyncWalletReconcile() {
+	c := cron.New()
+	c.AddFunc("30 3 * * *", func() {
+		if err := walletReconcile(time.Now()); err != nil {
+			logReport.Errorf("wallet reconcile %s", err)
+		}
+	})
+	c.Start()
+}
+
+// 对比用户钻石余额与账本余额, 记录差异并报警
+func walletReconcile(now time.Time) error {
+	unbalanced, err := models.GetUnbalancedLedgerCount()
+	if err != nil {
+		return fmt.Errorf("[Mysql] get unbalanced ledger count failed: %s", err)
+	}
+
+	drifts, err := models.GetWalletDrifts()
+	if err != nil {
+		return fmt.Errorf("[Mysql] get wallet drifts failed: %s", err)
+	}
+
+	repdate := now.AddDate(0, 0, -1).Format("20060102")
+	for _, drift := range drifts {
+		logReport.Warnf("wallet drift cus_id: %d, diamond: %d, ledger: %d", drift.CusId, drift.Diamond, drift.Ledger)
+		drift.Repdate = repdate
+		drift.CreatedAt = now
+		if err = drift.Create(); err != nil {
+			logReport.Errorf("[Mysql] create wallet drift %d failed: %s", drift.CusId, err)
+		}
+	}
+
+	if len(drifts) > 0 || unbalanced > 0 {
+		bark := monitor.Bark{Title: "钻石对账异常", Message: fmt.Sprintf("余额不一致用户:%d, 不平衡交易:%d", len(drifts), unbalanced)}
+		bark.SendMessage(monitor.WALLET_DRIFT)
+	}
+	return nil
+}
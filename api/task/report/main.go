@@ -16,6 +16,9 @@ func main() {
 	// 昨日统计
 	go cron.SyncYesterdayReport()
 
+	// 钻石对账
+	go cron.SyncWalletReconcile()
+
 	// 今日统计
 	go cron.SyncTodayReport(ws)
 
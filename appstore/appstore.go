@@ -0,0 +1,295 @@
+// StoreKit 2 签名数据校验和 App Store Server API
+//
+// 签名数据为JWS, header的x5c证书链需验证到苹果根证书 Apple Root CA - G3:
+// https://www.apple.com/certificateauthority/AppleRootCA-G3.cer
+//
+// 本地测试使用 appstoretest 的证书和模拟服务器
+package appstore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// 环境
+const (
+	ENV_PRODUCTION    = "Production"
+	ENV_SANDBOX       = "Sandbox"
+	ENV_XCODE         = "Xcode"
+	ENV_LOCAL_TESTING = "LocalTesting"
+)
+
+// 内购类型
+const (
+	TYPE_CONSUMABLE     = "Consumable"
+	TYPE_NON_CONSUMABLE = "Non-Consumable"
+	TYPE_AUTO_RENEWABLE = "Auto-Renewable Subscription"
+	TYPE_NON_RENEWING   = "Non-Renewing Subscription"
+)
+
+var (
+	ErrSignedData  = errors.New("appstore: bad signed data")
+	ErrCertificate = errors.New("appstore: untrusted certificate chain")
+	ErrBundleId    = errors.New("appstore: unexpected bundle id")
+	ErrEnvironment = errors.New("appstore: unexpected environment")
+)
+
+// 苹果证书扩展: 签名证书 和 中间证书 (Apple Worldwide Developer Relations)
+var (
+	oidLeaf         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	oidIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// 交易信息 JWSTransactionDecodedPayload, 时间均为毫秒时间戳
+type Transaction struct {
+	TransactionId         string `json:"transactionId"`
+	OriginalTransactionId string `json:"originalTransactionId"`
+	WebOrderLineItemId    string `json:"webOrderLineItemId,omitempty"`
+	BundleId              string `json:"bundleId"`
+	ProductId             string `json:"productId"`
+	SubscriptionGroupId   string `json:"subscriptionGroupIdentifier,omitempty"`
+	PurchaseDate          int64  `json:"purchaseDate"`
+	OriginalPurchaseDate  int64  `json:"originalPurchaseDate"`
+	ExpiresDate           int64  `json:"expiresDate,omitempty"`
+	Quantity              int    `json:"quantity"`
+	Type                  string `json:"type"` // TYPE_*
+	AppAccountToken       string `json:"appAccountToken,omitempty"`
+	InAppOwnershipType    string `json:"inAppOwnershipType,omitempty"`
+	SignedDate            int64  `json:"signedDate"`
+	RevocationReason      *int   `json:"revocationReason,omitempty"`
+	RevocationDate        int64  `json:"revocationDate,omitempty"`
+	IsUpgraded            bool   `json:"isUpgraded,omitempty"`
+	OfferType             int    `json:"offerType,omitempty"`
+	OfferIdentifier       string `json:"offerIdentifier,omitempty"`
+	OfferDiscountType     string `json:"offerDiscountType,omitempty"` // DISCOUNT_*
+	Environment           string `json:"environment"`                 // ENV_*
+	Storefront            string `json:"storefront,omitempty"`
+	TransactionReason     string `json:"transactionReason,omitempty"`
+	Currency              string `json:"currency,omitempty"`
+	Price                 int64  `json:"price,omitempty"` // 千分之一货币单位
+}
+
+// 是否已退款或撤销
+func (t *Transaction) Revoked() bool {
+	return t.RevocationDate != 0
+}
+
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	X5c []string `json:"x5c"`
+}
+
+// 校验签名数据
+type Verifier struct {
+	roots        *x509.CertPool
+	bundleIds    map[string]bool
+	environments map[string]bool
+	now          func() time.Time
+}
+
+// rootCerts为根证书(DER或PEM); bundleIds, environments为空时不校验
+func NewVerifier(rootCerts [][]byte, bundleIds, environments []string) (*Verifier, error) {
+	v := &Verifier{
+		roots:        x509.NewCertPool(),
+		bundleIds:    make(map[string]bool, len(bundleIds)),
+		environments: make(map[string]bool, len(environments)),
+		now:          time.Now,
+	}
+	count := 0
+	for _, data := range rootCerts {
+		certs, err := ParseCertificates(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			v.roots.AddCert(cert)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("appstore: no root certificate")
+	}
+	for _, id := range bundleIds {
+		v.bundleIds[id] = true
+	}
+	for _, env := range environments {
+		v.environments[env] = true
+	}
+	return v, nil
+}
+
+// 校验交易签名, bundle id和环境
+func (v *Verifier) VerifyTransaction(signed string) (*Transaction, error) {
+	trans := &Transaction{}
+	if err := v.Verify(signed, trans); err != nil {
+		return nil, err
+	}
+	if err := v.check(trans.BundleId, trans.Environment); err != nil {
+		return nil, err
+	}
+	return trans, nil
+}
+
+func (v *Verifier) check(bundleId, environment string) error {
+	if len(v.bundleIds) > 0 && !v.bundleIds[bundleId] {
+		return fmt.Errorf("%w: %q", ErrBundleId, bundleId)
+	}
+	if len(v.environments) > 0 && !v.environments[environment] {
+		return fmt.Errorf("%w: %q", ErrEnvironment, environment)
+	}
+	return nil
+}
+
+// 校验JWS签名和证书链, 通过后将payload解析到v
+func (v *Verifier) Verify(signed string, payload interface{}) error {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return ErrSignedData
+	}
+	header := jwsHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "ES256" || len(header.X5c) < 2 {
+		return fmt.Errorf("%w: alg %q, %d certificates", ErrSignedData, header.Alg, len(header.X5c))
+	}
+
+	// 证书链, x5c中的根证书不可信, 只作为中间证书参与验证
+	certs := make([]*x509.Certificate, 0, len(header.X5c))
+	for _, item := range header.X5c {
+		der, err := base64.StdEncoding.DecodeString(item)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrSignedData, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrSignedData, err)
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   v.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrCertificate, err)
+	}
+	trusted := false
+	for _, chain := range chains {
+		if len(chain) >= 3 && hasExtension(chain[0], oidLeaf) && hasExtension(chain[1], oidIntermediate) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("%w: missing apple extensions", ErrCertificate)
+	}
+
+	// ES256签名 r||s
+	key, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return fmt.Errorf("%w: leaf key is not P-256", ErrCertificate)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("%w: bad signature encoding", ErrSignedData)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, sum[:], r, s) {
+		return fmt.Errorf("%w: signature mismatch", ErrSignedData)
+	}
+	return decodeSegment(parts[1], payload)
+}
+
+// 解析证书, 支持DER和PEM
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	certs := make([]*x509.Certificate, 0, 1)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("appstore: no certificate in pem")
+	}
+	return certs, nil
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// 生成ES256签名的JWS
+func SignJWS(header, payload interface{}, key *ecdsa.PrivateKey) (string, error) {
+	segments := make([]string, 0, 3)
+	for _, v := range []interface{}{header, payload} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, base64.RawURLEncoding.EncodeToString(data))
+	}
+	signing := strings.Join(segments, ".")
+	sum := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSignedData, err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrSignedData, err)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package appstore_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	appstore "camera-appstore"
+	"camera-appstore/appstoretest"
+)
+
+const bundleId = "com.example.camera"
+
+func newVerifier(t *testing.T) *appstore.Verifier {
+	v, err := appstore.NewVerifier([][]byte{appstoretest.RootCert()}, []string{bundleId}, []string{appstore.ENV_PRODUCTION, appstore.ENV_SANDBOX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVerifyTransaction(t *testing.T) {
+	v := newVerifier(t)
+	fake := appstoretest.NewServer(bundleId, appstore.ENV_SANDBOX)
+
+	signed, err := fake.AddTransaction(appstore.Transaction{TransactionId: "1000", ProductId: "diamond_60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans, err := v.VerifyTransaction(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trans.TransactionId != "1000" || trans.OriginalTransactionId != "1000" || trans.ProductId != "diamond_60" || trans.Environment != appstore.ENV_SANDBOX {
+		t.Fatalf("transaction: %+v", trans)
+	}
+
+	// 篡改payload
+	parts := strings.Split(signed, ".")
+	other, _ := fake.AddTransaction(appstore.Transaction{TransactionId: "1001", ProductId: "diamond_600"})
+	forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	if _, err = v.VerifyTransaction(forged); !errors.Is(err, appstore.ErrSignedData) {
+		t.Fatalf("forged: %v", err)
+	}
+
+	// bundle id 和环境
+	signed, _ = fake.AddTransaction(appstore.Transaction{TransactionId: "1002", ProductId: "diamond_60", BundleId: "com.example.other"})
+	if _, err = v.VerifyTransaction(signed); !errors.Is(err, appstore.ErrBundleId) {
+		t.Fatalf("bundle id: %v", err)
+	}
+	signed, _ = fake.AddTransaction(appstore.Transaction{TransactionId: "1003", ProductId: "diamond_60", Environment: appstore.ENV_XCODE})
+	if _, err = v.VerifyTransaction(signed); !errors.Is(err, appstore.ErrEnvironment) {
+		t.Fatalf("environment: %v", err)
+	}
+
+	// 证书链不到根证书
+	untrusted, err := appstore.NewVerifier([][]byte{selfSigned(t)}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = untrusted.VerifyTransaction(signed); !errors.Is(err, appstore.ErrCertificate) {
+		t.Fatalf("untrusted: %v", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	v := newVerifier(t)
+	fake := appstoretest.NewServer(bundleId, appstore.ENV_PRODUCTION)
+	fake.PageSize = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := appstore.NewClient(fake.ClientConfig(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		fake.AddTransaction(appstore.Transaction{TransactionId: "200" + strconv.Itoa(i), OriginalTransactionId: "2000", ProductId: "vip_month", Type: appstore.TYPE_AUTO_RENEWABLE})
+	}
+	fake.AddTransaction(appstore.Transaction{TransactionId: "3000", ProductId: "diamond_60"})
+	fake.Revoke("3000", 0)
+
+	trans, err := client.Transaction(ctx, v, "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trans.ProductId != "diamond_60" || !trans.Revoked() {
+		t.Fatalf("transaction: %+v", trans)
+	}
+
+	list, err := client.History(ctx, v, "2003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 || list[0].TransactionId != "2000" || list[4].TransactionId != "2004" {
+		t.Fatalf("history: %d", len(list))
+	}
+
+	if _, err = client.Transaction(ctx, v, "9999"); !appstore.IsNotFound(err) {
+		t.Fatalf("not found: %v", err)
+	}
+
+	// 其他bundle id的凭证
+	cfg := fake.ClientConfig(server.URL)
+	cfg.BundleId = "com.example.other"
+	other, _ := appstore.NewClient(cfg)
+	var apiErr *appstore.APIError
+	if _, err = other.TransactionInfo(ctx, "3000"); !errors.As(err, &apiErr) || apiErr.Status != 401 {
+		t.Fatalf("bad token: %v", err)
+	}
+}
+
+// 与测试根证书无关的自签名证书
+func selfSigned(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Other Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestNotification(t *testing.T) {
+	v := newVerifier(t)
+	fake := appstoretest.NewServer(bundleId, appstore.ENV_SANDBOX)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	fake.AddTransaction(appstore.Transaction{TransactionId: "4000", ProductId: "diamond_60"})
+	fake.Revoke("4000", 1)
+	signed, err := fake.Notification(appstore.NOTIFY_REFUND, "", "4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification, err := v.VerifyNotification(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.NotificationType != appstore.NOTIFY_REFUND || notification.Data.BundleId != bundleId {
+		t.Fatalf("notification: %+v", notification)
+	}
+	trans, err := v.VerifyTransaction(notification.Data.SignedTransactionInfo)
+	if err != nil || trans.TransactionId != "4000" || !trans.Revoked() {
+		t.Fatalf("transaction: %+v, %v", trans, err)
+	}
+
+	client, _ := appstore.NewClient(fake.ClientConfig(server.URL))
+	req := &appstore.ConsumptionRequest{CustomerConsented: true, ConsumptionStatus: appstore.CONSUMPTION_PARTIAL, Platform: appstore.PLATFORM_APPLE}
+	if err = client.SendConsumption(context.Background(), "4000", req); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := fake.Consumption("4000"); !ok || got.ConsumptionStatus != appstore.CONSUMPTION_PARTIAL {
+		t.Fatalf("consumption: %+v %v", got, ok)
+	}
+
+	if tenure := appstore.AccountTenure(0); tenure != 1 {
+		t.Fatalf("tenure 0: %d", tenure)
+	}
+	if tenure := appstore.AccountTenure(400); tenure != 7 {
+		t.Fatalf("tenure 400: %d", tenure)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	v := newVerifier(t)
+	fake := appstoretest.NewServer(bundleId, appstore.ENV_SANDBOX)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client, _ := appstore.NewClient(fake.ClientConfig(server.URL))
+	ctx := context.Background()
+
+	// 试用一期后续费一期
+	now := time.Now()
+	fake.AddTransaction(appstore.Transaction{TransactionId: "5000", ProductId: "vip_month", Type: appstore.TYPE_AUTO_RENEWABLE,
+		OfferType: appstore.OFFER_INTRODUCTORY, OfferDiscountType: appstore.DISCOUNT_FREE_TRIAL, ExpiresDate: now.Add(-time.Hour).UnixMilli()})
+	fake.AddTransaction(appstore.Transaction{TransactionId: "5001", OriginalTransactionId: "5000", ProductId: "vip_month", Type: appstore.TYPE_AUTO_RENEWABLE,
+		Price: 12000, ExpiresDate: now.Add(time.Hour).UnixMilli()})
+
+	status, trans, renewal, err := client.SubscriptionStatus(ctx, v, "5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != appstore.STATUS_ACTIVE || trans.TransactionId != "5001" || trans.IsTrial() || renewal.AutoRenewStatus != 1 || renewal.OriginalTransactionId != "5000" {
+		t.Fatalf("active: %d %+v %+v", status, trans, renewal)
+	}
+	first, _ := client.Transaction(ctx, v, "5000")
+	if !first.IsTrial() {
+		t.Fatalf("trial: %+v", first)
+	}
+
+	// 续费失败进入宽限期
+	fake.AddTransaction(appstore.Transaction{TransactionId: "6000", ProductId: "vip_month", Type: appstore.TYPE_AUTO_RENEWABLE, ExpiresDate: now.Add(-time.Hour).UnixMilli()})
+	grace := now.Add(24 * time.Hour).UnixMilli()
+	fake.SetRenewalInfo(appstore.RenewalInfo{OriginalTransactionId: "6000", AutoRenewStatus: 1, IsInBillingRetryPeriod: true, GracePeriodExpiresDate: grace})
+	status, _, renewal, err = client.SubscriptionStatus(ctx, v, "6000")
+	if err != nil || status != appstore.STATUS_GRACE_PERIOD || renewal.GracePeriodExpiresDate != grace {
+		t.Fatalf("grace: %d %+v %v", status, renewal, err)
+	}
+
+	// 过期的通知带续期信息
+	fake.SetRenewalInfo(appstore.RenewalInfo{OriginalTransactionId: "6000", ExpirationIntent: 1})
+	signed, _ := fake.Notification(appstore.NOTIFY_EXPIRED, "VOLUNTARY", "6000")
+	notification, err := v.VerifyNotification(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewal, err = v.VerifyRenewalInfo(notification.Data.SignedRenewalInfo)
+	if err != nil || renewal.AutoRenewStatus != 0 || renewal.ExpirationIntent != 1 {
+		t.Fatalf("expired renewal: %+v %v", renewal, err)
+	}
+	if status, _, _, _ = client.SubscriptionStatus(ctx, v, "6000"); status != appstore.STATUS_EXPIRED {
+		t.Fatalf("expired: %d", status)
+	}
+
+	// 消耗型商品没有订阅
+	fake.AddTransaction(appstore.Transaction{TransactionId: "7000", ProductId: "diamond_60"})
+	if _, _, _, err = client.SubscriptionStatus(ctx, v, "7000"); !appstore.IsNotFound(err) {
+		t.Fatalf("not subscription: %v", err)
+	}
+}
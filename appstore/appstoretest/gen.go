@@ -0,0 +1,106 @@
+//go:build ignore
+
+// 生成测试证书和密钥: go run gen.go
+// 证书链 根证书 -> 中间证书 -> 签名证书, 带苹果的证书扩展; 仅用于测试, 私钥公开
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	oidLeaf         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	oidIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+	asn1Null        = []byte{0x05, 0x00}
+)
+
+func main() {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.AddDate(30, 0, 0)
+
+	rootKey := newKey()
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Camera Test Root CA", Organization: []string{"Camera Test"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER := create(root, root, rootKey, rootKey)
+	root, _ = x509.ParseCertificate(rootDER)
+
+	interKey := newKey()
+	inter := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Camera Test Worldwide Developer Relations CA", Organization: []string{"Camera Test"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidIntermediate, Value: asn1Null}},
+	}
+	interDER := create(inter, root, interKey, rootKey)
+	inter, _ = x509.ParseCertificate(interDER)
+
+	leafKey := newKey()
+	leaf := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Camera Test StoreKit Signing", Organization: []string{"Camera Test"}},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: oidLeaf, Value: asn1Null}},
+	}
+	leafDER := create(leaf, inter, leafKey, interKey)
+
+	write("root.pem", "CERTIFICATE", rootDER)
+	write("intermediate.pem", "CERTIFICATE", interDER)
+	write("leaf.pem", "CERTIFICATE", leafDER)
+	write("leaf.key", "PRIVATE KEY", marshalKey(leafKey))
+	write("api.p8", "PRIVATE KEY", marshalKey(newKey()))
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func create(template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) []byte {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+func marshalKey(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+func write(name, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(filepath.Join("testdata", name), data, 0644); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,495 @@
+// 模拟 App Store Server API 和 StoreKit 2 签名, 用于离线测试
+//
+// 签名使用testdata中的测试证书链, Verifier需以RootCert()为根证书; 测试私钥公开, 不可用于正式环境
+package appstoretest
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appstore "camera-appstore"
+)
+
+// 测试内购密钥
+const (
+	KeyId    = "TESTKEY001"
+	IssuerId = "00000000-0000-0000-0000-000000000000"
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+func readFile(name string) []byte {
+	data, err := testdata.ReadFile("testdata/" + name)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// 测试根证书, PEM格式
+func RootCert() []byte {
+	return readFile("root.pem")
+}
+
+// 测试内购私钥, .p8格式
+func APIKey() []byte {
+	return readFile("api.p8")
+}
+
+// 模拟服务器, 保存交易并按苹果接口返回签名数据
+//
+//	GET  /inApps/v1/transactions/{transactionId}
+//	GET  /inApps/v2/history/{transactionId}
+//	GET  /inApps/v1/subscriptions/{transactionId}
+//	PUT  /inApps/v1/transactions/consumption/{transactionId}
+//	POST /fake/transactions  添加交易, body为Transaction, 返回签名数据, 不校验凭证
+//	POST /fake/renewals      设置订阅的续期信息, body为RenewalInfo
+//	POST /fake/notifications 生成通知, body为 {"notificationType", "subtype", "transactionId"}, 返回signedPayload
+type Server struct {
+	BundleId    string
+	Environment string
+	PageSize    int // 交易历史每页数量
+
+	chain  []string
+	key    *ecdsa.PrivateKey
+	apiKey *ecdsa.PublicKey
+
+	mu           sync.Mutex
+	transactions []appstore.Transaction
+	consumptions map[string]appstore.ConsumptionRequest
+	renewals     map[string]appstore.RenewalInfo // 原始交易号
+}
+
+func NewServer(bundleId, environment string) *Server {
+	s := &Server{BundleId: bundleId, Environment: environment, PageSize: 20, consumptions: make(map[string]appstore.ConsumptionRequest), renewals: make(map[string]appstore.RenewalInfo)}
+	for _, name := range []string{"leaf.pem", "intermediate.pem", "root.pem"} {
+		block, _ := pem.Decode(readFile(name))
+		s.chain = append(s.chain, base64.StdEncoding.EncodeToString(block.Bytes))
+	}
+	var err error
+	if s.key, err = appstore.ParsePrivateKey(readFile("leaf.key")); err != nil {
+		panic(err)
+	}
+	apiKey, err := appstore.ParsePrivateKey(APIKey())
+	if err != nil {
+		panic(err)
+	}
+	s.apiKey = &apiKey.PublicKey
+	return s
+}
+
+// 接口客户端配置
+func (s *Server) ClientConfig(baseURL string) appstore.ClientConfig {
+	return appstore.ClientConfig{
+		BaseURL:    baseURL,
+		KeyId:      KeyId,
+		IssuerId:   IssuerId,
+		BundleId:   s.BundleId,
+		PrivateKey: APIKey(),
+	}
+}
+
+// 按苹果格式签名
+func (s *Server) Sign(payload interface{}) (string, error) {
+	return appstore.SignJWS(map[string]interface{}{"alg": "ES256", "x5c": s.chain}, payload, s.key)
+}
+
+// 添加交易并返回签名数据, 未填写的字段使用默认值
+func (s *Server) AddTransaction(trans appstore.Transaction) (string, error) {
+	now := time.Now().UnixMilli()
+	if trans.BundleId == "" {
+		trans.BundleId = s.BundleId
+	}
+	if trans.Environment == "" {
+		trans.Environment = s.Environment
+	}
+	if trans.OriginalTransactionId == "" {
+		trans.OriginalTransactionId = trans.TransactionId
+	}
+	if trans.Type == "" {
+		trans.Type = appstore.TYPE_CONSUMABLE
+	}
+	if trans.Quantity == 0 {
+		trans.Quantity = 1
+	}
+	if trans.PurchaseDate == 0 {
+		trans.PurchaseDate = now
+	}
+	if trans.OriginalPurchaseDate == 0 {
+		trans.OriginalPurchaseDate = trans.PurchaseDate
+	}
+	trans.SignedDate = now
+
+	s.mu.Lock()
+	s.transactions = append(s.transactions, trans)
+	s.mu.Unlock()
+	return s.Sign(trans)
+}
+
+// 标记交易已退款
+func (s *Server) Revoke(transactionId string, reason int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.transactions {
+		if s.transactions[i].TransactionId == transactionId {
+			s.transactions[i].RevocationDate = time.Now().UnixMilli()
+			s.transactions[i].RevocationReason = &reason
+			return true
+		}
+	}
+	return false
+}
+
+// 设置订阅的续期信息, 未设置时为自动续期开启
+func (s *Server) SetRenewalInfo(info appstore.RenewalInfo) {
+	s.mu.Lock()
+	s.renewals[info.OriginalTransactionId] = info
+	s.mu.Unlock()
+}
+
+// 订阅最近一期交易, 续期信息和状态
+func (s *Server) subscription(originalTransactionId string) (int, appstore.Transaction, appstore.RenewalInfo, bool) {
+	var latest appstore.Transaction
+	found := false
+	for _, trans := range s.history(originalTransactionId) {
+		if trans.Type == appstore.TYPE_AUTO_RENEWABLE && (!found || trans.ExpiresDate > latest.ExpiresDate) {
+			latest, found = trans, true
+		}
+	}
+	if !found {
+		return 0, latest, appstore.RenewalInfo{}, false
+	}
+
+	s.mu.Lock()
+	info, ok := s.renewals[originalTransactionId]
+	s.mu.Unlock()
+	if !ok {
+		info = appstore.RenewalInfo{AutoRenewStatus: 1}
+	}
+	info.OriginalTransactionId = originalTransactionId
+	if info.ProductId == "" {
+		info.ProductId = latest.ProductId
+	}
+	if info.AutoRenewProductId == "" {
+		info.AutoRenewProductId = latest.ProductId
+	}
+	info.Environment = latest.Environment
+	info.RenewalDate = latest.ExpiresDate
+	info.SignedDate = time.Now().UnixMilli()
+
+	now := time.Now().UnixMilli()
+	status := appstore.STATUS_EXPIRED
+	switch {
+	case latest.Revoked():
+		status = appstore.STATUS_REVOKED
+	case latest.ExpiresDate > now:
+		status = appstore.STATUS_ACTIVE
+	case info.GracePeriodExpiresDate > now:
+		status = appstore.STATUS_GRACE_PERIOD
+	case info.IsInBillingRetryPeriod:
+		status = appstore.STATUS_BILLING_RETRY
+	}
+	return status, latest, info, true
+}
+
+// 生成交易的通知, 退款类通知需先调用Revoke
+func (s *Server) Notification(notificationType, subtype, transactionId string) (string, error) {
+	trans, ok := s.find(transactionId)
+	if !ok {
+		return "", fmt.Errorf("transaction %s not found", transactionId)
+	}
+	trans.SignedDate = time.Now().UnixMilli()
+	signedTransaction, err := s.Sign(trans)
+	if err != nil {
+		return "", err
+	}
+	notification := appstore.Notification{
+		NotificationType: notificationType,
+		Subtype:          subtype,
+		NotificationUUID: fmt.Sprintf("%s-%s-%d", notificationType, transactionId, time.Now().UnixNano()),
+		Version:          "2.0",
+		SignedDate:       time.Now().UnixMilli(),
+		Data: appstore.NotificationData{
+			BundleId:              trans.BundleId,
+			Environment:           trans.Environment,
+			SignedTransactionInfo: signedTransaction,
+		},
+	}
+	if trans.Type == appstore.TYPE_AUTO_RENEWABLE {
+		_, _, info, _ := s.subscription(trans.OriginalTransactionId)
+		if notification.Data.SignedRenewalInfo, err = s.Sign(info); err != nil {
+			return "", err
+		}
+	}
+	if notificationType == appstore.NOTIFY_CONSUMPTION_REQUEST {
+		notification.Data.ConsumptionRequestReason = "UNINTENDED_PURCHASE"
+	}
+	return s.Sign(notification)
+}
+
+// 收到的消费信息
+func (s *Server) Consumption(transactionId string) (appstore.ConsumptionRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.consumptions[transactionId]
+	return req, ok
+}
+
+func (s *Server) find(transactionId string) (appstore.Transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, trans := range s.transactions {
+		if trans.TransactionId == transactionId {
+			return trans, true
+		}
+	}
+	return appstore.Transaction{}, false
+}
+
+// 同一原始交易下的全部交易
+func (s *Server) history(originalTransactionId string) []appstore.Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]appstore.Transaction, 0)
+	for _, trans := range s.transactions {
+		if trans.OriginalTransactionId == originalTransactionId {
+			list = append(list, trans)
+		}
+	}
+	return list
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/fake/transactions" {
+		s.serveAdd(w, r)
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/fake/renewals" {
+		info := appstore.RenewalInfo{}
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.OriginalTransactionId == "" {
+			writeError(w, http.StatusBadRequest, 0, "originalTransactionId is required")
+			return
+		}
+		s.SetRenewalInfo(info)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/fake/notifications" {
+		s.serveNotification(w, r)
+		return
+	}
+	if err := s.checkToken(r.Header.Get("Authorization")); err != nil {
+		writeError(w, http.StatusUnauthorized, 0, err.Error())
+		return
+	}
+	if r.Method == "PUT" {
+		if transactionId, ok := strings.CutPrefix(r.URL.Path, "/inApps/v1/transactions/consumption/"); ok {
+			s.serveConsumption(w, r, transactionId)
+			return
+		}
+	}
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, 0, "method not allowed")
+		return
+	}
+
+	var transactionId string
+	var ok bool
+	if transactionId, ok = strings.CutPrefix(r.URL.Path, "/inApps/v1/transactions/"); ok {
+		s.serveTransaction(w, transactionId)
+	} else if transactionId, ok = strings.CutPrefix(r.URL.Path, "/inApps/v1/subscriptions/"); ok {
+		s.serveSubscription(w, transactionId)
+	} else if transactionId, ok = strings.CutPrefix(r.URL.Path, "/inApps/v2/history/"); ok {
+		s.serveHistory(w, transactionId, r.URL.Query().Get("revision"))
+	} else {
+		writeError(w, http.StatusNotFound, 0, "not found")
+	}
+}
+
+func (s *Server) serveAdd(w http.ResponseWriter, r *http.Request) {
+	trans := appstore.Transaction{}
+	if err := json.NewDecoder(r.Body).Decode(&trans); err != nil || trans.TransactionId == "" || trans.ProductId == "" {
+		writeError(w, http.StatusBadRequest, 0, "transactionId and productId are required")
+		return
+	}
+	signed, err := s.AddTransaction(trans)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, 0, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"signedTransaction": signed})
+}
+
+func (s *Server) serveNotification(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		NotificationType string `json:"notificationType"`
+		Subtype          string `json:"subtype"`
+		TransactionId    string `json:"transactionId"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NotificationType == "" {
+		writeError(w, http.StatusBadRequest, 0, "notificationType and transactionId are required")
+		return
+	}
+	if req.NotificationType == appstore.NOTIFY_REFUND || req.NotificationType == appstore.NOTIFY_REVOKE {
+		s.Revoke(req.TransactionId, 0)
+	}
+	signed, err := s.Notification(req.NotificationType, req.Subtype, req.TransactionId)
+	if err != nil {
+		writeError(w, http.StatusNotFound, appstore.ERROR_TRANSACTION_NOT_FOUND, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"signedPayload": signed})
+}
+
+func (s *Server) serveConsumption(w http.ResponseWriter, r *http.Request, transactionId string) {
+	if _, ok := s.find(transactionId); !ok {
+		writeError(w, http.StatusNotFound, appstore.ERROR_TRANSACTION_NOT_FOUND, "Transaction id not found.")
+		return
+	}
+	req := appstore.ConsumptionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.CustomerConsented {
+		writeError(w, http.StatusBadRequest, 0, "invalid consumption request")
+		return
+	}
+	s.mu.Lock()
+	s.consumptions[transactionId] = req
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) serveTransaction(w http.ResponseWriter, transactionId string) {
+	trans, ok := s.find(transactionId)
+	if !ok {
+		writeError(w, http.StatusNotFound, appstore.ERROR_TRANSACTION_NOT_FOUND, "Transaction id not found.")
+		return
+	}
+	trans.SignedDate = time.Now().UnixMilli()
+	signed, err := s.Sign(trans)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, 0, err.Error())
+		return
+	}
+	writeJSON(w, map[string]string{"signedTransactionInfo": signed})
+}
+
+// 只返回该交易所属的订阅
+func (s *Server) serveSubscription(w http.ResponseWriter, transactionId string) {
+	trans, ok := s.find(transactionId)
+	if !ok {
+		writeError(w, http.StatusNotFound, appstore.ERROR_TRANSACTION_NOT_FOUND, "Transaction id not found.")
+		return
+	}
+	resp := appstore.StatusResponse{BundleId: s.BundleId, Environment: s.Environment, Data: []appstore.SubscriptionGroup{}}
+	status, latest, info, ok := s.subscription(trans.OriginalTransactionId)
+	if ok {
+		latest.SignedDate = time.Now().UnixMilli()
+		signedTransaction, err := s.Sign(latest)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, 0, err.Error())
+			return
+		}
+		signedRenewal, err := s.Sign(info)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, 0, err.Error())
+			return
+		}
+		resp.Data = append(resp.Data, appstore.SubscriptionGroup{
+			SubscriptionGroupIdentifier: latest.SubscriptionGroupId,
+			LastTransactions: []appstore.LastTransaction{{
+				OriginalTransactionId: latest.OriginalTransactionId,
+				Status:                status,
+				SignedTransactionInfo: signedTransaction,
+				SignedRenewalInfo:     signedRenewal,
+			}},
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// revision为已返回的交易数
+func (s *Server) serveHistory(w http.ResponseWriter, transactionId, revision string) {
+	trans, ok := s.find(transactionId)
+	if !ok {
+		writeError(w, http.StatusNotFound, appstore.ERROR_TRANSACTION_NOT_FOUND, "Transaction id not found.")
+		return
+	}
+	list := s.history(trans.OriginalTransactionId)
+	start, _ := strconv.Atoi(revision)
+	start = min(max(start, 0), len(list))
+	end := min(start+max(s.PageSize, 1), len(list))
+
+	resp := appstore.HistoryResponse{
+		Revision:           strconv.Itoa(end),
+		HasMore:            end < len(list),
+		BundleId:           s.BundleId,
+		Environment:        s.Environment,
+		SignedTransactions: make([]string, 0, end-start),
+	}
+	for _, item := range list[start:end] {
+		item.SignedDate = time.Now().UnixMilli()
+		signed, err := s.Sign(item)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, 0, err.Error())
+			return
+		}
+		resp.SignedTransactions = append(resp.SignedTransactions, signed)
+	}
+	writeJSON(w, resp)
+}
+
+// 校验接口凭证: ES256签名, aud, bid和有效期
+func (s *Server) checkToken(auth string) error {
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	parts := strings.Split(token, ".")
+	if !ok || len(parts) != 3 {
+		return fmt.Errorf("missing bearer token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("bad token signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(s.apiKey, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return fmt.Errorf("bad token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("bad token claims")
+	}
+	claims := struct {
+		Iss string `json:"iss"`
+		Aud string `json:"aud"`
+		Bid string `json:"bid"`
+		Exp int64  `json:"exp"`
+	}{}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return fmt.Errorf("bad token claims")
+	}
+	if claims.Iss != IssuerId || claims.Aud != "appstoreconnect-v1" || claims.Bid != s.BundleId || claims.Exp < time.Now().Unix() {
+		return fmt.Errorf("token claims rejected")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(appstore.APIError{Code: code, Message: message})
+}
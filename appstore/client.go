@@ -0,0 +1,221 @@
+package appstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// App Store Server API 地址
+const (
+	PRODUCTION_URL = "https://api.storekit.itunes.apple.com"
+	SANDBOX_URL    = "https://api.storekit-sandbox.itunes.apple.com"
+)
+
+// 交易不存在的错误码, 正式环境查不到时应再查沙盒
+const ERROR_TRANSACTION_NOT_FOUND = 4040010
+
+// 接口返回的错误
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    int    `json:"errorCode"`
+	Message string `json:"errorMessage"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("appstore: status %d, code %d: %s", e.Status, e.Code, e.Message)
+}
+
+// 交易是否不存在
+func IsNotFound(err error) bool {
+	var e *APIError
+	return errors.As(err, &e) && (e.Code == ERROR_TRANSACTION_NOT_FOUND || e.Status == http.StatusNotFound)
+}
+
+type ClientConfig struct {
+	BaseURL    string // PRODUCTION_URL, SANDBOX_URL 或模拟服务器地址
+	KeyId      string // App Store Connect 内购密钥ID
+	IssuerId   string
+	BundleId   string
+	PrivateKey []byte // .p8私钥, PEM格式
+}
+
+// App Store Server API, 每个bundle id和环境一个
+type Client struct {
+	cfg    ClientConfig
+	key    *ecdsa.PrivateKey
+	client *http.Client
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.BaseURL == "" || cfg.KeyId == "" || cfg.IssuerId == "" || cfg.BundleId == "" {
+		return nil, fmt.Errorf("appstore: incomplete client config")
+	}
+	key, err := ParsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	return &Client{cfg: cfg, key: key, client: &http.Client{Timeout: time.Second * 30}}, nil
+}
+
+// 解析.p8私钥
+func ParsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("appstore: private key is not pem")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("appstore: private key is not ecdsa")
+	}
+	return ecKey, nil
+}
+
+// 请求凭证, 有效期不超过1小时
+func (c *Client) token() (string, error) {
+	now := time.Now()
+	header := map[string]string{"alg": "ES256", "kid": c.cfg.KeyId, "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss": c.cfg.IssuerId,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute * 5).Unix(),
+		"aud": "appstoreconnect-v1",
+		"bid": c.cfg.BundleId,
+	}
+	return SignJWS(header, claims, c.key)
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	return c.do(ctx, "GET", path, query, nil, v)
+}
+
+// body不为nil时以json发送, v为nil时不解析返回
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, v interface{}) error {
+	rawurl := c.cfg.BaseURL + path
+	if len(query) > 0 {
+		rawurl += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, rawurl, reader)
+	if err != nil {
+		return err
+	}
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = string(data)
+		}
+		return apiErr
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 查询单个交易, 返回签名数据
+func (c *Client) TransactionInfo(ctx context.Context, transactionId string) (string, error) {
+	resp := struct {
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+	}{}
+	if err := c.get(ctx, "/inApps/v1/transactions/"+url.PathEscape(transactionId), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.SignedTransactionInfo, nil
+}
+
+// 交易历史的一页
+type HistoryResponse struct {
+	Revision           string   `json:"revision"`
+	HasMore            bool     `json:"hasMore"`
+	BundleId           string   `json:"bundleId"`
+	Environment        string   `json:"environment"`
+	SignedTransactions []string `json:"signedTransactions"`
+}
+
+// 查询交易历史的一页, revision为空时从头开始, 按购买时间升序
+func (c *Client) TransactionHistory(ctx context.Context, transactionId, revision string) (*HistoryResponse, error) {
+	query := url.Values{}
+	query.Set("sort", "ASCENDING")
+	if revision != "" {
+		query.Set("revision", revision)
+	}
+	resp := &HistoryResponse{}
+	if err := c.get(ctx, "/inApps/v2/history/"+url.PathEscape(transactionId), query, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// 查询并校验单个交易
+func (c *Client) Transaction(ctx context.Context, v *Verifier, transactionId string) (*Transaction, error) {
+	signed, err := c.TransactionInfo(ctx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	return v.VerifyTransaction(signed)
+}
+
+// 查询并校验交易所属用户的全部交易历史
+func (c *Client) History(ctx context.Context, v *Verifier, transactionId string) ([]*Transaction, error) {
+	list := make([]*Transaction, 0)
+	revision := ""
+	for {
+		resp, err := c.TransactionHistory(ctx, transactionId, revision)
+		if err != nil {
+			return nil, err
+		}
+		for _, signed := range resp.SignedTransactions {
+			trans, err := v.VerifyTransaction(signed)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, trans)
+		}
+		if !resp.HasMore || resp.Revision == "" || resp.Revision == revision {
+			break
+		}
+		revision = resp.Revision
+	}
+	return list, nil
+}
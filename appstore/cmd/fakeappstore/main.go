@@ -0,0 +1,46 @@
+// 本地模拟 App Store Server API, api配置 appstore 指向本服务即可离线测试苹果支付
+//
+//	go run ./cmd/fakeappstore -bundle com.example.camera
+//	curl -d '{"transactionId":"1000","productId":"diamond_60"}' http://127.0.0.1:3094/fake/transactions
+//
+// 返回的signedTransaction作为 /api/appstore/confirm 的signed_transaction参数; 退款通知:
+//
+//	curl -d '{"notificationType":"REFUND","transactionId":"1000"}' http://127.0.0.1:3094/fake/notifications
+//
+// 返回的signedPayload以 {"signedPayload": ...} 发送到 /api/appstore/notify
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	appstore "camera-appstore"
+	"camera-appstore/appstoretest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:3094", "listen address")
+	bundleId := flag.String("bundle", "", "bundle id")
+	env := flag.String("env", appstore.ENV_SANDBOX, "environment")
+	dir := flag.String("dir", ".", "directory to write root.pem and api.p8")
+	flag.Parse()
+	if *bundleId == "" {
+		log.Fatal("bundle id is required")
+	}
+
+	// 写出根证书和内购私钥, 供api配置 appstore.root_cert 和 appstore.private_key
+	files := map[string][]byte{"root.pem": appstoretest.RootCert(), "api.p8": appstoretest.APIKey()}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(*dir, name), data, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("key_id: %s, issuer_id: %s, root_cert: %s, private_key: %s",
+		appstoretest.KeyId, appstoretest.IssuerId, filepath.Join(*dir, "root.pem"), filepath.Join(*dir, "api.p8"))
+
+	log.Printf("fake app store %s (%s) listening on %s", *bundleId, *env, *addr)
+	log.Fatal(http.ListenAndServe(*addr, appstoretest.NewServer(*bundleId, *env)))
+}
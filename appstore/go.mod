@@ -0,0 +1,3 @@
+module camera-appstore
+
+go 1.21
@@ -0,0 +1,100 @@
+package appstore
+
+import (
+	"context"
+	"net/url"
+)
+
+// 通知类型 App Store Server Notifications V2, 只列出处理的类型
+const (
+	NOTIFY_REFUND              = "REFUND"
+	NOTIFY_REVOKE              = "REVOKE"
+	NOTIFY_DID_RENEW           = "DID_RENEW"
+	NOTIFY_CONSUMPTION_REQUEST = "CONSUMPTION_REQUEST"
+	NOTIFY_TEST                = "TEST"
+
+	// 自动续期订阅
+	NOTIFY_SUBSCRIBED                = "SUBSCRIBED"
+	NOTIFY_DID_CHANGE_RENEWAL_STATUS = "DID_CHANGE_RENEWAL_STATUS"
+	NOTIFY_DID_FAIL_TO_RENEW         = "DID_FAIL_TO_RENEW"
+	NOTIFY_EXPIRED                   = "EXPIRED"
+	NOTIFY_GRACE_PERIOD_EXPIRED      = "GRACE_PERIOD_EXPIRED"
+)
+
+// 通知 responseBodyV2DecodedPayload
+type Notification struct {
+	NotificationType string           `json:"notificationType"`
+	Subtype          string           `json:"subtype,omitempty"`
+	NotificationUUID string           `json:"notificationUUID"`
+	Version          string           `json:"version"`
+	SignedDate       int64            `json:"signedDate"`
+	Data             NotificationData `json:"data"`
+}
+
+type NotificationData struct {
+	AppAppleId               int64  `json:"appAppleId,omitempty"`
+	BundleId                 string `json:"bundleId"`
+	BundleVersion            string `json:"bundleVersion,omitempty"`
+	Environment              string `json:"environment"`
+	SignedTransactionInfo    string `json:"signedTransactionInfo,omitempty"`
+	SignedRenewalInfo        string `json:"signedRenewalInfo,omitempty"`
+	ConsumptionRequestReason string `json:"consumptionRequestReason,omitempty"`
+}
+
+// 校验通知签名, bundle id和环境
+func (v *Verifier) VerifyNotification(signedPayload string) (*Notification, error) {
+	notification := &Notification{}
+	if err := v.Verify(signedPayload, notification); err != nil {
+		return nil, err
+	}
+	if err := v.check(notification.Data.BundleId, notification.Data.Environment); err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+// 消费信息的取值
+const (
+	CONSUMPTION_UNDECLARED = 0
+	CONSUMPTION_NONE       = 1 // 未消耗
+	CONSUMPTION_PARTIAL    = 2 // 部分消耗
+	CONSUMPTION_FULL       = 3 // 全部消耗
+
+	DELIVERY_OK = 0 // 已正常发放
+
+	PLATFORM_APPLE = 1
+
+	USER_STATUS_ACTIVE    = 1
+	USER_STATUS_SUSPENDED = 2
+)
+
+// 退款请求的消费信息 ConsumptionRequest, 需取得用户同意后发送
+type ConsumptionRequest struct {
+	CustomerConsented        bool   `json:"customerConsented"`
+	ConsumptionStatus        int    `json:"consumptionStatus"`
+	Platform                 int    `json:"platform"`
+	SampleContentProvided    bool   `json:"sampleContentProvided"`
+	DeliveryStatus           int    `json:"deliveryStatus"`
+	AppAccountToken          string `json:"appAccountToken"`
+	AccountTenure            int    `json:"accountTenure"`
+	PlayTime                 int    `json:"playTime"`
+	LifetimeDollarsRefunded  int    `json:"lifetimeDollarsRefunded"`
+	LifetimeDollarsPurchased int    `json:"lifetimeDollarsPurchased"`
+	UserStatus               int    `json:"userStatus"`
+	RefundPreference         int    `json:"refundPreference"`
+}
+
+// 账户注册天数对应的AccountTenure
+func AccountTenure(days int) int {
+	for i, limit := range []int{3, 10, 30, 90, 180, 365} {
+		if days < limit {
+			return i + 1
+		}
+	}
+	return 7
+}
+
+// 回复退款请求的消费信息
+func (c *Client) SendConsumption(ctx context.Context, transactionId string, req *ConsumptionRequest) error {
+	return c.do(ctx, "PUT", "/inApps/v1/transactions/consumption/"+url.PathEscape(transactionId), nil, req, nil)
+}
@@ -0,0 +1,114 @@
+package appstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// 优惠类型
+const (
+	OFFER_INTRODUCTORY = 1 // 首次优惠
+	OFFER_PROMOTIONAL  = 2
+	OFFER_CODE         = 3
+
+	DISCOUNT_FREE_TRIAL = "FREE_TRIAL"
+)
+
+// 订阅状态
+const (
+	STATUS_ACTIVE        = 1
+	STATUS_EXPIRED       = 2
+	STATUS_BILLING_RETRY = 3 // 续费失败, 苹果仍在重试
+	STATUS_GRACE_PERIOD  = 4 // 续费失败, 宽限期内仍可使用
+	STATUS_REVOKED       = 5
+)
+
+// 是否免费试用; 旧版本系统没有offerDiscountType, 按首次优惠且价格为0判断
+func (t *Transaction) IsTrial() bool {
+	if t.OfferDiscountType != "" {
+		return t.OfferDiscountType == DISCOUNT_FREE_TRIAL
+	}
+	return t.OfferType == OFFER_INTRODUCTORY && t.Price == 0
+}
+
+// 续期信息 JWSRenewalInfoDecodedPayload, 时间均为毫秒时间戳
+type RenewalInfo struct {
+	OriginalTransactionId  string `json:"originalTransactionId"`
+	ProductId              string `json:"productId"`
+	AutoRenewProductId     string `json:"autoRenewProductId"`
+	AutoRenewStatus        int    `json:"autoRenewStatus"` // 1-自动续期开启
+	ExpirationIntent       int    `json:"expirationIntent,omitempty"`
+	GracePeriodExpiresDate int64  `json:"gracePeriodExpiresDate,omitempty"`
+	IsInBillingRetryPeriod bool   `json:"isInBillingRetryPeriod,omitempty"`
+	RenewalDate            int64  `json:"renewalDate,omitempty"`
+	Environment            string `json:"environment"`
+	SignedDate             int64  `json:"signedDate"`
+}
+
+// 续期信息没有bundle id, 只校验签名和环境
+func (v *Verifier) VerifyRenewalInfo(signed string) (*RenewalInfo, error) {
+	info := &RenewalInfo{}
+	if err := v.Verify(signed, info); err != nil {
+		return nil, err
+	}
+	if len(v.environments) > 0 && !v.environments[info.Environment] {
+		return nil, fmt.Errorf("%w: %q", ErrEnvironment, info.Environment)
+	}
+	return info, nil
+}
+
+// 订阅状态 Get All Subscription Statuses 的一项
+type LastTransaction struct {
+	OriginalTransactionId string `json:"originalTransactionId"`
+	Status                int    `json:"status"` // STATUS_*
+	SignedTransactionInfo string `json:"signedTransactionInfo"`
+	SignedRenewalInfo     string `json:"signedRenewalInfo"`
+}
+
+type SubscriptionGroup struct {
+	SubscriptionGroupIdentifier string            `json:"subscriptionGroupIdentifier"`
+	LastTransactions            []LastTransaction `json:"lastTransactions"`
+}
+
+type StatusResponse struct {
+	BundleId    string              `json:"bundleId"`
+	Environment string              `json:"environment"`
+	Data        []SubscriptionGroup `json:"data"`
+}
+
+// 查询交易所属用户的全部订阅状态
+func (c *Client) SubscriptionStatuses(ctx context.Context, transactionId string) (*StatusResponse, error) {
+	resp := &StatusResponse{}
+	if err := c.get(ctx, "/inApps/v1/subscriptions/"+url.PathEscape(transactionId), nil, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// 查询并校验原始交易的订阅状态, 返回最近一期交易和续期信息; 不属于订阅时返回NotFound
+func (c *Client) SubscriptionStatus(ctx context.Context, v *Verifier, originalTransactionId string) (int, *Transaction, *RenewalInfo, error) {
+	resp, err := c.SubscriptionStatuses(ctx, originalTransactionId)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, group := range resp.Data {
+		for _, last := range group.LastTransactions {
+			if last.OriginalTransactionId != originalTransactionId {
+				continue
+			}
+			trans, err := v.VerifyTransaction(last.SignedTransactionInfo)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			var renewal *RenewalInfo
+			if last.SignedRenewalInfo != "" {
+				if renewal, err = v.VerifyRenewalInfo(last.SignedRenewalInfo); err != nil {
+					return 0, nil, nil, err
+				}
+			}
+			return last.Status, trans, renewal, nil
+		}
+	}
+	return 0, nil, nil, &APIError{Code: ERROR_TRANSACTION_NOT_FOUND, Message: "subscription not found"}
+}
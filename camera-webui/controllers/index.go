@@ -37,9 +37,9 @@ func CreateSDTask(c echo.Context) error {
 		logApi.Errorf("body读取失败, %s", err)
 		return c.JSON(http.StatusOK, Response{FAILURE, "body读取失败"})
 	}
-	reqbody, err := lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	reqbody, err := lib.WebUICipher().Decrypt(string(body))
 	if err != nil {
-		logApi.Errorf("3DES解密失败, %s", string(body))
+		logApi.Errorf("解密失败, %s, %s", err, string(body))
 		return c.JSON(http.StatusOK, Response{FAILURE, "解密失败"})
 	}
 
@@ -49,6 +49,10 @@ func CreateSDTask(c echo.Context) error {
 		logApi.Errorf("json解析失败, %s, %s", err, string(reqbody))
 		return c.JSON(http.StatusOK, Response{FAILURE, "json解析失败"})
 	}
+	if err = task.CheckVersion(); err != nil {
+		logApi.Errorf("%s", err)
+		return c.JSON(http.StatusOK, Response{INVALID_PARAM, err.Error()})
+	}
 
 	data, err := json.Marshal(task)
 	if err != nil {
@@ -92,10 +96,10 @@ func CreateCheckTask(c echo.Context) error {
 		return c.JSON(http.StatusOK, Response{FAILURE, "body读取失败"})
 	}
 	reqbody := body
-	if len(lib.WebUIDeskey) > 0 {
-		reqbody, err = lib.DESDecrypt(string(body), lib.WebUIDeskey)
+	if lib.WebUICipher().Enabled() {
+		reqbody, err = lib.WebUICipher().Decrypt(string(body))
 		if err != nil {
-			logApi.Errorf("3DES解密失败, %s", string(body))
+			logApi.Errorf("解密失败, %s, %s", err, string(body))
 			return c.JSON(http.StatusOK, Response{FAILURE, "解密失败"})
 		}
 	}
@@ -106,6 +110,10 @@ func CreateCheckTask(c echo.Context) error {
 		logApi.Errorf("json解析失败, %s, %s", err, string(reqbody))
 		return c.JSON(http.StatusOK, Response{FAILURE, "json解析失败"})
 	}
+	if err = task.CheckVersion(); err != nil {
+		logApi.Errorf("%s", err)
+		return c.JSON(http.StatusOK, Response{INVALID_PARAM, err.Error()})
+	}
 
 	data, err := json.Marshal(task)
 	if err != nil {
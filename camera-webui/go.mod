@@ -3,9 +3,10 @@ module camera-webui
 go 1.21.0
 
 require (
+	camera-protocol v0.0.0
+	camera-storage v0.0.0
 	github.com/Baidu-AIP/golang-sdk v1.1.1
 	github.com/chai2010/webp v1.1.1
-	github.com/forgoer/openssl v1.6.0
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/json-iterator/go v1.1.12
 	github.com/labstack/echo/v4 v4.11.1
@@ -13,6 +14,7 @@ require (
 	github.com/qiniu/go-sdk/v7 v7.17.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/viper v1.16.0
+	golang.org/x/sys v0.10.0
 	golang.org/x/time v0.3.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
@@ -38,8 +40,12 @@ require (
 	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/net v0.12.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.10.0 // indirect
 	golang.org/x/text v0.11.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace (
+	camera-protocol => ../protocol
+	camera-storage => ../storage
+)
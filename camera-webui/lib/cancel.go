@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 取消查询间隔
+	CancelInterval = time.Second * 5
+
+	// 执行中的任务 cancelKey => *cancelTask
+	cancelTasks sync.Map
+)
+
+// 查询已取消的任务, 与api一致
+type TaskCancelQuery struct {
+	TaskType int    `json:"task_type"` // WORK_*
+	TaskIds  []uint `json:"task_ids"`  // 执行中的任务
+}
+
+type cancelKey struct {
+	taskType int
+	taskId   uint
+}
+
+type cancelTask struct {
+	canceled atomic.Bool
+	onCancel func()
+}
+
+// 登记执行中的任务, 被取消时调用onCancel(可为nil), 返回的函数在任务结束时调用
+// defer lib.WatchCancel(lib.WORK_TRAIN, id, fn)()
+func WatchCancel(taskType int, taskId uint, onCancel func()) func() {
+	key := cancelKey{taskType, taskId}
+	cancelTasks.Store(key, &cancelTask{onCancel: onCancel})
+	return func() {
+		cancelTasks.Delete(key)
+	}
+}
+
+// 任务是否已被取消
+func IsCanceled(taskType int, taskId uint) bool {
+	if v, ok := cancelTasks.Load(cancelKey{taskType, taskId}); ok {
+		return v.(*cancelTask).canceled.Load()
+	}
+	return false
+}
+
+// 定时查询执行中的任务是否已取消, 直到ctx结束
+func RunCancelWatcher(ctx context.Context, ws *sync.WaitGroup) {
+	defer ws.Done()
+
+	ticker := time.NewTicker(CancelInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollCanceled()
+		}
+	}
+}
+
+func pollCanceled() {
+	running := make(map[int][]uint)
+	cancelTasks.Range(func(k, v any) bool {
+		key := k.(cancelKey)
+		if !v.(*cancelTask).canceled.Load() {
+			running[key.taskType] = append(running[key.taskType], key.taskId)
+		}
+		return true
+	})
+
+	for taskType, ids := range running {
+		canceled, err := queryCanceled(TaskCancelQuery{TaskType: taskType, TaskIds: ids})
+		if err != nil {
+			logApi.Warnf("查询取消任务失败, %s, type: %d", err, taskType)
+			continue
+		}
+		for _, id := range canceled {
+			v, ok := cancelTasks.Load(cancelKey{taskType, id})
+			if !ok {
+				continue
+			}
+			task := v.(*cancelTask)
+			if task.canceled.CompareAndSwap(false, true) {
+				logApi.Infof("任务: %d_%d 已取消", taskType, id)
+				if task.onCancel != nil {
+					go task.onCancel()
+				}
+			}
+		}
+	}
+}
+
+func queryCanceled(query TaskCancelQuery) ([]uint, error) {
+	api, err := url.JoinPath(WebUIHost, "api/work/cancel")
+	if err != nil {
+		return nil, err
+	}
+	byteMsg, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	body, err := WebUICipher().Encrypt(byteMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	request, _ := http.NewRequest("POST", api, bytes.NewReader([]byte(body)))
+	request.Header.Set("Content-Type", "application/json")
+	SignRequest(request, []byte(body))
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	data := struct {
+		Code int    `json:"code"`
+		Data []uint `json:"data"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Code != 1 {
+		return nil, fmt.Errorf("code: %d", data.Code)
+	}
+	return data.Data, nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package lib
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// 目录所在磁盘剩余空间
+func DiskFree(path string) (uint64, error) {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,16 @@
+package lib
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// 目录所在磁盘剩余空间
+func DiskFree(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+	return free, err
+}
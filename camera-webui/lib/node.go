@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 软件版本, 编译时 -ldflags "-X camera-webui/lib.Version=xxx"
+	Version = "dev"
+
+	// 心跳间隔, 需小于api的heartbeat_timeout
+	HeartbeatInterval = time.Second * 15
+
+	// 执行中任务数
+	runningTasks atomic.Int32
+)
+
+// 节点信息, 与api一致
+type WorkerNode struct {
+	Service    string   `json:"service"`    // 服务名
+	Hostname   string   `json:"hostname"`   // 主机名
+	Version    string   `json:"version"`    // 软件版本
+	TaskTypes  []string `json:"task_types"` // 处理的队列 front side lora card photo hr
+	Threads    int      `json:"threads"`    // 并发数
+	Running    int      `json:"running"`    // 执行中任务数
+	Checkpoint string   `json:"checkpoint"` // 已加载的底模
+	DiskFree   uint64   `json:"disk_free"`  // 工作目录剩余空间 bytes
+	StartedAt  int64    `json:"started_at"` // 进程启动时间
+}
+
+// 记录任务开始执行, 返回结束函数
+// defer lib.TaskRunning()()
+func TaskRunning() func() {
+	runningTasks.Add(1)
+	return func() {
+		runningTasks.Add(-1)
+	}
+}
+
+// 执行中任务数
+func RunningTasks() int {
+	return int(runningTasks.Load())
+}
+
+// 注册节点并定时心跳, 直到ctx结束
+// workPath: 统计剩余空间的目录, checkpoint: 获取已加载底模, 可为nil
+func RunHeartbeat(ctx context.Context, ws *sync.WaitGroup, node WorkerNode, workPath string, checkpoint func() string) {
+	defer ws.Done()
+
+	node.Hostname, _ = os.Hostname()
+	node.Version = Version
+	node.StartedAt = time.Now().Unix()
+
+	registered := false
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		node.Running = RunningTasks()
+		node.DiskFree, _ = DiskFree(workPath)
+		if checkpoint != nil {
+			node.Checkpoint = checkpoint()
+		}
+
+		path := "api/work/heartbeat"
+		if !registered {
+			path = "api/work/register"
+		}
+		if err := postNode(path, node); err != nil {
+			logApi.Warnf("节点心跳失败, %s, %s", path, err)
+		} else {
+			registered = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func postNode(path string, node WorkerNode) error {
+	api, err := url.JoinPath(WebUIHost, path)
+	if err != nil {
+		return err
+	}
+	byteMsg, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	body, err := WebUICipher().Encrypt(byteMsg)
+	if err != nil {
+		return err
+	}
+
+	request, _ := http.NewRequest("POST", api, bytes.NewReader([]byte(body)))
+	request.Header.Set("Content-Type", "application/json")
+	SignRequest(request, []byte(body))
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	data := struct {
+		Code int `json:"code"`
+		Data any `json:"data"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	if data.Code != 1 {
+		return fmt.Errorf("code: %d, %v", data.Code, data.Data)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"camera-webui/models"
+)
+
+var (
+	outboxClient = &http.Client{Timeout: time.Second * 30}
+
+	// 重试间隔, 从OutboxBaseDelay开始翻倍, 不超过OutboxMaxDelay, 并加入随机抖动
+	OutboxBaseDelay = time.Second * 2
+	OutboxMaxDelay  = time.Minute * 10
+	// api明确拒绝的回调最多投递次数, 网络错误一直重试
+	OutboxMaxRejects = 10
+
+	// 有新回调时立即投递
+	outboxNotify = make(chan struct{}, 1)
+)
+
+// api拒绝回调
+type callbackRejected struct {
+	code int
+	msg  any
+}
+
+func (e *callbackRejected) Error() string {
+	return fmt.Sprintf("code: %d, %v", e.code, e.msg)
+}
+
+// 回调写入发件箱, 由RunOutbox投递
+// table/workId: 对应的任务记录, api确认后删除, 没有任务记录时table为空
+func EnqueueCallback(service, table string, workId uint, callback string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	box := &models.Outbox{
+		Service:   service,
+		WorkTable: table,
+		WorkId:    workId,
+		Callback:  callback,
+		Payload:   string(data),
+		NextAt:    now,
+		CreatedAt: now,
+	}
+	if err = box.Create(); err != nil {
+		return err
+	}
+	select {
+	case outboxNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 投递发件箱中的回调, 直到ctx结束
+func RunOutbox(ctx context.Context, ws *sync.WaitGroup, service string) {
+	defer ws.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		deliverOutbox(service)
+		select {
+		case <-ctx.Done():
+			// 退出前投递已到期的回调, 其余重启后继续
+			deliverOutbox(service)
+			return
+		case <-ticker.C:
+		case <-outboxNotify:
+		}
+	}
+}
+
+func deliverOutbox(service string) {
+	boxes, err := models.GetDueOutbox(service, time.Now().Unix(), 20)
+	if err != nil {
+		logApi.Errorf("获取待回调记录失败, %s", err)
+		return
+	}
+	for _, box := range boxes {
+		err = postCallback(box.Callback, []byte(box.Payload))
+		if err == nil {
+			if err = box.Ack(); err != nil {
+				logApi.Errorf("删除回调记录: %d 失败, %s", box.ID, err)
+			}
+			logApi.Infof("%s回调: %d 成功, 投递次数: %d", service, box.WorkId, box.Tries+1)
+			continue
+		}
+
+		box.Tries++
+		box.LastError = err.Error()
+		if _, rejected := err.(*callbackRejected); rejected && box.Tries >= OutboxMaxRejects {
+			logApi.Errorf("%s回调: %d 被拒绝%d次, 放弃, %s, %s", service, box.WorkId, box.Tries, err, box.Payload)
+			if err = box.Ack(); err != nil {
+				logApi.Errorf("删除回调记录: %d 失败, %s", box.ID, err)
+			}
+			continue
+		}
+		delay := outboxBackoff(box.Tries)
+		box.NextAt = time.Now().Add(delay).Unix()
+		logApi.Warnf("%s回调: %d 失败, %s, %s后重试", service, box.WorkId, err, delay)
+		if err = box.Retry(); err != nil {
+			logApi.Errorf("更新回调记录: %d 失败, %s", box.ID, err)
+		}
+	}
+}
+
+// 指数退避, 在[d/2, d)之间随机
+func outboxBackoff(tries int) time.Duration {
+	d := OutboxMaxDelay
+	if tries <= 16 {
+		d = min(OutboxBaseDelay<<(tries-1), OutboxMaxDelay)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func postCallback(callback string, payload []byte) error {
+	body, err := WebUICipher().Encrypt(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", callback, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	SignRequest(request, []byte(body))
+	resp, err := outboxClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Code int `json:"code"`
+		Data any `json:"data"`
+	}{}
+	if err = json.Unmarshal(result, &data); err != nil {
+		return err
+	}
+	if data.Code != 1 {
+		return &callbackRejected{code: data.Code, msg: data.Data}
+	}
+	return nil
+}
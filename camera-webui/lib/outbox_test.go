@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"camera-webui/models"
+
+	protocol "camera-protocol"
+)
+
+func TestMain(m *testing.M) {
+	cipher, err := protocol.NewCipher(protocol.CIPHER_DES, "0123456789abcdefghijklmn", "", nil)
+	if err != nil {
+		panic(err)
+	}
+	webuiCipher.Store(cipher)
+	code := m.Run()
+	// models和日志在init时写到当前目录
+	os.Remove("StableDiffusion.db")
+	os.RemoveAll("logs")
+	os.Exit(code)
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for tries := 1; tries <= 40; tries++ {
+		d := OutboxMaxDelay
+		if tries <= 16 {
+			d = min(OutboxBaseDelay<<(tries-1), OutboxMaxDelay)
+		}
+		for i := 0; i < 20; i++ {
+			if got := outboxBackoff(tries); got < d/2 || got > d {
+				t.Fatalf("outboxBackoff(%d) = %s, want [%s, %s]", tries, got, d/2, d)
+			}
+		}
+	}
+	if got := outboxBackoff(1); got > 2*time.Second {
+		t.Fatalf("first retry after %s", got)
+	}
+}
+
+// 立即到期, 每次deliverOutbox都会投递
+func noOutboxDelay(t *testing.T) {
+	base, max := OutboxBaseDelay, OutboxMaxDelay
+	OutboxBaseDelay, OutboxMaxDelay = 0, 0
+	t.Cleanup(func() {
+		OutboxBaseDelay, OutboxMaxDelay = base, max
+	})
+}
+
+func dueOutbox(t *testing.T, service string) []*models.Outbox {
+	t.Helper()
+	boxes, err := models.GetDueOutbox(service, time.Now().Unix(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return boxes
+}
+
+// api拒绝OutboxMaxRejects次后放弃
+func TestDeliverOutboxRejected(t *testing.T) {
+	noOutboxDelay(t)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(`{"code":2,"data":"参数错误"}`))
+	}))
+	defer srv.Close()
+
+	service := "test_rejected"
+	if err := EnqueueCallback(service, "", 0, srv.URL, map[string]int{"task_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < OutboxMaxRejects; i++ {
+		deliverOutbox(service)
+		boxes := dueOutbox(t, service)
+		if len(boxes) != 1 || boxes[0].Tries != i || boxes[0].LastError == "" {
+			t.Fatalf("after %d rejects: %v", i, boxes)
+		}
+	}
+	deliverOutbox(service)
+	if boxes := dueOutbox(t, service); len(boxes) != 0 {
+		t.Fatalf("not dropped after %d rejects: %v", OutboxMaxRejects, boxes)
+	}
+	if n := hits.Load(); n != int32(OutboxMaxRejects) {
+		t.Fatalf("delivered %d times, want %d", n, OutboxMaxRejects)
+	}
+}
+
+// 网络或服务错误一直重试, 直到api确认
+func TestDeliverOutboxRetryUntilAck(t *testing.T) {
+	noOutboxDelay(t)
+	var down atomic.Bool
+	down.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"code":1,"data":""}`))
+	}))
+	defer srv.Close()
+
+	service := "test_retry"
+	if err := EnqueueCallback(service, "", 0, srv.URL, map[string]int{"task_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < OutboxMaxRejects+2; i++ {
+		deliverOutbox(service)
+	}
+	boxes := dueOutbox(t, service)
+	if len(boxes) != 1 || boxes[0].Tries != OutboxMaxRejects+2 {
+		t.Fatalf("unavailable api: %v", boxes)
+	}
+
+	down.Store(false)
+	deliverOutbox(service)
+	if boxes = dueOutbox(t, service); len(boxes) != 0 {
+		t.Fatalf("not acked: %v", boxes)
+	}
+}
@@ -1,6 +1,10 @@
 package lib
 
 import (
+	"fmt"
+	"sync/atomic"
+
+	protocol "camera-protocol"
 	"camera-webui/logger"
 
 	"github.com/fsnotify/fsnotify"
@@ -10,8 +14,9 @@ import (
 var (
 	// WebUI
 	WebUIHost          string
-	WebUIDeskey        string
+	webuiCipher        atomic.Pointer[protocol.Cipher] // 配置重载时整体替换
 	WebUIThread        int
+	WebUIPhotoBatch    int // 每次领取的写真任务数
 	WebUIWorkPath      string
 	WebUITrainPath     string
 	WebUICheckPath     string
@@ -20,11 +25,9 @@ var (
 	WebUILoraSavePath  string
 	WebUIRoopModelPath string
 
-	//CDN
-	QiniuBucket    string
-	QiniuAccessKey string
-	QiniuSecretKey string
-	QiniuHost      string
+	// api签名凭证
+	WorkerId     string
+	WorkerSecret string
 
 	//Baidu
 	BaiduCheckApiKey    string
@@ -47,8 +50,22 @@ func init() {
 func initConfig() {
 	// WebUI
 	WebUIHost = viper.GetString("webui.host")
-	WebUIDeskey = viper.GetString("webui.deskey")
+	if cipher, err := protocol.NewCipher(
+		viper.GetString("webui.cipher.mode"),
+		viper.GetString("webui.deskey"),
+		viper.GetString("webui.cipher.key_id"),
+		viper.GetStringMapString("webui.cipher.keys"),
+	); err != nil {
+		// 配置错误时保留原配置, 首次加载失败则无法启动
+		if webuiCipher.Load() == nil {
+			panic(fmt.Errorf("webui cipher config: %s", err))
+		}
+		logApi.Errorf("加密配置错误, %s", err)
+	} else {
+		webuiCipher.Store(cipher)
+	}
 	WebUIThread = viper.GetInt("webui.thread")
+	WebUIPhotoBatch = viper.GetInt("webui.photo_batch")
 	WebUIWorkPath = viper.GetString("webui.work_path")
 	WebUITrainPath = viper.GetString("webui.train_path")
 	WebUICheckPath = viper.GetString("webui.check_path")
@@ -56,12 +73,8 @@ func initConfig() {
 	WebUILoraPath = viper.GetString("webui.lora_path")
 	WebUILoraSavePath = viper.GetString("webui.lora_save_path")
 	WebUIRoopModelPath = viper.GetString("webui.roop_model_path")
-
-	//CDN
-	QiniuBucket = viper.GetString("qiniu.bucket")
-	QiniuAccessKey = viper.GetString("qiniu.access_key")
-	QiniuSecretKey = viper.GetString("qiniu.secret_key")
-	QiniuHost = viper.GetString("qiniu.host")
+	WorkerId = viper.GetString("webui.worker_id")
+	WorkerSecret = viper.GetString("webui.worker_secret")
 
 	DeleteMidFile = viper.GetBool("deletemidfile")
 	MaxWaitMinute = viper.GetInt("maxWaitMinute")
@@ -79,3 +92,8 @@ func dynamicConfig() {
 		initConfig()
 	})
 }
+
+// 加解密, 配置重载时可能被替换, 每次使用时获取
+func WebUICipher() *protocol.Cipher {
+	return webuiCipher.Load()
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 任务执行阶段, 与api一致
+const (
+	STAGE_DOWNLOAD   = "download"          // 下载素材
+	STAGE_CLIP_FACES = "clip_faces"        // 裁剪头像
+	STAGE_REMOVE_BG  = "remove_background" // 去背景
+	STAGE_TRAIN      = "train"             // 训练
+	STAGE_GENERATE   = "generate"          // 出图
+	STAGE_UPLOAD     = "upload"            // 上传
+)
+
+// 任务类型, 与Task.TaskType一致
+const (
+	WORK_TRAIN = 0 // 训练
+	WORK_CARD  = 1 // 分身
+	WORK_PHOTO = 2 // 写真
+	WORK_HIRES = 3 // 高清
+)
+
+var (
+	progressClient = &http.Client{Timeout: time.Second * 3}
+
+	// 同一阶段内的最小上报间隔
+	progressInterval = time.Second * 2
+)
+
+// 进度上报结构
+type TaskProgress struct {
+	TaskType int    `json:"task_type"`
+	TaskId   uint   `json:"task_id"`
+	Stage    string `json:"stage"`
+	Percent  int    `json:"percent"` // 0-100
+}
+
+// 进度上报, 阶段变化立即上报, 同一阶段内限制频率
+type ProgressReporter struct {
+	TaskType int
+	TaskId   uint
+
+	mu         sync.Mutex
+	last       TaskProgress
+	reportedAt time.Time
+}
+
+func NewProgressReporter(taskType int, taskId uint) *ProgressReporter {
+	return &ProgressReporter{TaskType: taskType, TaskId: taskId}
+}
+
+// 上报进度, 失败只记录日志, 不影响任务执行
+func (r *ProgressReporter) Report(stage string, percent int) {
+	percent = min(max(percent, 0), 100)
+
+	r.mu.Lock()
+	if stage == r.last.Stage && (percent <= r.last.Percent || time.Since(r.reportedAt) < progressInterval) {
+		r.mu.Unlock()
+		return
+	}
+	progress := TaskProgress{TaskType: r.TaskType, TaskId: r.TaskId, Stage: stage, Percent: percent}
+	r.last, r.reportedAt = progress, time.Now()
+	r.mu.Unlock()
+
+	if err := postProgress(progress); err != nil {
+		logApi.Warnf("进度上报失败, %s, %+v", err, progress)
+	}
+}
+
+func postProgress(progress TaskProgress) error {
+	api, err := url.JoinPath(WebUIHost, "api/work/progress")
+	if err != nil {
+		return err
+	}
+	byteMsg, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	body, err := WebUICipher().Encrypt(byteMsg)
+	if err != nil {
+		return err
+	}
+
+	request, _ := http.NewRequest("POST", api, bytes.NewReader([]byte(body)))
+	request.Header.Set("Content-Type", "application/json")
+	SignRequest(request, []byte(body))
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	protocol "camera-protocol"
+)
+
+// api签名请求头, 与api一致
+const (
+	HeaderWorkerId        = "X-Worker-Id"
+	HeaderWorkerTimestamp = "X-Timestamp"
+	HeaderWorkerNonce     = "X-Nonce"
+	HeaderWorkerSignature = "X-Signature"
+)
+
+// 请求api时签名, 包含规范化后的query, 见protocol.WorkerSignature
+// 未配置worker_id时不签名
+func SignRequest(request *http.Request, body []byte) {
+	if WorkerId == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := GenGUID()
+
+	request.Header.Set(HeaderWorkerId, WorkerId)
+	request.Header.Set(HeaderWorkerTimestamp, timestamp)
+	request.Header.Set(HeaderWorkerNonce, nonce)
+	request.Header.Set(HeaderWorkerSignature, protocol.WorkerSignature(WorkerSecret, request.Method, request.URL.Path, request.URL.RawQuery, timestamp, nonce, body))
+}
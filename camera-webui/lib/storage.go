@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path/filepath"
+
+	storage "camera-storage"
+
+	"github.com/spf13/viper"
+)
+
+// 对象存储
+var Store storage.Storage
+
+// 存储配置, 未配置storage.driver时使用旧的qiniu配置
+func StorageConfig() storage.Config {
+	if viper.GetString("storage.driver") == "" {
+		return storage.Config{
+			Driver:    storage.DRIVER_QINIU,
+			Host:      viper.GetString("qiniu.host"),
+			Bucket:    viper.GetString("qiniu.bucket"),
+			AccessKey: viper.GetString("qiniu.access_key"),
+			SecretKey: viper.GetString("qiniu.secret_key"),
+		}
+	}
+	return storage.Config{
+		Driver:    viper.GetString("storage.driver"),
+		Host:      viper.GetString("storage.host"),
+		Bucket:    viper.GetString("storage.bucket"),
+		AccessKey: viper.GetString("storage.access_key"),
+		SecretKey: viper.GetString("storage.secret_key"),
+		Region:    viper.GetString("storage.region"),
+		Endpoint:  viper.GetString("storage.endpoint"),
+		PathStyle: viper.GetBool("storage.path_style"),
+	}
+}
+
+// 上传本地文件, 返回公开地址
+func UploadFile(fileName, key string) (string, error) {
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if _, err := storage.PutFile(context.Background(), Store, key, fileName, contentType); err != nil {
+		return "", err
+	}
+	return Store.URL(key), nil
+}
+
+func init() {
+	var err error
+	if Store, err = storage.New(StorageConfig()); err != nil {
+		panic(fmt.Errorf("storage config: %s", err))
+	}
+}
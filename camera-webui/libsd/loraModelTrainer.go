@@ -610,7 +610,7 @@ func (t SDLoraModelTrainer160) TrainLORAModel(session string, imgCnt int) (err e
 	// x := 45 * math.Pow(float64(batchSize), float64(2))
 	// y := float64(imgCnt * Loop)
 	// t.Epoch = int(math.Floor(x / y))
-	t.Epoch = 35
+	t.Epoch = TrainEpoch
 	t.ModelQuickPick = "custom"
 	t.SaveEveryNEpochs = saveEveryNEpochs
 	t.SaveLastNModels = 1
@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
+// 最近一次设置或查询到的底模
+var loadedCheckpoint atomic.Value
+
 type SDOptions struct {
 	SDModelCheckpoint string `json:"sd_model_checkpoint"`
 }
@@ -31,5 +36,56 @@ func (opt SDOptions) ApplySDOptions() error {
 		return err
 	}
 	fmt.Println("设置模型：", string(result))
-	return err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("设置失败: %d, %s", resp.StatusCode, result)
+	}
+	if opt.SDModelCheckpoint != "" {
+		loadedCheckpoint.Store(opt.SDModelCheckpoint)
+	}
+	return nil
+}
+
+// 获取当前加载的底模, 失败返回空
+func GetCheckpoint() string {
+	url := fmt.Sprintf("%s/sdapi/v1/options", webuiHost)
+
+	request, _ := http.NewRequest("GET", url, nil)
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	opt := SDOptions{}
+	if err = json.NewDecoder(resp.Body).Decode(&opt); err != nil {
+		return ""
+	}
+	if opt.SDModelCheckpoint != "" {
+		loadedCheckpoint.Store(opt.SDModelCheckpoint)
+	}
+	return opt.SDModelCheckpoint
+}
+
+// 切换底模, 与已加载的一致时跳过
+func ApplyCheckpoint(name string) error {
+	if checkpoint, ok := loadedCheckpoint.Load().(string); ok && checkpointName(checkpoint) == checkpointName(name) {
+		return nil
+	}
+	return SDOptions{SDModelCheckpoint: name}.ApplySDOptions()
+}
+
+// 去掉webui返回的hash: a.safetensors [6ce0161689] => a.safetensors
+func checkpointName(checkpoint string) string {
+	if i := strings.Index(checkpoint, " ["); i >= 0 {
+		checkpoint = checkpoint[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(checkpoint))
+}
+
+// 已加载的底模, 优先使用缓存, 用于领取任务时的底模亲和
+func LoadedCheckpoint() string {
+	if checkpoint, ok := loadedCheckpoint.Load().(string); ok && checkpoint != "" {
+		return checkpoint
+	}
+	return GetCheckpoint()
 }
@@ -0,0 +1,110 @@
+package libsd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	progressClient = &http.Client{Timeout: time.Second * 5}
+
+	// 训练轮数
+	TrainEpoch = 35
+)
+
+// A1111出图进度
+type SDProgress struct {
+	Progress    float64 `json:"progress"`     // 0-1
+	EtaRelative float64 `json:"eta_relative"` // 预计剩余秒数
+	State       struct {
+		JobCount      int `json:"job_count"`
+		SamplingStep  int `json:"sampling_step"`
+		SamplingSteps int `json:"sampling_steps"`
+	} `json:"state"`
+}
+
+// 获取出图进度
+func GetProgress() (SDProgress, error) {
+	url := fmt.Sprintf("%s/sdapi/v1/progress?skip_current_image=true", webuiHost)
+
+	data := SDProgress{}
+	request, _ := http.NewRequest("GET", url, nil)
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return data, err
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(result, &data)
+	return data, err
+}
+
+// 中止当前出图, A1111为单实例共享, 会中止正在执行的任意任务
+func Interrupt() error {
+	url := fmt.Sprintf("%s/sdapi/v1/interrupt", webuiHost)
+
+	request, _ := http.NewRequest("POST", url, nil)
+	resp, err := progressClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 定时采样进度直到stop关闭, fn参数为0-1
+func WatchProgress(stop <-chan struct{}, interval time.Duration, sample func() float64, fn func(float64)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fn(min(max(sample(), 0), 1))
+		}
+	}
+}
+
+// 出图进度采样
+func GenerateProgress() float64 {
+	progress, err := GetProgress()
+	if err != nil {
+		return 0
+	}
+	return progress.Progress
+}
+
+// 训练进度采样, 根据kohya按epoch保存的模型(name-000010.safetensors)估算
+func TrainProgress(outputFolder, modelName string) func() float64 {
+	return func() float64 {
+		if _, err := os.Stat(filepath.Join(outputFolder, modelName+".safetensors")); err == nil {
+			return 1
+		}
+		paths, err := filepath.Glob(filepath.Join(outputFolder, modelName+"-*.safetensors"))
+		if err != nil {
+			return 0
+		}
+		epoch := 0
+		for _, path := range paths {
+			name := strings.TrimSuffix(filepath.Base(path), ".safetensors")
+			if n, err := strconv.Atoi(name[strings.LastIndex(name, "-")+1:]); err == nil {
+				epoch = max(epoch, n)
+			}
+		}
+		return float64(epoch) / float64(TrainEpoch)
+	}
+}
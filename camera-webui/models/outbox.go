@@ -0,0 +1,136 @@
+package models
+
+import (
+	"fmt"
+)
+
+// 任务状态
+const (
+	STATUS_WAIT     = 0 // 待执行
+	STATUS_RUNNING  = 1 // 执行中
+	STATUS_REPORTED = 2 // 已写入发件箱, 等待api确认
+)
+
+// 有任务记录的表, 确认后删除
+var outboxWorkTables = map[string]bool{"sdwork": true, "trainwork": true, "imgcheck": true}
+
+// 回调发件箱, 任务结果先落库, api确认后删除, 重启后继续投递
+type Outbox struct {
+	ID        int64
+	Service   string // 服务名 check train qianyi photohr
+	WorkTable string // 任务表, 为空时没有任务记录
+	WorkId    uint   // 任务ID
+	Callback  string // 回调地址
+	Payload   string // 回调Json
+	Tries     int    // 已投递次数
+	NextAt    int64  // 下次投递时间
+	LastError string // 最近一次失败原因
+	CreatedAt int64  // 创建时间戳
+}
+
+func createOutbox() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS outbox(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		service TEXT NOT NULL,
+		work_table TEXT NOT NULL DEFAULT '',
+		work_id INTEGER NOT NULL DEFAULT 0,
+		callback TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		tries INTEGER NOT NULL DEFAULT 0,
+		next_at INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_outbox_service_next ON outbox(service, next_at)")
+	return err
+}
+
+// 写入api下发的任务, 同ID的任务已上报但api未确认时(租约到期后重新下发)覆盖为待执行
+// 旧回调确认时只删除等待确认的任务记录, 不影响重新下发的任务
+func createWork(table string, id uint, jsonData, callback string, createdAt int64) error {
+	res, err := db.Exec("INSERT INTO "+table+"(id,jsondata,callback,status,created_at) VALUES(?,?,?,?,?) "+
+		"ON CONFLICT(id) DO UPDATE SET jsondata = excluded.jsondata, callback = excluded.callback, status = excluded.status, created_at = excluded.created_at WHERE status = ?",
+		id, jsonData, callback, STATUS_WAIT, createdAt, STATUS_REPORTED)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("task: %d exists", id)
+	}
+	return err
+}
+
+// 写入发件箱, 同时将任务置为等待确认
+func (o *Outbox) Create() error {
+	if o.WorkTable != "" && !outboxWorkTables[o.WorkTable] {
+		return fmt.Errorf("bad work table: %s", o.WorkTable)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO outbox(service,work_table,work_id,callback,payload,tries,next_at,created_at) VALUES(?,?,?,?,?,?,?,?)",
+		o.Service, o.WorkTable, o.WorkId, o.Callback, o.Payload, 0, o.NextAt, o.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if o.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	if o.WorkTable != "" {
+		if _, err = tx.Exec("UPDATE "+o.WorkTable+" SET status = ? WHERE id = ?", STATUS_REPORTED, o.WorkId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 到期待投递的回调
+func GetDueOutbox(service string, now int64, limit int) ([]*Outbox, error) {
+	rows, err := db.Query("SELECT id,service,work_table,work_id,callback,payload,tries,next_at,last_error,created_at FROM outbox WHERE service = ? AND next_at <= ? ORDER BY next_at asc LIMIT ?", service, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Outbox, 0)
+	for rows.Next() {
+		o := &Outbox{}
+		if err = rows.Scan(&o.ID, &o.Service, &o.WorkTable, &o.WorkId, &o.Callback, &o.Payload, &o.Tries, &o.NextAt, &o.LastError, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
+
+// 投递失败, 记录下次投递时间
+func (o *Outbox) Retry() error {
+	_, err := db.Exec("UPDATE outbox SET tries = ?, next_at = ?, last_error = ? WHERE id = ?", o.Tries, o.NextAt, o.LastError, o.ID)
+	return err
+}
+
+// api已确认, 删除回调和任务记录
+func (o *Outbox) Ack() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM outbox WHERE id = ?", o.ID); err != nil {
+		return err
+	}
+	if o.WorkTable != "" && outboxWorkTables[o.WorkTable] {
+		if _, err = tx.Exec("DELETE FROM "+o.WorkTable+" WHERE id = ? AND status = ?", o.WorkId, STATUS_REPORTED); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// 使用临时数据库, 删除init在当前目录创建的
+	db.Close()
+	os.Remove("StableDiffusion.db")
+	dir, err := os.MkdirTemp("", "outbox")
+	if err != nil {
+		panic(err)
+	}
+	if db, err = sql.Open("sqlite3", filepath.Join(dir, "test.db")); err == nil {
+		err = createOutbox()
+	}
+	for _, table := range []string{"sdwork", "trainwork"} {
+		if err == nil {
+			_, err = db.Exec("CREATE TABLE " + table + "(id INTEGER PRIMARY KEY, jsondata TEXT, callback TEXT, status INTEGER, created_at INTEGER)")
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func workRow(t *testing.T, table string, id uint) (string, int, bool) {
+	t.Helper()
+	var jsonData string
+	var status int
+	err := db.QueryRow("SELECT jsondata,status FROM "+table+" WHERE id = ?", id).Scan(&jsonData, &status)
+	if err == sql.ErrNoRows {
+		return "", 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonData, status, true
+}
+
+// 任务上报后写入发件箱, api确认后回调和任务记录一并删除
+func TestOutboxCreateAck(t *testing.T) {
+	now := time.Now().Unix()
+	work := &SDWork{ID: 1, JsonData: "{}", Callback: "http://api/callback", CreatedAt: now}
+	if err := work.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := work.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	box := &Outbox{Service: "qianyi", WorkTable: "sdwork", WorkId: 1, Callback: work.Callback, Payload: `{"code":1}`, NextAt: now, CreatedAt: now}
+	if err := box.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := workRow(t, "sdwork", 1); status != STATUS_REPORTED {
+		t.Fatalf("work status = %d, want %d", status, STATUS_REPORTED)
+	}
+
+	boxes, err := GetDueOutbox("qianyi", now, 10)
+	if err != nil || len(boxes) != 1 || boxes[0].ID != box.ID || boxes[0].Payload != box.Payload {
+		t.Fatalf("due outbox = %v, %v", boxes, err)
+	}
+
+	// 投递失败后到下次投递时间才取出
+	box.Tries, box.NextAt, box.LastError = 1, now+60, "status code: 500"
+	if err = box.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	if boxes, _ = GetDueOutbox("qianyi", now, 10); len(boxes) != 0 {
+		t.Fatalf("due outbox before next_at = %v", boxes)
+	}
+	boxes, _ = GetDueOutbox("qianyi", now+60, 10)
+	if len(boxes) != 1 || boxes[0].Tries != 1 || boxes[0].LastError != box.LastError {
+		t.Fatalf("due outbox after retry = %v", boxes)
+	}
+
+	if err = box.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if boxes, _ = GetDueOutbox("qianyi", now+60, 10); len(boxes) != 0 {
+		t.Fatalf("due outbox after ack = %v", boxes)
+	}
+	if _, _, ok := workRow(t, "sdwork", 1); ok {
+		t.Fatal("work not deleted after ack")
+	}
+}
+
+func TestOutboxBadTable(t *testing.T) {
+	box := &Outbox{Service: "qianyi", WorkTable: "user_account", WorkId: 1, Callback: "http://api/callback", Payload: "{}"}
+	if err := box.Create(); err == nil {
+		t.Fatal("outbox created for unknown work table")
+	}
+}
+
+// 重启后等待确认的任务不会重新执行, 回调继续投递
+func TestOutboxRestart(t *testing.T) {
+	now := time.Now().Unix()
+	work := &TrainWork{ID: 2, JsonData: "{}", Callback: "http://api/callback", CreatedAt: now}
+	if err := work.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := work.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	box := &Outbox{Service: "train", WorkTable: "trainwork", WorkId: 2, Callback: work.Callback, Payload: "{}", NextAt: now, CreatedAt: now}
+	if err := box.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResetTrainWork(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&TrainWork{}).GetWork(); err == nil || err.Error() != NoRowError {
+		t.Fatalf("reported work picked up again after restart: %v", err)
+	}
+	boxes, err := GetDueOutbox("train", now, 10)
+	if err != nil || len(boxes) != 1 || boxes[0].WorkId != 2 {
+		t.Fatalf("due outbox after restart = %v, %v", boxes, err)
+	}
+
+	if err = boxes[0].Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := workRow(t, "trainwork", 2); ok {
+		t.Fatal("work not deleted after ack")
+	}
+}
+
+// api在确认前重新下发同一任务时覆盖等待确认的记录, 旧回调确认不删除新任务
+func TestOutboxRedelivered(t *testing.T) {
+	now := time.Now().Unix()
+	work := &SDWork{ID: 3, JsonData: "old", Callback: "http://api/callback", CreatedAt: now}
+	if err := work.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := work.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	box := &Outbox{Service: "qianyi", WorkTable: "sdwork", WorkId: 3, Callback: work.Callback, Payload: "{}", NextAt: now, CreatedAt: now}
+	if err := box.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	again := &SDWork{ID: 3, JsonData: "new", Callback: work.Callback, CreatedAt: now}
+	if err := again.Create(); err != nil {
+		t.Fatalf("redelivered work: %v", err)
+	}
+	if jsonData, status, _ := workRow(t, "sdwork", 3); jsonData != "new" || status != STATUS_WAIT {
+		t.Fatalf("redelivered work = %s, %d", jsonData, status)
+	}
+
+	// 执行中的任务不覆盖
+	if err := again.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Create(); err == nil {
+		t.Fatal("running work overwritten")
+	}
+
+	if err := box.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, ok := workRow(t, "sdwork", 3); !ok || status != STATUS_RUNNING {
+		t.Fatalf("redelivered work deleted by old ack, status %d", status)
+	}
+	if err := again.Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -28,13 +28,16 @@ func init() {
 	if err != nil {
 		logSql.Fatal(err)
 	}
+	if err = createOutbox(); err != nil {
+		logSql.Fatal(err)
+	}
 }
 
 type SDWork struct {
 	ID           uint     // 任务ID
 	JsonData     string   // 任务Json
 	Callback     string   // 回调地址
-	Status       int      // 0-待执行 1-执行中
+	Status       int      // 0-待执行 1-执行中 2-等待回调确认
 	CreatedAt    int64    // 创建时间戳
 	TaskPath     string   // 生图时的临时目录，用于删除
 	ADModelPaths []string // 最终使用的AD模型路径，用于删除
@@ -42,8 +45,7 @@ type SDWork struct {
 
 // 创建SD任务
 func (w *SDWork) Create() error {
-	_, err := db.Exec("INSERT INTO sdwork(id,jsondata,callback,status,created_at) VALUES(?,?,?,?,?)", w.ID, w.JsonData, w.Callback, 0, w.CreatedAt)
-	return err
+	return createWork("sdwork", w.ID, w.JsonData, w.Callback, w.CreatedAt)
 }
 
 // 是否存在
@@ -77,9 +79,9 @@ func (w *SDWork) Delete() error {
 	return err
 }
 
-// 批量重置任务
+// 批量重置执行中的任务, 等待回调确认的由发件箱处理
 func ResetSDWork() error {
-	_, err := db.Exec("UPDATE sdwork SET status=0")
+	_, err := db.Exec("UPDATE sdwork SET status=0 WHERE status = 1")
 	return err
 }
 
@@ -88,15 +90,14 @@ type TrainWork struct {
 	ID        uint   // 任务ID
 	JsonData  string // 任务Json
 	Callback  string // 回调地址
-	Status    int    // 0-待执行 1-执行中
+	Status    int    // 0-待执行 1-执行中 2-等待回调确认
 	CreatedAt int64  // 创建时间戳
 	TaskPath  string //训练时的临时目录
 }
 
 // 创建SD任务
 func (w *TrainWork) Create() error {
-	_, err := db.Exec("INSERT INTO trainwork(id,jsondata,callback,status,created_at) VALUES(?,?,?,?,?)", w.ID, w.JsonData, w.Callback, 0, w.CreatedAt)
-	return err
+	return createWork("trainwork", w.ID, w.JsonData, w.Callback, w.CreatedAt)
 }
 
 // 是否存在
@@ -130,9 +131,9 @@ func (w *TrainWork) Delete() error {
 	return err
 }
 
-// 批量重置任务
+// 批量重置执行中的任务, 等待回调确认的由发件箱处理
 func ResetTrainWork() error {
-	_, err := db.Exec("UPDATE trainwork SET status=0")
+	_, err := db.Exec("UPDATE trainwork SET status=0 WHERE status = 1")
 	return err
 }
 
@@ -141,7 +142,7 @@ type CheckWork struct {
 	ID        uint   // 任务ID
 	JsonData  string // 任务Json
 	Callback  string // 回调地址
-	Status    int    // 0-待执行 1-执行中
+	Status    int    // 0-待执行 1-执行中 2-等待回调确认
 	CreatedAt int64  // 创建时间戳
 	TaskPath  string // 检查临时目录
 }
@@ -186,8 +187,8 @@ func (w *CheckWork) Delete() error {
 	return err
 }
 
-// 批量重置任务
+// 批量重置执行中的任务, 等待回调确认的由发件箱处理
 func ResetCheckWork() error {
-	_, err := db.Exec("UPDATE imgcheck SET status=0")
+	_, err := db.Exec("UPDATE imgcheck SET status=0 WHERE status = 1")
 	return err
 }
@@ -91,12 +91,18 @@ func RunCheck(testWork *models.CheckWork) {
 	}
 
 	fmt.Println("获取到任务，进行解析......")
+	defer lib.TaskRunning()()
 	task := lib.TaskCheck{}
 	if err := json.Unmarshal([]byte(ckWork.JsonData), &task); err != nil {
 		logTask.Errorf("json解析失败, %s, %s", err, ckWork.JsonData)
 		checkFailed(ckWork, INVALID_PARAM, "json解析失败")
 		return
 	}
+	if err := task.CheckVersion(); err != nil {
+		logTask.Errorf("任务: %d, %s", ckWork.ID, err)
+		checkFailed(ckWork, INVALID_PARAM, err.Error())
+		return
+	}
 
 	// 下载图片
 	folderName := fmt.Sprintf("%d_%s", time.Now().Unix(), lib.GenGUID())
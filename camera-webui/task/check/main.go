@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	_ "camera-webui/config"
+	"camera-webui/lib"
 	"camera-webui/task/check/cron"
 )
 
@@ -23,10 +24,15 @@ func main() {
 	// stable-diffusion
 	go cron.CheckService(ctx, ws)
 
-	// 回调
+	// 节点注册和心跳
+	ws.Add(1)
+	node := lib.WorkerNode{Service: "check", TaskTypes: []string{"front", "side"}, Threads: 1}
+	go lib.RunHeartbeat(ctx, ws, node, lib.WebUICheckPath, nil)
+
+	// 回调发件箱
 	ctxCB, cancelCB := context.WithCancel(context.Background())
 	wscb.Add(1)
-	go cron.CallbackTask(ctxCB, wscb)
+	go lib.RunOutbox(ctxCB, wscb, "check")
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
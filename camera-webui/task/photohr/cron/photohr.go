@@ -3,7 +3,6 @@ package cron
 import (
 	"context"
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -55,6 +54,16 @@ func RunPhotoHr() {
 	}
 
 	fmt.Println("获取到任务，进行解析......")
+	defer lib.TaskRunning()()
+	if err := task.CheckVersion(); err != nil {
+		logTask.Errorf("任务: %d, %s", task.TaskId, err)
+		checkFailed(task, INVALID_PARAM, err.Error())
+		return
+	}
+
+	defer lib.WatchCancel(lib.WORK_HIRES, uint(task.TaskId), nil)()
+	progress := lib.NewProgressReporter(lib.WORK_HIRES, uint(task.TaskId))
+	progress.Report(lib.STAGE_DOWNLOAD, 0)
 
 	// 下载图片
 	folderName := fmt.Sprintf("%d_%d", time.Now().Unix(), task.TaskId)
@@ -68,23 +77,27 @@ func RunPhotoHr() {
 	}
 
 	// 高清处理
+	progress.Report(lib.STAGE_GENERATE, 20)
 	hrPath := filepath.Join(basePath, "hr"+fileExt)
 	if err = libsd.ImageHires(downloadPath, hrPath); err != nil {
 		logTask.Errorf("高清处理: %s 失败, %s", task.ImageUrl, err)
 		checkFailed(task, FAILURE, "高清处理失败")
 		return
 	}
+	// 高清处理不可中止, 完成后检查是否已取消
+	if lib.IsCanceled(lib.WORK_HIRES, uint(task.TaskId)) {
+		os.RemoveAll(basePath)
+		checkFailed(task, CANCELED, "任务已取消")
+		return
+	}
+
 	// 上传CDN
+	progress.Report(lib.STAGE_UPLOAD, 80)
 	key := lib.GenGUID()
 	hrKey := fmt.Sprintf("cphoto/%s/%s/%s.png", key[:2], key[2:4], key[4:])
-	if _, err = lib.UploadQNCDN(hrPath, hrKey); err != nil {
-		logTask.Errorf("上传CDN失败, %s", err)
-		checkFailed(task, FAILURE, "上传CDN失败")
-		return
-	}
-	hrUrl, err := url.JoinPath(lib.QiniuHost, hrKey)
+	hrUrl, err := lib.UploadFile(hrPath, hrKey)
 	if err != nil {
-		logTask.Errorf("url拼接失败: %s", err)
+		logTask.Errorf("上传CDN失败, %s", err)
 		checkFailed(task, FAILURE, "上传CDN失败")
 		return
 	}
@@ -95,8 +108,8 @@ func RunPhotoHr() {
 	if err = libsd.AddWatermark(hrPath, waterFileName); err == nil {
 		// 上传CDN
 		waterKey := fmt.Sprintf("cphoto/%s/%s/%s.png", key[:2], key[2:4], key[4:26])
-		if _, err = lib.UploadQNCDN(waterFileName, waterKey); err == nil {
-			waterUrl, _ = url.JoinPath(lib.QiniuHost, waterKey)
+		if waterUrl, err = lib.UploadFile(waterFileName, waterKey); err != nil {
+			logTask.Errorf("水印图上传CDN失败, %s", err)
 		}
 	}
 
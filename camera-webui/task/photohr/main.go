@@ -8,6 +8,8 @@ import (
 	"syscall"
 
 	_ "camera-webui/config"
+	"camera-webui/lib"
+	"camera-webui/libsd"
 	"camera-webui/task/photohr/cron"
 )
 
@@ -23,10 +25,19 @@ func main() {
 	// stable-diffusion
 	go cron.PhotoHrService(ctx, ws)
 
-	// 回调
+	// 节点注册和心跳
+	ws.Add(1)
+	node := lib.WorkerNode{Service: "photohr", TaskTypes: []string{"hr"}, Threads: 1}
+	go lib.RunHeartbeat(ctx, ws, node, lib.WebUIPhotoHrPath, libsd.GetCheckpoint)
+
+	// 查询取消的任务
+	ws.Add(1)
+	go lib.RunCancelWatcher(ctx, ws)
+
+	// 回调发件箱
 	ctxCB, cancelCB := context.WithCancel(context.Background())
 	wscb.Add(1)
-	go cron.CallbackTask(ctxCB, wscb)
+	go lib.RunOutbox(ctxCB, wscb, "photohr")
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
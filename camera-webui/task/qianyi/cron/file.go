@@ -4,10 +4,18 @@ import (
 	"camera-webui/lib"
 	"camera-webui/models"
 	"os"
+	"slices"
 )
 
 func DeleteTaskPath(sdWork *models.SDWork) {
-	if lib.DeleteMidFile && len(sdWork.TaskPath) > 0 {
+	if lib.DeleteMidFile {
+		RemoveTaskPath(sdWork)
+	}
+}
+
+// 删除任务目录, 不受DeleteMidFile控制
+func RemoveTaskPath(sdWork *models.SDWork) {
+	if len(sdWork.TaskPath) > 0 {
 		if err := os.RemoveAll(sdWork.TaskPath); err != nil {
 			logTask.Warningf("删除生成目录: %s 失败, %s", sdWork.TaskPath, err)
 		}
@@ -15,6 +23,26 @@ func DeleteTaskPath(sdWork *models.SDWork) {
 	}
 }
 
+// 同批任务共用的AD模型, 全部完成后删除
+type workBatch struct {
+	adModelPaths []string
+}
+
+func (b *workBatch) addADModel(path string) {
+	if !slices.Contains(b.adModelPaths, path) {
+		b.adModelPaths = append(b.adModelPaths, path)
+	}
+}
+
+func (b *workBatch) cleanup() {
+	for _, path := range b.adModelPaths {
+		if err := os.RemoveAll(path); err != nil {
+			logTask.Warningf("删除AD模型: %s 失败, %s", path, err)
+		}
+	}
+	b.adModelPaths = nil
+}
+
 func DeleteADModelPaths(sdWork *models.SDWork) {
 	if len(sdWork.ADModelPaths) > 0 {
 		for _, path := range sdWork.ADModelPaths {
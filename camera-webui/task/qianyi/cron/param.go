@@ -6,6 +6,7 @@ const (
 	FAILURE       RespCode = 0 // 失败
 	SUCCESS       RespCode = 1 // 成功
 	INVALID_PARAM RespCode = 2 // 参数错误
+	CANCELED      RespCode = 3 // 任务已取消
 )
 
 type Response struct {
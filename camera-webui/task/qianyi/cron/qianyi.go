@@ -3,11 +3,11 @@ package cron
 import (
 	"context"
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"camera-webui/lib"
@@ -25,6 +25,10 @@ var (
 
 	emptySleep = time.Second * 3
 	errorSleep = time.Second * 30
+
+	// A1111同时只执行一个出图, 多线程时在此排队, 取消时只中止自己的出图
+	generateLock sync.Mutex
+	generating   atomic.Pointer[models.SDWork]
 )
 
 func TaskService(ctx context.Context, ws *sync.WaitGroup) {
@@ -56,56 +60,131 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 		wcs.Done()
 	}()
 	fmt.Println("开始执行任务......")
-	sdwork := &models.SDWork{}
+	works := []*models.SDWork{testWork}
 	if testWork == nil {
-		// 取任务
-		if err := sdwork.GetWork(); err != nil && err.Error() != models.NoRowError {
-			logTask.Errorf("获取任务失败, %s", err)
-			time.Sleep(emptySleep)
+		var ok bool
+		if works, ok = fetchWorks(); !ok {
 			return
 		}
-		if sdwork.JsonData == "" {
-			// 从Web获取任务
-			task, err := lib.GetPhotoTask()
-			if err != nil {
-				logTask.Errorf("获取WEB任务失败, %s", err)
-				time.Sleep(errorSleep)
-				return
-			}
-			if task.Callback == "" {
-				time.Sleep(emptySleep)
-				return
-			}
-			data, err := json.Marshal(task)
-			if err != nil {
-				logTask.Errorf("json序列化失败, %s", err)
-				time.Sleep(errorSleep)
-				return
-			}
+	}
 
-			sdwork.ID = task.TaskId
-			sdwork.JsonData = string(data)
-			sdwork.Status = 0
-			sdwork.CreatedAt = time.Now().Unix()
-			sdwork.Callback = task.Callback
-			err = sdwork.Create()
-			if err != nil {
-				logTask.Errorf("创建任务失败, %s", err)
-				time.Sleep(errorSleep)
-				return
-			}
+	// 同批任务依次执行, 共用模型, 全部完成后删除AD模型
+	// Web按依次执行给第i个任务顺延i个租约时长, 开始执行后由进度上报续租, 不能改为并发执行
+	// 领取后整批登记取消, 排队中被取消的任务不再执行
+	unwatch := make([]func(), len(works))
+	for i, sdwork := range works {
+		unwatch[i] = watchWork(sdwork)
+	}
+	batch := &workBatch{}
+	defer batch.cleanup()
+	for i, sdwork := range works {
+		runWork(sdwork, batch)
+		unwatch[i]()
+	}
+}
+
+// 登记任务取消, 被取消时中止正在执行的出图, 返回的函数在任务结束时调用
+func watchWork(sdwork *models.SDWork) func() {
+	task := lib.Task{}
+	// 解析失败的任务在runWork中上报
+	if err := json.Unmarshal([]byte(sdwork.JsonData), &task); err != nil {
+		return func() {}
+	}
+	return lib.WatchCancel(task.TaskType, sdwork.ID, func() {
+		if generating.Load() != sdwork {
+			return
+		}
+		if err := libsd.Interrupt(); err != nil {
+			logTask.Warnf("中止出图: %d 失败, %s", sdwork.ID, err)
+		}
+	})
+}
+
+// 取任务, 先取本地未完成的任务, 再从Web批量获取
+func fetchWorks() ([]*models.SDWork, bool) {
+	sdwork := &models.SDWork{}
+	if err := sdwork.GetWork(); err != nil && err.Error() != models.NoRowError {
+		logTask.Errorf("获取任务失败, %s", err)
+		time.Sleep(emptySleep)
+		return nil, false
+	}
+	if sdwork.JsonData != "" {
+		return []*models.SDWork{sdwork}, true
+	}
+
+	// 从Web获取任务
+	tasks, err := lib.GetPhotoTasks(libsd.LoadedCheckpoint(), max(lib.WebUIPhotoBatch, 1))
+	if err != nil {
+		logTask.Errorf("获取WEB任务失败, %s", err)
+		time.Sleep(errorSleep)
+		return nil, false
+	}
+	if len(tasks) == 0 {
+		time.Sleep(emptySleep)
+		return nil, false
+	}
+
+	works := make([]*models.SDWork, 0, len(tasks))
+	for _, task := range tasks {
+		data, err := json.Marshal(task)
+		if err != nil {
+			logTask.Errorf("json序列化失败, %s", err)
+			continue
 		}
-	} else {
-		sdwork = testWork
+
+		sdwork := &models.SDWork{
+			ID:        task.TaskId,
+			JsonData:  string(data),
+			Status:    0,
+			CreatedAt: time.Now().Unix(),
+			Callback:  task.Callback,
+		}
+		// 同批任务由当前协程执行, 直接置为执行中
+		if err = sdwork.Create(); err == nil {
+			err = sdwork.UpdateStatus()
+		}
+		if err != nil {
+			logTask.Errorf("创建任务: %d 失败, %s", task.TaskId, err)
+			continue
+		}
+		works = append(works, sdwork)
+	}
+	if len(works) == 0 {
+		time.Sleep(errorSleep)
+		return nil, false
 	}
+	return works, true
+}
 
+func runWork(sdwork *models.SDWork, batch *workBatch) {
 	fmt.Println("获取到任务，进行解析......")
+	defer lib.TaskRunning()()
 	task := lib.Task{}
 	if err := json.Unmarshal([]byte(sdwork.JsonData), &task); err != nil {
 		logTask.Errorf("json解析失败, %s, %s", err, sdwork.JsonData)
 		taskFailed(sdwork, INVALID_PARAM, "json解析失败")
 		return
 	}
+	if err := task.CheckVersion(); err != nil {
+		logTask.Errorf("任务: %d, %s", sdwork.ID, err)
+		taskFailed(sdwork, INVALID_PARAM, err.Error())
+		return
+	}
+
+	// 取消已在RunTask中登记, 同批排在后面的任务开始前可能已被取消
+	canceled := func() bool {
+		if !lib.IsCanceled(task.TaskType, sdwork.ID) {
+			return false
+		}
+		taskCanceled(sdwork)
+		return true
+	}
+	if canceled() {
+		return
+	}
+
+	progress := lib.NewProgressReporter(task.TaskType, sdwork.ID)
+	progress.Report(lib.STAGE_DOWNLOAD, 0)
 
 	// 下载图片
 	var err error
@@ -236,16 +315,21 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 				}
 			}
 
-			sdwork.ADModelPaths = append(sdwork.ADModelPaths, dstLoraModelPath)
+			batch.addADModel(dstLoraModelPath)
 		}
 	}
 
-	// 设置模型
+	if canceled() {
+		return
+	}
+
+	// 设置模型, 已加载时跳过
 	fmt.Println(stype.MainModelPath)
-	options := libsd.SDOptions{
-		SDModelCheckpoint: filepath.Base(stype.MainModelPath),
+	if err = libsd.ApplyCheckpoint(filepath.Base(stype.MainModelPath)); err != nil {
+		logTask.Errorf("切换模型: %s 失败, %s", stype.MainModelPath, err)
+		taskFailed(sdwork, FAILURE, "切换模型失败")
+		return
 	}
-	options.ApplySDOptions()
 
 	//出图
 	savePath := filepath.Join(basePath, "output_image")
@@ -258,7 +342,15 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 		return
 	}
 
-	images, seed, err = tig.GenerateImages()
+	// 出图进度 10-90, 二次生成时两次各占一半
+	passes := 1
+	if task.SecondGeneration {
+		passes = 2
+	}
+	images, seed, err = generateImages(sdwork, task.TaskType, tig, progress, 0, passes)
+	if canceled() {
+		return
+	}
 	if err != nil {
 		logTask.Errorf("生成图像: %s, 失败, %s", basePath, err)
 		taskFailed(sdwork, FAILURE, "生成图像失败")
@@ -281,7 +373,10 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 		tig.RoopUnit = libsd.RoopUnit{}
 
 		// 二次生成
-		images, seed, err = tig.GenerateImages()
+		images, seed, err = generateImages(sdwork, task.TaskType, tig, progress, 1, passes)
+		if canceled() {
+			return
+		}
 		if err != nil {
 			logTask.Errorf("生成图像: %s, 失败, %s", basePath, err)
 			taskFailed(sdwork, FAILURE, "生成图像失败")
@@ -290,6 +385,7 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 	}
 
 	os.MkdirAll(savePath, 0644)
+	progress.Report(lib.STAGE_UPLOAD, 90)
 
 	urls, wurls := make([]string, 0), make([]string, 0)
 	for i, imgb64 := range images {
@@ -308,18 +404,12 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 
 		// 上传CDN
 		imgKey := fmt.Sprintf("cphoto/%s/%s/%s", imgName[:2], imgName[2:4], imgName[4:])
-		if _, err = lib.UploadQNCDN(imgPath, imgKey); err != nil {
+		imgUrl, err := lib.UploadFile(imgPath, imgKey)
+		if err != nil {
 			logTask.Errorf("上传CDN失败, %s", err)
 			taskFailed(sdwork, FAILURE, "上传CDN失败")
 			return
 		}
-
-		imgUrl, err := url.JoinPath(lib.QiniuHost, imgKey)
-		if err != nil {
-			logTask.Errorf("图片Url合并失败, %s", err)
-			taskFailed(sdwork, FAILURE, "图片Url合并失败")
-			return
-		}
 		urls = append(urls, imgUrl)
 
 		// 添加水印
@@ -329,10 +419,8 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 		} else {
 			// 上传CDN
 			waterKey := fmt.Sprintf("cphoto/%s/%s/%s", waterImgName[:2], waterImgName[2:4], waterImgName[4:])
-			if _, err = lib.UploadQNCDN(waterPath, waterKey); err == nil {
-				if waterUrl, err := url.JoinPath(lib.QiniuHost, waterKey); err == nil {
-					wurls = append(wurls, waterUrl)
-				}
+			if waterUrl, err := lib.UploadFile(waterPath, waterKey); err == nil {
+				wurls = append(wurls, waterUrl)
 			}
 		}
 		if len(wurls) == 0 {
@@ -350,6 +438,28 @@ func RunTask(wch chan int, wcs *sync.WaitGroup, testWork *models.SDWork) {
 	taskSuccess(sdwork, urls, wurls, seed)
 }
 
+// 出图并上报进度, pass为第几次生成
+// 排队等待A1111期间被取消的不再出图
+func generateImages(sdwork *models.SDWork, taskType int, tig libsd.SDTextToImageGenerator, progress *lib.ProgressReporter, pass, passes int) ([]string, int64, error) {
+	generateLock.Lock()
+	defer generateLock.Unlock()
+	generating.Store(sdwork)
+	defer generating.Store(nil)
+	if lib.IsCanceled(taskType, sdwork.ID) {
+		return nil, -1, fmt.Errorf("任务已取消")
+	}
+
+	start, span := 10+80*pass/passes, 80/passes
+	progress.Report(lib.STAGE_GENERATE, start)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go libsd.WatchProgress(stop, 2*time.Second, libsd.GenerateProgress, func(p float64) {
+		progress.Report(lib.STAGE_GENERATE, start+int(p*float64(span)))
+	})
+	return tig.GenerateImages()
+}
+
 // 创建生图器
 func createText2img(task lib.Task) (libsd.SDTextToImageGenerator, error) {
 	tig := libsd.SDTextToImageGenerator{
@@ -1,25 +1,10 @@
 package cron
 
 import (
-	"bytes"
-	"context"
-	"io"
-	"net/http"
-	"sync"
-	"time"
-
 	"camera-webui/lib"
 	"camera-webui/models"
 )
 
-var (
-	cwch   = make(chan lib.SDCallback, 100)
-	client = &http.Client{Timeout: time.Second * 10}
-
-	// 回调重试次数
-	retryCT = 3
-)
-
 // 任务失败回调
 func trainFailed(sdwork *models.TrainWork, code RespCode, msg string) {
 	cb := lib.SDCallback{
@@ -28,14 +13,25 @@ func trainFailed(sdwork *models.TrainWork, code RespCode, msg string) {
 		Message:  msg,
 		Callback: sdwork.Callback,
 	}
-	cwch <- cb
-	if err := sdwork.Delete(); err != nil {
-		logTask.Errorf("删除任务: %d 失败, %s", sdwork.ID, err)
-	}
+	enqueueCallback(sdwork, cb)
 
 	DeleteTaskPath(sdwork)
 }
 
+// 任务取消回调, 训练已中止, 删除训练目录
+func trainCanceled(sdwork *models.TrainWork) {
+	logTask.Infof("train任务: %d 已取消", sdwork.ID)
+	cb := lib.SDCallback{
+		TaskId:   sdwork.ID,
+		Code:     int(CANCELED),
+		Message:  "任务已取消",
+		Callback: sdwork.Callback,
+	}
+	enqueueCallback(sdwork, cb)
+
+	RemoveTaskPath(sdwork)
+}
+
 // 任务成功回调
 func trainSuccess(sdwork *models.TrainWork, loras []lib.LoraModel, gender int) {
 	logTask.Infof("train任务: %d 成功", sdwork.ID)
@@ -46,91 +42,15 @@ func trainSuccess(sdwork *models.TrainWork, loras []lib.LoraModel, gender int) {
 		Callback: sdwork.Callback,
 		Gender:   gender,
 	}
-	cwch <- cb
-	if err := sdwork.Delete(); err != nil {
-		logTask.Errorf("删除任务: %d 失败, %s", sdwork.ID, err)
-	}
+	enqueueCallback(sdwork, cb)
 
 	DeleteTaskPath(sdwork)
 }
 
-// 回调
-func CallbackTask(ctx context.Context, ws *sync.WaitGroup) {
-	defer ws.Done()
-
-	for {
-		select {
-		case <-ctx.Done():
-			logTask.Debug("stop callback")
-			for {
-				select {
-				case cb := <-cwch:
-					runCallback(cb)
-				case <-time.After(time.Second * 3):
-					return
-				}
-			}
-		case cb := <-cwch:
-			runCallback(cb)
-		}
-	}
-}
-
-func runCallback(cb lib.SDCallback) {
-	byteMsg, err := json.Marshal(cb)
-	if err != nil {
-		logTask.Errorf("json序列化失败, %s, %+v", err, cb)
-		return
-	}
-	body, err := lib.DESEncrypt(byteMsg, lib.WebUIDeskey)
-	if err != nil {
-		logTask.Errorf("3DES加密失败, %s, %+v", err, cb)
-		return
-	}
-
-	request, _ := http.NewRequest("POST", cb.Callback, bytes.NewReader([]byte(body)))
-	request.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(request)
-	if err != nil {
-		logTask.Errorf("回调失败, %s, %+v", err, cb)
-		if cb.FCT+1 < retryCT {
-			cb.IncrFCT()
-			cwch <- cb
-		}
-		time.Sleep(errorSleep)
-		return
-	}
-	defer resp.Body.Close()
-
-	result, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logTask.Errorf("回调失败, %s, %+v", err, cb)
-		if cb.FCT+1 < retryCT {
-			cb.IncrFCT()
-			cwch <- cb
-		}
-		time.Sleep(errorSleep)
-		return
-	}
-
-	data := Response{}
-	if err := json.Unmarshal(result, &data); err != nil {
-		logTask.Errorf("回调解析失败, %s, %+v", err, cb)
-		if cb.FCT+1 < retryCT {
-			cb.IncrFCT()
-			cwch <- cb
-		}
-		time.Sleep(errorSleep)
-		return
-	}
-	if data.Code != SUCCESS {
-		logTask.Errorf("回调失败, %s, %+v", data.Data.(string), cb)
-		if cb.FCT+1 < retryCT {
-			cb.IncrFCT()
-			cwch <- cb
-		}
-		time.Sleep(errorSleep)
-		return
+// 回调写入发件箱, api确认后删除任务记录
+func enqueueCallback(sdwork *models.TrainWork, cb lib.SDCallback) {
+	cb.Version = lib.SchemaVersion
+	if err := lib.EnqueueCallback("train", "trainwork", sdwork.ID, cb.Callback, cb); err != nil {
+		logTask.Errorf("写入回调: %d 失败, %s", sdwork.ID, err)
 	}
-	logTask.Infof("train回调: %d 成功", cb.TaskId)
 }
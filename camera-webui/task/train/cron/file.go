@@ -6,11 +6,18 @@ import (
 	"os"
 )
 
-func DeleteTaskPath(trainWork *models.TrainWork) {
-	if lib.DeleteMidFile && len(trainWork.TaskPath) > 0 {
+// 删除任务目录, 不受DeleteMidFile控制
+func RemoveTaskPath(trainWork *models.TrainWork) {
+	if len(trainWork.TaskPath) > 0 {
 		if err := os.RemoveAll(trainWork.TaskPath); err != nil {
 			logTask.Warningf("删除检查目录: %s 失败, %s", trainWork.TaskPath, err)
 		}
 		trainWork.TaskPath = ""
 	}
 }
+
+func DeleteTaskPath(trainWork *models.TrainWork) {
+	if lib.DeleteMidFile {
+		RemoveTaskPath(trainWork)
+	}
+}
@@ -3,7 +3,6 @@ package cron
 import (
 	"context"
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -98,12 +97,28 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 	}
 
 	fmt.Println("获取到任务，进行解析......")
+	defer lib.TaskRunning()()
 	task := lib.Task{}
 	if err := json.Unmarshal([]byte(sdwork.JsonData), &task); err != nil {
 		logTask.Errorf("json解析失败, %s, %s", err, sdwork.JsonData)
 		trainFailed(sdwork, INVALID_PARAM, "json解析失败")
 		return
 	}
+	if err := task.CheckVersion(); err != nil {
+		logTask.Errorf("任务: %d, %s", sdwork.ID, err)
+		trainFailed(sdwork, INVALID_PARAM, err.Error())
+		return
+	}
+
+	progress := lib.NewProgressReporter(lib.WORK_TRAIN, sdwork.ID)
+
+	// 任务取消时中止训练, 未开始训练时在下一步检查
+	session := lib.GenGUID()
+	defer lib.WatchCancel(lib.WORK_TRAIN, sdwork.ID, func() {
+		if err := libsd.CancelTrainTask(session); err != nil {
+			logTask.Warnf("中止训练: %d 失败, %s", sdwork.ID, err)
+		}
+	})()
 
 	folderName := fmt.Sprintf("%d_%d", time.Now().Unix(), task.TaskId)
 	basePath := filepath.Join(lib.WebUITrainPath, folderName)
@@ -115,6 +130,7 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 	downloadPath := filepath.Join(basePath, "download")
 	success := 0
 	for _, imgurl := range task.LoraTrain.ImageUrl {
+		progress.Report(lib.STAGE_DOWNLOAD, success*10/len(task.LoraTrain.ImageUrl))
 		bimgFullName := filepath.Join(downloadPath, filepath.Base(imgurl))
 		if err := lib.DownloadFile(imgurl, bimgFullName); err != nil {
 			break
@@ -127,6 +143,7 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 	}
 
 	//裁剪头像
+	progress.Report(lib.STAGE_CLIP_FACES, 10)
 	result, err := libsd.ClipFaces(downloadPath, clipPath, false)
 	if err != nil {
 		logTask.Errorf("裁剪头像: %s 失败, %s", downloadPath, err)
@@ -175,6 +192,7 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 	}
 
 	// 人脸去背景
+	progress.Report(lib.STAGE_REMOVE_BG, 20)
 	noBGPath := filepath.Join(basePath, "nobackground")
 	if err := libsd.BatchRemoveBackground(clipPath, noBGPath, false); err != nil {
 		logTask.Errorf("去背景: %s 失败, %s", clipPath, err)
@@ -229,8 +247,24 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 		LoggingFolder:   trainLogPath,
 		ModelOutputName: modelName,
 	}
-	session := lib.GenGUID()
+	if lib.IsCanceled(lib.WORK_TRAIN, sdwork.ID) {
+		trainCanceled(sdwork)
+		return
+	}
+
+	// 训练进度 25-95
+	progress.Report(lib.STAGE_TRAIN, 25)
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go libsd.WatchProgress(stopProgress, 10*time.Second, libsd.TrainProgress(trainOutputPath, modelName), func(p float64) {
+		progress.Report(lib.STAGE_TRAIN, 25+int(p*70))
+	})
+
 	if err = trainer.TrainLORAModel(session, imageCnt); err != nil {
+		if lib.IsCanceled(lib.WORK_TRAIN, sdwork.ID) {
+			trainCanceled(sdwork)
+			return
+		}
 		logTask.Errorf("训练模型: %s, 失败, %s", trainImagePath, err)
 		trainFailed(sdwork, FAILURE, "训练模型失败")
 		return
@@ -250,6 +284,10 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 				waitChan <- 1
 				return
 			case <-ticker.C:
+				if lib.IsCanceled(lib.WORK_TRAIN, sdwork.ID) {
+					waitChan <- 1
+					return
+				}
 				if lib.FileExists(tensorPathLast) {
 					size := lib.FileSize(tensorPathLast)
 					if modelSize > 0 && size == modelSize {
@@ -267,31 +305,31 @@ func RunTrain(ctx context.Context, tempWork *models.TrainWork) {
 	}()
 	<-waitChan
 
+	if lib.IsCanceled(lib.WORK_TRAIN, sdwork.ID) {
+		trainCanceled(sdwork)
+		return
+	}
 	if !lib.FileExists(tensorPathLast) {
 		logTask.Errorf("训练模型结果不存在: %s", modelName)
 		libsd.CancelTrainTask(session)
 		trainFailed(sdwork, FAILURE, "训练模型结果不存在")
 		return
 	}
+	progress.Report(lib.STAGE_UPLOAD, 95)
 	fn := task.UserId % lib.FolderCount
 	savePath := filepath.Join(lib.WebUILoraSavePath, fmt.Sprintf("%d", fn))
 	os.MkdirAll(savePath, os.ModePerm)
 	absPathLast := filepath.Join(savePath, fmt.Sprintf("%s.safetensors", modelName))
 
 	// 上传CDN
-	// if _, err := lib.UploadQNCDN(absPathLast, fmt.Sprintf("lora/%d/%s", fn, filepath.Base(absPathLast))); err != nil {
+	// if _, err := lib.UploadFile(absPathLast, fmt.Sprintf("lora/%d/%s", fn, filepath.Base(absPathLast))); err != nil {
 	// 	logTask.Errorf("模型2上传CDN: %s, 失败:%s", absPathLast, err)
 	// 	trainFailed(sdwork, FAILURE, "模型2上传CDN失败")
 	// 	return
 	// }
 	//we
 	os.Rename(tensorPathLast, absPathLast)
-	modelUrl2, err := url.JoinPath(lib.QiniuHost, fmt.Sprintf("lora/%d/%s", fn, filepath.Base(absPathLast)))
-	if err != nil {
-		logTask.Errorf("模型2路径拼接: %s, 失败:%s", absPathLast, err)
-		trainFailed(sdwork, FAILURE, "模型2路径拼接失败")
-		return
-	}
+	modelUrl2 := lib.Store.URL(fmt.Sprintf("lora/%d/%s", fn, filepath.Base(absPathLast)))
 
 	// 删除训练目录
 	// os.RemoveAll(basePath)
@@ -0,0 +1,283 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ALIPAY_GATEWAY         = "https://openapi.alipay.com/gateway.do"
+	ALIPAY_SANDBOX_GATEWAY = "https://openapi-sandbox.dl.alipaydev.com/gateway.do"
+)
+
+type AlipayConfig struct {
+	AppId           string
+	PrivateKey      []byte // 应用私钥
+	AlipayPublicKey []byte // 支付宝公钥
+	Sandbox         bool
+	Gateway         string // 为空时按Sandbox选择网关
+}
+
+// 支付宝 APP支付, 公钥模式 RSA2
+type alipay struct {
+	cfg    AlipayConfig
+	key    *rsa.PrivateKey
+	public *rsa.PublicKey
+	client *http.Client
+}
+
+func NewAlipay(cfg AlipayConfig) (Provider, error) {
+	if cfg.AppId == "" {
+		return nil, fmt.Errorf("payment: incomplete alipay config")
+	}
+	key, err := ParsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	public, err := ParsePublicKey(cfg.AlipayPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Gateway == "" {
+		cfg.Gateway = ALIPAY_GATEWAY
+		if cfg.Sandbox {
+			cfg.Gateway = ALIPAY_SANDBOX_GATEWAY
+		}
+	}
+	return &alipay{cfg: cfg, key: key, public: public, client: &http.Client{Timeout: time.Second * 30}}, nil
+}
+
+func (a *alipay) Name() string {
+	return PROVIDER_ALIPAY
+}
+
+// 本地生成签名后的order_string, 客户端直接调起支付
+func (a *alipay) CreateOrder(ctx context.Context, order *Order) (map[string]string, error) {
+	params, err := a.params("alipay.trade.app.pay", map[string]interface{}{
+		"out_trade_no": order.OrderNum,
+		"total_amount": formatYuan(order.Amount),
+		"subject":      order.Description,
+		"product_code": "QUICK_MSECURITY_PAY",
+	})
+	if err != nil {
+		return nil, err
+	}
+	params.Set("notify_url", order.NotifyURL)
+	if err = a.sign(params); err != nil {
+		return nil, err
+	}
+	return map[string]string{"order_string": params.Encode()}, nil
+}
+
+// 按商户订单号查询
+func (a *alipay) Verify(ctx context.Context, order *Order, token string) (*Payment, error) {
+	resp := struct {
+		alipayResponse
+		OutTradeNo  string `json:"out_trade_no"`
+		TradeNo     string `json:"trade_no"`
+		TradeStatus string `json:"trade_status"`
+		TotalAmount string `json:"total_amount"`
+	}{}
+	err := a.call(ctx, "alipay.trade.query", map[string]interface{}{"out_trade_no": order.OrderNum}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	// 用户未付款时交易不存在
+	if resp.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return &Payment{OrderNum: order.OrderNum}, nil
+	}
+	if err = resp.err(); err != nil {
+		return nil, err
+	}
+	if resp.OutTradeNo != order.OrderNum {
+		return nil, fmt.Errorf("payment: alipay trade mismatch: %s", resp.OutTradeNo)
+	}
+	amount, _ := strconv.ParseFloat(resp.TotalAmount, 64)
+	return &Payment{
+		OrderNum:      resp.OutTradeNo,
+		TransactionId: resp.TradeNo,
+		Amount:        amount,
+		Paid:          resp.TradeStatus == "TRADE_SUCCESS" || resp.TradeStatus == "TRADE_FINISHED",
+		Sandbox:       a.cfg.Sandbox,
+	}, nil
+}
+
+// 异步通知, 表单POST; 部分退款和全额退款都会带refund_fee
+func (a *alipay) HandleNotification(ctx context.Context, r *http.Request) (*Notification, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	form := r.PostForm
+	if form.Get("sign_type") != "RSA2" {
+		return nil, fmt.Errorf("%w: sign_type %q", ErrSignature, form.Get("sign_type"))
+	}
+	if err := verifyRSA(a.public, signContent(form, true), form.Get("sign")); err != nil {
+		return nil, err
+	}
+	if form.Get("app_id") != a.cfg.AppId {
+		return nil, fmt.Errorf("%w: app_id %q", ErrNotify, form.Get("app_id"))
+	}
+
+	amount, _ := strconv.ParseFloat(form.Get("total_amount"), 64)
+	notify := &Notification{Payment: Payment{
+		OrderNum:      form.Get("out_trade_no"),
+		TransactionId: form.Get("trade_no"),
+		Amount:        amount,
+		Sandbox:       a.cfg.Sandbox,
+	}}
+	switch status := form.Get("trade_status"); {
+	case form.Get("refund_fee") != "" || status == "TRADE_CLOSED" && form.Get("gmt_refund") != "":
+		notify.Type = NOTIFY_REFUND
+	case status == "TRADE_SUCCESS" || status == "TRADE_FINISHED":
+		notify.Type = NOTIFY_PAID
+		notify.Paid = true
+	default:
+		return nil, nil
+	}
+	return notify, nil
+}
+
+func (a *alipay) NotifyAck(w http.ResponseWriter) {
+	w.Write([]byte("success"))
+}
+
+func (a *alipay) Refund(ctx context.Context, refund *Refund) error {
+	resp := struct {
+		alipayResponse
+		FundChange string `json:"fund_change"`
+	}{}
+	err := a.call(ctx, "alipay.trade.refund", map[string]interface{}{
+		"out_trade_no":   refund.OrderNum,
+		"out_request_no": refund.RefundNo,
+		"refund_amount":  formatYuan(refund.Amount),
+		"refund_reason":  refund.Reason,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+// 公共应答参数
+type alipayResponse struct {
+	Code    string `json:"code"`
+	Msg     string `json:"msg"`
+	SubCode string `json:"sub_code"`
+	SubMsg  string `json:"sub_msg"`
+}
+
+func (r *alipayResponse) err() error {
+	if r.Code == "10000" {
+		return nil
+	}
+	return fmt.Errorf("payment: alipay %s %s: %s %s", r.Code, r.Msg, r.SubCode, r.SubMsg)
+}
+
+// 调用网关, 校验应答签名后解析 {method}_response
+func (a *alipay) call(ctx context.Context, method string, biz map[string]interface{}, v interface{}) error {
+	params, err := a.params(method, biz)
+	if err != nil {
+		return err
+	}
+	if err = a.sign(params); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.cfg.Gateway, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("payment: alipay %s status %d", method, resp.StatusCode)
+	}
+
+	body := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("payment: alipay %s: %s", method, err)
+	}
+	raw, ok := body[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		return fmt.Errorf("payment: alipay %s: no response", method)
+	}
+	// 签名覆盖原始JSON, 业务出错时可能不带签名
+	sign := ""
+	json.Unmarshal(body["sign"], &sign)
+	if sign != "" {
+		if err = verifyRSA(a.public, string(raw), sign); err != nil {
+			return err
+		}
+	} else if !bytes.Contains(raw, []byte(`"sub_code"`)) {
+		return fmt.Errorf("%w: alipay %s response unsigned", ErrSignature, method)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// 公共请求参数
+func (a *alipay) params(method string, biz map[string]interface{}) (url.Values, error) {
+	content, err := json.Marshal(biz)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("app_id", a.cfg.AppId)
+	params.Set("method", method)
+	params.Set("format", "JSON")
+	params.Set("charset", "utf-8")
+	params.Set("sign_type", "RSA2")
+	params.Set("timestamp", time.Now().Format(time.DateTime))
+	params.Set("version", "1.0")
+	params.Set("biz_content", string(content))
+	return params, nil
+}
+
+func (a *alipay) sign(params url.Values) error {
+	sign, err := signRSA(a.key, signContent(params, false))
+	if err != nil {
+		return err
+	}
+	params.Set("sign", sign)
+	return nil
+}
+
+// 待签名字符串: 除sign外的非空参数按key排序后 k=v&k=v, 通知验签时还要去掉sign_type
+func signContent(params url.Values, notify bool) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k == "sign" || notify && k == "sign_type" || params.Get(k) == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := strings.Builder{}
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(k + "=" + params.Get(k))
+	}
+	return buf.String()
+}
+
+func formatYuan(amount float64) string {
+	return strconv.FormatFloat(float64(toCent(amount))/100, 'f', 2, 64)
+}
@@ -0,0 +1,78 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"camera-payment"
+	"camera-payment/paymenttest"
+)
+
+func httptestServer(t *testing.T, h http.Handler) string {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestAlipay(t *testing.T) {
+	ctx := context.Background()
+	fake := paymenttest.NewAlipay("2021000000000000")
+	p, err := payment.NewAlipay(fake.Config(httptestServer(t, fake)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := &payment.Order{OrderNum: "A1001", Description: "60钻石", Amount: 6, NotifyURL: "https://example.com/api/pay/alipay/notify"}
+	params, err := p.CreateOrder(ctx, order)
+	if err != nil || params["order_string"] == "" {
+		t.Fatalf("create: %v %v", params, err)
+	}
+
+	// 未付款时交易不存在
+	result, err := p.Verify(ctx, order, "")
+	if err != nil || result.Paid {
+		t.Fatalf("verify unpaid: %+v %v", result, err)
+	}
+	if _, err = fake.Pay(strings.Replace(params["order_string"], "A1001", "A1002", 1)); err == nil {
+		t.Fatal("pay accepted forged order string")
+	}
+	if _, err = fake.Pay(params["order_string"]); err != nil {
+		t.Fatal(err)
+	}
+	result, err = p.Verify(ctx, order, "")
+	if err != nil || !result.Paid || result.TransactionId == "" || result.Amount != 6 || !result.Sandbox {
+		t.Fatalf("verify paid: %+v %v", result, err)
+	}
+
+	// 支付通知, 篡改金额后验签失败
+	req, _ := fake.Notification(order.OrderNum, false)
+	forged := cloneRequest(t, req, func(body string) string { return strings.Replace(body, "total_amount=6.00", "total_amount=600.00", 1) })
+	if _, err = p.HandleNotification(ctx, forged); !errors.Is(err, payment.ErrSignature) {
+		t.Fatalf("forged notify: %v", err)
+	}
+	notify, err := p.HandleNotification(ctx, req)
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_PAID || notify.TransactionId != result.TransactionId || notify.Amount != 6 {
+		t.Fatalf("paid notify: %+v %v", notify, err)
+	}
+
+	// 退款
+	refund := &payment.Refund{OrderNum: order.OrderNum, RefundNo: "R" + order.OrderNum, Amount: 6, Total: 6}
+	if err = p.Refund(ctx, refund); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Refunded(order.OrderNum) {
+		t.Fatal("trade not refunded")
+	}
+	if err = p.Refund(ctx, refund); err == nil {
+		t.Fatal("refunded twice")
+	}
+	req, _ = fake.Notification(order.OrderNum, true)
+	notify, err = p.HandleNotification(ctx, req)
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_REFUND || notify.OrderNum != order.OrderNum {
+		t.Fatalf("refund notify: %+v %v", notify, err)
+	}
+}
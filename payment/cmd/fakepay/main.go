@@ -0,0 +1,78 @@
+// 本地模拟 Google Play, 微信支付和支付宝, api配置 pay 下各渠道指向本服务即可离线测试
+//
+//	go run ./cmd/fakepay -notify http://127.0.0.1:8080
+//
+// 启动时随机生成各渠道密钥并写到 -dir, 按日志输出修改api配置后重启api. 模拟付款:
+//
+//	curl -d '{"productId":"diamond_60","orderNum":"..."}' http://127.0.0.1:3095/fake/googleplay/purchases
+//	curl -X POST 'http://127.0.0.1:3095/fake/wechat/notify?out_trade_no=...'
+//	curl --data-binary "$order_string" http://127.0.0.1:3095/fake/alipay/pay
+//
+// Google Play的purchaseToken作为 /api/pay/googleplay/confirm 的token参数; 微信和支付宝付款后通知直接发到api
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"camera-payment/paymenttest"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:3095", "listen address")
+	notify := flag.String("notify", "http://127.0.0.1:8080", "api address for google play notifications")
+	packageName := flag.String("package", "com.example.camera", "google play package name")
+	appId := flag.String("wechat-appid", "wx0000000000000000", "wechat app id")
+	mchId := flag.String("wechat-mchid", "1900000000", "wechat merchant id")
+	alipayAppId := flag.String("alipay-appid", "2021000000000000", "alipay app id")
+	dir := flag.String("dir", ".", "directory to write key files")
+	flag.Parse()
+
+	baseURL := "http://" + *addr
+	google := paymenttest.NewGooglePlay(*packageName)
+	google.NotifyURL = strings.TrimSuffix(*notify, "/") + "/api/pay/googleplay/notify"
+	wechat := paymenttest.NewWechat(*appId, *mchId)
+	alipay := paymenttest.NewAlipay(*alipayAppId)
+
+	googleCfg, wechatCfg, alipayCfg := google.Config(baseURL), wechat.Config(baseURL), alipay.Config(baseURL)
+	files := map[string][]byte{
+		"google_service_account.json": googleCfg.ServiceAccount,
+		"wechat_apiclient_key.pem":    wechatCfg.PrivateKey,
+		"wechat_platform_pub.pem":     wechatCfg.PlatformPublicKey,
+		"alipay_app_private_key.pem":  alipayCfg.PrivateKey,
+		"alipay_public_key.pem":       alipayCfg.AlipayPublicKey,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(*dir, name), data, 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	config, _ := json.MarshalIndent(map[string]interface{}{
+		"googleplay": map[string]string{"package_name": *packageName, "service_account": filepath.Join(*dir, "google_service_account.json"), "api_url": baseURL},
+		"wechat": map[string]string{
+			"app_id": *appId, "mch_id": *mchId, "serial_no": wechatCfg.SerialNo, "private_key": filepath.Join(*dir, "wechat_apiclient_key.pem"),
+			"apiv3_key": wechatCfg.APIv3Key, "platform_serial": wechatCfg.PlatformSerial, "platform_public_key": filepath.Join(*dir, "wechat_platform_pub.pem"), "api_url": baseURL,
+		},
+		"alipay": map[string]interface{}{
+			"app_id": *alipayAppId, "private_key": filepath.Join(*dir, "alipay_app_private_key.pem"),
+			"alipay_public_key": filepath.Join(*dir, "alipay_public_key.pem"), "sandbox": true, "gateway": alipayCfg.Gateway,
+		},
+	}, "", "  ")
+	log.Printf("pay config:\n%s", config)
+
+	mux := http.NewServeMux()
+	mux.Handle("/token", google)
+	mux.Handle("/androidpublisher/", google)
+	mux.Handle("/fake/googleplay/", google)
+	mux.Handle("/v3/", wechat)
+	mux.Handle("/fake/wechat/", wechat)
+	mux.Handle("/gateway.do", alipay)
+	mux.Handle("/fake/alipay/", alipay)
+	log.Printf("fake payment server listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -0,0 +1,3 @@
+module camera-payment
+
+go 1.21
@@ -0,0 +1,304 @@
+package payment
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GOOGLE_API_URL   = "https://androidpublisher.googleapis.com"
+	GOOGLE_TOKEN_URL = "https://oauth2.googleapis.com/token"
+	googleScope      = "https://www.googleapis.com/auth/androidpublisher"
+)
+
+// 一次性商品通知类型
+const (
+	googleOneTimePurchased = 1
+	googleOneTimeCanceled  = 2
+)
+
+type GooglePlayConfig struct {
+	PackageName    string
+	ServiceAccount []byte // 服务账号json密钥
+	NotifyToken    string // Pub/Sub推送地址的token参数, 为空时不校验
+	APIURL         string // 为空时使用GOOGLE_API_URL
+	TokenURL       string // 为空时使用服务账号中的token_uri
+}
+
+// 服务账号json密钥中用到的字段
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// Google Play Developer API, 客户端购买时需将商户订单号设为obfuscatedAccountId
+type googlePlay struct {
+	cfg    GooglePlayConfig
+	email  string
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expireAt    time.Time
+}
+
+func NewGooglePlay(cfg GooglePlayConfig) (Provider, error) {
+	account := googleServiceAccount{}
+	if err := json.Unmarshal(cfg.ServiceAccount, &account); err != nil {
+		return nil, fmt.Errorf("payment: google service account: %s", err)
+	}
+	if cfg.PackageName == "" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("payment: incomplete google play config")
+	}
+	key, err := ParsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = GOOGLE_API_URL
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = account.TokenURI
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = GOOGLE_TOKEN_URL
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	return &googlePlay{cfg: cfg, email: account.ClientEmail, key: key, client: &http.Client{Timeout: time.Second * 30}}, nil
+}
+
+func (g *googlePlay) Name() string {
+	return PROVIDER_GOOGLEPLAY
+}
+
+// 客户端通过Play Billing购买, 服务端只需返回订单号作为obfuscatedAccountId
+func (g *googlePlay) CreateOrder(ctx context.Context, order *Order) (map[string]string, error) {
+	return map[string]string{
+		"order_num":             order.OrderNum,
+		"product_id":            order.ProductId,
+		"obfuscated_account_id": order.OrderNum,
+	}, nil
+}
+
+// purchases.products.get 返回结果
+type googleProductPurchase struct {
+	PurchaseState               int    `json:"purchaseState"`    // 0-已购买 1-已取消 2-待处理
+	ConsumptionState            int    `json:"consumptionState"` // 0-未消耗 1-已消耗
+	OrderId                     string `json:"orderId"`
+	PurchaseType                *int   `json:"purchaseType"` // 0-测试
+	ProductId                   string `json:"productId"`
+	ObfuscatedExternalAccountId string `json:"obfuscatedExternalAccountId"`
+}
+
+// 查询购买, 已购买未消耗的商品在此消耗, 否则3天后会被自动退款
+func (g *googlePlay) Verify(ctx context.Context, order *Order, token string) (*Payment, error) {
+	if token == "" {
+		return nil, fmt.Errorf("payment: google purchase token is empty")
+	}
+	payment, purchase, err := g.purchase(ctx, order.ProductId, token)
+	if err != nil {
+		return nil, err
+	}
+	// 防止用其他订单的凭证确认
+	if payment.OrderNum != order.OrderNum {
+		return nil, fmt.Errorf("payment: google purchase belongs to order %q", payment.OrderNum)
+	}
+	if payment.Paid && purchase.ConsumptionState == 0 {
+		if err = g.consume(ctx, order.ProductId, token); err != nil {
+			return nil, err
+		}
+	}
+	return payment, nil
+}
+
+func (g *googlePlay) purchase(ctx context.Context, productId, token string) (*Payment, *googleProductPurchase, error) {
+	purchase := &googleProductPurchase{}
+	path := fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/products/%s/tokens/%s",
+		url.PathEscape(g.cfg.PackageName), url.PathEscape(productId), url.PathEscape(token))
+	if err := g.call(ctx, "GET", path, purchase); err != nil {
+		return nil, nil, err
+	}
+	if purchase.ProductId == "" {
+		purchase.ProductId = productId
+	}
+	return &Payment{
+		OrderNum:      purchase.ObfuscatedExternalAccountId,
+		TransactionId: purchase.OrderId,
+		ProductId:     purchase.ProductId,
+		Paid:          purchase.PurchaseState == 0,
+		Sandbox:       purchase.PurchaseType != nil && *purchase.PurchaseType == 0,
+	}, purchase, nil
+}
+
+func (g *googlePlay) consume(ctx context.Context, productId, token string) error {
+	path := fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/products/%s/tokens/%s:consume",
+		url.PathEscape(g.cfg.PackageName), url.PathEscape(productId), url.PathEscape(token))
+	return g.call(ctx, "POST", path, nil)
+}
+
+// 实时开发者通知 RTDN, 通过Pub/Sub推送
+func (g *googlePlay) HandleNotification(ctx context.Context, r *http.Request) (*Notification, error) {
+	if g.cfg.NotifyToken != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(g.cfg.NotifyToken)) != 1 {
+		return nil, ErrSignature
+	}
+	push := struct {
+		Message struct {
+			Data string `json:"data"`
+		} `json:"message"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&push); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	dn := struct {
+		PackageName                string `json:"packageName"`
+		OneTimeProductNotification *struct {
+			NotificationType int    `json:"notificationType"`
+			PurchaseToken    string `json:"purchaseToken"`
+			Sku              string `json:"sku"`
+		} `json:"oneTimeProductNotification"`
+		VoidedPurchaseNotification *struct {
+			PurchaseToken string `json:"purchaseToken"`
+			OrderId       string `json:"orderId"`
+		} `json:"voidedPurchaseNotification"`
+	}{}
+	if err = json.Unmarshal(data, &dn); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	if dn.PackageName != g.cfg.PackageName {
+		return nil, fmt.Errorf("%w: package %q", ErrNotify, dn.PackageName)
+	}
+
+	// 退款或撤销, 只有渠道交易号
+	if voided := dn.VoidedPurchaseNotification; voided != nil {
+		return &Notification{Type: NOTIFY_REFUND, Payment: Payment{TransactionId: voided.OrderId}}, nil
+	}
+	// 客户端未确认时由通知完成订单, 同样需要消耗
+	if one := dn.OneTimeProductNotification; one != nil && one.NotificationType == googleOneTimePurchased {
+		payment, purchase, err := g.purchase(ctx, one.Sku, one.PurchaseToken)
+		if err != nil {
+			return nil, err
+		}
+		if !payment.Paid || payment.OrderNum == "" {
+			return nil, nil
+		}
+		if purchase.ConsumptionState == 0 {
+			if err = g.consume(ctx, one.Sku, one.PurchaseToken); err != nil {
+				return nil, err
+			}
+		}
+		return &Notification{Type: NOTIFY_PAID, Payment: *payment}, nil
+	}
+	return nil, nil
+}
+
+func (g *googlePlay) NotifyAck(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 退款并撤销商品
+func (g *googlePlay) Refund(ctx context.Context, refund *Refund) error {
+	if refund.TransactionId == "" {
+		return fmt.Errorf("payment: google order id is empty")
+	}
+	path := fmt.Sprintf("/androidpublisher/v3/applications/%s/orders/%s:refund?revoke=true",
+		url.PathEscape(g.cfg.PackageName), url.PathEscape(refund.TransactionId))
+	return g.call(ctx, "POST", path, nil)
+}
+
+func (g *googlePlay) call(ctx context.Context, method, path string, v interface{}) error {
+	token, err := g.token(ctx)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, method, g.cfg.APIURL+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp, err := g.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("payment: google %s %s status %d: %s", method, path, resp.StatusCode, body)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// 服务账号JWT换取access token, 过期前1分钟刷新
+func (g *googlePlay) token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.accessToken != "" && time.Now().Before(g.expireAt) {
+		return g.accessToken, nil
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   g.email,
+		"scope": googleScope,
+		"aud":   g.cfg.TokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signing := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := signRSA(g.key, signing)
+	if err != nil {
+		return "", err
+	}
+	sigBytes, _ := base64.StdEncoding.DecodeString(sig)
+	assertion := signing + "." + base64.RawURLEncoding.EncodeToString(sigBytes)
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	request, err := http.NewRequestWithContext(ctx, "POST", g.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := g.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("payment: google token status %d: %s", resp.StatusCode, body)
+	}
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err = json.Unmarshal(body, &result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("payment: google token response: %s", body)
+	}
+	g.accessToken = result.AccessToken
+	g.expireAt = now.Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return g.accessToken, nil
+}
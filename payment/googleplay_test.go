@@ -0,0 +1,73 @@
+package payment_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"camera-payment"
+	"camera-payment/paymenttest"
+)
+
+func TestGooglePlay(t *testing.T) {
+	ctx := context.Background()
+	fake := paymenttest.NewGooglePlay("com.example.camera")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cfg := fake.Config(srv.URL)
+	cfg.NotifyToken = "secret"
+	p, err := payment.NewGooglePlay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := &payment.Order{OrderNum: "G1001", ProductId: "diamond_60", Amount: 6}
+	params, err := p.CreateOrder(ctx, order)
+	if err != nil || params["obfuscated_account_id"] != order.OrderNum {
+		t.Fatalf("create: %v %v", params, err)
+	}
+
+	token, orderId := fake.AddPurchase(order.ProductId, order.OrderNum)
+	result, err := p.Verify(ctx, order, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Paid || result.TransactionId != orderId || result.OrderNum != order.OrderNum || !result.Sandbox {
+		t.Fatalf("verify: %+v", result)
+	}
+	if !fake.Consumed(token) {
+		t.Fatal("purchase not consumed")
+	}
+
+	// 其他订单的凭证
+	other, _ := fake.AddPurchase(order.ProductId, "G1002")
+	if _, err = p.Verify(ctx, order, other); err == nil {
+		t.Fatal("verify accepted purchase of another order")
+	}
+
+	// 购买通知
+	token2, _ := fake.AddPurchase(order.ProductId, "G1003")
+	body, _ := fake.Notification(token2, false)
+	if _, err = p.HandleNotification(ctx, httptest.NewRequest("POST", "/notify?token=wrong", bytes.NewReader(body))); !errors.Is(err, payment.ErrSignature) {
+		t.Fatalf("notify token: %v", err)
+	}
+	notify, err := p.HandleNotification(ctx, httptest.NewRequest("POST", "/notify?token=secret", bytes.NewReader(body)))
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_PAID || notify.OrderNum != "G1003" || !fake.Consumed(token2) {
+		t.Fatalf("paid notify: %+v %v", notify, err)
+	}
+
+	// 退款
+	if err = p.Refund(ctx, &payment.Refund{OrderNum: order.OrderNum, TransactionId: orderId, Amount: 6, Total: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Refunded(orderId) {
+		t.Fatal("order not refunded")
+	}
+	body, _ = fake.Notification(token, true)
+	notify, err = p.HandleNotification(ctx, httptest.NewRequest("POST", "/notify?token=secret", bytes.NewReader(body)))
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_REFUND || notify.TransactionId != orderId {
+		t.Fatalf("refund notify: %+v %v", notify, err)
+	}
+}
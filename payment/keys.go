@@ -0,0 +1,97 @@
+package payment
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// 解析RSA私钥, 支持PKCS1和PKCS8, 以及不带PEM头的base64(支付宝)
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	der, err := pemOrBase64(data)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("payment: private key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+// 解析RSA公钥, 支持PKIX公钥, 证书, 以及不带PEM头的base64
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	der, err := pemOrBase64(data)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	if cert, err := x509.ParseCertificate(der); err == nil {
+		key = cert.PublicKey
+	} else if key, err = x509.ParsePKIXPublicKey(der); err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("payment: public key is not rsa")
+	}
+	return rsaKey, nil
+}
+
+func pemOrBase64(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("payment: key is neither pem nor base64")
+	}
+	return der, nil
+}
+
+// SHA256WithRSA签名, 返回base64
+func signRSA(key *rsa.PrivateKey, data string) (string, error) {
+	sum := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func verifyRSA(key *rsa.PublicKey, data, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrSignature
+	}
+	sum := sha256.Sum256([]byte(data))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+		return ErrSignature
+	}
+	return nil
+}
+
+// 元转分
+func toCent(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)[:n]
+}
@@ -0,0 +1,77 @@
+// 支付渠道, 每个渠道实现Provider: 下单, 查询, 处理渠道通知, 退款
+//
+// 金额单位均为元; 本地测试使用 paymenttest 中各渠道的模拟服务器
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// 支付渠道
+const (
+	PROVIDER_GOOGLEPLAY = "googleplay" // Google Play 应用内购买
+	PROVIDER_WECHAT     = "wechat"     // 微信支付 APP支付 API v3
+	PROVIDER_ALIPAY     = "alipay"     // 支付宝 APP支付
+)
+
+// 通知类型
+const (
+	NOTIFY_PAID   = "paid"
+	NOTIFY_REFUND = "refund"
+)
+
+var (
+	ErrSignature = errors.New("payment: bad signature")
+	ErrNotify    = errors.New("payment: bad notification")
+)
+
+// 商户订单
+type Order struct {
+	OrderNum    string  // 商户订单号
+	ProductId   string  // 产品ID, Google Play为商品ID
+	Description string  // 商品描述
+	Amount      float64 // 金额(元)
+	NotifyURL   string  // 渠道通知地址
+}
+
+// 渠道支付结果
+type Payment struct {
+	OrderNum      string  // 商户订单号
+	TransactionId string  // 渠道交易号
+	ProductId     string  // 渠道返回的产品ID, 不返回时为空
+	Amount        float64 // 渠道返回的金额, 不返回时为0
+	Paid          bool
+	Sandbox       bool
+}
+
+// 渠道通知, 退款通知可能只有渠道交易号
+type Notification struct {
+	Type string // NOTIFY_*
+	Payment
+}
+
+// 退款
+type Refund struct {
+	OrderNum      string
+	TransactionId string
+	RefundNo      string  // 商户退款单号
+	Amount        float64 // 退款金额
+	Total         float64 // 订单金额
+	Reason        string
+}
+
+type Provider interface {
+	Name() string
+	// 下单, 返回客户端调起支付所需的参数
+	CreateOrder(ctx context.Context, order *Order) (map[string]string, error)
+	// 查询支付结果, token为客户端支付后返回的凭证, 只有Google Play需要(purchaseToken)
+	Verify(ctx context.Context, order *Order, token string) (*Payment, error)
+	// 校验并解析渠道通知, 不需处理的通知返回nil
+	HandleNotification(ctx context.Context, r *http.Request) (*Notification, error)
+	// 通知处理成功的应答, 失败时返回非2xx渠道会重试
+	NotifyAck(w http.ResponseWriter)
+	// 退款
+	Refund(ctx context.Context, refund *Refund) error
+}
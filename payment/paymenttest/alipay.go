@@ -0,0 +1,253 @@
+package paymenttest
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camera-payment"
+)
+
+// 模拟支付宝网关
+//
+//	POST /gateway.do  alipay.trade.query, alipay.trade.refund
+//	POST /fake/alipay/pay     付款并发送通知, body为客户端拿到的order_string
+//	POST /fake/alipay/notify?out_trade_no={outTradeNo}&refund=1 发送退款通知
+type Alipay struct {
+	AppId string
+
+	appKey    *rsa.PrivateKey
+	alipayKey *rsa.PrivateKey
+
+	mu     sync.Mutex
+	trades map[string]*alipayTrade // out_trade_no
+}
+
+type alipayTrade struct {
+	OutTradeNo  string
+	TradeNo     string
+	TotalAmount string
+	Subject     string
+	NotifyURL   string
+	Refunded    bool
+}
+
+func NewAlipay(appId string) *Alipay {
+	return &Alipay{AppId: appId, appKey: generateKey(), alipayKey: generateKey(), trades: make(map[string]*alipayTrade)}
+}
+
+func (s *Alipay) Config(baseURL string) payment.AlipayConfig {
+	return payment.AlipayConfig{
+		AppId:           s.AppId,
+		PrivateKey:      privateKeyPEM(s.appKey),
+		AlipayPublicKey: publicKeyPEM(&s.alipayKey.PublicKey),
+		Sandbox:         true,
+		Gateway:         strings.TrimSuffix(baseURL, "/") + "/gateway.do",
+	}
+}
+
+// 模拟用户用order_string付款, 返回商户订单号
+func (s *Alipay) Pay(orderString string) (string, error) {
+	params, err := url.ParseQuery(orderString)
+	if err != nil {
+		return "", err
+	}
+	if err = s.checkSign(params); err != nil {
+		return "", err
+	}
+	if params.Get("method") != "alipay.trade.app.pay" {
+		return "", fmt.Errorf("method %q", params.Get("method"))
+	}
+	biz := struct {
+		OutTradeNo  string `json:"out_trade_no"`
+		TotalAmount string `json:"total_amount"`
+		Subject     string `json:"subject"`
+	}{}
+	if err = json.Unmarshal([]byte(params.Get("biz_content")), &biz); err != nil || biz.OutTradeNo == "" {
+		return "", fmt.Errorf("invalid biz_content")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.trades[biz.OutTradeNo]; !ok {
+		s.trades[biz.OutTradeNo] = &alipayTrade{
+			OutTradeNo:  biz.OutTradeNo,
+			TradeNo:     time.Now().Format("20060102") + "2200" + strconv.FormatInt(time.Now().UnixNano()%1e12, 10),
+			TotalAmount: biz.TotalAmount,
+			Subject:     biz.Subject,
+			NotifyURL:   params.Get("notify_url"),
+		}
+	}
+	return biz.OutTradeNo, nil
+}
+
+func (s *Alipay) Refunded(outTradeNo string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trade, ok := s.trades[outTradeNo]
+	return ok && trade.Refunded
+}
+
+// 生成签名后的异步通知请求, 发送到order_string中的notify_url
+func (s *Alipay) Notification(outTradeNo string, refund bool) (*http.Request, error) {
+	s.mu.Lock()
+	trade, ok := s.trades[outTradeNo]
+	var t alipayTrade
+	if ok {
+		t = *trade
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("trade %s not found", outTradeNo)
+	}
+
+	now := time.Now().Format(time.DateTime)
+	form := url.Values{}
+	form.Set("notify_time", now)
+	form.Set("notify_type", "trade_status_sync")
+	form.Set("notify_id", randomId(16))
+	form.Set("app_id", s.AppId)
+	form.Set("charset", "utf-8")
+	form.Set("version", "1.0")
+	form.Set("out_trade_no", t.OutTradeNo)
+	form.Set("trade_no", t.TradeNo)
+	form.Set("total_amount", t.TotalAmount)
+	form.Set("subject", t.Subject)
+	form.Set("gmt_payment", now)
+	form.Set("trade_status", "TRADE_SUCCESS")
+	if refund {
+		form.Set("trade_status", "TRADE_CLOSED")
+		form.Set("refund_fee", t.TotalAmount)
+		form.Set("gmt_refund", now)
+	}
+	form.Set("sign", sign(s.alipayKey, signContent(form, "sign", "sign_type")))
+	form.Set("sign_type", "RSA2")
+
+	req, err := http.NewRequest("POST", t.NotifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	return req, nil
+}
+
+func (s *Alipay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/gateway.do":
+		s.serveGateway(w, r)
+	case r.Method == "POST" && r.URL.Path == "/fake/alipay/pay":
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		outTradeNo, err := s.Pay(strings.TrimSpace(string(body)))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req, err := s.Notification(outTradeNo, false)
+		deliver(w, req, err)
+	case r.Method == "POST" && r.URL.Path == "/fake/alipay/notify":
+		outTradeNo := r.URL.Query().Get("out_trade_no")
+		refund := r.URL.Query().Get("refund") == "1"
+		if refund {
+			s.mu.Lock()
+			if trade, ok := s.trades[outTradeNo]; ok {
+				trade.Refunded = true
+			}
+			s.mu.Unlock()
+		}
+		req, err := s.Notification(outTradeNo, refund)
+		deliver(w, req, err)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Alipay) serveGateway(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := r.PostForm
+	method := params.Get("method")
+	if err := s.checkSign(params); err != nil {
+		s.writeResponse(w, method, map[string]string{"code": "40002", "msg": "Invalid Arguments", "sub_code": "isv.invalid-signature", "sub_msg": err.Error()})
+		return
+	}
+	biz := struct {
+		OutTradeNo   string `json:"out_trade_no"`
+		RefundAmount string `json:"refund_amount"`
+	}{}
+	json.Unmarshal([]byte(params.Get("biz_content")), &biz)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trade, ok := s.trades[biz.OutTradeNo]
+	if !ok {
+		s.writeResponse(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST", "sub_msg": "交易不存在"})
+		return
+	}
+	switch method {
+	case "alipay.trade.query":
+		status := "TRADE_SUCCESS"
+		if trade.Refunded {
+			status = "TRADE_CLOSED"
+		}
+		s.writeResponse(w, method, map[string]string{
+			"code": "10000", "msg": "Success",
+			"out_trade_no": trade.OutTradeNo, "trade_no": trade.TradeNo, "trade_status": status, "total_amount": trade.TotalAmount,
+		})
+	case "alipay.trade.refund":
+		refund, _ := strconv.ParseFloat(biz.RefundAmount, 64)
+		total, _ := strconv.ParseFloat(trade.TotalAmount, 64)
+		if trade.Refunded || refund <= 0 || refund > total {
+			s.writeResponse(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.REFUND_AMT_NOT_EQUAL_TOTAL", "sub_msg": "退款金额超限"})
+			return
+		}
+		trade.Refunded = true
+		s.writeResponse(w, method, map[string]string{
+			"code": "10000", "msg": "Success",
+			"out_trade_no": trade.OutTradeNo, "trade_no": trade.TradeNo, "refund_fee": biz.RefundAmount, "fund_change": "Y",
+		})
+	default:
+		s.writeResponse(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "isv.invalid-method", "sub_msg": "不支持的接口"})
+	}
+}
+
+// 应答签名覆盖 {method}_response 的原始JSON
+func (s *Alipay) writeResponse(w http.ResponseWriter, method string, resp map[string]string) {
+	raw, _ := json.Marshal(resp)
+	signature, _ := json.Marshal(sign(s.alipayKey, string(raw)))
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	fmt.Fprintf(w, `{"%s_response":%s,"sign":%s}`, strings.ReplaceAll(method, ".", "_"), raw, signature)
+}
+
+func (s *Alipay) checkSign(params url.Values) error {
+	if params.Get("app_id") != s.AppId || params.Get("sign_type") != "RSA2" {
+		return fmt.Errorf("app_id or sign_type mismatch")
+	}
+	if err := verify(&s.appKey.PublicKey, signContent(params, "sign"), params.Get("sign")); err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// 非空参数按key排序, 去掉exclude
+func signContent(params url.Values, exclude ...string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if params.Get(k) != "" && !slices.Contains(exclude, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+params.Get(k))
+	}
+	return strings.Join(pairs, "&")
+}
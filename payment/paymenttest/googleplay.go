@@ -0,0 +1,259 @@
+package paymenttest
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"camera-payment"
+)
+
+const googleAccessToken = "test-access-token"
+
+// 模拟 Google Play Developer API
+//
+//	POST /token  服务账号换取access token
+//	GET  /androidpublisher/v3/applications/{packageName}/purchases/products/{productId}/tokens/{token}
+//	POST /androidpublisher/v3/applications/{packageName}/purchases/products/{productId}/tokens/{token}:consume
+//	POST /androidpublisher/v3/applications/{packageName}/orders/{orderId}:refund
+//	POST /fake/googleplay/purchases 购买, body为 {"productId", "orderNum"}, 返回purchaseToken和orderId
+//	POST /fake/googleplay/notify    发送RTDN到NotifyURL, body为 {"purchaseToken", "voided"}
+type GooglePlay struct {
+	PackageName string
+	NotifyURL   string // RTDN推送地址, 仅/fake/googleplay/notify使用
+
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	purchases map[string]*googlePurchase // purchaseToken
+}
+
+type googlePurchase struct {
+	OrderId                     string `json:"orderId"`
+	ProductId                   string `json:"productId"`
+	PurchaseState               int    `json:"purchaseState"`
+	ConsumptionState            int    `json:"consumptionState"`
+	PurchaseType                int    `json:"purchaseType"`
+	ObfuscatedExternalAccountId string `json:"obfuscatedExternalAccountId"`
+	refunded                    bool
+}
+
+func NewGooglePlay(packageName string) *GooglePlay {
+	return &GooglePlay{PackageName: packageName, key: generateKey(), purchases: make(map[string]*googlePurchase)}
+}
+
+// 服务账号json密钥, token_uri指向模拟服务器
+func (g *GooglePlay) ServiceAccount(baseURL string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "test@camera.iam.gserviceaccount.com",
+		"private_key":  string(privateKeyPEM(g.key)),
+		"token_uri":    strings.TrimSuffix(baseURL, "/") + "/token",
+	})
+	return data
+}
+
+func (g *GooglePlay) Config(baseURL string) payment.GooglePlayConfig {
+	return payment.GooglePlayConfig{
+		PackageName:    g.PackageName,
+		ServiceAccount: g.ServiceAccount(baseURL),
+		APIURL:         baseURL,
+	}
+}
+
+// 模拟用户购买测试商品, orderNum即客户端设置的obfuscatedAccountId
+func (g *GooglePlay) AddPurchase(productId, orderNum string) (purchaseToken, orderId string) {
+	purchaseToken, orderId = randomId(24), "GPA."+randomId(8)
+	g.mu.Lock()
+	g.purchases[purchaseToken] = &googlePurchase{
+		OrderId:                     orderId,
+		ProductId:                   productId,
+		ObfuscatedExternalAccountId: orderNum,
+	}
+	g.mu.Unlock()
+	return purchaseToken, orderId
+}
+
+func (g *GooglePlay) Consumed(purchaseToken string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.purchases[purchaseToken]
+	return ok && p.ConsumptionState == 1
+}
+
+func (g *GooglePlay) Refunded(orderId string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, p := range g.purchases {
+		if p.OrderId == orderId {
+			return p.refunded
+		}
+	}
+	return false
+}
+
+// Pub/Sub推送的body, voided为退款通知
+func (g *GooglePlay) Notification(purchaseToken string, voided bool) ([]byte, error) {
+	g.mu.Lock()
+	p, ok := g.purchases[purchaseToken]
+	var purchase googlePurchase
+	if ok {
+		purchase = *p
+	}
+	g.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("purchase %s not found", purchaseToken)
+	}
+
+	dn := map[string]interface{}{
+		"version":         "1.0",
+		"packageName":     g.PackageName,
+		"eventTimeMillis": fmt.Sprint(time.Now().UnixMilli()),
+	}
+	if voided {
+		dn["voidedPurchaseNotification"] = map[string]interface{}{
+			"purchaseToken": purchaseToken, "orderId": purchase.OrderId, "productType": 2, "refundType": 1,
+		}
+	} else {
+		dn["oneTimeProductNotification"] = map[string]interface{}{
+			"version": "1.0", "notificationType": 1, "purchaseToken": purchaseToken, "sku": purchase.ProductId,
+		}
+	}
+	data, _ := json.Marshal(dn)
+	return json.Marshal(map[string]interface{}{
+		"message": map[string]string{
+			"data":      base64.StdEncoding.EncodeToString(data),
+			"messageId": randomId(8),
+		},
+		"subscription": "projects/test/subscriptions/play",
+	})
+}
+
+func (g *GooglePlay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/token":
+		g.serveToken(w, r)
+		return
+	case r.Method == "POST" && r.URL.Path == "/fake/googleplay/purchases":
+		g.serveAdd(w, r)
+		return
+	case r.Method == "POST" && r.URL.Path == "/fake/googleplay/notify":
+		g.serveNotify(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+googleAccessToken {
+		writeError(w, http.StatusUnauthorized, "invalid access token")
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/androidpublisher/v3/applications/"+g.PackageName+"/")
+	if !ok {
+		writeError(w, http.StatusNotFound, "package not found")
+		return
+	}
+	if orderId, ok := strings.CutPrefix(path, "orders/"); ok && r.Method == "POST" && strings.HasSuffix(orderId, ":refund") {
+		g.serveRefund(w, strings.TrimSuffix(orderId, ":refund"))
+		return
+	}
+	// purchases/products/{productId}/tokens/{token}[:consume]
+	parts := strings.Split(path, "/")
+	if len(parts) != 5 || parts[0] != "purchases" || parts[1] != "products" || parts[3] != "tokens" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	token, consume := strings.CutSuffix(parts[4], ":consume")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.purchases[token]
+	if !ok || p.ProductId != parts[2] {
+		writeError(w, http.StatusNotFound, "purchase token not found")
+		return
+	}
+	if !consume && r.Method == "GET" {
+		writeJSON(w, p)
+		return
+	}
+	if consume && r.Method == "POST" {
+		p.ConsumptionState = 1
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// 校验服务账号签名的JWT
+func (g *GooglePlay) serveToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	parts := strings.Split(r.PostForm.Get("assertion"), ".")
+	if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+		writeError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || verify(&g.key.PublicKey, parts[0]+"."+parts[1], base64.StdEncoding.EncodeToString(sig)) != nil {
+		writeError(w, http.StatusBadRequest, "invalid_grant: bad signature")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"access_token": googleAccessToken, "expires_in": 3600, "token_type": "Bearer"})
+}
+
+func (g *GooglePlay) serveRefund(w http.ResponseWriter, orderId string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, p := range g.purchases {
+		if p.OrderId == orderId {
+			p.refunded = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "order not found")
+}
+
+func (g *GooglePlay) serveAdd(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ProductId string `json:"productId"`
+		OrderNum  string `json:"orderNum"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ProductId == "" || req.OrderNum == "" {
+		writeError(w, http.StatusBadRequest, "productId and orderNum are required")
+		return
+	}
+	token, orderId := g.AddPurchase(req.ProductId, req.OrderNum)
+	writeJSON(w, map[string]string{"purchaseToken": token, "orderId": orderId})
+}
+
+func (g *GooglePlay) serveNotify(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		PurchaseToken string `json:"purchaseToken"`
+		Voided        bool   `json:"voided"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || g.NotifyURL == "" {
+		writeError(w, http.StatusBadRequest, "purchaseToken and notify url are required")
+		return
+	}
+	if req.Voided {
+		g.mu.Lock()
+		if p, ok := g.purchases[req.PurchaseToken]; ok {
+			p.refunded = true
+		}
+		g.mu.Unlock()
+	}
+	body, err := g.Notification(req.PurchaseToken, req.Voided)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	notify, err := http.NewRequest("POST", g.NotifyURL, bytes.NewReader(body))
+	if err == nil {
+		notify.Header.Set("Content-Type", "application/json")
+	}
+	deliver(w, notify, err)
+}
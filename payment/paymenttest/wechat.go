@@ -0,0 +1,340 @@
+package paymenttest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camera-payment"
+)
+
+// 测试商户证书和平台公钥序列号
+const (
+	WechatSerialNo       = "TESTMERCHANTSERIAL"
+	WechatPlatformSerial = "PUB_KEY_ID_TEST"
+)
+
+// 模拟微信支付 API v3
+//
+//	POST /v3/pay/transactions/app
+//	GET  /v3/pay/transactions/out-trade-no/{outTradeNo}?mchid={mchid}
+//	POST /v3/refund/domestic/refunds
+//	POST /fake/wechat/notify?out_trade_no={outTradeNo}&event={TRANSACTION.SUCCESS|REFUND.SUCCESS} 付款或退款并发送通知到下单时的notify_url
+type Wechat struct {
+	AppId string
+	MchId string
+
+	merchantKey *rsa.PrivateKey
+	platformKey *rsa.PrivateKey
+	apiV3Key    string
+
+	mu     sync.Mutex
+	orders map[string]*wechatOrder // out_trade_no
+}
+
+type wechatOrder struct {
+	OutTradeNo    string
+	TransactionId string
+	TradeState    string // NOTPAY, SUCCESS, REFUND
+	Total         int64
+	NotifyURL     string
+	Refunds       []string // out_refund_no
+}
+
+func NewWechat(appId, mchId string) *Wechat {
+	return &Wechat{
+		AppId:       appId,
+		MchId:       mchId,
+		merchantKey: generateKey(),
+		platformKey: generateKey(),
+		apiV3Key:    randomId(16),
+		orders:      make(map[string]*wechatOrder),
+	}
+}
+
+func (s *Wechat) Config(baseURL string) payment.WechatConfig {
+	return payment.WechatConfig{
+		AppId:             s.AppId,
+		MchId:             s.MchId,
+		SerialNo:          WechatSerialNo,
+		PrivateKey:        privateKeyPEM(s.merchantKey),
+		APIv3Key:          s.apiV3Key,
+		PlatformSerial:    WechatPlatformSerial,
+		PlatformPublicKey: publicKeyPEM(&s.platformKey.PublicKey),
+		APIURL:            baseURL,
+	}
+}
+
+// 模拟用户付款, 返回微信支付订单号
+func (s *Wechat) Pay(outTradeNo string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order, ok := s.orders[outTradeNo]
+	if !ok {
+		return "", fmt.Errorf("order %s not found", outTradeNo)
+	}
+	if order.TradeState == "NOTPAY" {
+		order.TradeState = "SUCCESS"
+		order.TransactionId = "4200" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return order.TransactionId, nil
+}
+
+func (s *Wechat) Refunds(outTradeNo string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if order, ok := s.orders[outTradeNo]; ok {
+		return append([]string(nil), order.Refunds...)
+	}
+	return nil
+}
+
+// 生成签名加密后的通知请求, 发送到下单时的notify_url
+func (s *Wechat) Notification(outTradeNo, event string) (*http.Request, error) {
+	s.mu.Lock()
+	order, ok := s.orders[outTradeNo]
+	var o wechatOrder
+	if ok {
+		o = *order
+	}
+	s.mu.Unlock()
+	if !ok || o.TransactionId == "" {
+		return nil, fmt.Errorf("order %s not paid", outTradeNo)
+	}
+
+	var resource interface{}
+	summary := "支付成功"
+	switch event {
+	case "TRANSACTION.SUCCESS":
+		resource = s.transaction(&o)
+	case "REFUND.SUCCESS":
+		summary = "退款成功"
+		resource = map[string]interface{}{
+			"mchid":          s.MchId,
+			"out_trade_no":   o.OutTradeNo,
+			"transaction_id": o.TransactionId,
+			"out_refund_no":  "R" + o.OutTradeNo,
+			"refund_id":      "5030" + strconv.FormatInt(time.Now().UnixNano(), 10),
+			"refund_status":  "SUCCESS",
+			"amount":         map[string]int64{"total": o.Total, "refund": o.Total, "payer_total": o.Total, "payer_refund": o.Total},
+		}
+	default:
+		return nil, fmt.Errorf("unknown event %s", event)
+	}
+	plain, _ := json.Marshal(resource)
+	nonce := randomId(6)
+	ciphertext, err := s.encrypt(plain, nonce, "transaction")
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":            randomId(16),
+		"create_time":   time.Now().Format(time.RFC3339),
+		"event_type":    event,
+		"resource_type": "encrypt-resource",
+		"summary":       summary,
+		"resource": map[string]string{
+			"algorithm":       "AEAD_AES_256_GCM",
+			"ciphertext":      ciphertext,
+			"associated_data": "transaction",
+			"nonce":           nonce,
+			"original_type":   "transaction",
+		},
+	})
+	req, err := http.NewRequest("POST", o.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.signHeader(req.Header, body)
+	return req, nil
+}
+
+func (s *Wechat) transaction(o *wechatOrder) map[string]interface{} {
+	trans := map[string]interface{}{
+		"appid":        s.AppId,
+		"mchid":        s.MchId,
+		"out_trade_no": o.OutTradeNo,
+		"trade_state":  o.TradeState,
+		"trade_type":   "APP",
+		"amount":       map[string]interface{}{"total": o.Total, "payer_total": o.Total, "currency": "CNY"},
+	}
+	if o.TransactionId != "" {
+		trans["transaction_id"] = o.TransactionId
+		trans["success_time"] = time.Now().Format(time.RFC3339)
+	}
+	return trans
+}
+
+func (s *Wechat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && r.URL.Path == "/fake/wechat/notify" {
+		s.serveNotify(w, r)
+		return
+	}
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err := s.checkAuth(r, body); err != nil {
+		s.writeJSON(w, http.StatusUnauthorized, map[string]string{"code": "SIGN_ERROR", "message": err.Error()})
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v3/pay/transactions/app":
+		s.serveOrder(w, body)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v3/pay/transactions/out-trade-no/"):
+		if r.URL.Query().Get("mchid") != s.MchId {
+			s.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "mchid"})
+			return
+		}
+		s.serveQuery(w, strings.TrimPrefix(r.URL.Path, "/v3/pay/transactions/out-trade-no/"))
+	case r.Method == "POST" && r.URL.Path == "/v3/refund/domestic/refunds":
+		s.serveRefund(w, body)
+	default:
+		s.writeJSON(w, http.StatusNotFound, map[string]string{"code": "NOT_FOUND", "message": "not found"})
+	}
+}
+
+func (s *Wechat) serveOrder(w http.ResponseWriter, body []byte) {
+	req := struct {
+		AppId      string `json:"appid"`
+		MchId      string `json:"mchid"`
+		OutTradeNo string `json:"out_trade_no"`
+		NotifyURL  string `json:"notify_url"`
+		Amount     struct {
+			Total int64 `json:"total"`
+		} `json:"amount"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil || req.AppId != s.AppId || req.MchId != s.MchId || req.OutTradeNo == "" || req.Amount.Total <= 0 {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "invalid order"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if order, ok := s.orders[req.OutTradeNo]; ok && order.TradeState != "NOTPAY" {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "ORDERPAID", "message": "该订单已支付"})
+		return
+	}
+	s.orders[req.OutTradeNo] = &wechatOrder{OutTradeNo: req.OutTradeNo, TradeState: "NOTPAY", Total: req.Amount.Total, NotifyURL: req.NotifyURL}
+	s.writeJSON(w, http.StatusOK, map[string]string{"prepay_id": "wx" + randomId(14)})
+}
+
+func (s *Wechat) serveQuery(w http.ResponseWriter, outTradeNo string) {
+	s.mu.Lock()
+	order, ok := s.orders[outTradeNo]
+	var o wechatOrder
+	if ok {
+		o = *order
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeJSON(w, http.StatusNotFound, map[string]string{"code": "ORDER_NOT_EXIST", "message": "订单不存在"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.transaction(&o))
+}
+
+func (s *Wechat) serveRefund(w http.ResponseWriter, body []byte) {
+	req := struct {
+		OutTradeNo  string `json:"out_trade_no"`
+		OutRefundNo string `json:"out_refund_no"`
+		Amount      struct {
+			Refund int64 `json:"refund"`
+			Total  int64 `json:"total"`
+		} `json:"amount"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil || req.OutRefundNo == "" {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "invalid refund"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order, ok := s.orders[req.OutTradeNo]
+	if !ok || order.TransactionId == "" || req.Amount.Total != order.Total || req.Amount.Refund > order.Total {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "INVALID_REQUEST", "message": "订单未支付或金额不符"})
+		return
+	}
+	order.TradeState = "REFUND"
+	order.Refunds = append(order.Refunds, req.OutRefundNo)
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"refund_id":      "5030" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		"out_refund_no":  req.OutRefundNo,
+		"transaction_id": order.TransactionId,
+		"out_trade_no":   order.OutTradeNo,
+		"status":         "SUCCESS",
+	})
+}
+
+func (s *Wechat) serveNotify(w http.ResponseWriter, r *http.Request) {
+	outTradeNo, event := r.URL.Query().Get("out_trade_no"), r.URL.Query().Get("event")
+	if event == "" {
+		event = "TRANSACTION.SUCCESS"
+	}
+	if event == "TRANSACTION.SUCCESS" {
+		if _, err := s.Pay(outTradeNo); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
+	req, err := s.Notification(outTradeNo, event)
+	deliver(w, req, err)
+}
+
+// 校验商户请求签名: 方法\nURL\n时间戳\n随机串\nbody\n
+func (s *Wechat) checkAuth(r *http.Request, body []byte) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "WECHATPAY2-SHA256-RSA2048 ")
+	if !ok {
+		return fmt.Errorf("missing authorization")
+	}
+	params := map[string]string{}
+	for _, item := range strings.Split(auth, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	if params["mchid"] != s.MchId || params["serial_no"] != WechatSerialNo {
+		return fmt.Errorf("mchid or serial_no mismatch")
+	}
+	message := r.Method + "\n" + r.URL.RequestURI() + "\n" + params["timestamp"] + "\n" + params["nonce_str"] + "\n" + string(body) + "\n"
+	if err := verify(&s.merchantKey.PublicKey, message, params["signature"]); err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// 平台签名: 时间戳\n随机串\nbody\n
+func (s *Wechat) signHeader(header http.Header, body []byte) {
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), randomId(16)
+	header.Set("Wechatpay-Timestamp", timestamp)
+	header.Set("Wechatpay-Nonce", nonce)
+	header.Set("Wechatpay-Serial", WechatPlatformSerial)
+	header.Set("Wechatpay-Signature", sign(s.platformKey, timestamp+"\n"+nonce+"\n"+string(body)+"\n"))
+}
+
+func (s *Wechat) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	s.signHeader(w.Header(), body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Wechat) encrypt(plain []byte, nonce, associatedData string) (string, error) {
+	block, err := aes.NewCipher([]byte(s.apiV3Key))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plain, []byte(associatedData))), nil
+}
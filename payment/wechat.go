@@ -0,0 +1,300 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const WECHAT_API_URL = "https://api.mch.weixin.qq.com"
+
+// 通知事件
+const (
+	wechatEventPaid   = "TRANSACTION.SUCCESS"
+	wechatEventRefund = "REFUND.SUCCESS"
+)
+
+type WechatConfig struct {
+	AppId             string
+	MchId             string
+	SerialNo          string // 商户API证书序列号
+	PrivateKey        []byte // 商户API私钥
+	APIv3Key          string // APIv3密钥, 32字节, 解密通知
+	PlatformSerial    string // 微信支付平台证书或公钥ID, 为空时不校验
+	PlatformPublicKey []byte // 微信支付平台公钥或证书, 校验应答和通知的签名
+	APIURL            string // 为空时使用WECHAT_API_URL
+}
+
+// 微信支付 API v3 APP支付
+type wechat struct {
+	cfg      WechatConfig
+	key      *rsa.PrivateKey
+	platform *rsa.PublicKey
+	client   *http.Client
+}
+
+func NewWechat(cfg WechatConfig) (Provider, error) {
+	if cfg.AppId == "" || cfg.MchId == "" || cfg.SerialNo == "" || len(cfg.APIv3Key) != 32 {
+		return nil, fmt.Errorf("payment: incomplete wechat config")
+	}
+	key, err := ParsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := ParsePublicKey(cfg.PlatformPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = WECHAT_API_URL
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	return &wechat{cfg: cfg, key: key, platform: platform, client: &http.Client{Timeout: time.Second * 30}}, nil
+}
+
+func (w *wechat) Name() string {
+	return PROVIDER_WECHAT
+}
+
+// APP下单, 返回客户端调起支付的参数
+func (w *wechat) CreateOrder(ctx context.Context, order *Order) (map[string]string, error) {
+	req := map[string]interface{}{
+		"appid":        w.cfg.AppId,
+		"mchid":        w.cfg.MchId,
+		"description":  order.Description,
+		"out_trade_no": order.OrderNum,
+		"notify_url":   order.NotifyURL,
+		"amount":       map[string]interface{}{"total": toCent(order.Amount), "currency": "CNY"},
+	}
+	resp := struct {
+		PrepayId string `json:"prepay_id"`
+	}{}
+	if _, err := w.call(ctx, "POST", "/v3/pay/transactions/app", req, &resp); err != nil {
+		return nil, err
+	}
+
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), randomString(32)
+	sign, err := signRSA(w.key, w.cfg.AppId+"\n"+timestamp+"\n"+nonce+"\n"+resp.PrepayId+"\n")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"appid":     w.cfg.AppId,
+		"partnerid": w.cfg.MchId,
+		"prepayid":  resp.PrepayId,
+		"package":   "Sign=WXPay",
+		"noncestr":  nonce,
+		"timestamp": timestamp,
+		"sign":      sign,
+	}, nil
+}
+
+// 交易信息, 查询结果和支付通知解密后相同
+type wechatTransaction struct {
+	AppId         string `json:"appid"`
+	MchId         string `json:"mchid"`
+	OutTradeNo    string `json:"out_trade_no"`
+	TransactionId string `json:"transaction_id"`
+	TradeState    string `json:"trade_state"`
+	Amount        struct {
+		Total int64 `json:"total"`
+	} `json:"amount"`
+}
+
+func (t *wechatTransaction) payment() *Payment {
+	return &Payment{
+		OrderNum:      t.OutTradeNo,
+		TransactionId: t.TransactionId,
+		Amount:        float64(t.Amount.Total) / 100,
+		Paid:          t.TradeState == "SUCCESS",
+	}
+}
+
+// 按商户订单号查询
+func (w *wechat) Verify(ctx context.Context, order *Order, token string) (*Payment, error) {
+	trans := &wechatTransaction{}
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(order.OrderNum) + "?mchid=" + url.QueryEscape(w.cfg.MchId)
+	status, err := w.call(ctx, "GET", path, nil, trans)
+	if status == http.StatusNotFound {
+		return &Payment{OrderNum: order.OrderNum}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trans.MchId != w.cfg.MchId || trans.OutTradeNo != order.OrderNum {
+		return nil, fmt.Errorf("payment: wechat transaction mismatch: %s %s", trans.MchId, trans.OutTradeNo)
+	}
+	return trans.payment(), nil
+}
+
+// 支付和退款通知, 验签后解密resource
+func (w *wechat) HandleNotification(ctx context.Context, r *http.Request) (*Notification, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err = w.verify(r.Header, body); err != nil {
+		return nil, err
+	}
+	notify := struct {
+		EventType string `json:"event_type"`
+		Resource  struct {
+			Algorithm      string `json:"algorithm"`
+			Ciphertext     string `json:"ciphertext"`
+			AssociatedData string `json:"associated_data"`
+			Nonce          string `json:"nonce"`
+		} `json:"resource"`
+	}{}
+	if err = json.Unmarshal(body, &notify); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	if notify.EventType != wechatEventPaid && notify.EventType != wechatEventRefund {
+		return nil, nil
+	}
+	if notify.Resource.Algorithm != "AEAD_AES_256_GCM" {
+		return nil, fmt.Errorf("%w: algorithm %q", ErrNotify, notify.Resource.Algorithm)
+	}
+	plain, err := w.decrypt(notify.Resource.Ciphertext, notify.Resource.Nonce, notify.Resource.AssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	if notify.EventType == wechatEventRefund {
+		refund := struct {
+			MchId         string `json:"mchid"`
+			OutTradeNo    string `json:"out_trade_no"`
+			TransactionId string `json:"transaction_id"`
+			RefundStatus  string `json:"refund_status"`
+		}{}
+		if err = json.Unmarshal(plain, &refund); err != nil || refund.MchId != w.cfg.MchId {
+			return nil, fmt.Errorf("%w: refund resource", ErrNotify)
+		}
+		if refund.RefundStatus != "SUCCESS" {
+			return nil, nil
+		}
+		return &Notification{Type: NOTIFY_REFUND, Payment: Payment{OrderNum: refund.OutTradeNo, TransactionId: refund.TransactionId}}, nil
+	}
+
+	trans := &wechatTransaction{}
+	if err = json.Unmarshal(plain, trans); err != nil || trans.MchId != w.cfg.MchId || trans.AppId != w.cfg.AppId {
+		return nil, fmt.Errorf("%w: transaction resource", ErrNotify)
+	}
+	if trans.TradeState != "SUCCESS" {
+		return nil, nil
+	}
+	return &Notification{Type: NOTIFY_PAID, Payment: *trans.payment()}, nil
+}
+
+func (w *wechat) NotifyAck(rw http.ResponseWriter) {
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *wechat) Refund(ctx context.Context, refund *Refund) error {
+	req := map[string]interface{}{
+		"out_trade_no":  refund.OrderNum,
+		"out_refund_no": refund.RefundNo,
+		"reason":        refund.Reason,
+		"amount":        map[string]interface{}{"refund": toCent(refund.Amount), "total": toCent(refund.Total), "currency": "CNY"},
+	}
+	resp := struct {
+		Status string `json:"status"`
+	}{}
+	if _, err := w.call(ctx, "POST", "/v3/refund/domestic/refunds", req, &resp); err != nil {
+		return err
+	}
+	if resp.Status != "SUCCESS" && resp.Status != "PROCESSING" {
+		return fmt.Errorf("payment: wechat refund status %q", resp.Status)
+	}
+	return nil
+}
+
+// 签名请求并校验应答签名, 返回http状态码
+func (w *wechat) call(ctx context.Context, method, path string, req, v interface{}) (int, error) {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return 0, err
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, method, w.cfg.APIURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), randomString(32)
+	sign, err := signRSA(w.key, method+"\n"+path+"\n"+timestamp+"\n"+nonce+"\n"+string(body)+"\n")
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf(`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		w.cfg.MchId, nonce, sign, timestamp, w.cfg.SerialNo))
+	request.Header.Set("Accept", "application/json")
+	if req != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := w.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("payment: wechat %s %s status %d: %s", method, path, resp.StatusCode, data)
+	}
+	if err = w.verify(resp.Header, data); err != nil {
+		return resp.StatusCode, err
+	}
+	if v == nil || len(data) == 0 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(data, v)
+}
+
+// 校验微信支付的签名: 时间戳\n随机串\nbody\n
+func (w *wechat) verify(header http.Header, body []byte) error {
+	if w.cfg.PlatformSerial != "" && header.Get("Wechatpay-Serial") != w.cfg.PlatformSerial {
+		return fmt.Errorf("%w: serial %q", ErrSignature, header.Get("Wechatpay-Serial"))
+	}
+	timestamp, err := strconv.ParseInt(header.Get("Wechatpay-Timestamp"), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)).Abs() > 5*time.Minute {
+		return fmt.Errorf("%w: timestamp", ErrSignature)
+	}
+	message := header.Get("Wechatpay-Timestamp") + "\n" + header.Get("Wechatpay-Nonce") + "\n" + string(body) + "\n"
+	return verifyRSA(w.platform, message, header.Get("Wechatpay-Signature"))
+}
+
+// AEAD_AES_256_GCM 解密
+func (w *wechat) decrypt(ciphertext, nonce, associatedData string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotify, err)
+	}
+	block, err := aes.NewCipher([]byte(w.cfg.APIv3Key))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, []byte(nonce), data, []byte(associatedData))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypt resource", ErrNotify)
+	}
+	return plain, nil
+}
@@ -0,0 +1,85 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"camera-payment"
+	"camera-payment/paymenttest"
+)
+
+func TestWechat(t *testing.T) {
+	ctx := context.Background()
+	fake := paymenttest.NewWechat("wx0000000000000000", "1900000000")
+	srv := httptestServer(t, fake)
+	p, err := payment.NewWechat(fake.Config(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := &payment.Order{OrderNum: "W1001", Description: "60钻石", Amount: 6, NotifyURL: "https://example.com/api/pay/wechat/notify"}
+	params, err := p.CreateOrder(ctx, order)
+	if err != nil || params["prepayid"] == "" || params["sign"] == "" {
+		t.Fatalf("create: %v %v", params, err)
+	}
+
+	// 未付款
+	result, err := p.Verify(ctx, order, "")
+	if err != nil || result.Paid {
+		t.Fatalf("verify unpaid: %+v %v", result, err)
+	}
+	if result, err = p.Verify(ctx, &payment.Order{OrderNum: "W404"}, ""); err != nil || result.Paid {
+		t.Fatalf("verify not exist: %+v %v", result, err)
+	}
+
+	transactionId, err := fake.Pay(order.OrderNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = p.Verify(ctx, order, "")
+	if err != nil || !result.Paid || result.TransactionId != transactionId || result.Amount != 6 {
+		t.Fatalf("verify paid: %+v %v", result, err)
+	}
+
+	// 支付通知, 篡改body后验签失败
+	req, err := fake.Notification(order.OrderNum, "TRANSACTION.SUCCESS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := cloneRequest(t, req, func(body string) string { return strings.Replace(body, `"id":"`, `"id":"x`, 1) })
+	if _, err = p.HandleNotification(ctx, forged); !errors.Is(err, payment.ErrSignature) {
+		t.Fatalf("forged notify: %v", err)
+	}
+	notify, err := p.HandleNotification(ctx, req)
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_PAID || notify.OrderNum != order.OrderNum || notify.Amount != 6 {
+		t.Fatalf("paid notify: %+v %v", notify, err)
+	}
+
+	// 退款
+	if err = p.Refund(ctx, &payment.Refund{OrderNum: order.OrderNum, RefundNo: "R" + order.OrderNum, Amount: 6, Total: 6, Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if refunds := fake.Refunds(order.OrderNum); len(refunds) != 1 || refunds[0] != "R"+order.OrderNum {
+		t.Fatalf("refunds: %v", refunds)
+	}
+	req, _ = fake.Notification(order.OrderNum, "REFUND.SUCCESS")
+	notify, err = p.HandleNotification(ctx, req)
+	if err != nil || notify == nil || notify.Type != payment.NOTIFY_REFUND || notify.TransactionId != transactionId {
+		t.Fatalf("refund notify: %+v %v", notify, err)
+	}
+}
+
+func cloneRequest(t *testing.T, req *http.Request, edit func(string) string) *http.Request {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(strings.NewReader(string(body)))
+	clone := req.Clone(context.Background())
+	clone.Body = io.NopCloser(strings.NewReader(edit(string(body))))
+	return clone
+}
@@ -0,0 +1,51 @@
+package protocol
+
+// 回调结果, 与api的返回码一致
+const (
+	CODE_FAILURE       = 0 // 失败
+	CODE_SUCCESS       = 1 // 成功
+	CODE_INVALID_PARAM = 2 // 参数错误, 不重试
+	CODE_CANCELED      = 3 // 任务已取消
+)
+
+type LoraModel struct {
+	LoraPath         string  `json:"lora_path"`
+	Weight           float64 `json:"weight"`
+	PromptWeight     float64 `json:"prompt_weight"`
+	SecondGeneration bool    `json:"second_generation"`
+}
+
+// 训练 分身 写真回调
+type SDCallback struct {
+	Version    int         `json:"version"` // 协议版本
+	Code       int         `json:"code"`
+	Message    string      `json:"msg"`
+	TaskId     uint        `json:"task_id"`
+	Images     []string    `json:"images"`
+	WaterMarks []string    `json:"water_marks"`
+	Loras      []LoraModel `json:"loras"`
+	Callback   string      `json:"callback"`
+	Gender     int         `json:"gender"` // 1-女性青年 2-男性青年
+	Seed       int64       `json:"seed"`
+}
+
+// 照片识别回调
+type CheckCallback struct {
+	Version  int            `json:"version"` // 协议版本
+	Code     int            `json:"code"`
+	Message  string         `json:"msg"`
+	TaskId   uint           `json:"task_id"`
+	Status   map[uint64]int `json:"check_status"` // 图片id->0-未识别 1-识别成功 2-识别失败
+	Callback string         `json:"callback"`
+}
+
+// 高清回调
+type PhotoHrCallback struct {
+	Version       int    `json:"version"` // 协议版本
+	Code          int    `json:"code"`
+	Message       string `json:"msg"`
+	TaskId        uint   `json:"task_id"`
+	ImageUrl      string `json:"image_url"`
+	WaterImageUrl string `json:"water_image_url"`
+	Callback      string `json:"callback"`
+}
@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 加密模式, 升级过程: 所有服务配置密钥并使用des -> 发送方改为mixed -> 全部改为aead
+const (
+	CIPHER_DES   = "des"   // 发送3DES, 配置了密钥时也接受AEAD
+	CIPHER_MIXED = "mixed" // 发送AEAD, 接受3DES和AEAD
+	CIPHER_AEAD  = "aead"  // 只收发AEAD
+)
+
+// AEAD密文格式 v1.<key_id>.<base64url(nonce+密文)>, 3DES密文为标准base64, 不含"."
+const envelopePrefix = "v1."
+
+var (
+	ErrCipherFormat   = errors.New("cipher: bad payload format")
+	ErrCipherKeyId    = errors.New("cipher: unknown key id")
+	ErrCipherAuth     = errors.New("cipher: message authentication failed")
+	ErrCipherLegacy   = errors.New("cipher: 3des payload rejected")
+	ErrCipherDisabled = errors.New("cipher: no key configured")
+)
+
+// 加解密, 支持按key_id轮换密钥和3DES过渡
+type Cipher struct {
+	mode   string
+	desKey []byte
+	keyId  string
+	keys   map[string]cipher.AEAD
+}
+
+// mode: CIPHER_*, 为空时使用des
+// desKey: 旧3DES密钥, 24字节
+// keyId: 加密使用的密钥, 必须在keys中
+// keys: key_id => base64(AES密钥), 解密时按密文中的key_id选择
+func NewCipher(mode, desKey, keyId string, keys map[string]string) (*Cipher, error) {
+	if mode == "" {
+		mode = CIPHER_DES
+	}
+	if mode != CIPHER_DES && mode != CIPHER_MIXED && mode != CIPHER_AEAD {
+		return nil, fmt.Errorf("cipher: bad mode %q", mode)
+	}
+
+	c := &Cipher{mode: mode, keyId: keyId, keys: make(map[string]cipher.AEAD)}
+	if desKey != "" && mode != CIPHER_AEAD {
+		if _, err := des.NewTripleDESCipher([]byte(desKey)); err != nil {
+			return nil, fmt.Errorf("cipher: bad 3des key: %w", err)
+		}
+		c.desKey = []byte(desKey)
+	}
+	for id, value := range keys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("cipher: bad key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("cipher: key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("cipher: key %s: %w", id, err)
+		}
+		if c.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("cipher: key %s: %w", id, err)
+		}
+	}
+
+	if len(c.keys) > 0 && c.keys[keyId] == nil {
+		return nil, fmt.Errorf("cipher: key id %q not in keys", keyId)
+	}
+	if mode != CIPHER_DES && len(c.keys) == 0 {
+		return nil, fmt.Errorf("cipher: mode %s requires keys", mode)
+	}
+	return c, nil
+}
+
+// 是否配置了密钥
+func (c *Cipher) Enabled() bool {
+	return c != nil && (len(c.desKey) > 0 || len(c.keys) > 0)
+}
+
+// 按模式加密
+func (c *Cipher) Encrypt(src []byte) (string, error) {
+	if c.mode == CIPHER_DES {
+		return c.encryptDES(src)
+	}
+	return c.seal(src)
+}
+
+// 按对方请求的格式加密响应, 未升级的客户端仍返回3DES
+func (c *Cipher) EncryptFor(src []byte, peer string) (string, error) {
+	if IsEnvelope(peer) && len(c.keys) > 0 {
+		return c.seal(src)
+	}
+	if c.mode == CIPHER_AEAD || len(c.desKey) == 0 {
+		return c.Encrypt(src)
+	}
+	return c.encryptDES(src)
+}
+
+// 解密, 非aead模式同时接受3DES
+func (c *Cipher) Decrypt(value string) ([]byte, error) {
+	if IsEnvelope(value) {
+		return c.open(value)
+	}
+	if c.mode == CIPHER_AEAD {
+		return nil, ErrCipherLegacy
+	}
+	return c.decryptDES(value)
+}
+
+// 是否为AEAD密文
+func IsEnvelope(value string) bool {
+	return strings.HasPrefix(value, envelopePrefix)
+}
+
+func (c *Cipher) seal(src []byte) (string, error) {
+	aead := c.keys[c.keyId]
+	if aead == nil {
+		return "", ErrCipherDisabled
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(src)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := envelopePrefix + c.keyId
+	data := aead.Seal(nonce, nonce, src, []byte(header))
+	return header + "." + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func (c *Cipher) open(value string) ([]byte, error) {
+	header, payload, ok := strings.Cut(value[len(envelopePrefix):], ".")
+	if !ok {
+		return nil, ErrCipherFormat
+	}
+	aead := c.keys[header]
+	if aead == nil {
+		return nil, ErrCipherKeyId
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCipherFormat
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, []byte(envelopePrefix+header))
+	if err != nil {
+		return nil, ErrCipherAuth
+	}
+	return plain, nil
+}
+
+// 3DES-ECB PKCS7, 与旧版本一致
+func (c *Cipher) encryptDES(src []byte) (string, error) {
+	if len(c.desKey) == 0 {
+		return "", ErrCipherDisabled
+	}
+	block, _ := des.NewTripleDESCipher(c.desKey)
+	size := block.BlockSize()
+	padding := size - len(src)%size
+	data := append(append([]byte{}, src...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	for i := 0; i < len(data); i += size {
+		block.Encrypt(data[i:i+size], data[i:i+size])
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (c *Cipher) decryptDES(value string) ([]byte, error) {
+	if len(c.desKey) == 0 {
+		return nil, ErrCipherDisabled
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := des.NewTripleDESCipher(c.desKey)
+	size := block.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, ErrCipherFormat
+	}
+	for i := 0; i < len(data); i += size {
+		block.Decrypt(data[i:i+size], data[i:i+size])
+	}
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > size {
+		return nil, ErrCipherFormat
+	}
+	return data[:len(data)-padding], nil
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const testDESKey = "camera-webui-3des-key-24"
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func newTestCipher(t *testing.T, mode, keyId string, keys map[string]string) *Cipher {
+	t.Helper()
+	desKey := testDESKey
+	if mode == CIPHER_AEAD {
+		desKey = ""
+	}
+	c, err := NewCipher(mode, desKey, keyId, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	keys := map[string]string{"k1": testKey1}
+	for _, mode := range []string{CIPHER_DES, CIPHER_MIXED, CIPHER_AEAD} {
+		c := newTestCipher(t, mode, "k1", keys)
+		for _, plain := range []string{"", "a", "12345678", `{"task_id":1,"code":1,"message":"出图完成"}`} {
+			value, err := c.Encrypt([]byte(plain))
+			if err != nil {
+				t.Fatalf("%s: encrypt: %v", mode, err)
+			}
+			if IsEnvelope(value) != (mode != CIPHER_DES) {
+				t.Fatalf("%s: ciphertext format %q", mode, value)
+			}
+			got, err := c.Decrypt(value)
+			if err != nil || string(got) != plain {
+				t.Fatalf("%s: decrypt = %q, %v, want %q", mode, got, err, plain)
+			}
+		}
+	}
+}
+
+// 与旧版本3DES-ECB PKCS7(openssl.Des3ECBEncrypt)的密文一致
+func TestCipherDESKnownAnswer(t *testing.T) {
+	c := newTestCipher(t, CIPHER_DES, "", nil)
+	for plain, want := range map[string]string{
+		"":                       "suhohl5bciI=",
+		"12345678":               "wWpaFmM99z2y6GiGXltyIg==",
+		`{"task_id":1,"code":1}`: "15WuAL7bDksKhHp1i3/Xx1Nw3V/aXlW3",
+	} {
+		got, err := c.Encrypt([]byte(plain))
+		if err != nil || got != want {
+			t.Errorf("encrypt %q = %q, %v, want %q", plain, got, err, want)
+		}
+		b, err := c.Decrypt(want)
+		if err != nil || string(b) != plain {
+			t.Errorf("decrypt %q = %q, %v, want %q", want, b, err, plain)
+		}
+	}
+}
+
+// 升级过程中各模式互通: des接受AEAD, mixed接受3DES, aead拒绝3DES
+func TestCipherUpgrade(t *testing.T) {
+	keys := map[string]string{"k1": testKey1}
+	des := newTestCipher(t, CIPHER_DES, "k1", keys)
+	mixed := newTestCipher(t, CIPHER_MIXED, "k1", keys)
+	aead := newTestCipher(t, CIPHER_AEAD, "k1", keys)
+
+	legacy, _ := des.Encrypt([]byte("legacy"))
+	envelope, _ := mixed.Encrypt([]byte("envelope"))
+	if b, err := des.Decrypt(envelope); err != nil || string(b) != "envelope" {
+		t.Errorf("des decrypt envelope = %q, %v", b, err)
+	}
+	if b, err := mixed.Decrypt(legacy); err != nil || string(b) != "legacy" {
+		t.Errorf("mixed decrypt 3des = %q, %v", b, err)
+	}
+	if _, err := aead.Decrypt(legacy); err != ErrCipherLegacy {
+		t.Errorf("aead decrypt 3des: %v, want %v", err, ErrCipherLegacy)
+	}
+
+	// 未升级的对方仍收到3DES
+	if value, _ := mixed.EncryptFor([]byte("resp"), legacy); IsEnvelope(value) {
+		t.Errorf("response to 3des peer is envelope: %q", value)
+	}
+	if value, _ := des.EncryptFor([]byte("resp"), envelope); !IsEnvelope(value) {
+		t.Errorf("response to envelope peer is 3des: %q", value)
+	}
+}
+
+func TestCipherTampered(t *testing.T) {
+	c := newTestCipher(t, CIPHER_AEAD, "k1", map[string]string{"k1": testKey1})
+	value, err := c.Encrypt([]byte(`{"task_id":1,"code":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := strings.LastIndex(value, ".") + 1
+	payload, _ := base64.RawURLEncoding.DecodeString(value[i:])
+	for n := range payload {
+		data := append([]byte{}, payload...)
+		data[n] ^= 1
+		if _, err = c.Decrypt(value[:i] + base64.RawURLEncoding.EncodeToString(data)); err != ErrCipherAuth {
+			t.Fatalf("byte %d flipped: %v, want %v", n, err, ErrCipherAuth)
+		}
+	}
+
+	for _, bad := range []string{"v1.k1", "v1.k1.!!", "v1.k1." + base64.RawURLEncoding.EncodeToString(payload[:10])} {
+		if _, err = c.Decrypt(bad); err != ErrCipherFormat {
+			t.Errorf("decrypt %q: %v, want %v", bad, err, ErrCipherFormat)
+		}
+	}
+}
+
+func TestCipherKeyId(t *testing.T) {
+	old := newTestCipher(t, CIPHER_AEAD, "k1", map[string]string{"k1": testKey1})
+	rotated := newTestCipher(t, CIPHER_AEAD, "k2", map[string]string{"k1": testKey1, "k2": testKey2})
+	other := newTestCipher(t, CIPHER_AEAD, "k2", map[string]string{"k2": testKey2})
+
+	// 轮换期间旧key_id的密文仍可解密
+	value, _ := old.Encrypt([]byte("k1"))
+	if b, err := rotated.Decrypt(value); err != nil || string(b) != "k1" {
+		t.Errorf("rotated decrypt k1 = %q, %v", b, err)
+	}
+	if _, err := other.Decrypt(value); err != ErrCipherKeyId {
+		t.Errorf("unknown key id: %v, want %v", err, ErrCipherKeyId)
+	}
+
+	// 改写key_id指向其他密钥时认证失败
+	value, _ = rotated.Encrypt([]byte("k2"))
+	if _, err := rotated.Decrypt(strings.Replace(value, "v1.k2.", "v1.k1.", 1)); err != ErrCipherAuth {
+		t.Errorf("wrong key id: %v, want %v", err, ErrCipherAuth)
+	}
+}
+
+func TestNewCipherConfig(t *testing.T) {
+	for _, tt := range []struct {
+		mode, desKey, keyId string
+		keys                map[string]string
+	}{
+		{"cbc", testDESKey, "", nil},
+		{CIPHER_DES, "short", "", nil},
+		{CIPHER_MIXED, testDESKey, "", nil},
+		{CIPHER_AEAD, "", "k2", map[string]string{"k1": testKey1}},
+		{CIPHER_AEAD, "", "k.1", map[string]string{"k.1": testKey1}},
+		{CIPHER_AEAD, "", "k1", map[string]string{"k1": "short"}},
+	} {
+		if _, err := NewCipher(tt.mode, tt.desKey, tt.keyId, tt.keys); err == nil {
+			t.Errorf("NewCipher(%q, %q, %q, %v) accepted", tt.mode, tt.desKey, tt.keyId, tt.keys)
+		}
+	}
+}
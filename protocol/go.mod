@@ -0,0 +1,3 @@
+module camera-protocol
+
+go 1.21
@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// worker请求签名 HMAC-SHA256(secret, method\npath[?query]\ntimestamp\nnonce\nsha256(body))
+// query按key和值排序后编码, 没有query时与不签query的旧版本一致
+func WorkerSignature(secret, method, path, rawQuery, timestamp, nonce string, body []byte) string {
+	if query := CanonicalQuery(rawQuery); query != "" {
+		path += "?" + query
+	}
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 规范化query: 按key排序, 同一个key的值排序, 统一编码; 无法解析时原样返回
+func CanonicalQuery(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	return values.Encode()
+}
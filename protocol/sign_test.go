@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestWorkerSignatureQuery(t *testing.T) {
+	body := []byte(`{"task_id":1}`)
+	sign := WorkerSignature("secret", "GET", "/api/work/photo", "checkpoint=a.safetensors&batch=4", "1700000000", "n1", body)
+
+	// 参数顺序和编码不影响签名
+	for _, query := range []string{"batch=4&checkpoint=a.safetensors", "checkpoint=a%2Esafetensors&batch=4"} {
+		if got := WorkerSignature("secret", "GET", "/api/work/photo", query, "1700000000", "n1", body); got != sign {
+			t.Errorf("query %q: signature changed", query)
+		}
+	}
+
+	// 修改query后签名不一致
+	for _, query := range []string{"checkpoint=b.safetensors&batch=4", "checkpoint=a.safetensors&batch=8", "checkpoint=a.safetensors", "checkpoint=a.safetensors&batch=4&batch=8", ""} {
+		if got := WorkerSignature("secret", "GET", "/api/work/photo", query, "1700000000", "n1", body); got == sign {
+			t.Errorf("query %q: tampered query accepted", query)
+		}
+	}
+}
+
+func TestWorkerSignatureWithoutQuery(t *testing.T) {
+	// 没有query时与不签query的旧版本一致
+	sum := sha256.Sum256(nil)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/api/report/photo\n1700000000\nn1\n" + hex.EncodeToString(sum[:])))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if got := WorkerSignature("secret", "POST", "/api/report/photo", "", "1700000000", "n1", nil); got != want {
+		t.Fatalf("signature = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+type ControlNet struct {
+	ImagePath     string  `json:"image_path"`      // 底图
+	Preprocessor  string  `json:"preprocessor"`    // 预处理器
+	ModelName     string  `json:"model_name"`      // 模型名称
+	Weight        float64 `json:"weight"`          // 权重
+	StartCtrlStep float64 `json:"start_ctrl_step"` // START_CTRL_STEP
+	EndCtrlStep   float64 `json:"end_ctrl_step"`   // END_CTRL_STEP
+	PreprocRes    int     `json:"preproc_res"`     // 预处理器分辨率
+	ControlMode   string  `json:"control_mode"`    // 控制模式
+	ResizeMode    string  `json:"resize_mode"`     // 大小调整模式
+	PixelPerfect  bool    `json:"pixel_perfect"`   // 完美像素
+}
+
+type Roop struct {
+	ImagePath              string  `json:"image_path"`               // 换脸图片, url或base64
+	FaceRestorerName       string  `json:"face_restorer_name"`       // 面部修复模型
+	FaceRestorerVisibility float64 `json:"face_restorer_visibility"` // 面部修复强度
+}
+
+type ADetailer struct {
+	ModelUrl            string  `json:"model_url"`
+	AdModel             string  `json:"ad_model"`
+	AdPrompt            string  `json:"ad_prompt"`
+	AdNegativePrompt    string  `json:"ad_negative_prompt"`
+	AdConfidence        float64 `json:"ad_confidence"`
+	AdDilateErode       int     `json:"ad_dilate_erode"`
+	AdDenoisingStrength float64 `json:"ad_denoising_strength"`
+	AdInpaintWidth      int     `json:"ad_inpaint_width"`
+	AdInpaintHeight     int     `json:"ad_inpaint_height"`
+}
+
+// 风格结构
+type Stype struct {
+	EnableHr          bool    `json:"enable_hr"`            // 是否超清放大
+	HrScale           float64 `json:"hr_scale"`             // 超清放大倍数
+	HiresUpscaler     string  `json:"hires_upscaler"`       // 需要超清放大时使用的HIRES超清放大模型名称
+	HrSecondPassSteps int     `json:"hr_second_pass_steps"` // 需要超清放大时HIRES步数
+	DenoisingStrength float64 `json:"denoising_strength"`   // 去噪强度
+
+	SamplerName    string `json:"sampler_name"`    // 采样方法
+	Prompt         string `json:"prompt"`          // 提示词
+	NegativePrompt string `json:"negative_prompt"` // 反向提示词
+
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+	Seed   int64 `json:"seed"`  // 随机种子
+	Steps  int   `json:"steps"` // 采样步长
+
+	RestoreFace bool    `json:"restore_face"` // 是否重绘面部
+	Tiling      bool    `json:"tiling"`       // 是否分片
+	CfgScale    float64 `json:"cfg_scale"`    // 提示词引导系数
+	BatchSize   int     `json:"batch_size"`   // 单批次生成张数
+	BatchCount  int     `json:"batch_count"`  // 单批次生成张数
+
+	MainModelPath string `json:"main_model_path"` // 主模型路径
+	SubModelUrl   string `json:"sub_model_url"`   // 子模型url
+
+	RandnSource string `json:"randn_source"` // override_settings中的配置RNG=CPU
+
+	ControlNets []*ControlNet `json:"control_nets"` // 风格姿势配置
+	Roop        *Roop         `json:"roop"`         // 换脸配置
+	ADetailer   []*ADetailer  `json:"adetailer"`    // 细节配置
+}
+
+// 训练结构
+type LoraTrain struct {
+	BaseModel string   `json:"base_model"` // 主模型
+	ImageUrl  []string `json:"image_url"`  // 素材
+	UUID      string   `json:"uuid"`       // tag
+}
+
+// 任务结构, 训练 分身 写真
+type Task struct {
+	Version          int       `json:"version"`           // 协议版本
+	TaskType         int       `json:"task_type"`         // 0-训练 1-分身 2-写真
+	UserId           int       `json:"user_id"`           // 用户ID
+	TaskId           uint      `json:"task_id"`           // 任务ID
+	Stype            Stype     `json:"stype"`             // 生图方式
+	Callback         string    `json:"callback"`          // 回调地址
+	LoraTrain        LoraTrain `json:"lora_train"`        // 训练
+	SecondGeneration bool      `json:"second_generation"` // 是否二次生成
+}
+
+func (t Task) CheckVersion() error {
+	return CheckVersion(t.Version)
+}
+
+// 照片识别任务
+type TaskCheck struct {
+	Version   int               `json:"version"`    // 协议版本
+	BaseImage string            `json:"base_image"` // 正面图，用于验证图片是否一致
+	ImagesMap map[uint64]string `json:"image_urls"` // 图片id->url
+	Callback  string            `json:"callback"`   // 回调地址
+}
+
+func (t TaskCheck) CheckVersion() error {
+	return CheckVersion(t.Version)
+}
+
+// 高清任务
+type TaskPhotoHr struct {
+	Version  int    `json:"version"` // 协议版本
+	TaskId   int    `json:"task_id"`
+	ImageUrl string `json:"image_url"`
+	Callback string `json:"callback"` // 回调地址
+}
+
+func (t TaskPhotoHr) CheckVersion() error {
+	return CheckVersion(t.Version)
+}
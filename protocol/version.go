@@ -0,0 +1,32 @@
+// 任务协议, api下发任务和worker回调使用的结构, api和camera-webui共用
+//
+// 兼容规则:
+//  1. 新增可选字段不升级版本, 旧worker忽略该字段, 旧api不下发时为零值
+//  2. 删除字段, 修改字段类型或含义, 新增worker必须处理的字段时升级SchemaVersion
+//  3. 先升级全部worker再升级api, 新worker须继续支持上一版本的任务;
+//     先升级api会导致旧worker领取的任务全部失败. worker拒绝版本高于SchemaVersion的任务, 回调失败原因
+//  4. 版本为0是升级前的api下发的任务, 按版本1处理
+package protocol
+
+import "fmt"
+
+// 协议版本
+const SchemaVersion = 1
+
+// 任务版本高于worker支持的版本
+type VersionError struct {
+	Version   int // 任务版本
+	Supported int // worker支持的最高版本
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("任务协议版本 %d 高于worker支持的版本 %d, 请升级worker", e.Version, e.Supported)
+}
+
+// 检查任务版本是否支持
+func CheckVersion(version int) error {
+	if version > SchemaVersion {
+		return &VersionError{Version: version, Supported: SchemaVersion}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+module camera-storage
+
+go 1.21
+
+require github.com/qiniu/go-sdk/v7 v7.17.0
+
+require golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4 // indirect
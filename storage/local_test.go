@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	s, err := New(Config{Driver: DRIVER_LOCAL, Host: "http://127.0.0.1:3093/files", Endpoint: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	if url := s.URL("cphoto/ab/1.png"); url != "http://127.0.0.1:3093/files/cphoto/ab/1.png" {
+		t.Fatalf("url: %s", url)
+	}
+	for _, key := range []string{"", "../a.png", "cphoto/../../a.png", "/a.png", "cphoto//a.png"} {
+		if err = s.Put(context.Background(), key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Fatalf("put bad key %q", key)
+		}
+	}
+}
+
+// 各驱动通用的测试, 需要空的存储
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	var err error
+	for _, key := range []string{"cphoto/ab/1.png", "cphoto/cd/2.png", "lora/1/a.safetensors"} {
+		if err = s.Put(ctx, key, strings.NewReader(key), -1, "image/png"); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+
+	r, err := s.Get(ctx, "cphoto/ab/1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "cphoto/ab/1.png" {
+		t.Fatalf("get: %q", data)
+	}
+
+	obj, err := s.Stat(ctx, "cphoto/cd/2.png")
+	if err != nil || obj.Size != int64(len("cphoto/cd/2.png")) {
+		t.Fatalf("stat: %+v, %v", obj, err)
+	}
+
+	list, err := s.List(ctx, "cphoto/", 10)
+	if err != nil || len(list) != 2 || list[0].Key != "cphoto/ab/1.png" || list[1].Key != "cphoto/cd/2.png" {
+		t.Fatalf("list: %+v, %v", list, err)
+	}
+	if list, _ = s.List(ctx, "", 1); len(list) != 1 {
+		t.Fatalf("list limit: %+v", list)
+	}
+
+	if key, ok := s.Key(s.URL("cphoto/ab/1.png")); !ok || key != "cphoto/ab/1.png" {
+		t.Fatalf("key: %s %v", key, ok)
+	}
+	if _, ok := s.Key("http://cdn.example.com/cphoto/ab/1.png"); ok {
+		t.Fatal("key of other host")
+	}
+
+	if err = s.Delete(ctx, "cphoto/ab/1.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(ctx, "cphoto/ab/1.png"); err != nil {
+		t.Fatalf("delete missing: %s", err)
+	}
+	if _, err = s.Get(ctx, "cphoto/ab/1.png"); err != ErrNotExist {
+		t.Fatalf("get deleted: %v", err)
+	}
+	if _, err = s.Stat(ctx, "cphoto/ab/1.png"); err != ErrNotExist {
+		t.Fatalf("stat deleted: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/qiniu/go-sdk/v7/auth/qbox"
+	"github.com/qiniu/go-sdk/v7/client"
+	qnstorage "github.com/qiniu/go-sdk/v7/storage"
+)
+
+// 七牛文件不存在的状态码
+const qiniuNoSuchFile = 612
+
+type qiniuStorage struct {
+	cfg     Config
+	mac     *qbox.Mac
+	qncfg   *qnstorage.Config
+	manager *qnstorage.BucketManager
+}
+
+func newQiniu(cfg Config) (*qiniuStorage, error) {
+	if cfg.Region == "" {
+		cfg.Region = string(qnstorage.RIDHuanan)
+	}
+	region, ok := qnstorage.GetRegionByID(qnstorage.RegionID(cfg.Region))
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown qiniu region %q", cfg.Region)
+	}
+	s := &qiniuStorage{
+		cfg: cfg,
+		mac: qbox.NewMac(cfg.AccessKey, cfg.SecretKey),
+		qncfg: &qnstorage.Config{
+			Region:        &region,
+			UseHTTPS:      true,
+			UseCdnDomains: false,
+		},
+	}
+	s.manager = qnstorage.NewBucketManager(s.mac, s.qncfg)
+	return s, nil
+}
+
+func (s *qiniuStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	putPolicy := qnstorage.PutPolicy{
+		Scope: s.cfg.Bucket + ":" + key,
+	}
+	upToken := putPolicy.UploadToken(s.mac)
+	ret := qnstorage.PutRet{}
+	extra := &qnstorage.PutExtra{MimeType: contentType}
+	return qnstorage.NewFormUploader(s.qncfg).Put(ctx, &ret, upToken, key, r, size, extra)
+}
+
+func (s *qiniuStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	signed, err := s.SignedURL(key, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", signed, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("storage: qiniu get %s status %d", key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s *qiniuStorage) Delete(ctx context.Context, key string) error {
+	if err := s.manager.Delete(s.cfg.Bucket, key); err != nil && !qiniuNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *qiniuStorage) Stat(ctx context.Context, key string) (*Object, error) {
+	info, err := s.manager.Stat(s.cfg.Bucket, key)
+	if err != nil {
+		if qiniuNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return &Object{
+		Key:          key,
+		Size:         info.Fsize,
+		ContentType:  info.MimeType,
+		LastModified: qiniuTime(info.PutTime),
+	}, nil
+}
+
+func (s *qiniuStorage) List(ctx context.Context, prefix string, limit int) ([]Object, error) {
+	objects := make([]Object, 0)
+	marker := ""
+	for len(objects) < limit {
+		ret, hasNext, err := s.manager.ListFilesWithContext(ctx, s.cfg.Bucket,
+			qnstorage.ListInputOptionsPrefix(prefix),
+			qnstorage.ListInputOptionsMarker(marker),
+			qnstorage.ListInputOptionsLimit(min(limit-len(objects), 1000)))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range ret.Items {
+			objects = append(objects, Object{
+				Key:          item.Key,
+				Size:         item.Fsize,
+				ContentType:  item.MimeType,
+				LastModified: qiniuTime(item.PutTime),
+			})
+		}
+		if !hasNext {
+			break
+		}
+		marker = ret.Marker
+	}
+	return objects, nil
+}
+
+func (s *qiniuStorage) URL(key string) string {
+	return joinURL(s.cfg.Host, key)
+}
+
+func (s *qiniuStorage) SignedURL(key string, expire time.Time) (string, error) {
+	return qnstorage.MakePrivateURLv2(s.mac, s.cfg.Host, key, expire.Unix()), nil
+}
+
+func (s *qiniuStorage) Key(rawurl string) (string, bool) {
+	return trimHost(s.cfg.Host, rawurl)
+}
+
+func qiniuNotExist(err error) bool {
+	if e, ok := err.(*client.ErrorInfo); ok {
+		return e.Code == qiniuNoSuchFile || e.Code == http.StatusNotFound
+	}
+	return false
+}
+
+// 七牛时间单位为100纳秒
+func qiniuTime(putTime int64) time.Time {
+	return time.Unix(0, putTime*100)
+}
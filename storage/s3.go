@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 签名中不计算body的hash
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// 签名时间, 测试时替换
+var s3Now = time.Now
+
+// S3兼容存储, 使用AWS Signature V4
+type s3Storage struct {
+	cfg      Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3(cfg Config) (*s3Storage, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: bad s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 bucket is empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if !cfg.PathStyle {
+		endpoint.Host = cfg.Bucket + "." + endpoint.Host
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	if cfg.PathStyle {
+		endpoint.Path += "/" + cfg.Bucket
+	}
+	if cfg.Host == "" {
+		cfg.Host = endpoint.String()
+	}
+	return &s3Storage{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: time.Minute * 5}}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size < 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	request, err := s.newRequest(ctx, "PUT", key, nil, r)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	request, err := s.newRequest(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	request, err := s.newRequest(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(request)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (*Object, error) {
+	request, err := s.newRequest(ctx, "HEAD", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &Object{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: modified,
+	}, nil
+}
+
+// ListObjectsV2 返回结果
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, limit int) ([]Object, error) {
+	objects := make([]Object, 0)
+	token := ""
+	for len(objects) < limit {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("max-keys", strconv.Itoa(min(limit-len(objects), 1000)))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		request, err := s.newRequest(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(request)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Contents {
+			objects = append(objects, Object{Key: item.Key, Size: item.Size, LastModified: item.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+func (s *s3Storage) URL(key string) string {
+	return joinURL(s.cfg.Host, key)
+}
+
+// 预签名地址, 最长7天
+func (s *s3Storage) SignedURL(key string, expire time.Time) (string, error) {
+	now := s3Now().UTC()
+	seconds := int64(expire.Sub(now).Seconds())
+	if seconds < 1 || seconds > 7*24*3600 {
+		return "", fmt.Errorf("storage: bad s3 expire %d", seconds)
+	}
+	date, amzDate := now.Format("20060102"), now.Format("20060102T150405Z")
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(date))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(seconds, 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	path := s.objectPath(key)
+	canonicalQuery := s3Query(query)
+	canonicalRequest := strings.Join([]string{"GET", path, canonicalQuery, "host:" + s.endpoint.Host, "", "host", unsignedPayload}, "\n")
+	signature := s.signature(date, amzDate, canonicalRequest)
+	return s.endpoint.Scheme + "://" + s.endpoint.Host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+func (s *s3Storage) Key(rawurl string) (string, bool) {
+	return trimHost(s.cfg.Host, rawurl)
+}
+
+func (s *s3Storage) objectPath(key string) string {
+	return s3Escape(s.endpoint.Path+"/"+key, false)
+}
+
+func (s *s3Storage) scope(date string) string {
+	return date + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// 签名 key=HMAC链(date, region, s3, aws4_request)
+func (s *s3Storage) signature(date, amzDate, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, s.scope(date), hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, v := range []string{date, s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// 带Authorization头的请求, key为空时请求桶
+func (s *s3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	path := s.objectPath(key)
+	if key == "" {
+		path = s3Escape(s.endpoint.Path+"/", false)
+	}
+	canonicalQuery := s3Query(query)
+	rawurl := s.endpoint.Scheme + "://" + s.endpoint.Host + path
+	if canonicalQuery != "" {
+		rawurl += "?" + canonicalQuery
+	}
+	request, err := http.NewRequestWithContext(ctx, method, rawurl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s3Now().UTC()
+	date, amzDate := now.Format("20060102"), now.Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + s.endpoint.Host + "\nx-amz-content-sha256:" + unsignedPayload + "\nx-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{method, path, canonicalQuery, canonicalHeaders, signedHeaders, unsignedPayload}, "\n")
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, s.scope(date), signedHeaders, s.signature(date, amzDate, canonicalRequest)))
+	return request, nil
+}
+
+// 发送请求, 404返回ErrNotExist, 其他非2xx返回错误
+func (s *s3Storage) do(request *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("storage: s3 %s %s status %d: %s", request.Method, request.URL.Path, resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// 规范查询串, 按key排序, 空格编码为%20
+func s3Query(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, s3Escape(k, true)+"="+s3Escape(query.Get(k), true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// S3编码, 除unreserved字符外全部编码, 路径中保留/
+func s3Escape(value string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || strings.IndexByte("-_.~", ch) >= 0 || ch == '/' && !slash {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
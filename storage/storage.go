@@ -0,0 +1,123 @@
+// 对象存储, api和camera-webui共用
+//
+// 对象以key标识, 如 cphoto/ab/cd/xxx.png; 数据库中保存URL(key)返回的公开地址, 删除时用Key解析回key
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 存储驱动
+const (
+	DRIVER_QINIU = "qiniu" // 七牛云
+	DRIVER_S3    = "s3"    // S3兼容存储, 如MinIO
+	DRIVER_LOCAL = "local" // 本地目录, 用于开发和测试
+)
+
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// 对象信息
+type Object struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+type Storage interface {
+	// 上传, size未知时传-1
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// 下载, 不存在时返回ErrNotExist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// 删除, 不存在时不报错
+	Delete(ctx context.Context, key string) error
+	// 对象信息, 不存在时返回ErrNotExist
+	Stat(ctx context.Context, key string) (*Object, error)
+	// 列举前缀下的对象, 按key排序, 最多limit个
+	List(ctx context.Context, prefix string, limit int) ([]Object, error)
+	// 公开访问地址
+	URL(key string) string
+	// 在expire前有效的访问地址, 私有空间使用
+	SignedURL(key string, expire time.Time) (string, error)
+	// 由URL解析key, 不是本存储的地址返回false
+	Key(rawurl string) (string, bool)
+}
+
+type Config struct {
+	Driver    string // DRIVER_*
+	Host      string // 公开访问地址
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string // qiniu: 区域ID, 默认z2; s3: 区域, 默认us-east-1
+	Endpoint  string // s3: 服务地址, 如 http://127.0.0.1:9000; local: 根目录
+	PathStyle bool   // s3: 使用 endpoint/bucket/key 形式, MinIO需开启
+}
+
+func New(cfg Config) (Storage, error) {
+	switch cfg.Driver {
+	case DRIVER_QINIU:
+		return newQiniu(cfg)
+	case DRIVER_S3:
+		return newS3(cfg)
+	case DRIVER_LOCAL:
+		return newLocal(cfg)
+	}
+	return nil, fmt.Errorf("storage: unknown driver %q", cfg.Driver)
+}
+
+// 上传本地文件
+func PutFile(ctx context.Context, s Storage, key, fileName, contentType string) (int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), s.Put(ctx, key, file, info.Size(), contentType)
+}
+
+// 拼接公开地址
+func joinURL(host, key string) string {
+	return strings.TrimSuffix(host, "/") + "/" + escapeKey(key)
+}
+
+// 去掉host前缀得到key
+func trimHost(host, rawurl string) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	h, err := url.Parse(host)
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host != h.Host {
+		return "", false
+	}
+	prefix := strings.TrimSuffix(h.Path, "/") + "/"
+	if !strings.HasPrefix(u.Path, prefix) || len(u.Path) == len(prefix) {
+		return "", false
+	}
+	return u.Path[len(prefix):], true
+}
+
+// key按路径编码, 保留/
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}